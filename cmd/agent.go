@@ -17,7 +17,9 @@ var agentCmd = &cobra.Command{
 on the Kubernetes cluster, and sends the results back to the client.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Starting KubeGate agent...")
+		flushTraces := initTracing("kubegate-agent")
 		err := KubeGate.StartAgent()
+		flushTraces()
 		if err != nil {
 			log.Fatalf("Agent encountered an error: %v", err)
 			logging.Logger.WithFields(logrus.Fields{
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/KubeGate"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var agentsContext string
+
+var agentsCmd = &cobra.Command{
+	Use:   "agents",
+	Short: "List live agents for a context",
+	Long: `The agents command reads the heartbeats that agents append to their presence
+log and lists every agent seen recently for the selected context. Presence logs
+exist on the RabbitMQ and memory backends, not on SQS.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			fmt.Println("Failed to load config:", err)
+			return
+		}
+
+		name := agentsContext
+		if name == "" {
+			name = cfg.CurrentContext
+		}
+		ctx, err := config.GetContext(cfg, name)
+		if err != nil {
+			fmt.Printf("Failed to get context %s: %v\n", name, err)
+			return
+		}
+
+		agents, err := KubeGate.GetAgents(ctx)
+		if err != nil {
+			fmt.Println("Failed to list agents:", err)
+			return
+		}
+		if len(agents) == 0 {
+			fmt.Printf("No live agents found for context %s (queue %s)\n", ctx.Name, ctx.CommandQueue)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "AGENT\tCLUSTER\tVERSION\tLOAD\tLAST SEEN\tQUEUES\tCAPABILITIES")
+		for _, a := range agents {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s ago\t%s\t%s\n",
+				a.AgentID, a.Cluster, a.Version, a.Load,
+				time.Since(a.Timestamp).Round(time.Second),
+				strings.Join(a.Queues, ","), strings.Join(a.Capabilities, ","))
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	agentsCmd.Flags().StringVar(&agentsContext, "context", "", "Context to list agents for (defaults to the current context)")
+	agentsCmd.RegisterFlagCompletionFunc("context", completeContextNames)
+	rootCmd.AddCommand(agentsCmd)
+}
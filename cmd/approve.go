@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/spf13/cobra"
+)
+
+var (
+	approvalContext string
+	approvalYes     bool
+)
+
+var approveCmd = &cobra.Command{
+	Use:   "approve <id>",
+	Short: "Approve a command waiting for approval, which the agent then runs",
+	Long: `Agents park commands matching their approval rules (KUBEGATE_APPROVAL_RULES)
+until an approver (KUBEGATE_APPROVERS) approves or denies them. The requester
+is told the command's ID and gets its output once it has run. Approvers cannot
+approve their own commands.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newJobClient(approvalContext)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer c.Close()
+
+		ctx := context.Background()
+		job, err := c.JobStatus(ctx, args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to get command:", err)
+			os.Exit(1)
+		}
+		if job.State != protocol.JobPendingApproval {
+			fmt.Fprintf(os.Stderr, "Command %s is not waiting for approval (%s)\n", job.ID, job.State)
+			os.Exit(1)
+		}
+		if !approvalYes {
+			printJob(job)
+			if err := confirm(fmt.Sprintf("Run '%s' requested by %s?", job.Command, job.Client)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		if job, err = c.Approve(ctx, job.ID); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to approve command:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Command %s approved and running on agent %s\nFollow it with 'kubegate job wait %s'\n", job.ID, job.Agent, job.ID)
+	},
+}
+
+var denyCmd = &cobra.Command{
+	Use:   "deny <id>",
+	Short: "Deny a command waiting for approval",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newJobClient(approvalContext)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer c.Close()
+
+		job, err := c.Deny(context.Background(), args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to deny command:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Command %s denied\n", job.ID)
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{approveCmd, denyCmd} {
+		cmd.Flags().StringVar(&approvalContext, "context", "", "Context the command was sent to (defaults to the current context)")
+		cmd.RegisterFlagCompletionFunc("context", completeContextNames)
+		rootCmd.AddCommand(cmd)
+	}
+	approveCmd.Flags().BoolVarP(&approvalYes, "yes", "y", false, "Approve without showing the command and asking for confirmation")
+}
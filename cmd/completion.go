@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+// completionTimeout bounds how long a completion waits for the agent
+const completionTimeout = 5 * time.Second
+
+var completionCmd = &cobra.Command{
+	Use:   "completion bash|zsh|fish",
+	Short: "Generate a shell completion script",
+	Long: `Generate a shell completion script for kubegate.
+
+KubeGate's own commands are completed locally. kubectl commands, including
+resource names, are completed by the agent of the current context, which runs
+'kubectl __complete'; results are cached for 30 seconds.
+
+  bash:  source <(kubegate completion bash)
+  zsh:   source <(kubegate completion zsh)
+  fish:  kubegate completion fish | source
+
+If kubectl is aliased to kubegate, also register the completion for the alias,
+e.g. in bash: complete -o default -F __start_kubegate kubectl`,
+	Args:                  cobra.ExactArgs(1),
+	ValidArgs:             []string{"bash", "zsh", "fish"},
+	DisableFlagsInUseLine: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		switch args[0] {
+		case "bash":
+			return rootCmd.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			return rootCmd.GenZshCompletion(os.Stdout)
+		case "fish":
+			return rootCmd.GenFishCompletion(os.Stdout, true)
+		default:
+			return fmt.Errorf("unsupported shell %q (expected bash, zsh or fish)", args[0])
+		}
+	},
+}
+
+// completeKubectl forwards the completion of a kubectl command line to the
+// agent of the current context
+func completeKubectl(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	// KubeGate's own run flags are not passed to kubectl
+	_, kubeArgs, err := parseRunArgs(args)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	c, err := client.NewFromCurrentContext(client.WithTimeout(completionTimeout))
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	defer c.Close()
+
+	completion, err := c.Complete(context.Background(), kubeArgs, toComplete)
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	return completion.Values, cobra.ShellCompDirective(completion.Directive)
+}
+
+// completeContextNames completes the names of configured contexts
+func completeContextNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var names []string
+	for _, ctx := range cfg.Contexts {
+		if strings.HasPrefix(ctx.Name, toComplete) {
+			names = append(names, ctx.Name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeContextArg completes a single context name argument
+func completeContextArg(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return completeContextNames(cmd, args, toComplete)
+}
+
+func init() {
+	// Replace Cobra's default completion command, which includes shells KubeGate does not document
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
+	rootCmd.AddCommand(completionCmd)
+
+	rootCmd.ValidArgsFunction = completeKubectl
+	runCmd.ValidArgsFunction = completeKubectl
+}
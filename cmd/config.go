@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/loaynaser3/KubeGate/pkg/config"
 	"github.com/spf13/cobra"
@@ -13,6 +14,17 @@ var (
 	commandQueue string
 	replyQueue   string
 	backend      string
+	compression  string
+	labels       map[string]string
+	timeout      time.Duration
+	protected    bool
+
+	kubeconfigPath    string
+	kubeconfigProxy   string
+	kubeconfigSuffix  string
+	kubeconfigContext []string
+
+	kubeconfigRotateToken bool
 )
 
 // Root command for config
@@ -38,11 +50,15 @@ var setContextCmd = &cobra.Command{
 		}
 
 		ctx := config.Context{
-			Name:         contextName,
-			RabbitMQURL:  rabbitMQURL,
-			CommandQueue: commandQueue,
-			ReplyQueue:   replyQueue,
-			Backend:      backend,
+			Name:            contextName,
+			RabbitMQURL:     rabbitMQURL,
+			CommandQueue:    commandQueue,
+			ReplyQueue:      replyQueue,
+			Backend:         backend,
+			Compression:     compression,
+			Labels:          labels,
+			ResponseTimeout: timeout,
+			Protected:       protected,
 		}
 
 		// Set the context
@@ -71,7 +87,7 @@ var getContextsCmd = &cobra.Command{
 
 		fmt.Println("Available contexts:")
 		for _, ctx := range cfg.Contexts {
-			fmt.Printf("- %s (BrokerURL: %s, ReplyQueue: %s, CommandQueue: %s, Backend: %s)\n", ctx.Name, ctx.RabbitMQURL, ctx.ReplyQueue, ctx.CommandQueue, ctx.Backend)
+			fmt.Printf("- %s (BrokerURL: %s, ReplyQueue: %s, CommandQueue: %s, Backend: %s, Labels: %v)\n", ctx.Name, ctx.RabbitMQURL, ctx.ReplyQueue, ctx.CommandQueue, ctx.Backend, ctx.Labels)
 		}
 		fmt.Printf("Current context: %s\n", cfg.CurrentContext)
 	},
@@ -118,12 +134,71 @@ var deleteContextCmd = &cobra.Command{
 	},
 }
 
+var exportKubeconfigCmd = &cobra.Command{
+	Use:   "export-kubeconfig",
+	Short: "Add KubeGate contexts to a kubectl kubeconfig",
+	Long: `The export-kubeconfig command adds a kubectl cluster, context and user for each
+KubeGate context, named <context>-via-gate, pointed at 'kubegate proxy' and
+holding the token the proxy requires. The kubeconfig is replaced in one step. With
+the proxy running, native kubectl reaches clusters through their agents:
+
+  kubegate proxy &
+  kubectl --context prod-via-gate get pods`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			fmt.Println("Failed to load config:", err)
+			return
+		}
+
+		contexts := cfg.Contexts
+		if len(kubeconfigContext) > 0 {
+			contexts = nil
+			for _, name := range kubeconfigContext {
+				ctx, err := config.GetContext(cfg, name)
+				if err != nil {
+					fmt.Printf("Failed to get context %s: %v\n", name, err)
+					return
+				}
+				contexts = append(contexts, *ctx)
+			}
+		}
+		if len(contexts) == 0 {
+			fmt.Println("No contexts to export")
+			return
+		}
+
+		path := kubeconfigPath
+		if path == "" {
+			path = config.KubeconfigPath()
+		}
+		token, err := config.ProxyToken(kubeconfigRotateToken)
+		if err != nil {
+			fmt.Println("Failed to load proxy token:", err)
+			return
+		}
+		names, err := config.ExportKubeconfig(path, contexts, "http://"+kubeconfigProxy, token, kubeconfigSuffix)
+		if err != nil {
+			fmt.Println("Failed to export kubeconfig:", err)
+			return
+		}
+		for _, name := range names {
+			fmt.Printf("Exported kubectl context %s to %s\n", name, path)
+		}
+	},
+}
+
 func init() {
 	// Add subcommands to config
 	configCmd.AddCommand(setContextCmd)
 	configCmd.AddCommand(getContextsCmd)
 	configCmd.AddCommand(useContextCmd)
 	configCmd.AddCommand(deleteContextCmd)
+	configCmd.AddCommand(exportKubeconfigCmd)
+
+	// Complete context names
+	useContextCmd.ValidArgsFunction = completeContextArg
+	deleteContextCmd.ValidArgsFunction = completeContextArg
 
 	// Add flags to set-context
 	setContextCmd.Flags().StringVarP(&contextName, "name", "n", "", "Name of the context")
@@ -131,6 +206,18 @@ func init() {
 	setContextCmd.Flags().StringVarP(&commandQueue, "commandQueue", "c", "", "Command queue name")
 	setContextCmd.Flags().StringVarP(&replyQueue, "replyQueue", "r", "", "Reply queue name")
 	setContextCmd.Flags().StringVarP(&backend, "backend", "b", "rabbitmq", "Backend type (rabbitmq/sqs/pubsub)")
+	setContextCmd.Flags().StringToStringVarP(&labels, "label", "l", nil, "Labels used to select the context for fan-out, e.g. --label env=prod")
+	setContextCmd.Flags().StringVar(&compression, "compression", "", "Compress commands sent to the agent (zstd/gzip); requires an agent that supports it")
+	setContextCmd.Flags().DurationVar(&timeout, "response-timeout", 0, "How long to wait for the agent's response (default 60s)")
+	setContextCmd.Flags().BoolVar(&protected, "protected", false, "Preview mutating commands and ask for confirmation before running them")
+
+	// Add flags to export-kubeconfig
+	exportKubeconfigCmd.Flags().StringVar(&kubeconfigPath, "kubeconfig", "", "Kubeconfig to update (defaults to the first $KUBECONFIG path or ~/.kube/config)")
+	exportKubeconfigCmd.Flags().StringVar(&kubeconfigProxy, "proxy-address", DefaultProxyAddress, "Address of 'kubegate proxy'")
+	exportKubeconfigCmd.Flags().StringVar(&kubeconfigSuffix, "suffix", config.DefaultKubeconfigSuffix, "Suffix appended to context names")
+	exportKubeconfigCmd.Flags().StringSliceVar(&kubeconfigContext, "context", nil, "Contexts to export (defaults to all)")
+	exportKubeconfigCmd.Flags().BoolVar(&kubeconfigRotateToken, "rotate-token", false, "Replace the proxy token; restart 'kubegate proxy' afterwards")
+	exportKubeconfigCmd.RegisterFlagCompletionFunc("context", completeContextNames)
 
 	// Attach config command to root
 	rootCmd.AddCommand(configCmd)
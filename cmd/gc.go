@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/KubeGate"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/spf13/cobra"
+)
+
+var (
+	gcContext string
+	gcOptions KubeGate.GCOptions
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete orphaned reply queues",
+	Long: `The gc command lists reply queues on the broker of a context and deletes those
+that have no consumers and have been idle longer than --older-than. RabbitMQ
+queues are listed through the management API, SQS queues through ListQueues.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			fmt.Println("Failed to load config:", err)
+			return
+		}
+
+		name := gcContext
+		if name == "" {
+			name = cfg.CurrentContext
+		}
+		ctx, err := config.GetContext(cfg, name)
+		if err != nil {
+			fmt.Printf("Failed to get context %s: %v\n", name, err)
+			return
+		}
+
+		results, err := KubeGate.RunGC(ctx, gcOptions)
+		if err != nil {
+			fmt.Println("Failed to collect reply queues:", err)
+			return
+		}
+		if len(results) == 0 {
+			fmt.Printf("No orphaned queues found for context %s\n", ctx.Name)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "QUEUE\tMESSAGES\tIDLE\tACTION")
+		for _, result := range results {
+			action := "deleted"
+			switch {
+			case gcOptions.DryRun:
+				action = "would delete"
+			case result.Error != "":
+				action = "failed: " + result.Error
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", result.Queue.Name, result.Queue.Messages,
+				time.Since(result.Queue.IdleSince).Round(time.Minute), action)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	gcCmd.Flags().StringVar(&gcContext, "context", "", "Context whose broker is cleaned (defaults to the current context)")
+	gcCmd.RegisterFlagCompletionFunc("context", completeContextNames)
+	gcCmd.Flags().StringVar(&gcOptions.Prefix, "prefix", queue.ReplyQueuePrefix, "Only consider queues whose name starts with this prefix")
+	gcCmd.Flags().DurationVar(&gcOptions.MinIdle, "older-than", KubeGate.DefaultGCMinIdle, "Minimum idle time before a queue is deleted")
+	gcCmd.Flags().BoolVar(&gcOptions.DryRun, "dry-run", false, "List the queues that would be deleted without deleting them")
+	rootCmd.AddCommand(gcCmd)
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/history"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/spf13/cobra"
+)
+
+var (
+	historyQuery  history.Query
+	historySince  time.Duration
+	replayContext string
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history [text]",
+	Short: "List or search commands run with kubegate",
+	Long: `The history command lists the commands run with 'kubegate run', newest last,
+with their context, exit code and correlation ID. Text filters on the command
+line. Secrets in arguments and responses are masked before they are recorded.
+
+History is kept in ~/.kubegate/history.jsonl; configure it under 'history' in
+~/.kubegate/config.yaml (max-entries, response-bytes, disabled) or disable it
+with KUBEGATE_HISTORY=off.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := history.Load()
+		if err != nil {
+			fmt.Println("Failed to load history:", err)
+			return
+		}
+		query := historyQuery
+		if len(args) == 1 {
+			query.Text = args[0]
+		}
+		if historySince > 0 {
+			query.Since = time.Now().Add(-historySince)
+		}
+		entries = history.Search(entries, query)
+		if len(entries) == 0 {
+			fmt.Println("No matching commands in history")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTIME\tCONTEXT\tEXIT\tCOMMAND")
+		for _, entry := range entries {
+			exit := strconv.Itoa(entry.ExitCode)
+			if entry.Error != "" {
+				exit = "error"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", entry.ID, entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Context, exit, entry.Command())
+		}
+		w.Flush()
+	},
+}
+
+var historyShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Show a recorded command and its response",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		entry, err := historyEntry(args[0])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "ID:\t%d\n", entry.ID)
+		fmt.Fprintf(w, "Time:\t%s\n", entry.Time.Local().Format(time.RFC3339))
+		fmt.Fprintf(w, "Context:\t%s\n", entry.Context)
+		fmt.Fprintf(w, "Command:\t%s\n", entry.Command())
+		fmt.Fprintf(w, "Correlation ID:\t%s\n", entry.CorrelationID)
+		fmt.Fprintf(w, "Exit Code:\t%d\n", entry.ExitCode)
+		fmt.Fprintf(w, "Duration:\t%s\n", time.Duration(entry.DurationMs)*time.Millisecond)
+		if entry.Error != "" {
+			fmt.Fprintf(w, "Error:\t%s\n", entry.Error)
+		}
+		w.Flush()
+		if entry.Response != "" {
+			fmt.Printf("\nResponse:\n%s", entry.Response)
+			if entry.Truncated {
+				fmt.Print("\n... (truncated)")
+			}
+			fmt.Println()
+		}
+	},
+}
+
+var historyReplayCmd = &cobra.Command{
+	Use:   "replay <id>",
+	Short: "Run a recorded command again",
+	Long: `The replay command runs a recorded kubectl command again on the context it
+was recorded on, or on --context. Output filters used originally are not
+replayed; the kubectl arguments are.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		entry, err := historyEntry(args[0])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if entry.Redacted() {
+			fmt.Printf("Command %d had secrets masked when it was recorded and cannot be replayed:\n  %s\n", entry.ID, entry.Command())
+			os.Exit(1)
+		}
+
+		target := entry.Context
+		if replayContext != "" {
+			target = replayContext
+		}
+		// kubectl's own --context is forwarded to the agent, so the KubeGate
+		// context is selected the way CURRENT_CONTEXT does
+		os.Setenv("CURRENT_CONTEXT", target)
+		fmt.Fprintf(os.Stderr, "Replaying on context %s: %s\n", target, entry.Command())
+		executeRun(entry.Argv)
+	},
+}
+
+// historyEntry returns the entry whose ID is given as text
+func historyEntry(arg string) (*history.Entry, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid history ID %q", arg)
+	}
+	return history.Get(id)
+}
+
+// recordHistory records the outcome of a command on contextName; failing
+// to record never fails the command
+func recordHistory(cfg config.HistoryConfig, contextName string, argv []string, result *client.Result, err error) {
+	entry := history.Entry{Time: time.Now(), Context: contextName, Argv: argv}
+	if result != nil {
+		entry.Time = entry.Time.Add(-result.Duration)
+		entry.CorrelationID = result.CorrelationID
+		entry.ExitCode = result.ExitCode
+		entry.DurationMs = result.Duration.Milliseconds()
+		entry.Response = result.Output
+	}
+	var exitErr *client.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		entry.Error = err.Error()
+	}
+	if err := history.Record(cfg, entry); err != nil {
+		logging.Logger.WithError(err).Warn("Failed to record command history")
+	}
+}
+
+func init() {
+	historyCmd.Flags().StringVar(&historyQuery.Context, "context", "", "Only commands run on this context")
+	historyCmd.RegisterFlagCompletionFunc("context", completeContextNames)
+	historyCmd.Flags().DurationVar(&historySince, "since", 0, "Only commands run within this duration, e.g. 24h")
+	historyCmd.Flags().BoolVar(&historyQuery.Failed, "failed", false, "Only commands that failed")
+	historyCmd.Flags().IntVar(&historyQuery.Limit, "limit", 50, "Show at most this many of the newest matches (0 for all)")
+	historyReplayCmd.Flags().StringVar(&replayContext, "context", "", "Context to run the command on instead of the recorded one")
+	historyReplayCmd.RegisterFlagCompletionFunc("context", completeContextNames)
+
+	historyCmd.AddCommand(historyShowCmd)
+	historyCmd.AddCommand(historyReplayCmd)
+	rootCmd.AddCommand(historyCmd)
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/output"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/spf13/cobra"
+)
+
+var (
+	jobContext      string
+	jobOutput       string
+	jobWaitTimeout  time.Duration
+	jobPollInterval time.Duration
+)
+
+var jobCmd = &cobra.Command{
+	Use:   "job",
+	Short: "Follow asynchronous jobs",
+	Long: `Commands started with 'kubegate run --async' run as jobs on the agent, which
+keeps their results for 24 hours (KUBEGATE_JOB_TTL). Jobs can be followed from
+any machine using the same context.`,
+}
+
+var jobStatusCmd = &cobra.Command{
+	Use:   "status <id>",
+	Short: "Show the state of a job",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newJobClient(jobContext)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer c.Close()
+
+		job, err := c.JobStatus(context.Background(), args[0])
+		if err != nil {
+			fmt.Println("Failed to get job:", err)
+			os.Exit(1)
+		}
+		printJob(job)
+	},
+}
+
+var jobLogsCmd = &cobra.Command{
+	Use:   "logs <id>",
+	Short: "Print the output of a finished job and exit with its status",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newJobClient(jobContext)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer c.Close()
+
+		result, err := c.JobLogs(context.Background(), args[0])
+		exitWithJobOutput(result, err)
+	},
+}
+
+var jobWaitCmd = &cobra.Command{
+	Use:   "wait <id>",
+	Short: "Wait for a job to finish, then print its output and exit with its status",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newJobClient(jobContext)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer c.Close()
+
+		ctx := context.Background()
+		if jobWaitTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, jobWaitTimeout)
+			defer cancel()
+		}
+		job, err := c.WaitJob(ctx, args[0], jobPollInterval)
+		if errors.Is(err, context.DeadlineExceeded) {
+			fmt.Fprintf(os.Stderr, "Job %s did not finish within %s\n", args[0], jobWaitTimeout)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to wait for job:", err)
+			os.Exit(1)
+		}
+		result, err := c.JobLogs(context.Background(), job.ID)
+		exitWithJobOutput(result, err)
+	},
+}
+
+var jobCancelCmd = &cobra.Command{
+	Use:   "cancel <id>",
+	Short: "Cancel a running job",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newJobClient(jobContext)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer c.Close()
+
+		job, err := c.CancelJob(context.Background(), args[0])
+		if err != nil {
+			fmt.Println("Failed to cancel job:", err)
+			os.Exit(1)
+		}
+		if job.Done() {
+			fmt.Printf("Job %s already %s\n", job.ID, job.State)
+			return
+		}
+		fmt.Printf("Job %s cancelled\n", job.ID)
+	},
+}
+
+// submitJob runs argv on target as a job and prints its ID; terminals also
+// get a hint on how to follow it
+func submitJob(ctx context.Context, target config.Context, argv []string, out *os.File, raw bool) (*client.Job, error) {
+	c := client.New(target)
+	defer c.Close()
+
+	job, err := c.Submit(ctx, argv, nil)
+	if err != nil {
+		return nil, err
+	}
+	if raw || !output.IsTerminal(out) {
+		fmt.Fprintln(out, job.ID)
+		return job, nil
+	}
+	if job.State == protocol.JobPendingApproval {
+		fmt.Fprintf(out, "Job %s is waiting for approval on context %s; approvers run 'kubegate approve %s'\nFollow it with 'kubegate job wait %s'\n", job.ID, target.Name, job.ID, job.ID)
+		return job, nil
+	}
+	fmt.Fprintf(out, "Job %s submitted to context %s\nFollow it with 'kubegate job wait %s'\n", job.ID, target.Name, job.ID)
+	return job, nil
+}
+
+// newJobClient returns a client for contextName or, when empty, the current context
+func newJobClient(contextName string) (*client.Client, error) {
+	if contextName == "" {
+		return client.NewFromCurrentContext()
+	}
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+	target, err := config.GetContext(cfg, contextName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get context %s: %v", contextName, err)
+	}
+	return client.New(*target), nil
+}
+
+// printJob prints a job as a list of fields or, with -o json, as JSON
+func printJob(job *client.Job) {
+	if jobOutput == "json" {
+		data, _ := json.MarshalIndent(job, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", job.ID)
+	fmt.Fprintf(w, "State:\t%s\n", job.State)
+	if job.Done() {
+		fmt.Fprintf(w, "Exit Code:\t%d\n", job.ExitCode)
+	}
+	fmt.Fprintf(w, "Command:\t%s\n", job.Command)
+	if job.Client != "" {
+		fmt.Fprintf(w, "Requested By:\t%s\n", job.Client)
+	}
+	if job.Approver != "" {
+		fmt.Fprintf(w, "Decided By:\t%s\n", job.Approver)
+	}
+	fmt.Fprintf(w, "Submitted:\t%s\n", job.SubmittedAt.Local().Format(time.RFC3339))
+	if job.Done() {
+		fmt.Fprintf(w, "Finished:\t%s (took %s)\n", job.FinishedAt.Local().Format(time.RFC3339), job.FinishedAt.Sub(job.SubmittedAt).Round(time.Second))
+	}
+	fmt.Fprintf(w, "Expires:\t%s\n", job.ExpiresAt.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "Agent:\t%s\n", job.Agent)
+	w.Flush()
+}
+
+// exitWithJobOutput prints a job's output and exits with the job's status
+func exitWithJobOutput(result *client.Result, err error) {
+	var exitErr *client.ExitError
+	if errors.As(err, &exitErr) {
+		fmt.Fprint(os.Stderr, result.Output)
+		os.Exit(exitErr.Code)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	fmt.Print(result.Output)
+}
+
+func init() {
+	jobCmd.PersistentFlags().StringVar(&jobContext, "context", "", "Context the job was submitted to (defaults to the current context)")
+	jobCmd.RegisterFlagCompletionFunc("context", completeContextNames)
+	jobStatusCmd.Flags().StringVarP(&jobOutput, "output", "o", "", "Output format (json)")
+	jobWaitCmd.Flags().DurationVar(&jobWaitTimeout, "timeout", 0, "Give up waiting after this long (0 waits until the job finishes)")
+	jobWaitCmd.Flags().DurationVar(&jobPollInterval, "poll-interval", client.DefaultJobPollInterval, "How often to check the job")
+
+	jobCmd.AddCommand(jobStatusCmd)
+	jobCmd.AddCommand(jobLogsCmd)
+	jobCmd.AddCommand(jobWaitCmd)
+	jobCmd.AddCommand(jobCancelCmd)
+	rootCmd.AddCommand(jobCmd)
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/output"
+)
+
+// previewAndConfirm shows what argv would change on target and asks for
+// confirmation, unless yes is set. It returns a context carrying the
+// preview token, which agents requiring previews check before running argv.
+func previewAndConfirm(ctx context.Context, target config.Context, argv []string, yes bool) (context.Context, error) {
+	c := client.New(target)
+	defer c.Close()
+
+	preview, err := c.Preview(ctx, argv, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to preview the command: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "=== Preview (%s) on context %s ===\n", preview.Method, target.Name)
+	fmt.Fprint(os.Stderr, preview.Output)
+	if preview.Output != "" && !strings.HasSuffix(preview.Output, "\n") {
+		fmt.Fprintln(os.Stderr)
+	}
+	if preview.ExitCode != 0 {
+		return nil, fmt.Errorf("the preview failed with exit status %d; the command was not run", preview.ExitCode)
+	}
+
+	if !yes {
+		if err := confirm(fmt.Sprintf("Run '%s' on context %s?", strings.Join(argv, " "), target.Name)); err != nil {
+			return nil, err
+		}
+	}
+	return client.WithPreviewToken(ctx, preview.Token), nil
+}
+
+// confirm asks question on the terminal and fails unless the answer is yes
+func confirm(question string) error {
+	if !output.IsTerminal(os.Stdin) {
+		return fmt.Errorf("confirmation required; pass --yes when stdin is not a terminal")
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return fmt.Errorf("aborted")
+	}
+	return nil
+}
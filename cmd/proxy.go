@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// DefaultProxyAddress is where `kubegate proxy` listens and exported kubeconfigs point
+const DefaultProxyAddress = "127.0.0.1:8001"
+
+var proxyAddress string
+
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Serve the Kubernetes API of all contexts on a local address",
+	Long: `The proxy command serves the Kubernetes API of every KubeGate context under
+http://<address>/<context>/, running each request on the context's agent. Pair
+it with 'kubegate config export-kubeconfig' to use native kubectl, e.g.
+'kubectl --context prod-via-gate get pods'. Watches and PATCH are not supported.
+
+The proxy listens on localhost by default and only serves requests addressed to
+localhost that carry its bearer token, which export-kubeconfig writes into the
+kubeconfig user of each context. The token is kept in ~/.kubegate/proxy-token;
+rotate it with 'kubegate config export-kubeconfig --rotate-token' and restart
+the proxy.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			fmt.Println("Failed to load config:", err)
+			return
+		}
+		if len(cfg.Contexts) == 0 {
+			fmt.Println("No contexts configured; add one with 'kubegate config set-context'")
+			return
+		}
+
+		token, err := config.ProxyToken(false)
+		if err != nil {
+			fmt.Println("Failed to load proxy token:", err)
+			return
+		}
+		proxy := client.NewProxy(cfg.Contexts, token)
+		defer proxy.Close()
+		server := &http.Server{Addr: proxyAddress, Handler: proxy, ReadHeaderTimeout: 5 * time.Second}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}()
+
+		for _, target := range cfg.Contexts {
+			fmt.Printf("Serving context %s at http://%s%s\n", target.Name, proxyAddress, client.ProxyPath(target.Name))
+		}
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logging.Logger.WithFields(logrus.Fields{
+				"address": proxyAddress,
+				"error":   err.Error(),
+			}).Error("Proxy server failed")
+			fmt.Println("Proxy server failed:", err)
+		}
+	},
+}
+
+func init() {
+	proxyCmd.Flags().StringVar(&proxyAddress, "address", DefaultProxyAddress, "Address to listen on")
+	rootCmd.AddCommand(proxyCmd)
+}
@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
-	"github.com/loaynaser3/KubeGate/pkg/KubeGate"
 	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/tracing"
 	"github.com/spf13/cobra"
 )
 
@@ -30,14 +33,11 @@ and an interactive shell.`,
 		}
 
 		// Treat the remaining args as a Kubernetes command
-		kubeCommand := args[0]
-		commandArgs := args[1:]
-
 		logging.Logger.WithFields(map[string]interface{}{
-			"command": kubeCommand,
-			"args":    commandArgs,
+			"command": args[0],
+			"args":    args[1:],
 		}).Info("Running command as kubegate run")
-		KubeGate.ExecuteRun(kubeCommand, commandArgs)
+		executeRun(args)
 	},
 }
 
@@ -46,6 +46,9 @@ func Execute() {
 	logging.Logger.Info("KubeGate CLI started")
 	// Disable Cobra's default flag parsing
 	rootCmd.DisableFlagParsing = true
+	if isKubectlPlugin(os.Args[0]) {
+		rootCmd.Annotations = map[string]string{cobra.CommandDisplayNameAnnotation: "kubectl gate"}
+	}
 
 	if err := rootCmd.Execute(); err != nil {
 		logging.Logger.WithField("error", err.Error()).Error("Command execution failed")
@@ -53,6 +56,13 @@ func Execute() {
 	}
 }
 
+// isKubectlPlugin reports whether the binary was invoked as the kubectl plugin
+// kubectl-gate, e.g. through a symlink, so help refers to `kubectl gate`
+func isKubectlPlugin(argv0 string) bool {
+	name := strings.TrimSuffix(filepath.Base(argv0), ".exe")
+	return name == "kubectl-gate"
+}
+
 // containsHelpFlag checks if the arguments include `-h` or `--help`
 func containsHelpFlag(args []string) bool {
 	for _, arg := range args {
@@ -62,3 +72,18 @@ func containsHelpFlag(args []string) bool {
 	}
 	return false
 }
+
+// initTracing configures OpenTelemetry for serviceName and returns a function
+// that flushes pending spans
+func initTracing(serviceName string) func() {
+	shutdown, err := tracing.Init(context.Background(), serviceName)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("Failed to initialize tracing")
+		return func() {}
+	}
+	return func() {
+		if err := shutdown(context.Background()); err != nil {
+			logging.Logger.WithError(err).Warn("Failed to flush traces")
+		}
+	}
+}
@@ -1,7 +1,18 @@
 package cmd
 
 import (
-	"github.com/loaynaser3/KubeGate/pkg/KubeGate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/output"
 	"github.com/spf13/cobra"
 )
 
@@ -9,20 +20,396 @@ var runCmd = &cobra.Command{
 	Use:   "run [command] [args...]",
 	Short: "Execute a Kubernetes command",
 	Long: `The run command sends a Kubernetes command to the KubeGate agent
-via RabbitMQ for execution and retrieves the response.`,
-	Args: cobra.MinimumNArgs(1), // Require at least one argument
-	Run: func(cmd *cobra.Command, args []string) {
-		// The first argument is the Kubernetes command (e.g., "get pods")
-		kubeCommand := args[0]
+via RabbitMQ for execution and retrieves the response.
 
-		// Any additional arguments are passed to the command (e.g., "-n default")
-		commandArgs := args[1:]
+KubeGate flags (all other flags are passed to kubectl):
+  --contexts a,b,c           Run the command on several contexts concurrently
+  --all-contexts             Run the command on every configured context
+  --context-selector k=v     Run the command on contexts whose labels match
+  --context-timeout 60s      Per-context response timeout for fan-out
+  --fanout-output text|json  Print results with per-cluster headers or as JSON
+  --jq EXPR                  Filter the JSON response locally with a jq expression
+  --jsonpath TEMPLATE        Filter the JSON response locally with a JSONPath template
+  --raw                      Print the response only, without banners or headers;
+                             with --jq, print strings unquoted (kubectl's
+                             --raw /path is still passed through)
+  --output-file PATH         Write the response to a file instead of stdout, once
+                             the command succeeded
+  --async                    Submit the command as a job and print its ID; follow
+                             it with 'kubegate job status|logs|wait|cancel <id>'
+  --preview                  Preview a mutating command with a server-side dry run
+                             or kubectl diff and ask for confirmation first
+  --yes                      Run a previewed command without asking for confirmation
+
+The "Response received:" banner is only printed when stdout is a terminal.
+Commands the agent parks for approval wait until an approver runs
+'kubegate approve <id>' or 'kubegate deny <id>'.
+With --jq or --jsonpath, "-o json" is added to the kubectl command.
+Mutating commands on contexts marked protected are always previewed, as are
+commands refused by agents that require previews.`,
+	Args:               cobra.MinimumNArgs(1), // Require at least one argument
+	DisableFlagParsing: true,                  // kubectl flags are forwarded untouched
+	Run: func(cmd *cobra.Command, args []string) {
+		if containsHelpFlag(args) {
+			cmd.Help()
+			return
+		}
 
 		// Delegate to the `run` function in the `pkg/KubeGate` package
-		KubeGate.ExecuteRun(kubeCommand, commandArgs)
+		executeRun(args)
 	},
 }
 
+// runOptions holds KubeGate's own run flags, which are removed from the
+// arguments before they are forwarded to kubectl
+type runOptions struct {
+	contexts        []string
+	allContexts     bool
+	contextSelector string
+	contextTimeout  time.Duration
+	fanOutOutput    string
+	jq              string
+	jsonPath        string
+	raw             bool
+	outputFile      string
+	async           bool
+	preview         bool
+	yes             bool
+}
+
+// fanOut reports whether the command targets more than the current context
+func (o runOptions) fanOut() bool {
+	return len(o.contexts) > 0 || o.allContexts || o.contextSelector != ""
+}
+
+// parseRunArgs extracts KubeGate flags from args and returns the remaining kubectl arguments
+func parseRunArgs(args []string) (runOptions, []string, error) {
+	opts := runOptions{fanOutOutput: client.FanOutText}
+	var rest []string
+
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		// takeValue returns the flag value from `--flag=value` or `--flag value`
+		takeValue := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("flag %s requires a value", name)
+			}
+			i++
+			return args[i], nil
+		}
+
+		switch name {
+		case "--contexts":
+			v, err := takeValue()
+			if err != nil {
+				return opts, nil, err
+			}
+			for _, ctx := range strings.Split(v, ",") {
+				if ctx = strings.TrimSpace(ctx); ctx != "" {
+					opts.contexts = append(opts.contexts, ctx)
+				}
+			}
+		case "--all-contexts":
+			opts.allContexts = !hasValue || value == "true"
+		case "--context-selector":
+			v, err := takeValue()
+			if err != nil {
+				return opts, nil, err
+			}
+			opts.contextSelector = v
+		case "--context-timeout":
+			v, err := takeValue()
+			if err != nil {
+				return opts, nil, err
+			}
+			timeout, err := time.ParseDuration(v)
+			if err != nil {
+				return opts, nil, fmt.Errorf("invalid --context-timeout: %v", err)
+			}
+			opts.contextTimeout = timeout
+		case "--fanout-output":
+			v, err := takeValue()
+			if err != nil {
+				return opts, nil, err
+			}
+			if v != client.FanOutText && v != client.FanOutJSON {
+				return opts, nil, fmt.Errorf("invalid --fanout-output %q (expected text or json)", v)
+			}
+			opts.fanOutOutput = v
+		case "--jq", "--jsonpath", "--output-file":
+			v, err := takeValue()
+			if err != nil {
+				return opts, nil, err
+			}
+			switch name {
+			case "--jq":
+				opts.jq = v
+			case "--jsonpath":
+				opts.jsonPath = v
+			default:
+				opts.outputFile = v
+			}
+		case "--async":
+			opts.async = !hasValue || value == "true"
+		case "--preview":
+			opts.preview = !hasValue || value == "true"
+		case "--yes":
+			opts.yes = !hasValue || value == "true"
+		case "--raw":
+			// kubectl's --raw takes a URI such as /api/v1/pods; a bare --raw is ours
+			switch {
+			case hasValue && (value == "true" || value == "false"):
+				opts.raw = value == "true"
+			case hasValue:
+				rest = append(rest, args[i])
+			case i+1 < len(args) && strings.HasPrefix(args[i+1], "/"):
+				rest = append(rest, args[i], args[i+1])
+				i++
+			default:
+				opts.raw = true
+			}
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return opts, rest, nil
+}
+
+// withJSONOutput asks kubectl for JSON output, which local filters need.
+// Output flags other than json are rejected, and requests made with kubectl's
+// --raw are left alone since they return JSON already.
+func withJSONOutput(args []string) ([]string, error) {
+	end := len(args)
+	for i, arg := range args {
+		if arg == "--" {
+			end = i // Arguments after -- belong to the command run by exec or run
+			break
+		}
+	}
+
+	for i := 0; i < end; i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		switch {
+		case name == "--raw":
+			return args, nil
+		case name == "-o" || name == "--output":
+			if !hasValue && i+1 < end {
+				value = args[i+1]
+			}
+			if value != "json" {
+				return nil, fmt.Errorf("--jq and --jsonpath need JSON output, got %s %s", name, value)
+			}
+			return args, nil
+		case strings.HasPrefix(args[i], "-o") && len(args[i]) > 2:
+			if value := strings.TrimPrefix(args[i][2:], "="); value != "json" {
+				return nil, fmt.Errorf("--jq and --jsonpath need JSON output, got -o %s", value)
+			}
+			return args, nil
+		}
+	}
+
+	out := append([]string(nil), args[:end]...)
+	out = append(out, "-o", "json")
+	return append(out, args[end:]...), nil
+}
+
+// executeRun runs the command and exits with a non-zero status on failure,
+// using the command's own exit status when it failed on the agent
+func executeRun(args []string) {
+	flushTraces := initTracing("kubegate-client")
+	err := runCommand(args)
+	flushTraces()
+	var exitErr *client.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.Code) // The agent's error output has already been printed
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// runCommand parses KubeGate flags and runs the command on the selected contexts
+func runCommand(args []string) (err error) {
+	opts, kubeArgs, err := parseRunArgs(args)
+	if err != nil {
+		return err
+	}
+	if len(kubeArgs) == 0 {
+		return fmt.Errorf("no kubectl command given")
+	}
+	filter, err := output.Compile(opts.jq, opts.jsonPath, opts.raw)
+	if err != nil {
+		return err
+	}
+	argv := kubeArgs // Recorded in the history as typed
+	if filter != nil {
+		if kubeArgs, err = withJSONOutput(kubeArgs); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	out := os.Stdout
+	if opts.outputFile != "" {
+		file, commit, err := createOutputFile(opts.outputFile)
+		if err != nil {
+			return err
+		}
+		defer func() { err = commit(err) }()
+		out = file
+	}
+
+	ctx := context.Background()
+	if key := os.Getenv("KUBEGATE_IDEMPOTENCY_KEY"); key != "" {
+		// Lets a retried invocation reuse the key of an earlier one
+		ctx = client.WithIdempotencyKey(ctx, key)
+	}
+
+	if !opts.fanOut() {
+		target, err := config.GetContext(cfg, cfg.CurrentContext)
+		if err != nil {
+			return fmt.Errorf("failed to get current context: %v", err)
+		}
+		if opts.async && filter != nil {
+			return fmt.Errorf("--async cannot be combined with output filters")
+		}
+
+		guarded := client.IsMutating(kubeArgs) && (target.Protected || opts.preview)
+		if guarded {
+			if ctx, err = previewAndConfirm(ctx, *target, kubeArgs, opts.yes); err != nil {
+				return err
+			}
+		}
+		err = runSingle(ctx, cfg, *target, argv, kubeArgs, filter, opts, out)
+		if errors.Is(err, client.ErrPreviewRequired) && !guarded {
+			// The agent refuses this command until it has been previewed
+			if ctx, err = previewAndConfirm(ctx, *target, kubeArgs, opts.yes); err != nil {
+				return err
+			}
+			err = runSingle(ctx, cfg, *target, argv, kubeArgs, filter, opts, out)
+		}
+		return err
+	}
+
+	if opts.async {
+		return fmt.Errorf("--async cannot be combined with fan-out")
+	}
+	if opts.preview {
+		return fmt.Errorf("--preview cannot be combined with fan-out")
+	}
+	contexts, err := config.SelectContexts(cfg, opts.contexts, opts.allContexts, opts.contextSelector)
+	if err != nil {
+		return err
+	}
+	if client.IsMutating(kubeArgs) {
+		for _, target := range contexts {
+			if target.Protected {
+				return fmt.Errorf("context %s is protected; run mutating commands on it alone to preview and confirm them", target.Name)
+			}
+		}
+	}
+
+	return client.ExecuteFanOut(ctx, contexts, kubeArgs, client.FanOutOptions{
+		Timeout: opts.contextTimeout,
+		Output:  opts.fanOutOutput,
+		Filter:  filter,
+		Raw:     opts.raw,
+		OnResult: func(contextName string, result *client.Result, err error) {
+			recordHistory(cfg.History, contextName, argv, result, err)
+		},
+	}, out)
+}
+
+// createOutputFile returns a temporary file next to path for the response.
+// commit moves it into place when the command succeeded and removes it
+// otherwise, so an existing file is only replaced by a complete response.
+func createOutputFile(path string) (*os.File, func(error) error, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create output file: %v", err)
+	}
+	commit := func(runErr error) error {
+		defer os.Remove(file.Name()) // No-op once renamed
+		closeErr := file.Close()
+		if runErr != nil {
+			return runErr
+		}
+		if closeErr != nil {
+			return fmt.Errorf("failed to write output file: %v", closeErr)
+		}
+		mode := os.FileMode(0o644)
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+		if err := os.Chmod(file.Name(), mode); err != nil {
+			return fmt.Errorf("failed to write output file: %v", err)
+		}
+		if err := os.Rename(file.Name(), path); err != nil {
+			return fmt.Errorf("failed to write output file: %v", err)
+		}
+		return nil
+	}
+	return file, commit, nil
+}
+
+// runSingle runs the command on target, or submits it as a job with --async,
+// and records it in the history
+func runSingle(ctx context.Context, cfg *config.Config, target config.Context, argv, kubeArgs []string, filter output.Filter, opts runOptions, out *os.File) error {
+	if opts.async {
+		job, err := submitJob(ctx, target, kubeArgs, out, opts.raw)
+		if job != nil {
+			recordHistory(cfg.History, target.Name, argv, &client.Result{Output: "Job submitted", CorrelationID: job.ID}, nil)
+		}
+		return err
+	}
+
+	c := client.New(target)
+	defer c.Close()
+
+	result, err := c.RunWithApproval(ctx, kubeArgs, nil, 0, func(job *client.Job) {
+		fmt.Fprintf(os.Stderr, "Waiting for approval on context %s until %s; approvers run 'kubegate approve %s'\n",
+			target.Name, job.ExpiresAt.Local().Format(time.Kitchen), job.ID)
+	})
+	if errors.Is(err, client.ErrPreviewRequired) {
+		return err // Previewed and run again by the caller
+	}
+	recordHistory(cfg.History, target.Name, argv, result, err)
+	var exitErr *client.ExitError
+	if errors.As(err, &exitErr) {
+		fmt.Fprint(os.Stderr, result.Output)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return printResponse(out, result.Output, filter, opts.raw)
+}
+
+// printResponse filters response and writes it to out, after a banner when
+// out is a terminal
+func printResponse(out *os.File, response string, filter output.Filter, raw bool) error {
+	if filter != nil {
+		filtered, err := filter(response)
+		if err != nil {
+			return err
+		}
+		response = filtered
+	}
+	if !raw && output.IsTerminal(out) {
+		fmt.Fprintln(out, "Response received:")
+	}
+	_, err := io.WriteString(out, response)
+	return err
+}
+
 func init() {
 	rootCmd.AddCommand(runCmd)
 }
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+)
+
+func TestParseRunArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		opts runOptions
+		rest []string
+	}{
+		{
+			name: "plain kubectl arguments",
+			args: []string{"get", "pods", "-n", "prod"},
+			opts: runOptions{fanOutOutput: client.FanOutText},
+			rest: []string{"get", "pods", "-n", "prod"},
+		},
+		{
+			name: "contexts with spaces and empty entries",
+			args: []string{"--contexts", "a, b,,c", "get", "pods"},
+			opts: runOptions{contexts: []string{"a", "b", "c"}, fanOutOutput: client.FanOutText},
+			rest: []string{"get", "pods"},
+		},
+		{
+			name: "fan-out flags in both forms",
+			args: []string{"get", "--all-contexts", "--context-timeout=5s", "--fanout-output", "json", "pods"},
+			opts: runOptions{allContexts: true, contextTimeout: 5 * time.Second, fanOutOutput: client.FanOutJSON},
+			rest: []string{"get", "pods"},
+		},
+		{
+			name: "selector and boolean values",
+			args: []string{"--context-selector=env=prod", "--async=false", "--preview", "--yes=true", "delete", "pod", "web"},
+			opts: runOptions{contextSelector: "env=prod", preview: true, yes: true, fanOutOutput: client.FanOutText},
+			rest: []string{"delete", "pod", "web"},
+		},
+		{
+			name: "filters and output file",
+			args: []string{"get", "pods", "--jq", ".items[]", "--jsonpath={.items[*].metadata.name}", "--output-file", "out.json"},
+			opts: runOptions{jq: ".items[]", jsonPath: "{.items[*].metadata.name}", outputFile: "out.json", fanOutOutput: client.FanOutText},
+			rest: []string{"get", "pods"},
+		},
+		{
+			name: "bare raw is KubeGate's",
+			args: []string{"get", "pods", "--raw"},
+			opts: runOptions{raw: true, fanOutOutput: client.FanOutText},
+			rest: []string{"get", "pods"},
+		},
+		{
+			name: "raw with a URI is kubectl's",
+			args: []string{"get", "--raw", "/api/v1/pods"},
+			opts: runOptions{fanOutOutput: client.FanOutText},
+			rest: []string{"get", "--raw", "/api/v1/pods"},
+		},
+		{
+			name: "raw with an inline URI is kubectl's",
+			args: []string{"get", "--raw=/healthz"},
+			opts: runOptions{fanOutOutput: client.FanOutText},
+			rest: []string{"get", "--raw=/healthz"},
+		},
+		{
+			name: "raw with a boolean value",
+			args: []string{"get", "pods", "--raw=true"},
+			opts: runOptions{raw: true, fanOutOutput: client.FanOutText},
+			rest: []string{"get", "pods"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, rest, err := parseRunArgs(tt.args)
+			if err != nil {
+				t.Fatalf("parseRunArgs(%q): %v", tt.args, err)
+			}
+			if !reflect.DeepEqual(opts, tt.opts) {
+				t.Errorf("options = %+v, want %+v", opts, tt.opts)
+			}
+			if !reflect.DeepEqual(rest, tt.rest) {
+				t.Errorf("kubectl arguments = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestParseRunArgsErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"get", "pods", "--contexts"}, "requires a value"},
+		{[]string{"--context-timeout", "soon", "get", "pods"}, "invalid --context-timeout"},
+		{[]string{"--fanout-output", "yaml", "get", "pods"}, "invalid --fanout-output"},
+		{[]string{"get", "pods", "--jq"}, "requires a value"},
+	}
+	for _, tt := range tests {
+		if _, _, err := parseRunArgs(tt.args); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseRunArgs(%q) = %v, want an error containing %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestCreateOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.json")
+	if err := os.WriteFile(path, []byte("previous"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed command leaves the existing file as it was
+	file, commit, err := createOutputFile(path)
+	if err != nil {
+		t.Fatalf("createOutputFile: %v", err)
+	}
+	file.WriteString("partial")
+	runErr := errors.New("agent unreachable")
+	if err := commit(runErr); err != runErr {
+		t.Errorf("commit returned %v, want the command's error", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "previous" {
+		t.Errorf("file after a failed command = %q, want it untouched", data)
+	}
+
+	file, commit, err = createOutputFile(path)
+	if err != nil {
+		t.Fatalf("createOutputFile: %v", err)
+	}
+	file.WriteString("response")
+	if err := commit(nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "response" {
+		t.Errorf("file after success = %q, want the response", data)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o640 {
+		t.Errorf("file mode after success = %v, want the previous 0640", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the output file", len(entries))
+	}
+
+	// A failed command does not create a missing file
+	missing := filepath.Join(dir, "missing.json")
+	if _, commit, err = createOutputFile(missing); err != nil {
+		t.Fatalf("createOutputFile: %v", err)
+	}
+	commit(runErr)
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("failed command created %s: %v", missing, err)
+	}
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/KubeGate"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	sessionContext  string
+	sessionClearAll bool
+)
+
+var sessionCmd = &cobra.Command{
+	Use:   "session",
+	Short: "Manage reply queue sessions",
+	Long: `Backends without direct replies reuse a reply queue per context for one hour.
+Sessions are stored in ~/.kubegate/sessions, keyed by context and backend.`,
+}
+
+var sessionListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List stored sessions",
+	Run: func(cmd *cobra.Command, args []string) {
+		sessions, err := utils.ListSessions()
+		if err != nil {
+			fmt.Println("Failed to list sessions:", err)
+			return
+		}
+		if len(sessions) == 0 {
+			fmt.Println("No sessions found")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CONTEXT\tBACKEND\tQUEUE\tAGE\tSTATUS")
+		for _, s := range sessions {
+			status := "valid"
+			if time.Since(s.Timestamp) >= protocol.SessionDuration {
+				status = "expired"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Context, s.Backend, s.QueueName,
+				time.Since(s.Timestamp).Round(time.Second), status)
+		}
+		w.Flush()
+	},
+}
+
+var sessionRenewCmd = &cobra.Command{
+	Use:   "renew",
+	Short: "Restart the validity period of a context's session",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, err := sessionTarget()
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		session, err := KubeGate.RenewSession(ctx)
+		if err != nil {
+			fmt.Printf("Failed to renew session for context %s: %v\n", ctx.Name, err)
+			return
+		}
+		fmt.Printf("Session for context %s renewed (queue %s)\n", ctx.Name, session.QueueName)
+	},
+}
+
+var sessionClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Delete a session and its reply queue",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !sessionClearAll {
+			ctx, err := sessionTarget()
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			if err := KubeGate.ClearSession(ctx); err != nil {
+				fmt.Printf("Failed to clear session for context %s: %v\n", ctx.Name, err)
+				return
+			}
+			fmt.Printf("Session for context %s cleared\n", ctx.Name)
+			return
+		}
+
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			fmt.Println("Failed to load config:", err)
+			return
+		}
+		sessions, err := utils.ListSessions()
+		if err != nil {
+			fmt.Println("Failed to list sessions:", err)
+			return
+		}
+		cleared := 0
+		for _, s := range sessions {
+			ctx, err := config.GetContext(cfg, s.Context)
+			if err != nil || ctx.Backend != s.Backend {
+				// The context is gone or changed backend; only the file can be removed
+				if err := os.Remove(s.Path); err != nil {
+					fmt.Printf("Failed to remove session file %s: %v\n", s.Path, err)
+					continue
+				}
+				cleared++
+				continue
+			}
+			if err := KubeGate.ClearSession(ctx); err != nil {
+				fmt.Printf("Failed to clear session for context %s: %v\n", ctx.Name, err)
+				continue
+			}
+			cleared++
+		}
+		fmt.Printf("Cleared %d of %d sessions\n", cleared, len(sessions))
+	},
+}
+
+// sessionTarget returns the context selected with --context, or the current context
+func sessionTarget() (*config.Context, error) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+	name := sessionContext
+	if name == "" {
+		name = cfg.CurrentContext
+	}
+	ctx, err := config.GetContext(cfg, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get context %s: %v", name, err)
+	}
+	return ctx, nil
+}
+
+func init() {
+	sessionCmd.PersistentFlags().StringVar(&sessionContext, "context", "", "Context of the session (defaults to the current context)")
+	sessionCmd.RegisterFlagCompletionFunc("context", completeContextNames)
+	sessionClearCmd.Flags().BoolVar(&sessionClearAll, "all", false, "Clear the sessions of every context")
+	sessionCmd.AddCommand(sessionListCmd, sessionRenewCmd, sessionClearCmd)
+	rootCmd.AddCommand(sessionCmd)
+}
@@ -1,29 +1,80 @@
 package KubeGate
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/loaynaser3/KubeGate/pkg/config"
 	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/metrics"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
 	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/redact"
+	"github.com/loaynaser3/KubeGate/pkg/tracing"
 	"github.com/loaynaser3/KubeGate/pkg/utils"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// agent holds the state shared by the command handler and background tasks
+type agent struct {
+	id       string
+	cfg      *config.AgentConfig
+	mq       queue.MessageQueue
+	inFlight atomic.Int64 // Commands currently being handled
+
+	consuming atomic.Bool // Whether the command queue consumer is running
+	kubeAPI   kubeAPIChecker
+
+	idempotency     *idempotencyCache // Nil when duplicate suppression is disabled
+	idempotentVerbs map[string]bool
+
+	executor       Executor       // Runs kubectl commands
+	streamExecutor StreamExecutor // Runs kubectl commands whose output is streamed
+	previews       *previewSigner
+
+	jobs       *jobStore // Nil when asynchronous jobs are disabled
+	jobMu      sync.Mutex
+	jobCancels map[string]context.CancelFunc // Cancels jobs running on this agent
+
+	limiter  *rateLimiter   // Nil when no rate limit is configured
+	slots    chan struct{}  // One token per command allowed to run concurrently
+	jobSlots chan struct{}  // One token per asynchronous job allowed to run concurrently
+	running  sync.WaitGroup // Commands still being handled
+}
+
+// AgentOptions customizes an agent started with RunAgent
+type AgentOptions struct {
+	Executor Executor // Runs kubectl commands; the kubectl binary when nil
+	// StreamExecutor runs commands whose output is streamed; the kubectl
+	// binary when both are nil, or Executor, whose output comes at the end
+	StreamExecutor StreamExecutor
+}
+
 // StartAgent initializes the RabbitMQ consumer and starts processing messages
 func StartAgent() error {
 	cfg, err := config.LoadAgentConfig()
 	if err != nil {
 		return fmt.Errorf("failed to load agent config: %v", err)
 	}
+	return RunAgent(context.Background(), cfg, AgentOptions{})
+}
 
+// RunAgent processes commands from cfg's command queue until ctx is
+// cancelled or the consumer stops, then waits for running commands
+func RunAgent(ctx context.Context, cfg *config.AgentConfig, opts AgentOptions) error {
 	// Initialize the messaging backend
-	messageQueue, err := queue.NewMessageQueue(cfg.Backend, cfg.RabbitMQURL)
+	backendQueue, err := queue.NewMessageQueue(cfg.Backend, cfg.RabbitMQURL)
 	if err != nil {
 		return fmt.Errorf("failed to initialize messaging backend: %v", err)
 	}
+	setManagementURL(backendQueue, cfg.ManagementURL)
+	messageQueue := queue.WithCompression(queue.WithChunking(backendQueue, cfg.MaxMessageSize), cfg.Compression, queue.DefaultCompressionThreshold)
 	defer func() {
 		if err := messageQueue.Close(); err != nil {
 			logging.Logger.WithError(err).Error("Failed to close message queue")
@@ -35,48 +86,309 @@ func StartAgent() error {
 		return fmt.Errorf("failed to connect to messaging backend: %v", err)
 	}
 
+	// Closing the backend stops the consumer when ctx is cancelled
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			messageQueue.Close()
+		case <-stopped:
+		}
+	}()
+
+	a := &agent{id: newAgentID(), cfg: cfg, mq: messageQueue, executor: opts.Executor, streamExecutor: opts.StreamExecutor}
+	if a.streamExecutor == nil && a.executor != nil {
+		a.streamExecutor = bufferedStream(a.executor)
+	}
+	if a.executor == nil {
+		a.executor = executeKubectlCommand
+	}
+	if a.streamExecutor == nil {
+		a.streamExecutor = streamKubectlCommand
+	}
+	a.configureIdempotency()
+	a.configureJobs()
+	a.previews = newPreviewSigner(cfg.PreviewSecret)
+	a.limiter = newRateLimiter(cfg)
+	maxConcurrent := cfg.MaxConcurrentCommands
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMaxConcurrentCommands
+	}
+	a.slots = make(chan struct{}, maxConcurrent)
+	maxJobs := cfg.MaxConcurrentJobs
+	if maxJobs <= 0 {
+		maxJobs = DefaultMaxConcurrentJobs
+	}
+	a.jobSlots = make(chan struct{}, maxJobs)
+
+	// Report broker reconnects; the backend resumes consuming on its own
+	if source, ok := queue.Unwrap(messageQueue).(queue.EventSource); ok {
+		go logConnectionEvents(source.Events())
+	}
+
 	logging.Logger.WithFields(logrus.Fields{
+		"agent_id":      a.id,
 		"backend":       cfg.Backend,
 		"command_queue": cfg.CommandQueue,
 	}).Info("Agent started and listening on command queue")
 
+	// Announce presence so clients can discover the agent and fail fast when it is down
+	interval := cfg.HeartbeatInterval
+	if interval == 0 {
+		interval = protocol.DefaultHeartbeatInterval
+	}
+	if interval > 0 && protocol.SupportsPresence(messageQueue) {
+		stop := make(chan struct{})
+		defer close(stop)
+		go a.runHeartbeat(interval, stop)
+	}
+
+	// Delete reply queues left behind by clients that went away
+	if cfg.GCInterval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go a.runJanitor(cfg.GCInterval, stop)
+	}
+
+	// Expose liveness, readiness and version for Kubernetes probes
+	healthAddr := cfg.HealthAddr
+	if healthAddr == "" {
+		healthAddr = DefaultHealthAddr
+	}
+	if healthAddr != "off" {
+		server := a.startHealthServer(healthAddr)
+		defer server.Close()
+	}
+
 	// Start consuming messages from the command queue
-	return messageQueue.ReceiveMessages(cfg.CommandQueue, func(msg queue.Message) error {
-		return handleCommand(msg, messageQueue)
-	})
+	a.consuming.Store(true)
+	defer a.consuming.Store(false)
+	err = messageQueue.ReceiveMessages(cfg.CommandQueue, a.dispatch)
+	a.running.Wait()
+	return err
+}
+
+// dispatch handles each command in its own goroutine, blocking the consumer
+// while the maximum number of concurrent commands are already running. Job
+// queries are answered without a slot, so long jobs cannot block them.
+//
+// Delivery is at most once: dispatch returns before the command runs, so the
+// backend acknowledges (RabbitMQ) or deletes (SQS) the message at once, and a
+// command interrupted by an agent crash is not delivered again. Clients see
+// a timeout; a retry with the same idempotency key is answered with the
+// stored response if the command did complete.
+func (a *agent) dispatch(msg queue.Message) error {
+	if isJobQuery(msg) {
+		a.running.Add(1)
+		go func() {
+			defer a.running.Done()
+			_ = a.handleCommand(msg)
+		}()
+		return nil
+	}
+	a.slots <- struct{}{}
+	a.running.Add(1)
+	go func() {
+		defer func() {
+			<-a.slots
+			a.running.Done()
+		}()
+		// handleCommand logs its own failures
+		_ = a.handleCommand(msg)
+	}()
+	return nil
+}
+
+// execute runs a decoded command and records its outcome, returning the
+// response and the command's exit status. Only successful results are
+// reported as cacheable, so retries of failed commands run again.
+func (a *agent) execute(ctx context.Context, args []string, verb string) (string, int, bool) {
+	logging.Logger.WithField("command", args).Info("Executing kubectl command")
+	result, err := a.executor(ctx, kubectlArgs(args))
+	if err != nil {
+		logging.Logger.WithFields(logrus.Fields{
+			"command": args,
+			"error":   err.Error(),
+		}).Error("Failed to execute kubectl command")
+		metrics.CommandsTotal.WithLabelValues(verb, "error").Inc()
+		return fmt.Sprintf("Error: failed to execute command: %s, error: %v", result, err), exitCode(err), false
+	}
+	metrics.CommandsTotal.WithLabelValues(verb, "success").Inc()
+	return result, 0, true
+}
+
+// kubectlArgs drops empty arguments, except the word being completed by
+// __complete, which is empty when completing a new word
+func kubectlArgs(args []string) []string {
+	argv := strings.Fields(strings.Join(args, " "))
+	if len(args) > 1 && args[0] == protocol.CompleteVerb && args[len(args)-1] == "" {
+		argv = append(argv, "")
+	}
+	return argv
+}
+
+// configureIdempotency sets up duplicate suppression from the agent config
+func (a *agent) configureIdempotency() {
+	ttl := a.cfg.IdempotencyTTL
+	if ttl == 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	if ttl < 0 {
+		return
+	}
+
+	verbs := a.cfg.IdempotentVerbs
+	if len(verbs) == 0 {
+		verbs = DefaultIdempotentVerbs
+	}
+	a.idempotentVerbs = map[string]bool{}
+	for _, verb := range verbs {
+		a.idempotentVerbs[strings.TrimSpace(verb)] = true
+	}
+	a.idempotency = newIdempotencyCache(ttl, maxIdempotencyEntries)
+}
+
+// logConnectionEvents logs connection state changes until the backend is closed
+func logConnectionEvents(events <-chan queue.ConnectionEvent) {
+	for event := range events {
+		entry := logging.Logger.WithFields(logrus.Fields{
+			"state":   event.State,
+			"attempt": event.Attempt,
+		})
+		if event.Err != nil {
+			entry = entry.WithError(event.Err)
+		}
+		if event.State == queue.StateConnected || event.State == queue.StateClosed {
+			entry.Info("Broker connection state changed")
+		} else {
+			entry.Warn("Broker connection state changed")
+		}
+	}
 }
 
 // handleCommand processes a single message and sends a response back to the client
-func handleCommand(msg queue.Message, mq queue.MessageQueue) error {
+func (a *agent) handleCommand(msg queue.Message) error {
+	a.inFlight.Add(1)
+	metrics.CommandsInFlight.Inc()
+	defer func() {
+		a.inFlight.Add(-1)
+		metrics.CommandsInFlight.Dec()
+	}()
+	verb := metrics.Verb(protocol.ParseCommandLine(strings.Fields(msg.Body)).Verb)
+
+	// Continue the trace started by the client
+	ctx, span := tracing.Tracer().Start(tracing.Extract(msg.Headers), "handleCommand")
+	span.SetAttributes(
+		attribute.String("kubegate.verb", verb),
+		attribute.String("kubegate.correlation_id", msg.CorrelationID),
+	)
+	defer span.End()
+
 	logging.Logger.WithFields(logrus.Fields{
 		"command":     msg.Body,
 		"reply_queue": msg.ReplyTo,
 		"correlation": msg.CorrelationID,
 	}).Info("Received command from client")
 
-	// Decode Base64 arguments and prepare the command
-	decodedArgs, err := utils.ReplaceBase64WithFile(strings.Split(msg.Body, " "), utils.DecodeBase64StringToFile)
+	// Refuse commands beyond the global or per-client rate limit
+	if a.limiter != nil {
+		client := clientIdentity(msg)
+		if wait, ok := a.limiter.allow(client); !ok {
+			logging.Logger.WithFields(logrus.Fields{
+				"client":      client,
+				"client_id":   msg.Headers[protocol.HeaderClientID],
+				"correlation": msg.CorrelationID,
+				"retry_after": wait.String(),
+			}).Warn("Command rate limited")
+			metrics.CommandsTotal.WithLabelValues(verb, "rate_limited").Inc()
+			response := fmt.Sprintf("Error: rate limited, retry after %s", wait.Round(time.Millisecond))
+			return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, response, tracing.Inject(ctx, rateLimitedHeaders(wait)))
+		}
+	}
+
+	if isJobQuery(msg) {
+		return a.handleJobQuery(ctx, msg)
+	}
+
+	// Decode Base64 arguments and prepare the command; completions carry no files
+	var err error
+	decodedArgs := strings.Split(msg.Body, " ")
+	if decodedArgs[0] != protocol.CompleteVerb {
+		decodedArgs, err = utils.ReplaceBase64WithFile(decodedArgs, utils.DecodeBase64StringToFile)
+	}
 	if err != nil {
 		logging.Logger.WithFields(logrus.Fields{
 			"error":   err.Error(),
 			"command": msg.Body,
 		}).Error("Failed to decode Base64 arguments")
+		metrics.CommandsTotal.WithLabelValues(verb, "error").Inc()
 		return err
 	}
 
-	// Execute the command
-	logging.Logger.WithField("command", decodedArgs).Info("Executing kubectl command")
-	result, err := executeKubectlCommand(strings.Join(decodedArgs, " "))
-	if err != nil {
+	// Templated output prints Secret fields SecretData cannot find to mask
+	if !a.cfg.AllowSecretData && readsSecretsTemplated(protocol.ParseCommandLine(decodedArgs)) {
 		logging.Logger.WithFields(logrus.Fields{
-			"command": decodedArgs,
-			"error":   err.Error(),
-		}).Error("Failed to execute kubectl command")
-		result = fmt.Sprintf("Error: %v", err)
+			"correlation": msg.CorrelationID,
+			"client":      reportedClient(msg),
+		}).Warn("Templated output of Secrets refused")
+		metrics.CommandsTotal.WithLabelValues(verb, "refused").Inc()
+		response := "Error: this agent masks Secret data, which jsonpath, go-template and custom-columns output would bypass; use -o json or -o yaml, or set KUBEGATE_ALLOW_SECRET_DATA=true on the agent"
+		return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, response, tracing.Inject(ctx, exitCodeHeaders(1)))
+	}
+
+	// Park commands matching an approval rule until an approver decides,
+	// previews included, so that approval rules hold whatever is asked
+	if a.approvalRequired(decodedArgs) {
+		return a.parkForApproval(ctx, msg, verb)
+	}
+
+	// Preview mutating commands, and refuse them without a preview when required
+	if msg.Headers[protocol.HeaderPreview] == "true" {
+		return a.handlePreview(ctx, msg, decodedArgs, verb)
+	}
+	if a.previewRequired(decodedArgs) && !a.previews.verify(msg.Headers[protocol.HeaderPreviewToken], msg.Body) {
+		return a.refusePreview(ctx, msg, verb)
+	}
+
+	if msg.Headers[protocol.HeaderAsync] == "true" {
+		return a.runJob(ctx, msg, decodedArgs, verb)
+	}
+	if msg.Headers[protocol.HeaderStream] == "true" && a.streamable(msg, verb) {
+		return a.stream(ctx, msg, decodedArgs, verb)
+	}
+
+	// Execute the command, or return the stored response of a duplicate
+	var code int
+	run := func() (string, bool) {
+		result, exitCode, cacheable := a.execute(ctx, decodedArgs, verb)
+		code = exitCode
+		return result, cacheable
+	}
+	var result string
+	if key := idempotencyKey(msg, a.idempotentVerbs); a.idempotency != nil && key != "" {
+		var cached bool
+		if result, cached = a.idempotency.do(key, run); cached {
+			logging.Logger.WithFields(logrus.Fields{
+				"correlation":     msg.CorrelationID,
+				"idempotency_key": key,
+			}).Info("Duplicate command, returning stored response")
+			span.SetAttributes(attribute.Bool("kubegate.duplicate", true))
+			metrics.CommandsTotal.WithLabelValues(verb, "duplicate").Inc()
+		}
+	} else {
+		result, _ = run()
+	}
+
+	// Mask Secret data unless the agent's policy allows returning it
+	if verb == "get" && !a.cfg.AllowSecretData {
+		result = redact.SecretData(result)
 	}
 
 	// Send response using the messaging backend
-	if err := mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, result); err != nil {
+	if err := a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, result, tracing.Inject(ctx, exitCodeHeaders(code))); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		logging.Logger.WithFields(logrus.Fields{
 			"correlation": msg.CorrelationID,
 			"reply_queue": msg.ReplyTo,
@@ -92,25 +404,6 @@ func handleCommand(msg queue.Message, mq queue.MessageQueue) error {
 	return nil
 }
 
-// executeKubectlCommand executes a kubectl command in the agent pod
-func executeKubectlCommand(command string) (string, error) {
-	// Prepare the kubectl command
-	kubectlArgs := strings.Fields(command)
-	cmd := exec.Command("kubectl", kubectlArgs...)
-
-	// Capture the output
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		logging.Logger.WithFields(logrus.Fields{
-			"command": string(output),
-			"error":   err,
-		}).Error("Failed to execute command")
-		return "failed to execute command: %s, error: %v", fmt.Errorf("failed to execute command: %s, error: %v", string(output), err)
-	}
-
-	return string(output), nil
-}
-
 // ExecuteCommand SIMULATE executing a kubectl command.
 func ExecuteCommand(command string) (string, error) {
 	// Simulate processing the command
@@ -0,0 +1,252 @@
+package KubeGate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/metrics"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/redact"
+	"github.com/loaynaser3/KubeGate/pkg/tracing"
+	"github.com/loaynaser3/KubeGate/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultApprovalTTL is how long a command waits for approval
+const DefaultApprovalTTL = time.Hour
+
+// approvalRequired reports whether args match one of the agent's approval rules
+func (a *agent) approvalRequired(args []string) bool {
+	for _, rule := range a.cfg.ApprovalRules {
+		if matchesApprovalRule(args, strings.Fields(rule)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesApprovalRule reports whether args run the verb of rule, its first
+// word, on the resources named by its other words, in the same order.
+// "delete namespace" matches `delete ns foo`, `-n x delete namespaces/foo`,
+// `delete --raw /api/v1/namespaces/foo` and `delete -f` of a Namespace
+// manifest. Manifests that cannot be read, such as URLs and directories, and
+// kustomizations match every rule of their verb.
+func matchesApprovalRule(args, rule []string) bool {
+	cmd := protocol.ParseCommandLine(args)
+	if len(rule) == 0 || cmd.Verb != rule[0] {
+		return false
+	}
+	words := rule[1:]
+	if len(words) == 0 {
+		return true
+	}
+	if _, ok := cmd.Flag("kustomize"); ok {
+		return true
+	}
+
+	var targets []string
+	for _, word := range cmd.Words {
+		for _, resource := range strings.Split(word, ",") {
+			targets = append(targets, canonicalResource(resource))
+		}
+	}
+	for _, uri := range cmd.Flags["raw"] {
+		targets = append(targets, rawResource(uri))
+	}
+	for _, file := range cmd.Flags["filename"] {
+		resources, ok := manifestResources(file)
+		if !ok {
+			return true
+		}
+		targets = append(targets, resources...)
+	}
+	for _, target := range targets {
+		if len(words) == 0 {
+			break
+		}
+		if target == canonicalResource(words[0]) {
+			words = words[1:]
+		}
+	}
+	return len(words) == 0
+}
+
+// manifestObject is the part of a manifest object rules look at
+type manifestObject struct {
+	Kind  string           `yaml:"kind"`
+	Items []manifestObject `yaml:"items"`
+}
+
+// manifestResources returns the resources of the objects in a YAML or JSON
+// manifest, including the items of Lists, and false when it cannot be read
+func manifestResources(path string) ([]string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var resources []string
+	var add func(objects []manifestObject)
+	add = func(objects []manifestObject) {
+		for _, object := range objects {
+			if object.Kind != "" && !strings.HasSuffix(object.Kind, "List") {
+				resources = append(resources, canonicalResource(object.Kind))
+			}
+			add(object.Items)
+		}
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var object manifestObject
+		if err := decoder.Decode(&object); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false
+		}
+		add([]manifestObject{object})
+	}
+	return resources, len(resources) > 0
+}
+
+// isApprover reports whether identity may approve and deny commands
+func (a *agent) isApprover(identity string) bool {
+	for _, approver := range a.cfg.Approvers {
+		if strings.TrimSpace(approver) == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// parkForApproval stores the command of msg as a job waiting for approval
+// and replies with it. Redelivered commands are answered with the existing job.
+func (a *agent) parkForApproval(ctx context.Context, msg queue.Message, verb string) error {
+	if a.jobs == nil {
+		metrics.CommandsTotal.WithLabelValues(verb, "error").Inc()
+		return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, "Error: this command requires approval, which needs asynchronous jobs enabled on the agent", tracing.Inject(ctx, exitCodeHeaders(1)))
+	}
+
+	job, err := a.jobs.get(msg.CorrelationID)
+	if err != nil {
+		job = &protocol.Job{
+			ID:          msg.CorrelationID,
+			Command:     redact.String(msg.Body),
+			State:       protocol.JobPendingApproval,
+			Agent:       a.id,
+			Client:      clientIdentity(msg),
+			SubmittedAt: time.Now(),
+		}
+		if err := a.jobs.park(job, msg.Body); err != nil {
+			logging.Logger.WithFields(logrus.Fields{
+				"job":   job.ID,
+				"error": err.Error(),
+			}).Error("Failed to store job")
+			return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, fmt.Sprintf("Error: failed to store job: %v", err), tracing.Inject(ctx, exitCodeHeaders(1)))
+		}
+		logging.Logger.WithFields(logrus.Fields{
+			"job":     job.ID,
+			"client":  job.Client,
+			"command": job.Command,
+		}).Warn("Command waiting for approval")
+		metrics.CommandsTotal.WithLabelValues(verb, "approval_pending").Inc()
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{protocol.HeaderStatus: protocol.StatusApprovalPending}
+	return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, string(data), tracing.Inject(ctx, headers))
+}
+
+// decideApproval runs or denies a job waiting for approval. Only configured
+// approvers may decide, and never on their own commands.
+func (a *agent) decideApproval(ctx context.Context, msg queue.Message, job *protocol.Job, approve bool) error {
+	reply := func(body string) error {
+		return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, body, tracing.Inject(ctx, exitCodeHeaders(1)))
+	}
+	// Only the sender authenticated by the broker is trusted; the client ID
+	// header is chosen by the sender
+	approver := clientIdentity(msg)
+	switch {
+	case msg.UserID == "":
+		logging.Logger.WithFields(logrus.Fields{
+			"job":    job.ID,
+			"client": reportedClient(msg),
+		}).Warn("Approval refused to a sender not authenticated by the broker")
+		return reply("Error: approvals need a sender authenticated by the broker")
+	case !a.isApprover(approver):
+		logging.Logger.WithFields(logrus.Fields{
+			"job":    job.ID,
+			"client": approver,
+		}).Warn("Approval refused to a client that is not an approver")
+		return reply(fmt.Sprintf("Error: %s is not an approver on this agent", approver))
+	case approver == job.Client:
+		return reply("Error: commands cannot be approved or denied by their requester")
+	case job.State != protocol.JobPendingApproval:
+		return reply(fmt.Sprintf("Error: job %s is not waiting for approval (%s)", job.ID, job.State))
+	}
+
+	if !approve {
+		return a.closeApproval(ctx, msg, job, protocol.JobDenied, fmt.Sprintf("Error: the command was denied by %s\n", approver))
+	}
+
+	command, err := a.jobs.command(job.ID)
+	if err != nil {
+		return reply(fmt.Sprintf("Error: %v", err))
+	}
+	args, err := utils.ReplaceBase64WithFile(strings.Split(command, " "), utils.DecodeBase64StringToFile)
+	if err != nil {
+		return reply(fmt.Sprintf("Error: failed to decode the command: %v", err))
+	}
+	if err := a.jobs.claim(job.ID); err != nil {
+		return reply(fmt.Sprintf("Error: %v", err))
+	}
+	job.State, job.Agent, job.Approver = protocol.JobRunning, a.id, approver
+	if err := a.jobs.save(job); err != nil {
+		return reply(fmt.Sprintf("Error: failed to store job: %v", err))
+	}
+	logging.Logger.WithFields(logrus.Fields{
+		"job":      job.ID,
+		"client":   job.Client,
+		"approver": approver,
+	}).Warn("Command approved")
+	if err := a.publishJob(ctx, msg, job); err != nil {
+		logging.Logger.WithFields(logrus.Fields{
+			"job":   job.ID,
+			"error": err.Error(),
+		}).Error("Failed to send job to approver")
+	}
+
+	// Approved commands run in a job slot, like other jobs
+	a.startJob(ctx, job, args, metrics.Verb(protocol.ParseCommandLine(args).Verb))
+	return nil
+}
+
+// closeApproval finishes a job waiting for approval without running it
+func (a *agent) closeApproval(ctx context.Context, msg queue.Message, job *protocol.Job, state protocol.JobState, output string) error {
+	if err := a.jobs.claim(job.ID); err != nil {
+		return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, fmt.Sprintf("Error: %v", err), tracing.Inject(ctx, exitCodeHeaders(1)))
+	}
+	job.State, job.ExitCode, job.FinishedAt = state, 1, time.Now()
+	if state == protocol.JobDenied {
+		job.Approver = clientIdentity(msg)
+	}
+	if err := a.jobs.finish(job, output); err != nil {
+		return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, fmt.Sprintf("Error: %v", err), tracing.Inject(ctx, exitCodeHeaders(1)))
+	}
+	logging.Logger.WithFields(logrus.Fields{
+		"job":      job.ID,
+		"approver": clientIdentity(msg),
+		"state":    state,
+	}).Warn("Command not approved")
+	return a.publishJob(ctx, msg, job)
+}
@@ -0,0 +1,63 @@
+package KubeGate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchesApprovalRule(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return path
+	}
+	namespace := write("ns.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\napiVersion: v1\nkind: Namespace\nmetadata:\n  name: foo\n")
+	list := write("list.json", `{"kind":"List","items":[{"kind":"Namespace","metadata":{"name":"foo"}}]}`)
+	configMap := write("cm.yaml", "kind: ConfigMap\nmetadata:\n  name: a\n")
+	invalid := write("invalid.yaml", "kind: [\n")
+
+	rule := []string{"delete", "namespace"}
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"delete", "namespace", "foo"}, true},
+		{[]string{"delete", "namespace/foo"}, true},
+		{[]string{"delete", "ns", "foo"}, true},
+		{[]string{"delete", "namespaces", "foo"}, true},
+		{[]string{"delete", "Namespace.v1", "foo"}, true},
+		{[]string{"delete", "pods,ns", "foo"}, true},
+		{[]string{"-n", "prod", "delete", "ns", "foo"}, true},
+		{[]string{"--context=prod", "delete", "ns", "foo", "--wait=false"}, true},
+		{[]string{"delete", "--raw", "/api/v1/namespaces/foo"}, true},
+		{[]string{"delete", "--raw=/api/v1/namespaces/foo"}, true},
+		{[]string{"delete", "-f", namespace}, true},
+		{[]string{"delete", "--filename=" + list}, true},
+		{[]string{"delete", "-f", invalid}, true},
+		{[]string{"delete", "-f", dir}, true},
+		{[]string{"delete", "-f", "https://example.com/ns.yaml"}, true},
+		{[]string{"delete", "-k", "overlays/prod"}, true},
+		{[]string{"delete", "pod", "web"}, false},
+		{[]string{"delete", "--raw", "/api/v1/namespaces/foo/pods/web"}, false},
+		{[]string{"delete", "-f", configMap}, false},
+		{[]string{"get", "ns", "foo"}, false},
+		{[]string{"-n", "delete", "get", "ns"}, false},
+	}
+	for _, tt := range tests {
+		if got := matchesApprovalRule(tt.args, rule); got != tt.want {
+			t.Errorf("matchesApprovalRule(%q, %q) = %v, want %v", tt.args, rule, got, tt.want)
+		}
+	}
+
+	if !matchesApprovalRule([]string{"-n", "prod", "exec", "web", "--", "sh"}, []string{"exec"}) {
+		t.Error("exec after global flags did not match the exec rule")
+	}
+	if !matchesApprovalRule(strings.Fields("rollout undo deploy/web"), strings.Fields("rollout undo deployment")) {
+		t.Error("rollout undo did not match its rule")
+	}
+}
@@ -0,0 +1,227 @@
+package KubeGate_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/KubeGate"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/testharness"
+)
+
+func TestRunReturnsKubectlOutput(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("get pods", testharness.Reply{Output: "NAME  READY\nweb   1/1\n"})
+
+	result, err := h.Run("get", "pods", "-n", "default")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if want := "NAME  READY\nweb   1/1\n"; result.Output != want {
+		t.Errorf("output = %q, want %q", result.Output, want)
+	}
+
+	calls := h.Kubectl.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("kubectl was called %d times, want 1", len(calls))
+	}
+	if want := []string{"get", "pods", "-n", "default"}; !reflect.DeepEqual(calls[0].Args, want) {
+		t.Errorf("kubectl args = %q, want %q", calls[0].Args, want)
+	}
+}
+
+func TestRunMaterializesFiles(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("apply", testharness.Reply{Output: "deployment.apps/web created\n"})
+
+	manifest := "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n"
+	path := filepath.Join(t.TempDir(), "web.yaml")
+	if err := os.WriteFile(path, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{{"-f", path}, {"--filename=" + path}} {
+		if _, err := h.Run(append([]string{"apply"}, args...)...); err != nil {
+			t.Fatalf("Run(apply %s): %v", strings.Join(args, " "), err)
+		}
+	}
+
+	calls := h.Kubectl.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("kubectl was called %d times, want 2", len(calls))
+	}
+	for _, call := range calls {
+		if len(call.Files) != 1 {
+			t.Fatalf("kubectl received files %v in %q, want one file", call.Files, call.Args)
+		}
+		for agentPath, content := range call.Files {
+			if agentPath == path {
+				t.Errorf("kubectl received the client's path %s instead of a copy", path)
+			}
+			if content != manifest {
+				t.Errorf("file content = %q, want %q", content, manifest)
+			}
+		}
+	}
+}
+
+func TestRunReportsExitCode(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("get pods missing", testharness.Reply{Output: `Error from server (NotFound): pods "missing" not found`, ExitCode: 2})
+
+	result, err := h.Run("get", "pods", "missing")
+	var exitErr *protocol.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 2 {
+		t.Fatalf("Run returned %v, want exit status 2", err)
+	}
+	if result.ExitCode != 2 {
+		t.Errorf("ExitCode = %d, want 2", result.ExitCode)
+	}
+	if !strings.Contains(result.Output, `pods "missing" not found`) {
+		t.Errorf("output %q does not contain kubectl's error", result.Output)
+	}
+}
+
+func TestRunTimesOut(t *testing.T) {
+	h := testharness.New(t, testharness.Options{ResponseTimeout: 200 * time.Millisecond})
+	h.Kubectl.On("get pods", testharness.Reply{Output: "too late\n", Delay: time.Second})
+
+	start := time.Now()
+	_, err := h.Run("get", "pods")
+	if err == nil || !strings.Contains(err.Error(), "timeout waiting for response") {
+		t.Fatalf("Run returned %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("Run returned after %s, want about 200ms", elapsed)
+	}
+}
+
+func TestRunFailsWithoutAgent(t *testing.T) {
+	h := testharness.New(t, testharness.Options{
+		Context: func(c *config.Context) { c.CommandQueue = "no-such-queue" },
+	})
+
+	_, err := h.Run("get", "pods")
+	if err == nil || !strings.Contains(err.Error(), "no-such-queue") {
+		t.Fatalf("Run returned %v, want an error naming the missing queue", err)
+	}
+	if calls := h.Kubectl.Calls(); len(calls) != 0 {
+		t.Errorf("kubectl was called %d times, want 0", len(calls))
+	}
+}
+
+func TestRunRefusesTemplatedSecretOutput(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("get", testharness.Reply{Output: "ok\n"})
+	manifest := filepath.Join(t.TempDir(), "secret.yaml")
+	if err := os.WriteFile(manifest, []byte("apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, argv := range [][]string{
+		{"get", "secret", "db", "-o", "jsonpath={.data.password}"},
+		{"-n", "prod", "get", "secrets", "-ogo-template={{.data}}"},
+		{"get", "secret/db", "--output=custom-columns=DATA:.data"},
+		{"get", "-f", manifest, "--template={{.data}}", "-o", "go-template"},
+	} {
+		_, err := h.Run(argv...)
+		var exitErr *protocol.ExitError
+		if !errors.As(err, &exitErr) || exitErr.Code != 1 {
+			t.Errorf("Run(%s) returned %v, want it refused", strings.Join(argv, " "), err)
+		}
+	}
+	if calls := h.Kubectl.Calls(); len(calls) != 0 {
+		t.Fatalf("kubectl was called for %q, want refused commands not to run", calls[0].Args)
+	}
+
+	if _, err := h.Run("get", "pods", "-o", "jsonpath={.items[*].metadata.name}"); err != nil {
+		t.Errorf("Run(get pods -o jsonpath) returned %v, want it to run", err)
+	}
+	if _, err := h.Run("get", "secrets", "-o", "name"); err != nil {
+		t.Errorf("Run(get secrets -o name) returned %v, want it to run", err)
+	}
+}
+
+func TestRunMasksSecretData(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	secret := "kind: Secret\nmetadata:\n  name: db\ndata:\n  password: aHVudGVyMg==\n"
+	h.Kubectl.On("get secret", testharness.Reply{Output: secret})
+	h.Kubectl.On("-n prod get secret", testharness.Reply{Output: secret})
+
+	// Global flags before the verb do not hide that the command reads Secrets
+	for _, argv := range [][]string{
+		{"get", "secret", "db", "-o", "yaml"},
+		{"-n", "prod", "get", "secret", "db", "-o", "yaml"},
+	} {
+		result, err := h.Run(argv...)
+		if err != nil {
+			t.Fatalf("Run(%s): %v", strings.Join(argv, " "), err)
+		}
+		if strings.Contains(result.Output, "aHVudGVyMg==") {
+			t.Errorf("Run(%s) returned Secret data: %q", strings.Join(argv, " "), result.Output)
+		}
+
+		var streamed strings.Builder
+		if _, err := h.Client().Stream(context.Background(), argv, nil, &streamed); err != nil {
+			t.Fatalf("Stream(%s): %v", strings.Join(argv, " "), err)
+		}
+		if strings.Contains(streamed.String(), "aHVudGVyMg==") {
+			t.Errorf("Stream(%s) returned Secret data: %q", strings.Join(argv, " "), streamed.String())
+		}
+	}
+}
+
+func TestRunAllowsTemplatedSecretOutputByPolicy(t *testing.T) {
+	h := testharness.New(t, testharness.Options{
+		Agent: func(cfg *config.AgentConfig) { cfg.AllowSecretData = true },
+	})
+	h.Kubectl.On("get secret db", testharness.Reply{Output: "c2VjcmV0"})
+
+	result, err := h.Run("get", "secret", "db", "-o", "jsonpath={.data.password}")
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Output != "c2VjcmV0" {
+		t.Errorf("output = %q, want the Secret value", result.Output)
+	}
+}
+
+func TestGetAgents(t *testing.T) {
+	h := testharness.New(t, testharness.Options{Agent: func(cfg *config.AgentConfig) {
+		cfg.HeartbeatInterval = 20 * time.Millisecond
+	}})
+
+	agents, err := KubeGate.GetAgents(&config.Context{Backend: "memory", RabbitMQURL: h.Broker, CommandQueue: h.CommandQueue})
+	if err != nil || len(agents) != 1 {
+		t.Fatalf("GetAgents = %+v, %v; want the agent", agents, err)
+	}
+
+	// Heartbeats only go to the presence log
+	mq := &queue.Memory{URL: h.Broker}
+	if err := mq.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+	queues, err := mq.ListQueues(h.CommandQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range queues {
+		if info.Name == h.CommandQueue+".presence" {
+			t.Errorf("agent created the presence queue %s", info.Name)
+		}
+	}
+
+	_, err = KubeGate.GetAgents(&config.Context{Backend: "sqs", RabbitMQURL: "https://sqs.us-east-1.amazonaws.com/000000000000/commands", CommandQueue: "commands"})
+	if !errors.Is(err, protocol.ErrPresenceUnsupported) {
+		t.Errorf("GetAgents on SQS returned %v, want ErrPresenceUnsupported", err)
+	}
+}
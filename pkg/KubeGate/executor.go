@@ -0,0 +1,82 @@
+package KubeGate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/metrics"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/tracing"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Executor runs a kubectl command line on the agent and returns its combined
+// output. A command that ran but failed is reported with an *ExitError.
+type Executor func(ctx context.Context, args []string) (string, error)
+
+// StreamExecutor runs a kubectl command line like Executor, writing the
+// combined output to w as the command produces it
+type StreamExecutor func(ctx context.Context, args []string, w io.Writer) error
+
+// exitCode returns the status to report for a failed command
+func exitCode(err error) int {
+	var exitErr *protocol.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return 1
+}
+
+// exitCodeHeaders returns the response headers for a command that exited with code
+func exitCodeHeaders(code int) map[string]string {
+	if code == 0 {
+		return nil
+	}
+	return map[string]string{protocol.HeaderExitCode: strconv.Itoa(code)}
+}
+
+// executeKubectlCommand executes a kubectl command in the agent pod
+func executeKubectlCommand(ctx context.Context, args []string) (string, error) {
+	var output bytes.Buffer
+	err := streamKubectlCommand(ctx, args, &output)
+	return output.String(), err
+}
+
+// streamKubectlCommand executes a kubectl command in the agent pod, writing
+// its combined output to w as it is produced
+func streamKubectlCommand(ctx context.Context, args []string, w io.Writer) error {
+	verb := metrics.Verb(protocol.ParseCommandLine(args).Verb)
+	_, span := tracing.Tracer().Start(ctx, "executeKubectlCommand")
+	span.SetAttributes(attribute.String("kubegate.verb", verb))
+	defer span.End()
+
+	// Prepare the kubectl command; cancelling ctx kills it, e.g. for cancelled jobs
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	cmd.Stdout, cmd.Stderr = w, w
+
+	start := time.Now()
+	err := cmd.Run()
+	metrics.CommandDuration.WithLabelValues(verb).Observe(time.Since(start).Seconds())
+	if err != nil {
+		logging.Logger.WithFields(logrus.Fields{
+			"command": args,
+			"error":   err,
+		}).Error("Failed to execute command")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+			return &protocol.ExitError{Code: exitErr.ExitCode()}
+		}
+		return err
+	}
+	return nil
+}
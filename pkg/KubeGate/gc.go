@@ -0,0 +1,131 @@
+package KubeGate
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultGCMinIdle is how long a reply queue must be idle before it is
+// collected. It exceeds the one-hour session lifetime so queues of live
+// sessions are never deleted.
+const DefaultGCMinIdle = 2 * time.Hour
+
+// GCOptions controls which queues CollectGarbage deletes
+type GCOptions struct {
+	Prefix  string        // Queue name prefix, defaults to queue.ReplyQueuePrefix
+	MinIdle time.Duration // Queues idle for less than this are kept
+	DryRun  bool          // Report candidates without deleting them
+}
+
+// GCResult is a queue selected for collection
+type GCResult struct {
+	Queue   queue.QueueInfo
+	Deleted bool
+	Error   string
+}
+
+// CollectGarbage finds queues matching opts.Prefix that have no consumers and
+// have been idle for at least opts.MinIdle, and deletes them unless DryRun is
+// set. On backends that cannot report consumers, queues holding messages are
+// assumed to be in use and kept.
+func CollectGarbage(mq queue.MessageQueue, opts GCOptions) ([]GCResult, error) {
+	lister, ok := queue.Unwrap(mq).(queue.QueueLister)
+	if !ok {
+		return nil, fmt.Errorf("listing queues is not supported by this backend")
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = queue.ReplyQueuePrefix
+	}
+	if opts.MinIdle <= 0 {
+		opts.MinIdle = DefaultGCMinIdle
+	}
+
+	queues, err := lister.ListQueues(opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var results []GCResult
+	for _, info := range queues {
+		if info.Consumers > 0 || info.IdleSince.IsZero() || now.Sub(info.IdleSince) < opts.MinIdle {
+			continue
+		}
+		if info.ConsumersUnknown && info.Messages > 0 {
+			continue
+		}
+
+		result := GCResult{Queue: info}
+		if !opts.DryRun {
+			if err := mq.DeleteQueue(info.Name); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Deleted = true
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// RunGC connects to the backend of context and collects its orphaned reply queues
+func RunGC(context *config.Context, opts GCOptions) ([]GCResult, error) {
+	messageQueue, err := queue.NewMessageQueue(context.Backend, context.RabbitMQURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize messaging backend: %v", err)
+	}
+	setManagementURL(messageQueue, context.ManagementURL)
+	defer func() {
+		if err := messageQueue.Close(); err != nil {
+			logging.Logger.WithError(err).Warn("Failed to close message queue")
+		}
+	}()
+
+	if err := messageQueue.Connect(); err != nil {
+		return nil, fmt.Errorf("failed to connect to messaging backend: %v", err)
+	}
+	return CollectGarbage(messageQueue, opts)
+}
+
+// setManagementURL configures the management API endpoint on RabbitMQ backends
+func setManagementURL(mq queue.MessageQueue, managementURL string) {
+	if rabbit, ok := queue.Unwrap(mq).(*queue.RabbitMQ); ok && managementURL != "" {
+		rabbit.ManagementURL = managementURL
+	}
+}
+
+// runJanitor collects orphaned reply queues every interval until stop is closed
+func (a *agent) runJanitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		results, err := CollectGarbage(a.mq, GCOptions{MinIdle: a.cfg.GCMinIdle})
+		if err != nil {
+			logging.Logger.WithError(err).Warn("Failed to collect orphaned reply queues")
+			continue
+		}
+		for _, result := range results {
+			entry := logging.Logger.WithFields(logrus.Fields{
+				"queue":      result.Queue.Name,
+				"idle_since": result.Queue.IdleSince,
+			})
+			if result.Error != "" {
+				entry.WithField("error", result.Error).Warn("Failed to delete orphaned reply queue")
+			} else {
+				entry.Info("Deleted orphaned reply queue")
+			}
+		}
+	}
+}
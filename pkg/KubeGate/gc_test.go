@@ -0,0 +1,157 @@
+package KubeGate_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/loaynaser3/KubeGate/pkg/KubeGate"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/queue/queuetest"
+)
+
+// collected returns the names of the queues in results and whether each was deleted
+func collected(results []KubeGate.GCResult) map[string]bool {
+	names := map[string]bool{}
+	for _, result := range results {
+		names[result.Queue.Name] = result.Deleted
+	}
+	return names
+}
+
+func TestCollectGarbageMemory(t *testing.T) {
+	mq := &queue.Memory{URL: "gc-" + uuid.New().String()}
+	if err := mq.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer mq.Close()
+
+	for _, name := range []string{"reply-queue-idle", "reply-queue-busy", "reply-queue-unread", "commands"} {
+		if err := mq.CreateQueue(name); err != nil {
+			t.Fatalf("CreateQueue %s: %v", name, err)
+		}
+	}
+	go mq.ReceiveMessages("reply-queue-busy", func(queue.Message) error { return nil })
+	waitForConsumer(t, mq, "reply-queue-busy")
+	// The memory backend reports consumers, so an unread reply does not keep its queue
+	if err := mq.SendMessage("reply-queue-unread", "reply", "", "", nil); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// Dry runs report the candidates without deleting them
+	results, err := KubeGate.CollectGarbage(mq, KubeGate.GCOptions{MinIdle: 10 * time.Millisecond, DryRun: true})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if got := collected(results); len(got) != 2 || got["reply-queue-idle"] || got["reply-queue-unread"] {
+		t.Fatalf("dry run selected %v, want reply-queue-idle and reply-queue-unread undeleted", got)
+	}
+
+	// Only queues idle for MinIdle are collected; a consumer keeps a queue
+	results, err = KubeGate.CollectGarbage(mq, KubeGate.GCOptions{MinIdle: time.Hour})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("collected %v with a one hour MinIdle, want nothing", collected(results))
+	}
+	results, err = KubeGate.CollectGarbage(mq, KubeGate.GCOptions{MinIdle: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if got := collected(results); len(got) != 2 || !got["reply-queue-idle"] || !got["reply-queue-unread"] {
+		t.Fatalf("collected %v, want reply-queue-idle and reply-queue-unread deleted", got)
+	}
+	infos, err := mq.ListQueues("")
+	if err != nil {
+		t.Fatalf("ListQueues: %v", err)
+	}
+	var left []string
+	for _, info := range infos {
+		left = append(left, info.Name)
+	}
+	if len(left) != 2 || left[0] != "commands" || left[1] != "reply-queue-busy" {
+		t.Errorf("queues left = %v, want commands and reply-queue-busy", left)
+	}
+}
+
+func TestCollectGarbageSQSKeepsQueuesWithMessages(t *testing.T) {
+	url := queuetest.StartSQS(t)
+	mq := &queue.SQS{QueueURL: url + "/000000000000/commands", Timeout: time.Second}
+	if err := mq.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer mq.Close()
+
+	for _, name := range []string{"reply-queue-empty", "reply-queue-pending"} {
+		if err := mq.CreateQueue(name); err != nil {
+			t.Fatalf("CreateQueue %s: %v", name, err)
+		}
+	}
+	// SQS cannot report that a client is waiting for this reply
+	if err := mq.SendMessage("reply-queue-pending", "reply", "", "", nil); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+
+	results, err := KubeGate.CollectGarbage(mq, KubeGate.GCOptions{MinIdle: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if got := collected(results); len(got) != 1 || !got["reply-queue-empty"] {
+		t.Fatalf("collected %v, want only reply-queue-empty deleted", got)
+	}
+	infos, err := mq.ListQueues(queue.ReplyQueuePrefix)
+	if err != nil {
+		t.Fatalf("ListQueues: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Name != "reply-queue-pending" || infos[0].Messages != 1 || !infos[0].ConsumersUnknown {
+		t.Errorf("queues left = %+v, want reply-queue-pending with one message and unknown consumers", infos)
+	}
+}
+
+// waitForConsumer waits until queueName reports a consumer
+func waitForConsumer(t *testing.T, mq *queue.Memory, queueName string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		infos, err := mq.ListQueues(queueName)
+		if err == nil && len(infos) == 1 && infos[0].Consumers > 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("queue %s has no consumer", queueName)
+}
+
+func TestCollectGarbageSQSKeepsConsumedQueues(t *testing.T) {
+	url := queuetest.StartSQS(t)
+	mq := &queue.SQS{QueueURL: url + "/000000000000/commands", Timeout: time.Second}
+	if err := mq.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer mq.Close()
+	for _, name := range []string{"reply-queue-live", "reply-queue-idle"} {
+		if err := mq.CreateQueue(name); err != nil {
+			t.Fatalf("CreateQueue %s: %v", name, err)
+		}
+	}
+
+	// A long-lived consumer, such as `kubegate proxy`, keeps using its queue
+	// after SQS last reports a change to it
+	consumer := &queue.SQS{QueueURL: url + "/000000000000/commands", Timeout: time.Second, TouchInterval: 200 * time.Millisecond}
+	if err := consumer.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer consumer.Close()
+	go consumer.ReceiveMessages("reply-queue-live", func(queue.Message) error { return nil })
+	time.Sleep(3 * time.Second)
+
+	results, err := KubeGate.CollectGarbage(mq, KubeGate.GCOptions{MinIdle: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if got := collected(results); len(got) != 1 || !got["reply-queue-idle"] {
+		t.Fatalf("collected %v, want only reply-queue-idle deleted", got)
+	}
+}
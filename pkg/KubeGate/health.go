@@ -0,0 +1,161 @@
+package KubeGate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/metrics"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/version"
+)
+
+const (
+	// DefaultHealthAddr is where the agent serves its health endpoints
+	DefaultHealthAddr = ":8080"
+
+	// kubeAPICheckInterval is how long a Kubernetes API check result is reused
+	kubeAPICheckInterval = 15 * time.Second
+	kubeAPICheckTimeout  = 5 * time.Second
+)
+
+// healthStatus is the JSON body returned by the health endpoints
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// kubeAPIChecker caches the result of probing the Kubernetes API server so
+// frequent readiness probes do not each spawn kubectl. Probes run in the
+// background, so a slow API server never makes a health request time out.
+type kubeAPIChecker struct {
+	probe func(ctx context.Context) error // Probes the API server; kubectl when nil
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	checking  bool
+	err       error
+}
+
+// errKubeAPIPending is reported until the first probe of the API server finished
+var errKubeAPIPending = fmt.Errorf("kubernetes API has not been checked yet")
+
+// check returns the last probe result without waiting, starting a new probe
+// when the result is older than kubeAPICheckInterval
+func (k *kubeAPIChecker) check() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if time.Since(k.checkedAt) >= kubeAPICheckInterval && !k.checking {
+		k.checking = true
+		go k.refresh()
+	}
+	if k.checkedAt.IsZero() {
+		return errKubeAPIPending
+	}
+	return k.err
+}
+
+// refresh probes the API server and records the result
+func (k *kubeAPIChecker) refresh() {
+	probe := k.probe
+	if probe == nil {
+		probe = probeKubeAPI
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubeAPICheckTimeout)
+	defer cancel()
+	err := probe(ctx)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.err = err
+	k.checkedAt = time.Now()
+	k.checking = false
+}
+
+// probeKubeAPI asks the API server for its readiness with kubectl
+func probeKubeAPI(ctx context.Context) error {
+	output, err := exec.CommandContext(ctx, "kubectl", "get", "--raw", "/readyz").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("kubernetes API unreachable: %v: %s", err, output)
+	}
+	return nil
+}
+
+// startHealthServer serves the health endpoints on addr
+func (a *agent) startHealthServer(addr string) *http.Server {
+	a.kubeAPI.check() // Start probing the API server before the first readiness probe
+	server := &http.Server{Addr: addr, Handler: a.healthHandler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logging.Logger.WithError(err).Error("Health server stopped")
+		}
+	}()
+	logging.Logger.WithField("addr", addr).Info("Health server listening")
+	return server
+}
+
+// healthHandler serves /healthz, /readyz, /metrics and /version
+func (a *agent) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, map[string]error{"consumer": a.consumerHealth()})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, map[string]error{
+			"consumer":       a.consumerHealth(),
+			"broker":         a.brokerHealth(),
+			"kubernetes-api": a.kubeAPI.check(),
+		})
+	})
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"version":  version.Version,
+			"agent_id": a.id,
+			"cluster":  a.cfg.ClusterName,
+		})
+	})
+	return mux
+}
+
+// consumerHealth reports whether the command queue consumer is running
+func (a *agent) consumerHealth() error {
+	if !a.consuming.Load() {
+		return fmt.Errorf("command queue consumer is not running")
+	}
+	return nil
+}
+
+// brokerHealth reports whether the messaging backend connection is usable
+func (a *agent) brokerHealth() error {
+	if checker, ok := queue.Unwrap(a.mq).(queue.HealthChecker); ok {
+		return checker.Healthy()
+	}
+	return nil
+}
+
+// writeHealth responds 200 when every check passed and 503 otherwise
+func writeHealth(w http.ResponseWriter, checks map[string]error) {
+	status := healthStatus{Status: "ok", Checks: map[string]string{}}
+	code := http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			status.Status = "failed"
+			status.Checks[name] = err.Error()
+			code = http.StatusServiceUnavailable
+		} else {
+			status.Checks[name] = "ok"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
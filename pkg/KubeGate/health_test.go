@@ -0,0 +1,129 @@
+package KubeGate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+)
+
+// healthAgent returns an agent over a memory backend whose API server probe is probe
+func healthAgent(t *testing.T, probe func(ctx context.Context) error) *agent {
+	mq := &queue.Memory{URL: "health-" + t.Name()}
+	if err := mq.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { mq.Close() })
+	a := &agent{id: "agent-1", cfg: &config.AgentConfig{ClusterName: "prod"}, mq: mq}
+	a.kubeAPI.probe = probe
+	return a
+}
+
+// getHealth requests path and decodes the health status
+func getHealth(t *testing.T, a *agent, path string) (int, healthStatus) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	a.healthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	var status healthStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("%s returned invalid JSON: %v", path, err)
+	}
+	return recorder.Code, status
+}
+
+// waitForReady polls /readyz until it reports code
+func waitForReady(t *testing.T, a *agent, code int) healthStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, status := getHealth(t, a, "/readyz")
+		if got == code {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/readyz returned %d with %+v, want %d", got, status, code)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	a := healthAgent(t, func(ctx context.Context) error { return nil })
+
+	if code, status := getHealth(t, a, "/healthz"); code != http.StatusServiceUnavailable || status.Checks["consumer"] == "ok" {
+		t.Errorf("/healthz before consuming = %d %+v, want 503 with a failed consumer check", code, status)
+	}
+
+	a.consuming.Store(true)
+	if code, status := getHealth(t, a, "/healthz"); code != http.StatusOK || status.Status != "ok" {
+		t.Errorf("/healthz = %d %+v, want 200", code, status)
+	}
+	status := waitForReady(t, a, http.StatusOK)
+	for _, check := range []string{"consumer", "broker", "kubernetes-api"} {
+		if status.Checks[check] != "ok" {
+			t.Errorf("readiness check %s = %q, want ok", check, status.Checks[check])
+		}
+	}
+
+	// A closed backend fails readiness but not liveness
+	a.mq.Close()
+	if code, status := getHealth(t, a, "/readyz"); code != http.StatusServiceUnavailable || status.Checks["broker"] == "ok" {
+		t.Errorf("/readyz with a closed backend = %d %+v, want 503 with a failed broker check", code, status)
+	}
+	if code, _ := getHealth(t, a, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz with a closed backend = %d, want 200", code)
+	}
+}
+
+func TestReadinessDoesNotWaitForKubeAPI(t *testing.T) {
+	release := make(chan struct{})
+	a := healthAgent(t, func(ctx context.Context) error {
+		select {
+		case <-release:
+			return errors.New("kubernetes API unreachable")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	a.consuming.Store(true)
+
+	// The probe hangs, yet readiness answers at once that it is pending
+	start := time.Now()
+	code, status := getHealth(t, a, "/readyz")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("/readyz took %s while the API server probe hung", elapsed)
+	}
+	if code != http.StatusServiceUnavailable || status.Checks["kubernetes-api"] != errKubeAPIPending.Error() {
+		t.Errorf("/readyz during the first probe = %d %+v, want 503 with a pending API check", code, status)
+	}
+
+	// The result is reported once the probe finished
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for status.Checks["kubernetes-api"] != "kubernetes API unreachable" {
+		if time.Now().After(deadline) {
+			t.Fatalf("/readyz = %+v, want the probe's failure", status)
+		}
+		time.Sleep(5 * time.Millisecond)
+		_, status = getHealth(t, a, "/readyz")
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	a := healthAgent(t, nil)
+	recorder := httptest.NewRecorder()
+	a.healthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var body map[string]string
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("/version returned invalid JSON: %v", err)
+	}
+	if body["agent_id"] != "agent-1" || body["cluster"] != "prod" || body["version"] == "" {
+		t.Errorf("/version = %v, want the agent id, cluster and version", body)
+	}
+}
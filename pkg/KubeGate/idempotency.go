@@ -0,0 +1,141 @@
+package KubeGate
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+)
+
+// Idempotency defaults
+const (
+	DefaultIdempotencyTTL = 10 * time.Minute
+	maxIdempotencyEntries = 1000
+)
+
+// DefaultIdempotentVerbs are the mutating verbs whose duplicates are
+// suppressed; read-only verbs are always re-executed
+var DefaultIdempotentVerbs = []string{
+	"annotate", "apply", "autoscale", "cordon", "create", "delete", "drain",
+	"expose", "label", "patch", "replace", "rollout", "run", "scale", "set",
+	"taint", "uncordon",
+}
+
+// idempotencyKey returns the key used to suppress duplicates of msg, or ""
+// when its verb, which may follow global flags, is not deduplicated. The key
+// includes a hash of the command, so a reused idempotency key never returns
+// the response of another command.
+func idempotencyKey(msg queue.Message, verbs map[string]bool) string {
+	if !verbs[protocol.ParseCommandLine(strings.Fields(msg.Body)).Verb] {
+		return ""
+	}
+	key := msg.Headers[protocol.HeaderIdempotencyKey]
+	if key == "" {
+		key = msg.CorrelationID
+	}
+	sum := sha256.Sum256([]byte(msg.Body))
+	return key + "/" + hex.EncodeToString(sum[:])
+}
+
+// idempotencyEntry is a completed response kept for its TTL
+type idempotencyEntry struct {
+	key      string
+	response string
+	expires  time.Time
+}
+
+// idempotencyCache is a bounded TTL cache of responses to completed commands.
+// Concurrent duplicates wait for the first delivery instead of executing.
+type idempotencyCache struct {
+	ttl time.Duration
+	max int
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element // Values are *idempotencyEntry
+	order    *list.List               // Least recently completed at the front
+	inflight map[string]chan struct{}
+}
+
+func newIdempotencyCache(ttl time.Duration, max int) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:      ttl,
+		max:      max,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+		inflight: map[string]chan struct{}{},
+	}
+}
+
+// do returns the cached response for key, or runs fn and caches its response
+// when fn reports it as cacheable. cached reports whether fn was skipped.
+func (c *idempotencyCache) do(key string, fn func() (response string, cacheable bool)) (response string, cached bool) {
+	for {
+		c.mu.Lock()
+		if response, ok := c.lookup(key); ok {
+			c.mu.Unlock()
+			return response, true
+		}
+		wait, running := c.inflight[key]
+		if !running {
+			break // Still holding c.mu
+		}
+		c.mu.Unlock()
+		<-wait
+	}
+	done := make(chan struct{})
+	c.inflight[key] = done
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, key)
+		c.mu.Unlock()
+		close(done)
+	}()
+
+	response, cacheable := fn()
+	if cacheable {
+		c.mu.Lock()
+		c.store(key, response)
+		c.mu.Unlock()
+	}
+	return response, false
+}
+
+// lookup returns an unexpired response; c.mu must be held
+func (c *idempotencyCache) lookup(key string) (string, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*idempotencyEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.response, true
+}
+
+// store adds a response, evicting expired and then oldest entries; c.mu must be held
+func (c *idempotencyCache) store(key, response string) {
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[key] = c.order.PushBack(&idempotencyEntry{key: key, response: response, expires: time.Now().Add(c.ttl)})
+
+	now := time.Now()
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(*idempotencyEntry)
+		if len(c.entries) <= c.max && now.Before(entry.expires) {
+			break
+		}
+		c.order.Remove(front)
+		delete(c.entries, entry.key)
+	}
+}
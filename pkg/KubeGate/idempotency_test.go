@@ -0,0 +1,137 @@
+package KubeGate
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	verbs := map[string]bool{"apply": true, "delete": true}
+	withKey := func(body, key string) queue.Message {
+		return queue.Message{Body: body, CorrelationID: "corr", Headers: map[string]string{protocol.HeaderIdempotencyKey: key}}
+	}
+
+	if key := idempotencyKey(withKey("get pods", "k"), verbs); key != "" {
+		t.Errorf("key of a read-only verb = %q, want none", key)
+	}
+	if key := idempotencyKey(queue.Message{}, verbs); key != "" {
+		t.Errorf("key of an empty command = %q, want none", key)
+	}
+
+	if key := idempotencyKey(withKey("-n prod get pods", "k"), verbs); key != "" {
+		t.Errorf("key of a read-only verb after global flags = %q, want none", key)
+	}
+	if key := idempotencyKey(withKey("-n prod delete pod web", "k"), verbs); key == "" {
+		t.Error("a mutating verb after global flags has no key")
+	}
+
+	deleteWeb := idempotencyKey(withKey("delete pod web", "k"), verbs)
+	if deleteWeb == "" || deleteWeb != idempotencyKey(withKey("delete pod web", "k"), verbs) {
+		t.Errorf("keys of the same command differ or are empty: %q", deleteWeb)
+	}
+	// A reused key must not match another command
+	if deleteWeb == idempotencyKey(withKey("delete pod db", "k"), verbs) {
+		t.Error("different commands with the same idempotency key have the same key")
+	}
+	if deleteWeb == idempotencyKey(withKey("delete pod web", "other"), verbs) {
+		t.Error("the same command with different idempotency keys has the same key")
+	}
+	// The correlation ID stands in for a missing idempotency key
+	if idempotencyKey(withKey("delete pod web", "corr"), verbs) != idempotencyKey(queue.Message{Body: "delete pod web", CorrelationID: "corr"}, verbs) {
+		t.Error("a message without an idempotency key is not keyed by its correlation ID")
+	}
+}
+
+func TestIdempotencyCacheTTL(t *testing.T) {
+	cache := newIdempotencyCache(50*time.Millisecond, 10)
+	runs := 0
+	run := func() (string, bool) {
+		runs++
+		return fmt.Sprintf("run %d", runs), true
+	}
+
+	if response, cached := cache.do("key", run); cached || response != "run 1" {
+		t.Fatalf("first do = %q, %v; want a fresh run", response, cached)
+	}
+	if response, cached := cache.do("key", run); !cached || response != "run 1" {
+		t.Fatalf("second do = %q, %v; want the cached response", response, cached)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if response, cached := cache.do("key", run); cached || response != "run 2" {
+		t.Errorf("do after the TTL = %q, %v; want a fresh run", response, cached)
+	}
+}
+
+func TestIdempotencyCacheSkipsUncacheable(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute, 10)
+	runs := 0
+	run := func() (string, bool) {
+		runs++
+		return "failed", false
+	}
+	cache.do("key", run)
+	if _, cached := cache.do("key", run); cached || runs != 2 {
+		t.Errorf("uncacheable response was reused: cached=%v runs=%d", cached, runs)
+	}
+}
+
+func TestIdempotencyCacheEvictsOldest(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute, 2)
+	for _, key := range []string{"a", "b", "c"} {
+		cache.do(key, func() (string, bool) { return key, true })
+	}
+	for key, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		if _, cached := cache.do(key, func() (string, bool) { return key, false }); cached != want {
+			t.Errorf("%s cached = %v, want %v", key, cached, want)
+		}
+	}
+	if len(cache.entries) != 2 || cache.order.Len() != 2 {
+		t.Errorf("cache holds %d entries and %d ordered, want 2", len(cache.entries), cache.order.Len())
+	}
+}
+
+func TestIdempotencyCacheRunsConcurrentDuplicatesOnce(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute, 10)
+	var runs int32
+	release := make(chan struct{})
+	run := func() (string, bool) {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return "done", true
+	}
+
+	const duplicates = 8
+	var wg sync.WaitGroup
+	results := make(chan bool, duplicates)
+	for i := 0; i < duplicates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, cached := cache.do("key", run)
+			if response != "done" {
+				t.Errorf("response = %q, want %q", response, "done")
+			}
+			results <- cached
+		}()
+	}
+	time.Sleep(20 * time.Millisecond) // Let the duplicates wait on the first run
+	close(release)
+	wg.Wait()
+	close(results)
+
+	fresh := 0
+	for cached := range results {
+		if !cached {
+			fresh++
+		}
+	}
+	if runs != 1 || fresh != 1 {
+		t.Errorf("ran %d times with %d fresh responses, want 1 and 1", runs, fresh)
+	}
+}
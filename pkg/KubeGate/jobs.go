@@ -0,0 +1,442 @@
+package KubeGate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/metrics"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/redact"
+	"github.com/loaynaser3/KubeGate/pkg/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultJobTTL is how long results of finished jobs are kept
+const DefaultJobTTL = 24 * time.Hour
+
+// errJobNotFound is returned for unknown and expired jobs
+var errJobNotFound = errors.New("job not found")
+
+// jobIDPattern keeps job IDs usable as file names
+var jobIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// jobStore keeps jobs and their output as files, so results survive agent
+// restarts and can be shared by agents mounting the same directory
+type jobStore struct {
+	dir         string
+	ttl         time.Duration
+	approvalTTL time.Duration // How long jobs wait for approval
+	mu          sync.Mutex
+}
+
+// newJobStore creates dir if needed
+func newJobStore(dir string, ttl, approvalTTL time.Duration) (*jobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create job directory: %v", err)
+	}
+	return &jobStore{dir: dir, ttl: ttl, approvalTTL: approvalTTL}, nil
+}
+
+// path returns the file of job id with the given extension
+func (s *jobStore) path(id, ext string) (string, error) {
+	if !jobIDPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid job ID %q", id)
+	}
+	return filepath.Join(s.dir, id+ext), nil
+}
+
+// get returns an unexpired job. Jobs left waiting for approval too long
+// become expired jobs.
+func (s *jobStore) get(id string) (*protocol.Job, error) {
+	path, err := s.path(id, ".json")
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job: %v", err)
+	}
+	var job protocol.Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("failed to parse job: %v", err)
+	}
+	if time.Now().After(job.ExpiresAt) {
+		if job.State == protocol.JobPendingApproval && s.claim(id) == nil {
+			job.State, job.ExitCode, job.FinishedAt = protocol.JobExpired, 1, job.ExpiresAt
+			if err := s.finish(&job, "Error: the command was not approved in time\n"); err != nil {
+				return nil, err
+			}
+			return &job, nil
+		}
+		s.remove(id)
+		return nil, errJobNotFound
+	}
+	return &job, nil
+}
+
+// output returns the output of a finished job
+func (s *jobStore) output(id string) (string, error) {
+	path, err := s.path(id, ".log")
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read job output: %v", err)
+	}
+	return string(data), nil
+}
+
+// save writes job, refreshing its expiry
+func (s *jobStore) save(job *protocol.Job) error {
+	switch {
+	case job.Done():
+		job.ExpiresAt = job.FinishedAt.Add(s.ttl)
+	case job.State == protocol.JobPendingApproval:
+		job.ExpiresAt = job.SubmittedAt.Add(s.approvalTTL)
+	default:
+		job.ExpiresAt = job.SubmittedAt.Add(s.ttl) // Jobs of agents that died expire too
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode job: %v", err)
+	}
+	path, err := s.path(job.ID, ".json")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// finish stores the output of job before marking it finished
+func (s *jobStore) finish(job *protocol.Job, output string) error {
+	path, err := s.path(job.ID, ".log")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, []byte(output)); err != nil {
+		return err
+	}
+	if err := s.save(job); err != nil {
+		return err
+	}
+	if path, err := s.path(job.ID, ".cmd"); err == nil {
+		os.Remove(path) // Only needed while waiting for approval
+	}
+	return nil
+}
+
+// park stores a job waiting for approval with the command it will run
+func (s *jobStore) park(job *protocol.Job, command string) error {
+	path, err := s.path(job.ID, ".cmd")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, []byte(command)); err != nil {
+		return err
+	}
+	return s.save(job)
+}
+
+// command returns the command of a job waiting for approval
+func (s *jobStore) command(id string) (string, error) {
+	path, err := s.path(id, ".cmd")
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the command of job %s: %v", id, err)
+	}
+	return string(data), nil
+}
+
+// claim takes the decision on a job waiting for approval. Only the first
+// claim succeeds, also among agents sharing the directory.
+func (s *jobStore) claim(id string) error {
+	path, err := s.path(id, ".claim")
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("job %s was already decided", id)
+	}
+	return file.Close()
+}
+
+// prune deletes expired jobs
+func (s *jobStore) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		s.get(id) // Removes the job when expired
+	}
+}
+
+// remove deletes a job and its output
+func (s *jobStore) remove(id string) {
+	for _, ext := range []string{".json", ".log", ".cmd", ".claim"} {
+		if path, err := s.path(id, ext); err == nil {
+			os.Remove(path)
+		}
+	}
+}
+
+// writeFileAtomic replaces path with data through a temporary file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// isJobQuery reports whether msg queries a job rather than running a command
+func isJobQuery(msg queue.Message) bool {
+	return strings.HasPrefix(msg.Body, protocol.JobVerb+" ")
+}
+
+// configureJobs sets up the job store from the agent config
+func (a *agent) configureJobs() {
+	ttl := a.cfg.JobTTL
+	if ttl == 0 {
+		ttl = DefaultJobTTL
+	}
+	if ttl < 0 {
+		return
+	}
+	dir := a.cfg.JobDir
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".kubegate", "jobs")
+	}
+	approvalTTL := a.cfg.ApprovalTTL
+	if approvalTTL <= 0 {
+		approvalTTL = DefaultApprovalTTL
+	}
+	store, err := newJobStore(dir, ttl, approvalTTL)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("Asynchronous jobs are disabled")
+		return
+	}
+	store.prune()
+	a.jobs = store
+	a.jobCancels = map[string]context.CancelFunc{}
+}
+
+// runJob replies with the job for msg at once, then runs the command and
+// stores its result. Redelivered submissions are answered with the existing job.
+func (a *agent) runJob(ctx context.Context, msg queue.Message, args []string, verb string) error {
+	if a.jobs == nil {
+		metrics.CommandsTotal.WithLabelValues(verb, "error").Inc()
+		return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, "Error: asynchronous jobs are disabled on this agent", tracing.Inject(ctx, exitCodeHeaders(1)))
+	}
+
+	if job, err := a.jobs.get(msg.CorrelationID); err == nil {
+		return a.publishJob(ctx, msg, job)
+	}
+	now := time.Now()
+	job := &protocol.Job{
+		ID:          msg.CorrelationID,
+		Command:     redact.String(msg.Body),
+		State:       protocol.JobRunning,
+		Agent:       a.id,
+		Client:      clientIdentity(msg),
+		SubmittedAt: now,
+	}
+	if err := a.jobs.save(job); err != nil {
+		logging.Logger.WithFields(logrus.Fields{
+			"job":   job.ID,
+			"error": err.Error(),
+		}).Error("Failed to store job")
+		return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, fmt.Sprintf("Error: failed to store job: %v", err), tracing.Inject(ctx, exitCodeHeaders(1)))
+	}
+	go a.jobs.prune()
+	if err := a.publishJob(ctx, msg, job); err != nil {
+		logging.Logger.WithFields(logrus.Fields{
+			"job":   job.ID,
+			"error": err.Error(),
+		}).Error("Failed to send job to client")
+	}
+
+	a.startJob(ctx, job, args, verb)
+	return nil
+}
+
+// startJob runs job in the background, so that it frees the command slot
+// of its submission at once
+func (a *agent) startJob(ctx context.Context, job *protocol.Job, args []string, verb string) {
+	a.running.Add(1)
+	go func() {
+		defer a.running.Done()
+		// executeJob logs its own failures
+		_ = a.executeJob(ctx, job, args, verb)
+	}()
+}
+
+// executeJob runs the command of job in a job slot and stores its result.
+// Jobs wait for a job slot rather than a command slot, so long jobs cannot
+// keep interactive commands from running.
+func (a *agent) executeJob(ctx context.Context, job *protocol.Job, args []string, verb string) error {
+	// The job outlives the request, so only cancellation through `__job cancel` stops it
+	jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	a.jobMu.Lock()
+	a.jobCancels[job.ID] = cancel
+	a.jobMu.Unlock()
+	defer func() {
+		a.jobMu.Lock()
+		delete(a.jobCancels, job.ID)
+		a.jobMu.Unlock()
+		cancel()
+	}()
+
+	var result string
+	var code int
+	select {
+	case a.jobSlots <- struct{}{}:
+		logging.Logger.WithFields(logrus.Fields{
+			"job":     job.ID,
+			"command": job.Command,
+		}).Info("Job started")
+		result, code, _ = a.execute(jobCtx, args, verb)
+		<-a.jobSlots
+		if verb == "get" && !a.cfg.AllowSecretData {
+			result = redact.SecretData(result)
+		}
+	case <-jobCtx.Done():
+		result, code = "Error: the job was cancelled before it started\n", 1
+	}
+
+	job.ExitCode, job.FinishedAt = code, time.Now()
+	switch {
+	case code != 0 && jobCtx.Err() != nil:
+		job.State = protocol.JobCancelled
+	case code != 0:
+		job.State = protocol.JobFailed
+	default:
+		job.State = protocol.JobSucceeded
+	}
+	if err := a.jobs.finish(job, result); err != nil {
+		logging.Logger.WithFields(logrus.Fields{
+			"job":   job.ID,
+			"error": err.Error(),
+		}).Error("Failed to store job result")
+		return err
+	}
+	logging.Logger.WithFields(logrus.Fields{
+		"job":       job.ID,
+		"state":     job.State,
+		"exit_code": code,
+	}).Info("Job finished")
+	return nil
+}
+
+// publishJob replies to msg with job as JSON
+func (a *agent) publishJob(ctx context.Context, msg queue.Message, job *protocol.Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, string(data), tracing.Inject(ctx, exitCodeHeaders(0)))
+}
+
+// mayCancel reports whether the sender of msg may cancel job: its requester,
+// or an approver authenticated by the broker
+func (a *agent) mayCancel(msg queue.Message, job *protocol.Job) bool {
+	return clientIdentity(msg) == job.Client || (msg.UserID != "" && a.isApprover(msg.UserID))
+}
+
+// handleJobQuery answers __job status|logs|cancel|approve|deny <id>
+func (a *agent) handleJobQuery(ctx context.Context, msg queue.Message) error {
+	reply := func(body string, headers map[string]string) error {
+		return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, body, tracing.Inject(ctx, headers))
+	}
+	fields := strings.Fields(msg.Body)
+	if len(fields) != 3 {
+		return reply("Error: usage: __job status|logs|cancel|approve|deny <id>", exitCodeHeaders(1))
+	}
+	if a.jobs == nil {
+		return reply("Error: asynchronous jobs are disabled on this agent", exitCodeHeaders(1))
+	}
+	query, id := fields[1], fields[2]
+
+	job, err := a.jobs.get(id)
+	if errors.Is(err, errJobNotFound) {
+		headers := exitCodeHeaders(1)
+		headers[protocol.HeaderStatus] = protocol.StatusJobNotFound
+		return reply(fmt.Sprintf("Error: job %s not found or expired", id), headers)
+	}
+	if err != nil {
+		return reply(fmt.Sprintf("Error: %v", err), exitCodeHeaders(1))
+	}
+
+	switch query {
+	case protocol.JobStatus:
+		return a.publishJob(ctx, msg, job)
+	case protocol.JobLogs:
+		if job.State == protocol.JobPendingApproval {
+			return reply(fmt.Sprintf("Error: job %s is waiting for approval", id), exitCodeHeaders(1))
+		}
+		if !job.Done() {
+			return reply(fmt.Sprintf("Error: job %s is still running", id), exitCodeHeaders(1))
+		}
+		output, err := a.jobs.output(id)
+		if err != nil {
+			return reply(fmt.Sprintf("Error: %v", err), exitCodeHeaders(1))
+		}
+		// The job's exit status lets `kubegate job logs` exit like the command did
+		return reply(output, exitCodeHeaders(job.ExitCode))
+	case protocol.JobCancel:
+		if job.Done() {
+			return a.publishJob(ctx, msg, job)
+		}
+		if !a.mayCancel(msg, job) {
+			logging.Logger.WithFields(logrus.Fields{
+				"job":    id,
+				"client": clientIdentity(msg),
+			}).Warn("Cancellation refused to a client that neither requested the job nor is an approver")
+			return reply(fmt.Sprintf("Error: job %s can only be cancelled by its requester or an approver", id), exitCodeHeaders(1))
+		}
+		if job.State == protocol.JobPendingApproval {
+			return a.closeApproval(ctx, msg, job, protocol.JobCancelled, "Error: the command was cancelled before it was approved\n")
+		}
+		a.jobMu.Lock()
+		cancel, ok := a.jobCancels[id]
+		a.jobMu.Unlock()
+		if !ok {
+			return reply(fmt.Sprintf("Error: job %s is running on agent %s", id, job.Agent), exitCodeHeaders(1))
+		}
+		cancel()
+		logging.Logger.WithField("job", id).Info("Job cancelled")
+		return a.publishJob(ctx, msg, job)
+	case protocol.JobApprove, protocol.JobDeny:
+		return a.decideApproval(ctx, msg, job, query == protocol.JobApprove)
+	}
+	return reply(fmt.Sprintf("Error: unknown job query %q", query), exitCodeHeaders(1))
+}
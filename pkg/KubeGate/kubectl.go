@@ -0,0 +1,139 @@
+package KubeGate
+
+import (
+	"strings"
+
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+)
+
+// resourceType returns the resource of a word such as "secrets",
+// "secret/db" or "secrets.v1.", lowercased and without its group or name
+func resourceType(word string) string {
+	word, _, _ = strings.Cut(word, "/")
+	word, _, _ = strings.Cut(word, ".")
+	return strings.ToLower(word)
+}
+
+// templatedOutputs are the output formats that print fields chosen by the
+// caller, which SecretData cannot find in the output to mask
+var templatedOutputs = []string{"jsonpath", "go-template", "template", "custom-columns"}
+
+// readsSecretsTemplated reports whether cmd is a get that may return Secrets
+// in a templated output format, e.g. `get secret db -o jsonpath={.data}`
+func readsSecretsTemplated(cmd protocol.CommandLine) bool {
+	if cmd.Verb != "get" {
+		return false
+	}
+	output, _ := cmd.Flag("output")
+	_, template := cmd.Flag("template")
+	templated := template
+	for _, format := range templatedOutputs {
+		if strings.HasPrefix(output, format) {
+			templated = true
+		}
+	}
+	if !templated {
+		return false
+	}
+
+	// Manifests and kustomizations may name Secrets of any kind
+	if _, ok := cmd.Flag("filename"); ok {
+		return true
+	}
+	if _, ok := cmd.Flag("kustomize"); ok {
+		return true
+	}
+	for _, word := range cmd.Words {
+		for _, resource := range strings.Split(word, ",") {
+			if t := resourceType(resource); t == "secret" || t == "secrets" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resourceNames lists the names kubectl accepts for common resources: the
+// plural first, then the singular, kind and short names
+var resourceNames = [][]string{
+	{"pods", "pod", "po"},
+	{"services", "service", "svc"},
+	{"deployments", "deployment", "deploy"},
+	{"replicasets", "replicaset", "rs"},
+	{"statefulsets", "statefulset", "sts"},
+	{"daemonsets", "daemonset", "ds"},
+	{"replicationcontrollers", "replicationcontroller", "rc"},
+	{"jobs", "job"},
+	{"cronjobs", "cronjob", "cj"},
+	{"namespaces", "namespace", "ns"},
+	{"nodes", "node", "no"},
+	{"configmaps", "configmap", "cm"},
+	{"secrets", "secret"},
+	{"serviceaccounts", "serviceaccount", "sa"},
+	{"persistentvolumes", "persistentvolume", "pv"},
+	{"persistentvolumeclaims", "persistentvolumeclaim", "pvc"},
+	{"storageclasses", "storageclass", "sc"},
+	{"ingresses", "ingress", "ing"},
+	{"ingressclasses", "ingressclass"},
+	{"networkpolicies", "networkpolicy", "netpol"},
+	{"endpoints", "endpoint", "ep"},
+	{"events", "event", "ev"},
+	{"limitranges", "limitrange", "limits"},
+	{"resourcequotas", "resourcequota", "quota"},
+	{"horizontalpodautoscalers", "horizontalpodautoscaler", "hpa"},
+	{"poddisruptionbudgets", "poddisruptionbudget", "pdb"},
+	{"priorityclasses", "priorityclass", "pc"},
+	{"roles", "role"},
+	{"rolebindings", "rolebinding"},
+	{"clusterroles", "clusterrole"},
+	{"clusterrolebindings", "clusterrolebinding"},
+	{"customresourcedefinitions", "customresourcedefinition", "crd", "crds"},
+	{"certificatesigningrequests", "certificatesigningrequest", "csr"},
+	{"mutatingwebhookconfigurations", "mutatingwebhookconfiguration"},
+	{"validatingwebhookconfigurations", "validatingwebhookconfiguration"},
+}
+
+// resourceAliases maps every name in resourceNames to its plural
+var resourceAliases = map[string]string{}
+
+func init() {
+	for _, names := range resourceNames {
+		for _, name := range names {
+			resourceAliases[name] = names[0]
+		}
+	}
+}
+
+// canonicalResource returns the plural name of the resource of a word such
+// as "ns", "namespace/foo" or "Deployment". Unknown resources, such as custom
+// ones, lose a trailing "s", so their singular and plural compare equal.
+func canonicalResource(word string) string {
+	t := resourceType(word)
+	if plural, ok := resourceAliases[t]; ok {
+		return plural
+	}
+	return strings.TrimSuffix(t, "s")
+}
+
+// rawResource returns the resource addressed by a `--raw` URI, e.g.
+// "namespaces" for /api/v1/namespaces/foo and "deployments" for
+// /apis/apps/v1/namespaces/shop/deployments/web, or "" for other paths
+func rawResource(uri string) string {
+	path, _, _ := strings.Cut(uri, "?")
+	segments := strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+	switch {
+	case len(segments) >= 2 && segments[0] == "api":
+		segments = segments[2:]
+	case len(segments) >= 3 && segments[0] == "apis":
+		segments = segments[3:]
+	default:
+		return ""
+	}
+	if len(segments) >= 3 && segments[0] == "namespaces" {
+		segments = segments[2:] // Namespaced resources follow their namespace
+	}
+	if len(segments) == 0 {
+		return ""
+	}
+	return canonicalResource(segments[0])
+}
@@ -0,0 +1,50 @@
+package KubeGate
+
+import (
+	"testing"
+)
+
+func TestResourceType(t *testing.T) {
+	for word, want := range map[string]string{
+		"secrets":          "secrets",
+		"Secret/db":        "secret",
+		"secrets.v1.":      "secrets",
+		"deployments.apps": "deployments",
+		"ns/kube-system":   "ns",
+	} {
+		if got := resourceType(word); got != want {
+			t.Errorf("resourceType(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestCanonicalResource(t *testing.T) {
+	for word, want := range map[string]string{
+		"ns":                   "namespaces",
+		"Namespace":            "namespaces",
+		"namespaces/foo":       "namespaces",
+		"deploy.apps":          "deployments",
+		"netpol":               "networkpolicies",
+		"certificate":          "certificate",
+		"certificates.cert-io": "certificate",
+	} {
+		if got := canonicalResource(word); got != want {
+			t.Errorf("canonicalResource(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestRawResource(t *testing.T) {
+	for uri, want := range map[string]string{
+		"/api/v1/namespaces/foo":                                "namespaces",
+		"/api/v1/namespaces":                                    "namespaces",
+		"/api/v1/namespaces/shop/pods/web?force=true":           "pods",
+		"/apis/apps/v1/namespaces/shop/deployments/web":         "deployments",
+		"/apis/rbac.authorization.k8s.io/v1/clusterroles/admin": "clusterroles",
+		"/healthz": "",
+	} {
+		if got := rawResource(uri); got != want {
+			t.Errorf("rawResource(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
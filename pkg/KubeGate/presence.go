@@ -0,0 +1,111 @@
+package KubeGate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/version"
+	"github.com/sirupsen/logrus"
+)
+
+// presenceRetention is how long the presence log keeps heartbeats
+const presenceRetention = time.Hour
+
+// newAgentID builds an identifier that is stable for the life of the process
+func newAgentID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "agent"
+	}
+	return host + "-" + uuid.New().String()[:8]
+}
+
+// agentCapabilities lists the optional protocol features this agent supports
+func agentCapabilities() []string {
+	capabilities := []string{"chunking", "jobs", "preview", "approvals"}
+	for _, enc := range queue.SupportedEncodings {
+		capabilities = append(capabilities, "compression:"+enc)
+	}
+	return capabilities
+}
+
+// runHeartbeat publishes a heartbeat every interval until stop is closed
+func (a *agent) runHeartbeat(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Heartbeats are published with mandatory routing, so the log must exist first
+	if err := queue.Unwrap(a.mq).(queue.LogReader).CreateLog(protocol.PresenceLog(a.cfg.CommandQueue), presenceRetention); err != nil {
+		logging.Logger.WithError(err).Warn("Failed to create presence log")
+	}
+
+	for {
+		if err := a.publishHeartbeat(interval); err != nil {
+			logging.Logger.WithError(err).Warn("Failed to publish heartbeat")
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishHeartbeat appends a heartbeat to the presence log
+func (a *agent) publishHeartbeat(interval time.Duration) error {
+	heartbeat := protocol.Heartbeat{
+		AgentID:      a.id,
+		Cluster:      a.cfg.ClusterName,
+		Version:      version.Version,
+		Capabilities: agentCapabilities(),
+		Load:         a.inFlight.Load(),
+		Queues:       []string{a.cfg.CommandQueue},
+		Interval:     interval,
+		Timestamp:    time.Now().UTC(),
+	}
+	data, err := json.Marshal(heartbeat)
+	if err != nil {
+		return fmt.Errorf("failed to encode heartbeat: %v", err)
+	}
+
+	// Bypass compression and chunking so clients can read the raw heartbeat
+	mq := queue.Unwrap(a.mq)
+	if err := mq.SendMessage(protocol.PresenceLog(a.cfg.CommandQueue), string(data), "", "", nil); err != nil {
+		return err
+	}
+
+	logging.Logger.WithFields(logrus.Fields{
+		"agent_id": a.id,
+		"load":     heartbeat.Load,
+	}).Debug("Heartbeat published")
+	return nil
+}
+
+// GetAgents connects to the backend of context and lists its live agents. It
+// returns protocol.ErrPresenceUnsupported on backends without presence logs.
+func GetAgents(context *config.Context) ([]protocol.Heartbeat, error) {
+	messageQueue, err := queue.NewMessageQueue(context.Backend, context.RabbitMQURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize messaging backend: %v", err)
+	}
+	if !protocol.SupportsPresence(messageQueue) {
+		return nil, fmt.Errorf("%w (%s); its agents publish no heartbeats", protocol.ErrPresenceUnsupported, context.Backend)
+	}
+	defer func() {
+		if err := messageQueue.Close(); err != nil {
+			logging.Logger.WithError(err).Warn("Failed to close message queue")
+		}
+	}()
+
+	if err := messageQueue.Connect(); err != nil {
+		return nil, fmt.Errorf("failed to connect to messaging backend: %v", err)
+	}
+	return protocol.ListAgents(messageQueue, context.CommandQueue)
+}
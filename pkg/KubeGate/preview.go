@@ -0,0 +1,181 @@
+package KubeGate
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/metrics"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// PreviewTTL is how long a preview token allows its command to run
+const PreviewTTL = 10 * time.Minute
+
+// previewSigner issues and checks preview tokens. Tokens are an HMAC of the
+// command and the expiry, so agents sharing the secret accept each other's.
+type previewSigner struct {
+	secret []byte
+}
+
+// newPreviewSigner uses secret, or a random secret private to this agent when empty
+func newPreviewSigner(secret string) *previewSigner {
+	if secret != "" {
+		return &previewSigner{secret: []byte(secret)}
+	}
+	random := make([]byte, 32)
+	rand.Read(random)
+	return &previewSigner{secret: random}
+}
+
+// token returns a token for command that expires at expires
+func (s *previewSigner) token(command string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + s.sign(expiry, command)
+}
+
+// verify reports whether token was issued for command and has not expired
+func (s *previewSigner) verify(token, command string) bool {
+	expiry, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().After(time.Unix(seconds, 0)) {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.sign(expiry, command)))
+}
+
+func (s *previewSigner) sign(expiry, command string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(expiry + "\n" + command))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// previewRequired reports whether the agent refuses args without a preview token
+func (a *agent) previewRequired(args []string) bool {
+	return a.cfg.RequirePreview && protocol.IsMutating(args, a.cfg.PreviewVerbs)
+}
+
+// unpreviewable are the verbs kubectl cannot dry-run; they would run for real
+var unpreviewable = map[string]bool{
+	"attach": true, "cp": true, "debug": true, "edit": true, "exec": true,
+	"port-forward": true, "proxy": true,
+}
+
+// previewable reports whether cmd can be previewed without running it.
+// `--raw` requests ignore --dry-run, so they cannot be previewed either.
+func previewable(cmd protocol.CommandLine) bool {
+	_, raw := cmd.Flag("raw")
+	return cmd.Verb != "" && !unpreviewable[cmd.Verb] && !raw
+}
+
+// handlePreview answers msg with what its command would change, without running it
+func (a *agent) handlePreview(ctx context.Context, msg queue.Message, args []string, verb string) error {
+	if !previewable(protocol.ParseCommandLine(args)) {
+		logging.Logger.WithFields(logrus.Fields{
+			"correlation": msg.CorrelationID,
+		}).Warn("Preview refused for a command that cannot be dry-run")
+		metrics.CommandsTotal.WithLabelValues(verb, "refused").Inc()
+		response := "Error: this command cannot be previewed, as kubectl cannot dry-run it"
+		return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, response, tracing.Inject(ctx, exitCodeHeaders(1)))
+	}
+
+	preview := a.preview(ctx, args)
+	expires := time.Now().Add(PreviewTTL)
+	preview.Token, preview.ExpiresAt = a.previews.token(msg.Body, expires), expires
+	metrics.CommandsTotal.WithLabelValues(verb, "preview").Inc()
+	logging.Logger.WithFields(logrus.Fields{
+		"correlation": msg.CorrelationID,
+		"method":      preview.Method,
+		"exit_code":   preview.ExitCode,
+	}).Info("Preview sent to client")
+
+	data, err := json.Marshal(preview)
+	if err != nil {
+		return err
+	}
+	return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, string(data), tracing.Inject(ctx, nil))
+}
+
+// preview runs `kubectl diff` for apply, falling back to a server-side dry
+// run, which is used for every other verb
+func (a *agent) preview(ctx context.Context, args []string) protocol.Preview {
+	args = withoutDryRun(args)
+	if cmd := protocol.ParseCommandLine(args); cmd.Verb == "apply" {
+		diffArgs := append([]string{}, args...)
+		diffArgs[cmd.At] = "diff"
+		output, err := a.executor(ctx, kubectlArgs(diffArgs))
+		// kubectl diff exits with 1 when there are differences and above 1 on errors
+		if code := exitCodeOf(err); code <= 1 {
+			if code == 0 && strings.TrimSpace(output) == "" {
+				output = "No changes\n"
+			}
+			return protocol.Preview{Method: protocol.PreviewDiff, Output: output}
+		}
+	}
+
+	output, err := a.executor(ctx, kubectlArgs(withFlag(args, "--dry-run=server")))
+	return protocol.Preview{Method: protocol.PreviewDryRun, Output: output, ExitCode: exitCodeOf(err)}
+}
+
+// exitCodeOf returns 0 for success and the exit status of a failed command
+func exitCodeOf(err error) int {
+	if err == nil {
+		return 0
+	}
+	return exitCode(err)
+}
+
+// withoutDryRun drops --dry-run flags, which the preview sets itself. Words
+// after --, which belong to the command run by kubectl, are kept.
+func withoutDryRun(args []string) []string {
+	var out []string
+	for i, arg := range args {
+		if arg == "--" {
+			return append(out, args[i:]...)
+		}
+		if arg != "--dry-run" && !strings.HasPrefix(arg, "--dry-run=") {
+			out = append(out, arg)
+		}
+	}
+	return out
+}
+
+// withFlag adds flag to kubectl's own arguments, before any --
+func withFlag(args []string, flag string) []string {
+	out := make([]string, 0, len(args)+1)
+	for i, arg := range args {
+		if arg == "--" {
+			out = append(out, flag)
+			return append(out, args[i:]...)
+		}
+		out = append(out, arg)
+	}
+	return append(out, flag)
+}
+
+// refusePreview answers a mutating command sent without a valid preview token
+func (a *agent) refusePreview(ctx context.Context, msg queue.Message, verb string) error {
+	logging.Logger.WithFields(logrus.Fields{
+		"correlation": msg.CorrelationID,
+		"client":      reportedClient(msg),
+	}).Warn("Mutating command refused without preview")
+	metrics.CommandsTotal.WithLabelValues(verb, "preview_required").Inc()
+	headers := exitCodeHeaders(1)
+	headers[protocol.HeaderStatus] = protocol.StatusPreviewRequired
+	response := fmt.Sprintf("Error: this agent requires a preview of mutating commands; preview them with 'kubegate run --preview' (token valid for %s)", PreviewTTL)
+	return a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, response, tracing.Inject(ctx, headers))
+}
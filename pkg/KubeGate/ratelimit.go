@@ -0,0 +1,142 @@
+package KubeGate
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"golang.org/x/time/rate"
+)
+
+// DefaultMaxConcurrentCommands bounds how many commands an agent runs at once
+const DefaultMaxConcurrentCommands = 4
+
+// DefaultMaxConcurrentJobs bounds how many asynchronous jobs an agent runs at once
+const DefaultMaxConcurrentJobs = 2
+
+// idleClientLimiter is how long an unused per-client limiter is kept
+const idleClientLimiter = 10 * time.Minute
+
+// anonymousClient is the identity of commands without an authenticated sender
+const anonymousClient = "anonymous"
+
+// clientLimiter is the token bucket of one client identity
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter applies a global token bucket and one per client identity
+type rateLimiter struct {
+	global    *rate.Limiter // Nil when unlimited
+	perClient config.RateLimit
+	overrides map[string]config.RateLimit
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+}
+
+// newRateLimiter returns nil when no limit is configured
+func newRateLimiter(cfg *config.AgentConfig) *rateLimiter {
+	if cfg.RateLimit.Rate <= 0 && cfg.ClientRateLimit.Rate <= 0 && len(cfg.ClientRateLimits) == 0 {
+		return nil
+	}
+	return &rateLimiter{
+		global:    newLimiter(cfg.RateLimit),
+		perClient: cfg.ClientRateLimit,
+		overrides: cfg.ClientRateLimits,
+		clients:   map[string]*clientLimiter{},
+	}
+}
+
+// newLimiter builds a token bucket, defaulting the burst to one second of rate
+func newLimiter(limit config.RateLimit) *rate.Limiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+	return rate.NewLimiter(rate.Limit(limit.Rate), burst)
+}
+
+// allow takes a token for client from its bucket and the global bucket. When
+// either is empty no token is taken and the wait until the next one is returned.
+func (l *rateLimiter) allow(client string) (time.Duration, bool) {
+	now := time.Now()
+	var reservations []*rate.Reservation
+	for _, limiter := range []*rate.Limiter{l.clientLimiter(client, now), l.global} {
+		if limiter == nil {
+			continue
+		}
+		reservation := limiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			for _, taken := range reservations {
+				taken.CancelAt(now)
+			}
+			return delay, false
+		}
+		reservations = append(reservations, reservation)
+	}
+	return 0, true
+}
+
+// clientLimiter returns the bucket of client, creating it on first use
+func (l *rateLimiter) clientLimiter(client string, now time.Time) *rate.Limiter {
+	limit, ok := l.overrides[client]
+	if !ok {
+		limit = l.perClient
+	}
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.clients[client]
+	if !ok {
+		// Forget clients that went quiet so spoofed identities cannot grow the map forever
+		for id, idle := range l.clients {
+			if now.Sub(idle.lastSeen) > idleClientLimiter {
+				delete(l.clients, id)
+			}
+		}
+		entry = &clientLimiter{limiter: newLimiter(limit)}
+		l.clients[client] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter
+}
+
+// clientIdentity returns the identity rate limits apply to: the sender as
+// authenticated by the broker. The client ID header is chosen by the sender,
+// so it is not trusted and commands without an authenticated sender share
+// one identity.
+func clientIdentity(msg queue.Message) string {
+	if msg.UserID != "" {
+		return msg.UserID
+	}
+	return anonymousClient
+}
+
+// reportedClient returns the client ID the sender reported, for logs and records
+func reportedClient(msg queue.Message) string {
+	if id := msg.Headers[protocol.HeaderClientID]; id != "" {
+		return id
+	}
+	return anonymousClient
+}
+
+// rateLimitedHeaders marks a response as refused, with the wait before a retry
+func rateLimitedHeaders(retryAfter time.Duration) map[string]string {
+	return map[string]string{
+		protocol.HeaderStatus:     protocol.StatusRateLimited,
+		protocol.HeaderRetryAfter: strconv.FormatInt(retryAfter.Milliseconds(), 10),
+	}
+}
@@ -0,0 +1,91 @@
+package KubeGate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+)
+
+func TestNewRateLimiterDisabled(t *testing.T) {
+	if l := newRateLimiter(&config.AgentConfig{}); l != nil {
+		t.Error("rate limiter created without a configured limit")
+	}
+}
+
+func TestRateLimiterPerClient(t *testing.T) {
+	l := newRateLimiter(&config.AgentConfig{
+		ClientRateLimit:  config.RateLimit{Rate: 1, Burst: 2},
+		ClientRateLimits: map[string]config.RateLimit{"ci": {Rate: 1, Burst: 3}, "batch": {}},
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, ok := l.allow("alice"); !ok {
+			t.Fatalf("alice refused within her burst (command %d)", i+1)
+		}
+	}
+	wait, ok := l.allow("alice")
+	if ok {
+		t.Fatal("alice allowed beyond her burst")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("retry after %s, want up to the one second refill", wait)
+	}
+
+	// Limits are kept per client, with overrides
+	if _, ok := l.allow("bob"); !ok {
+		t.Error("bob refused because of alice's limit")
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := l.allow("ci"); !ok {
+			t.Fatalf("ci refused within its overridden burst (command %d)", i+1)
+		}
+	}
+	if _, ok := l.allow("ci"); ok {
+		t.Error("ci allowed beyond its overridden burst")
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := l.allow("batch"); !ok {
+			t.Fatal("batch refused although its override is unlimited")
+		}
+	}
+}
+
+func TestRateLimiterGlobalRefundsClientTokens(t *testing.T) {
+	l := newRateLimiter(&config.AgentConfig{
+		RateLimit:       config.RateLimit{Rate: 1, Burst: 1},
+		ClientRateLimit: config.RateLimit{Rate: 1, Burst: 2},
+	})
+
+	if _, ok := l.allow("alice"); !ok {
+		t.Fatal("first command refused")
+	}
+	if _, ok := l.allow("alice"); ok {
+		t.Fatal("second command allowed beyond the global burst")
+	}
+	// The refused command must not have used alice's second token
+	l.global = nil
+	if _, ok := l.allow("alice"); !ok {
+		t.Error("refusal by the global limit took a token from the client's bucket")
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  queue.Message
+		want string
+	}{
+		{"authenticated", queue.Message{UserID: "alice"}, "alice"},
+		{"header is not trusted", queue.Message{UserID: "alice", Headers: map[string]string{protocol.HeaderClientID: "bob"}}, "alice"},
+		{"header alone", queue.Message{Headers: map[string]string{protocol.HeaderClientID: "bob"}}, anonymousClient},
+		{"nothing", queue.Message{}, anonymousClient},
+	}
+	for _, tt := range tests {
+		if got := clientIdentity(tt.msg); got != tt.want {
+			t.Errorf("%s: clientIdentity = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
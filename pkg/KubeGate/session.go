@@ -0,0 +1,36 @@
+package KubeGate
+
+import (
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/utils"
+)
+
+// RenewSession restarts the validity period of the reply queue session of context
+func RenewSession(context *config.Context) (utils.Session, error) {
+	return utils.NewContextSessionManager(context.Name, context.Backend, protocol.SessionDuration, nil).Renew()
+}
+
+// ClearSession deletes the reply queue recorded in the session of context and
+// removes the session file. The file is removed even if the broker is unreachable.
+func ClearSession(context *config.Context) error {
+	var messageQueue queue.MessageQueue
+	backendQueue, err := queue.NewMessageQueue(context.Backend, context.RabbitMQURL)
+	if err == nil {
+		err = backendQueue.Connect()
+	}
+	if err != nil {
+		logging.Logger.WithError(err).Warn("Failed to connect to messaging backend; the reply queue is left for kubegate gc")
+	} else {
+		messageQueue = backendQueue
+		defer func() {
+			if err := messageQueue.Close(); err != nil {
+				logging.Logger.WithError(err).Warn("Failed to close message queue")
+			}
+		}()
+	}
+
+	return utils.NewContextSessionManager(context.Name, context.Backend, protocol.SessionDuration, messageQueue).CleanupStaleSession()
+}
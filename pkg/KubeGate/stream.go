@@ -0,0 +1,177 @@
+package KubeGate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/metrics"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// Streamed output is sent in parts of up to streamPartSize bytes, or what
+// was written within streamFlushInterval when the command writes less
+const (
+	streamPartSize      = 32 << 10
+	streamFlushInterval = 250 * time.Millisecond
+)
+
+// bufferedStream adapts an Executor, whose output comes once the command ends
+func bufferedStream(execute Executor) StreamExecutor {
+	return func(ctx context.Context, args []string, w io.Writer) error {
+		output, err := execute(ctx, args)
+		if _, werr := io.WriteString(w, output); werr != nil && err == nil {
+			return werr
+		}
+		return err
+	}
+}
+
+// streamable reports whether the output of msg can be sent as it is
+// produced. Output whose Secret data is masked, or that is stored for
+// duplicates, is only complete once the command ends.
+func (a *agent) streamable(msg queue.Message, verb string) bool {
+	if verb == "get" && !a.cfg.AllowSecretData {
+		return false
+	}
+	return a.idempotency == nil || idempotencyKey(msg, a.idempotentVerbs) == ""
+}
+
+// stream runs a command, sending its output in partial responses as it is
+// produced, then a final response with the rest of it and the exit status
+func (a *agent) stream(ctx context.Context, msg queue.Message, args []string, verb string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	out := &responseStream{a: a, ctx: ctx, cancel: cancel, msg: msg}
+
+	logging.Logger.WithField("command", args).Info("Streaming kubectl command")
+	err := a.streamExecutor(ctx, kubectlArgs(args), out)
+	rest, parts, sendErr := out.close()
+	if sendErr != nil {
+		logging.Logger.WithFields(logrus.Fields{
+			"correlation": msg.CorrelationID,
+			"reply_queue": msg.ReplyTo,
+			"error":       sendErr.Error(),
+		}).Error("Failed to stream output to client, command stopped")
+		metrics.CommandsTotal.WithLabelValues(verb, "error").Inc()
+		return sendErr
+	}
+
+	code := 0
+	if err != nil {
+		logging.Logger.WithFields(logrus.Fields{
+			"command": args,
+			"error":   err.Error(),
+		}).Error("Failed to execute kubectl command")
+		metrics.CommandsTotal.WithLabelValues(verb, "error").Inc()
+		rest += fmt.Sprintf("Error: failed to execute command: %v\n", err)
+		code = exitCode(err)
+	} else {
+		metrics.CommandsTotal.WithLabelValues(verb, "success").Inc()
+	}
+
+	headers := map[string]string{protocol.HeaderSequence: strconv.Itoa(parts)}
+	for name, value := range exitCodeHeaders(code) {
+		headers[name] = value
+	}
+	if err := a.mq.PublishResponse(msg.ReplyTo, msg.CorrelationID, rest, tracing.Inject(ctx, headers)); err != nil {
+		logging.Logger.WithFields(logrus.Fields{
+			"correlation": msg.CorrelationID,
+			"reply_queue": msg.ReplyTo,
+			"error":       err.Error(),
+		}).Error("Failed to send response to client")
+		return err
+	}
+	logging.Logger.WithFields(logrus.Fields{
+		"correlation": msg.CorrelationID,
+		"parts":       parts,
+	}).Info("Streamed response sent to client")
+	return nil
+}
+
+// responseStream sends what a command writes to it as numbered partial
+// responses. A part that cannot be sent stops the command.
+type responseStream struct {
+	a      *agent
+	ctx    context.Context
+	cancel context.CancelFunc
+	msg    queue.Message
+
+	mu     sync.Mutex
+	buf    []byte
+	timer  *time.Timer // Flushes the buffer when the command writes little
+	parts  int         // Partial responses sent
+	err    error
+	closed bool
+}
+
+func (s *responseStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.buf = append(s.buf, p...)
+	if len(s.buf) >= streamPartSize {
+		s.flush()
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(streamFlushInterval, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.timer = nil
+			if !s.closed {
+				s.flush()
+			}
+		})
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return len(p), nil
+}
+
+// flush sends the buffered output as the next part, keeping a trailing
+// incomplete UTF-8 sequence for the next one; s.mu must be held
+func (s *responseStream) flush() {
+	n := len(s.buf)
+	for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s.buf[i]) {
+			if !utf8.FullRune(s.buf[i:]) {
+				n = i
+			}
+			break
+		}
+	}
+	if n == 0 || s.err != nil {
+		return
+	}
+
+	headers := map[string]string{queue.HeaderPartial: "true", protocol.HeaderSequence: strconv.Itoa(s.parts)}
+	if err := s.a.mq.PublishResponse(s.msg.ReplyTo, s.msg.CorrelationID, string(s.buf[:n]), tracing.Inject(s.ctx, headers)); err != nil {
+		s.err = fmt.Errorf("failed to send output: %v", err)
+		s.cancel()
+		return
+	}
+	s.parts++
+	s.buf = append(s.buf[:0], s.buf[n:]...)
+}
+
+// close stops flushing and returns the output not sent yet, the number of
+// parts sent and the error that stopped the stream, if any
+func (s *responseStream) close() (string, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	return string(s.buf), s.parts, s.err
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+)
+
+// Approve lets a command waiting for approval run on the agent. Agents only
+// accept approvals from the identities configured as approvers, other than
+// the command's requester.
+func (c *Client) Approve(ctx context.Context, id string) (*Job, error) {
+	return c.jobQuery(ctx, protocol.JobApprove, id)
+}
+
+// Deny refuses a command waiting for approval, which then never runs
+func (c *Client) Deny(ctx context.Context, id string) (*Job, error) {
+	return c.jobQuery(ctx, protocol.JobDeny, id)
+}
+
+// PendingJob returns the job of a command parked for approval from the
+// Result returned with ErrApprovalPending
+func PendingJob(result *Result) (*Job, error) {
+	return parseJob(result.Output)
+}
+
+// RunWithApproval is like Run, but when the agent parks the command for
+// approval it calls pending with the job, waits for the job to be decided and
+// finish, polling every interval, and returns the job's output. Denied and
+// expired commands fail with an *ExitError like failed commands.
+func (c *Client) RunWithApproval(ctx context.Context, argv []string, files map[string][]byte, interval time.Duration, pending func(*Job)) (*Result, error) {
+	result, err := c.Run(ctx, argv, files)
+	if !errors.Is(err, ErrApprovalPending) {
+		return result, err
+	}
+	job, err := PendingJob(result)
+	if err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		pending(job)
+	}
+	if _, err := c.WaitJob(ctx, job.ID, interval); err != nil {
+		return nil, err
+	}
+	return c.JobLogs(ctx, job.ID)
+}
@@ -0,0 +1,166 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/testharness"
+)
+
+// ran reports whether the fake kubectl received a command starting with prefix
+func ran(h *testharness.Harness, prefix string) bool {
+	for _, call := range h.Kubectl.Calls() {
+		if strings.HasPrefix(strings.Join(call.Args, " "), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestApprovalWorkflow(t *testing.T) {
+	h := testharness.New(t, testharness.Options{
+		Agent: func(cfg *config.AgentConfig) {
+			cfg.ApprovalRules = []string{"delete namespace", "exec"}
+			cfg.Approvers = []string{"alice", "bob"}
+		},
+	})
+	h.Kubectl.On("delete namespace shop", testharness.Reply{Output: "namespace \"shop\" deleted\n"})
+	h.Kubectl.On("delete pod", testharness.Reply{Output: "pod \"web\" deleted\n"})
+	h.Kubectl.On("exec", testharness.Reply{Output: "root\n"})
+	requester := h.ClientAs("bob")
+	approver := h.ClientAs("alice")
+	ctx := context.Background()
+
+	// Commands matching no rule run at once
+	if _, err := requester.Run(ctx, []string{"delete", "pod", "web"}, nil); err != nil {
+		t.Fatalf("delete pod: %v", err)
+	}
+
+	result, err := requester.Run(ctx, []string{"delete", "namespace", "shop"}, nil)
+	if !errors.Is(err, client.ErrApprovalPending) {
+		t.Fatalf("delete namespace: err = %v, want ErrApprovalPending", err)
+	}
+	job, err := client.PendingJob(result)
+	if err != nil {
+		t.Fatalf("PendingJob: %v", err)
+	}
+	if job.State != protocol.JobPendingApproval || job.Client != "bob" || job.Done() {
+		t.Fatalf("pending job = %+v", job)
+	}
+	if ran(h, "delete namespace") {
+		t.Fatal("the command ran before it was approved")
+	}
+
+	// Requesters cannot approve their own commands, nor can other identities
+	if _, err := requester.Approve(ctx, job.ID); err == nil {
+		t.Error("the requester approved their own command")
+	}
+	if _, err := h.ClientAs("mallory").Approve(ctx, job.ID); err == nil {
+		t.Error("a client that is not an approver approved the command")
+	}
+	// Client IDs are chosen by the sender, so they do not make an approver
+	if _, err := h.ClientAs("mallory", client.WithClientID("alice")).Approve(ctx, job.ID); err == nil {
+		t.Error("a client reporting an approver's ID approved the command")
+	}
+	if _, err := h.Client(client.WithClientID("alice")).Approve(ctx, job.ID); err == nil {
+		t.Error("a sender the broker did not authenticate approved the command")
+	}
+
+	approved, err := approver.Approve(ctx, job.ID)
+	if err != nil {
+		t.Fatalf("Approve: %v", err)
+	}
+	if approved.Approver != "alice" || approved.State != protocol.JobRunning {
+		t.Errorf("approved job = %+v", approved)
+	}
+	if _, err := approver.Deny(ctx, job.ID); err == nil {
+		t.Error("an approved command was denied")
+	}
+	if _, err := requester.WaitJob(ctx, job.ID, 20*time.Millisecond); err != nil {
+		t.Fatalf("WaitJob: %v", err)
+	}
+	result, err = requester.JobLogs(ctx, job.ID)
+	if err != nil || result.Output != "namespace \"shop\" deleted\n" {
+		t.Errorf("JobLogs = %+v, %v", result, err)
+	}
+
+	// Previews of commands matching a rule are parked like the commands
+	if _, err := requester.Preview(ctx, []string{"-n", "shop", "delete", "ns", "tmp"}, nil); !errors.Is(err, client.ErrApprovalPending) {
+		t.Errorf("preview of delete namespace: err = %v, want ErrApprovalPending", err)
+	}
+	if ran(h, "-n shop delete") {
+		t.Error("a preview ran a command waiting for approval")
+	}
+
+	// Only the requester and approvers may cancel a job
+	pending, err := requester.Submit(ctx, []string{"exec", "web", "--", "id"}, nil)
+	if err != nil || pending.State != protocol.JobPendingApproval {
+		t.Fatalf("Submit = %+v, %v", pending, err)
+	}
+	if _, err := h.ClientAs("mallory").CancelJob(ctx, pending.ID); err == nil {
+		t.Error("a client that is neither requester nor approver cancelled the job")
+	}
+	if _, err := h.Client(client.WithClientID("bob")).CancelJob(ctx, pending.ID); err == nil {
+		t.Error("a sender the broker did not authenticate cancelled the job")
+	}
+	if cancelled, err := approver.CancelJob(ctx, pending.ID); err != nil || cancelled.State != protocol.JobCancelled {
+		t.Errorf("approver CancelJob = %+v, %v", cancelled, err)
+	}
+	pending, err = requester.Submit(ctx, []string{"exec", "web", "--", "id"}, nil)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if cancelled, err := requester.CancelJob(ctx, pending.ID); err != nil || cancelled.State != protocol.JobCancelled {
+		t.Errorf("requester CancelJob = %+v, %v", cancelled, err)
+	}
+	if ran(h, "exec") {
+		t.Error("a cancelled command ran")
+	}
+
+	// Denied commands never run and fail like failed commands
+	result, err = requester.RunWithApproval(ctx, []string{"exec", "web", "--", "whoami"}, nil, 20*time.Millisecond, func(job *client.Job) {
+		if _, err := approver.Deny(ctx, job.ID); err != nil {
+			t.Errorf("Deny: %v", err)
+		}
+	})
+	var exitErr *client.ExitError
+	if !errors.As(err, &exitErr) || !strings.Contains(result.Output, "denied by alice") {
+		t.Errorf("denied command = %+v, %v", result, err)
+	}
+	if ran(h, "exec") {
+		t.Error("a denied command ran")
+	}
+}
+
+func TestApprovalExpires(t *testing.T) {
+	h := testharness.New(t, testharness.Options{
+		Agent: func(cfg *config.AgentConfig) {
+			cfg.ApprovalRules = []string{"drain"}
+			cfg.Approvers = []string{"alice"}
+			cfg.ApprovalTTL = 200 * time.Millisecond
+		},
+	})
+	c := h.ClientAs("bob")
+	ctx := context.Background()
+
+	// Asynchronous submissions return the job waiting for approval
+	job, err := c.Submit(ctx, []string{"drain", "node-1"}, nil)
+	if err != nil || job.State != protocol.JobPendingApproval {
+		t.Fatalf("Submit = %+v, %v", job, err)
+	}
+	if job, err = c.WaitJob(ctx, job.ID, 50*time.Millisecond); err != nil || job.State != protocol.JobExpired {
+		t.Fatalf("WaitJob = %+v, %v; want an expired job", job, err)
+	}
+	if _, err := h.ClientAs("alice").Approve(ctx, job.ID); err == nil {
+		t.Error("an expired command was approved")
+	}
+	if ran(h, "drain") {
+		t.Error("an expired command ran")
+	}
+}
@@ -0,0 +1,606 @@
+// Package client sends kubectl commands to KubeGate agents. It is the
+// library behind `kubegate run` and can be embedded in other Go tools.
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/metrics"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/tracing"
+	"github.com/loaynaser3/KubeGate/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// DefaultResponseTimeout is how long the client waits for the agent to reply
+const DefaultResponseTimeout = 60 * time.Second
+
+// Handling of rate-limited responses
+const (
+	maxRateLimitRetries = 5
+	minRateLimitBackoff = 500 * time.Millisecond
+)
+
+// Result is the outcome of a command run by the agent
+type Result struct {
+	Output        string        // Combined kubectl output; empty for Stream
+	ExitCode      int           // kubectl's exit status
+	CorrelationID string        // Correlation ID of the answered attempt
+	Duration      time.Duration // Time from the first send to the response
+}
+
+// Client sends commands to the agent behind a context. It connects on first
+// use and reuses the connection and reply address for later calls until
+// Close. A Client is safe for concurrent use.
+type Client struct {
+	target        config.Context
+	timeout       time.Duration
+	clientID      string
+	completionTTL time.Duration
+
+	mu      sync.Mutex
+	mq      queue.MessageQueue // Nil until connected
+	session *utils.SessionManager
+	replyTo string
+	pending map[string]*call // Calls waiting for a response by correlation ID
+	closed  bool
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithTimeout sets how long each call waits for the agent's response,
+// overriding the context's response-timeout. Non-positive values are ignored.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		if timeout > 0 {
+			c.timeout = timeout
+		}
+	}
+}
+
+// WithClientID sets the name of this client in agent logs and metrics,
+// overriding the context's client-id
+func WithClientID(id string) Option {
+	return func(c *Client) { c.clientID = id }
+}
+
+// New returns a client for target. It does not connect until the first call.
+func New(target config.Context, opts ...Option) *Client {
+	c := &Client{
+		target:        target,
+		timeout:       target.ResponseTimeout,
+		clientID:      target.ClientID,
+		completionTTL: DefaultCompletionCacheTTL,
+		pending:       map[string]*call{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.timeout <= 0 {
+		c.timeout = DefaultResponseTimeout
+	}
+	if c.clientID == "" {
+		c.clientID = defaultClientID()
+	}
+	return c
+}
+
+// NewFromCurrentContext returns a client for the current context of the
+// KubeGate configuration
+func NewFromCurrentContext(opts ...Option) (*Client, error) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+	target, err := config.GetContext(cfg, cfg.CurrentContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current context: %v", err)
+	}
+	return New(*target, opts...), nil
+}
+
+// Context returns the context the client sends commands to
+func (c *Client) Context() config.Context {
+	return c.target
+}
+
+// Run sends argv (e.g. get pods -n default) to the agent and waits for the
+// response. Files named by -f/--filename are sent along with the command:
+// their contents are taken from files, keyed by the name used in argv, or
+// read from disk. A command that fails on the agent returns its Result
+// together with an *ExitError. Mutating commands on a protected context
+// return ErrProtected unless ctx carries a preview token.
+func (c *Client) Run(ctx context.Context, argv []string, files map[string][]byte) (*Result, error) {
+	if err := c.checkProtected(ctx, argv); err != nil {
+		return nil, err
+	}
+	command, err := encodeCommand(argv, files)
+	if err != nil {
+		return nil, err
+	}
+	return c.run(ctx, command, nil, nil)
+}
+
+// Stream is like Run but writes the command's output to w as the agent
+// produces it, e.g. for `logs -f`, instead of returning it in the Result.
+// The response timeout applies to each wait for more output rather than to
+// the whole command. Agents send the output of commands they mask Secret
+// data of, or deduplicate, once the command ends.
+func (c *Client) Stream(ctx context.Context, argv []string, files map[string][]byte, w io.Writer) (*Result, error) {
+	if err := c.checkProtected(ctx, argv); err != nil {
+		return nil, err
+	}
+	command, err := encodeCommand(argv, files)
+	if err != nil {
+		return nil, err
+	}
+	return c.run(ctx, command, nil, w)
+}
+
+// Close releases the connection and fails calls still waiting for a response
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	calls := c.pending
+	c.pending = map[string]*call{}
+	mq, session := c.mq, c.session
+	c.mu.Unlock()
+
+	for _, call := range calls {
+		call.send(reply{err: ErrClosed})
+	}
+	if mq == nil {
+		return nil
+	}
+	session.Release()
+	return mq.Close()
+}
+
+// run sends an encoded command line with extra headers, retrying with backoff
+// while the agent reports a rate limit, and records the request latency. The
+// output is streamed to w unless it is nil.
+func (c *Client) run(ctx context.Context, command string, extra map[string]string, w io.Writer) (*Result, error) {
+	verb := metrics.Verb(protocol.ParseCommandLine(strings.Fields(command)).Verb)
+	ctx, span := tracing.Tracer().Start(ctx, "ExecuteRun")
+	span.SetAttributes(
+		attribute.String("kubegate.context", c.target.Name),
+		attribute.String("kubegate.verb", verb),
+	)
+	defer span.End()
+
+	start := time.Now()
+	result, err := c.sendAndWait(ctx, command, extra, w)
+	if result != nil {
+		result.Duration = time.Since(start)
+	}
+
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	if c.target.PushgatewayURL != "" {
+		if err := c.pushMetrics(verb, outcome, time.Since(start)); err != nil {
+			logging.Logger.WithError(err).Warn("Failed to push client metrics")
+		}
+	}
+	return result, err
+}
+
+// sendAndWait performs the request/response exchange with the agent
+func (c *Client) sendAndWait(ctx context.Context, command string, extra map[string]string, w io.Writer) (*Result, error) {
+	mq, replyTo, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	idempotencyKey := IdempotencyKey(ctx)
+	if idempotencyKey == "" {
+		idempotencyKey = uuid.New().String()
+	}
+	if w == nil {
+		// Timeout to avoid indefinite waiting; streams time out between parts instead
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		correlationID := uuid.New().String()
+		pending := c.expect(correlationID, w != nil)
+		headers := map[string]string{
+			protocol.HeaderIdempotencyKey: idempotencyKey,
+			protocol.HeaderClientID:       c.clientID,
+		}
+		if w != nil {
+			headers[protocol.HeaderStream] = "true"
+		}
+		if token := PreviewToken(ctx); token != "" {
+			headers[protocol.HeaderPreviewToken] = token
+		}
+		for name, value := range extra {
+			headers[name] = value
+		}
+		headers = tracing.Inject(ctx, headers)
+		err := mq.SendMessage(c.target.CommandQueue, command, correlationID, replyTo, headers)
+		var unroutable *queue.UnroutableError
+		if errors.As(err, &unroutable) {
+			c.forget(correlationID, pending)
+			return nil, fmt.Errorf("%w: queue %s; is an agent running for context %s?", ErrQueueNotFound, c.target.CommandQueue, c.target.Name)
+		}
+		if err != nil {
+			c.forget(correlationID, pending)
+			c.reset(mq)
+			return nil, fmt.Errorf("failed to send command: %v", err)
+		}
+
+		var response queue.Message
+		if w == nil {
+			response, err = c.await(ctx, correlationID, pending)
+		} else {
+			response, err = c.receiveStream(ctx, correlationID, pending, w)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch response.Headers[protocol.HeaderStatus] {
+		case protocol.StatusJobNotFound:
+			return nil, fmt.Errorf("%w (context %s)", ErrJobNotFound, c.target.Name)
+		case protocol.StatusPreviewRequired:
+			return nil, fmt.Errorf("%w (context %s)", ErrPreviewRequired, c.target.Name)
+		case protocol.StatusApprovalPending:
+			result := &Result{Output: response.Body, CorrelationID: correlationID}
+			return result, fmt.Errorf("%w as job %s (context %s)", ErrApprovalPending, correlationID, c.target.Name)
+		}
+		wait, limited := retryAfter(response)
+		if !limited {
+			result := &Result{Output: response.Body, CorrelationID: correlationID}
+			if w != nil {
+				if _, err := io.WriteString(w, response.Body); err != nil {
+					return nil, fmt.Errorf("failed to write output: %v", err)
+				}
+				result.Output = ""
+			}
+			result.ExitCode, _ = strconv.Atoi(response.Headers[protocol.HeaderExitCode])
+			if result.ExitCode != 0 {
+				return result, &ExitError{Code: result.ExitCode}
+			}
+			return result, nil
+		}
+		if attempt >= maxRateLimitRetries {
+			return nil, fmt.Errorf("%w after %d attempts: %s", ErrRateLimited, attempt, response.Body)
+		}
+
+		backoff := rateLimitBackoff(wait, attempt)
+		logging.Logger.WithFields(logrus.Fields{
+			"attempt": attempt,
+			"backoff": backoff.String(),
+		}).Warn("Rate limited by agent, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, c.timeoutError(ctx, " (rate limited by agent)")
+		}
+	}
+}
+
+// connect connects on first use, checks that an agent is alive and starts
+// receiving replies. Later calls reuse the connection.
+func (c *Client) connect() (queue.MessageQueue, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, "", ErrClosed
+	}
+	if c.mq != nil {
+		return c.mq, c.replyTo, nil
+	}
+
+	backendQueue, err := queue.NewMessageQueue(c.target.Backend, c.target.RabbitMQURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to initialize messaging backend: %v", err)
+	}
+	mq := queue.WithCompression(queue.WithChunking(backendQueue, c.target.MaxMessageSize), c.target.Compression, queue.DefaultCompressionThreshold)
+	if err := mq.Connect(); err != nil {
+		return nil, "", fmt.Errorf("failed to connect to messaging backend: %v", err)
+	}
+	closeQueue := func() {
+		if err := mq.Close(); err != nil {
+			logging.Logger.WithError(err).Warn("Failed to close message queue")
+		}
+	}
+
+	// Fail fast instead of waiting for the timeout when no agent has been seen recently
+	if err := c.checkPresence(mq); err != nil {
+		closeQueue()
+		return nil, "", err
+	}
+
+	// Start receiving replies before sending, as Direct Reply-To requires
+	sessionManager := utils.NewContextSessionManager(c.target.Name, c.target.Backend, protocol.SessionDuration, mq)
+	replyTo, err := sessionManager.ReceiveReplies(c.deliver)
+	if err != nil {
+		sessionManager.Release()
+		closeQueue()
+		return nil, "", fmt.Errorf("failed to manage reply queue: %v", err)
+	}
+
+	c.mq, c.session, c.replyTo = mq, sessionManager, replyTo
+	if source, ok := queue.Unwrap(backendQueue).(queue.EventSource); ok {
+		go c.watch(mq, replyTo == queue.DirectReplyTo, source.Events())
+	}
+	return mq, replyTo, nil
+}
+
+// reset drops a connection that failed, so the next call connects again
+func (c *Client) reset(mq queue.MessageQueue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mq != mq || c.closed {
+		return
+	}
+	c.session.Release()
+	c.mq, c.session, c.replyTo = nil, nil, ""
+	if err := mq.Close(); err != nil {
+		logging.Logger.WithError(err).Warn("Failed to close message queue")
+	}
+}
+
+// watch follows the connection state of a backend that reconnects on its
+// own. Replies sent to Direct Reply-To while the connection is down are lost,
+// so calls waiting for one fail instead of running into the timeout; later
+// calls get replies on the new connection. When the backend stops, the
+// connection is dropped so the next call connects again.
+func (c *Client) watch(mq queue.MessageQueue, direct bool, events <-chan queue.ConnectionEvent) {
+	for event := range events {
+		if event.State == queue.StateDisconnected && direct {
+			c.failPending(fmt.Errorf("%w while waiting for the response; the command may have run", ErrConnectionLost))
+		}
+	}
+	c.reset(mq)
+}
+
+// failPending fails every call waiting for a response with err
+func (c *Client) failPending(err error) {
+	c.mu.Lock()
+	calls := c.pending
+	c.pending = map[string]*call{}
+	c.mu.Unlock()
+	for _, call := range calls {
+		call.send(reply{err: err})
+	}
+}
+
+// reply is a response to a call, or the error that ended the wait
+type reply struct {
+	msg queue.Message
+	err error
+}
+
+// call is a request waiting for its response, which partial responses
+// precede when the call streams its output
+type call struct {
+	replies chan reply
+	stream  bool
+	done    chan struct{} // Closed when the caller stops waiting
+	once    sync.Once
+}
+
+// send hands r to the caller, unless it stopped waiting
+func (p *call) send(r reply) {
+	select {
+	case p.replies <- r:
+	case <-p.done:
+	}
+}
+
+// expect registers a call waiting for the response to correlationID
+func (c *Client) expect(correlationID string, stream bool) *call {
+	pending := &call{replies: make(chan reply, 1), stream: stream, done: make(chan struct{})}
+	if stream {
+		pending.replies = make(chan reply, 16)
+	}
+	c.mu.Lock()
+	c.pending[correlationID] = pending
+	c.mu.Unlock()
+	return pending
+}
+
+// forget stops waiting for the response to correlationID
+func (c *Client) forget(correlationID string, pending *call) {
+	c.mu.Lock()
+	if c.pending[correlationID] == pending {
+		delete(c.pending, correlationID)
+	}
+	c.mu.Unlock()
+	pending.once.Do(func() { close(pending.done) })
+}
+
+// deliver routes a reply to the call waiting for its correlation ID. Streamed
+// calls keep receiving until they are done, as parts may arrive after the
+// final response on backends that do not keep messages in order.
+func (c *Client) deliver(msg queue.Message) error {
+	c.mu.Lock()
+	pending, ok := c.pending[msg.CorrelationID]
+	if ok && !pending.stream {
+		delete(c.pending, msg.CorrelationID)
+	}
+	c.mu.Unlock()
+	if !ok {
+		logging.Logger.Printf("Skipped message: CorrelationID=%s", msg.CorrelationID)
+		return nil
+	}
+	pending.send(reply{msg: msg})
+	return nil
+}
+
+// await waits for the reply to correlationID
+func (c *Client) await(ctx context.Context, correlationID string, pending *call) (queue.Message, error) {
+	select {
+	case r := <-pending.replies:
+		return r.msg, r.err
+	case <-ctx.Done():
+		c.forget(correlationID, pending)
+		return queue.Message{}, c.timeoutError(ctx, "")
+	}
+}
+
+// receiveStream writes the parts of a streamed response to w in order, each
+// within the response timeout of the previous one, and returns the final
+// response once every part before it has been written
+func (c *Client) receiveStream(ctx context.Context, correlationID string, pending *call, w io.Writer) (queue.Message, error) {
+	defer c.forget(correlationID, pending)
+	parts := map[int]string{} // Parts that arrived before the ones preceding them
+	next, total := 0, -1
+	var final queue.Message
+	for total < 0 || next < total {
+		partCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		msg, err := c.await(partCtx, correlationID, pending)
+		cancel()
+		if err != nil {
+			return queue.Message{}, err
+		}
+
+		sequence, _ := strconv.Atoi(msg.Headers[protocol.HeaderSequence])
+		if msg.Headers[queue.HeaderPartial] != "true" {
+			final, total = msg, sequence // Agents that do not stream send no parts
+			continue
+		}
+		parts[sequence] = msg.Body
+		for body, ok := parts[next]; ok; body, ok = parts[next] {
+			if _, err := io.WriteString(w, body); err != nil {
+				return queue.Message{}, fmt.Errorf("failed to write output: %v", err)
+			}
+			delete(parts, next)
+			next++
+		}
+	}
+	return final, nil
+}
+
+// timeoutError describes why ctx ended: the client's timeout or the caller's context
+func (c *Client) timeoutError(ctx context.Context, detail string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s%s", ErrTimeout, c.timeout, detail)
+	}
+	return ctx.Err()
+}
+
+// encodeCommand joins argv into the command line sent to the agent, with the
+// contents of files named by -f/--filename inlined as Base64
+func encodeCommand(argv []string, files map[string][]byte) (string, error) {
+	if len(argv) == 0 {
+		return "", fmt.Errorf("no kubectl command given")
+	}
+	encodedArgs, err := utils.ReplaceFileWithBase64(append([]string(nil), argv[1:]...), encodeFile(files))
+	if err != nil {
+		return "", fmt.Errorf("failed to encode message: %v", err)
+	}
+	return strings.Join(append([]string{argv[0]}, encodedArgs...), " "), nil
+}
+
+// encodeFile returns a file encoder for ReplaceFileWithBase64 that prefers
+// the contents given in files over reading from disk
+func encodeFile(files map[string][]byte) func(string) (string, error) {
+	return func(path string) (string, error) {
+		if data, ok := files[path]; ok {
+			return base64.StdEncoding.EncodeToString(data), nil
+		}
+		return utils.EncodeFileToBase64String(path)
+	}
+}
+
+// idempotencyKeyType is the context key of an idempotency key
+type idempotencyKeyType struct{}
+
+// WithIdempotencyKey returns a context whose calls carry key as their
+// idempotency key, so that a retried invocation is answered with the stored
+// response of an earlier one instead of running again
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyType{}, key)
+}
+
+// IdempotencyKey returns the idempotency key set with WithIdempotencyKey
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyType{}).(string)
+	return key
+}
+
+// retryAfter reports whether msg is a rate-limited response and how long to wait
+func retryAfter(msg queue.Message) (time.Duration, bool) {
+	if msg.Headers[protocol.HeaderStatus] != protocol.StatusRateLimited {
+		return 0, false
+	}
+	ms, _ := strconv.ParseInt(msg.Headers[protocol.HeaderRetryAfter], 10, 64)
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// rateLimitBackoff returns the wait before retry attempt, at least the
+// agent's retry-after and growing exponentially with jitter
+func rateLimitBackoff(retryAfter time.Duration, attempt int) time.Duration {
+	backoff := minRateLimitBackoff << (attempt - 1)
+	if retryAfter > backoff {
+		backoff = retryAfter
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
+
+// ClientMetricsFile is where the latency totals pushed to a Pushgateway are kept
+func ClientMetricsFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".kubegate", "cache", "client-metrics.json")
+}
+
+// pushMetrics adds a request to the latency totals of this client and pushes
+// the totals of its context, grouped by context and client ID
+func (c *Client) pushMetrics(verb, outcome string, duration time.Duration) error {
+	path := ClientMetricsFile()
+	unlock, err := utils.LockPath(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	totals := metrics.LoadClientTotals(path)
+	totals.Observe(c.target.Name, verb, outcome, duration)
+	if err := metrics.SaveClientTotals(path, totals); err != nil {
+		return err
+	}
+	return metrics.PushClientMetrics(c.target.PushgatewayURL, c.target.Name, c.clientID, totals)
+}
+
+// defaultClientID identifies the client as user@hostname
+func defaultClientID() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
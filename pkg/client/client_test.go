@@ -0,0 +1,217 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/testharness"
+)
+
+func TestClientReusesConnection(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("get pods", testharness.Reply{Output: "web\n"})
+	c := h.Client()
+
+	// Calls run concurrently over one connection and get their own responses
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, err := c.Run(context.Background(), []string{"get", "pods", "-l", fmt.Sprintf("app=%d", i)}, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if result.Output != "web\n" || result.CorrelationID == "" {
+				errs <- fmt.Errorf("call %d got %+v", i, result)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if calls := h.Kubectl.Calls(); len(calls) != 10 {
+		t.Errorf("kubectl was called %d times, want 10", len(calls))
+	}
+}
+
+func TestClientSendsFiles(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("apply", testharness.Reply{Output: "configmap/app created\n"})
+	manifest := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n"
+
+	// The file only exists in memory
+	_, err := h.Client().Run(context.Background(), []string{"apply", "-f", "app.yaml"}, map[string][]byte{"app.yaml": []byte(manifest)})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	calls := h.Kubectl.Calls()
+	if len(calls) != 1 || len(calls[0].Files) != 1 {
+		t.Fatalf("kubectl calls = %+v, want one call with one file", calls)
+	}
+	for _, content := range calls[0].Files {
+		if content != manifest {
+			t.Errorf("file content = %q, want %q", content, manifest)
+		}
+	}
+}
+
+// timedWriter records when each write happened
+type timedWriter struct {
+	out    bytes.Buffer
+	writes []time.Time
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, time.Now())
+	return w.out.Write(p)
+}
+
+func TestClientStream(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("logs", testharness.Reply{Chunks: []string{"line 1\n", "line 2\n", "line 3\n"}, Delay: 500 * time.Millisecond})
+	h.Kubectl.On("get secret", testharness.Reply{Output: "kind: Secret\ndata:\n  password: aHVudGVyMg==\n"})
+	h.Kubectl.On("exec", testharness.Reply{Chunks: []string{"starting\n", "boom\n"}, ExitCode: 2})
+
+	// The timeout applies between parts, not to the whole command
+	c := h.Client(client.WithTimeout(time.Second))
+	var out timedWriter
+	result, err := c.Stream(context.Background(), []string{"logs", "--follow", "web"}, nil, &out)
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	finished := time.Now()
+	if out.out.String() != "line 1\nline 2\nline 3\n" || result.Output != "" {
+		t.Errorf("streamed %q with Result.Output %q, want the lines and no Output", out.out.String(), result.Output)
+	}
+	if len(out.writes) < 3 {
+		t.Errorf("output written in %d parts, want each line as it is printed", len(out.writes))
+	} else if early := finished.Sub(out.writes[0]); early < 500*time.Millisecond {
+		t.Errorf("first line written %s before the end, want it as soon as it is printed", early)
+	}
+	if _, err := c.Run(context.Background(), []string{"logs", "--follow", "web"}, nil); !errors.Is(err, client.ErrTimeout) {
+		t.Errorf("Run of the same command returned %v, want ErrTimeout", err)
+	}
+
+	// Masked output is sent once complete
+	var secret bytes.Buffer
+	if _, err := c.Stream(context.Background(), []string{"get", "secret", "db", "-o", "yaml"}, nil, &secret); err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if strings.Contains(secret.String(), "aHVudGVyMg==") {
+		t.Errorf("streamed Secret data: %q", secret.String())
+	}
+
+	var failed bytes.Buffer
+	result, err = c.Stream(context.Background(), []string{"exec", "web", "--", "run"}, nil, &failed)
+	var exitErr *client.ExitError
+	if !errors.As(err, &exitErr) || result == nil || result.ExitCode != 2 {
+		t.Errorf("Stream of a failing command returned %+v, %v, want exit status 2", result, err)
+	}
+	if !strings.HasPrefix(failed.String(), "starting\nboom\n") {
+		t.Errorf("streamed %q", failed.String())
+	}
+}
+
+func TestClientTypedErrors(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("get pods", testharness.Reply{Output: "web\n", Delay: time.Second})
+	h.Kubectl.On("delete", testharness.Reply{Output: "Error from server (Forbidden)", ExitCode: 1})
+
+	_, err := h.Client(client.WithTimeout(100*time.Millisecond)).Run(context.Background(), []string{"get", "pods"}, nil)
+	if !errors.Is(err, client.ErrTimeout) {
+		t.Errorf("slow command returned %v, want ErrTimeout", err)
+	}
+
+	result, err := h.Client().Run(context.Background(), []string{"delete", "pod", "web"}, nil)
+	var exitErr *client.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 1 || result == nil || !strings.Contains(result.Output, "Forbidden") {
+		t.Errorf("failed command returned %+v, %v; want its output and exit status 1", result, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.Client().Run(ctx, []string{"get", "pods"}, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled call returned %v, want context.Canceled", err)
+	}
+
+	c := h.Client()
+	c.Close()
+	if _, err := c.Run(context.Background(), []string{"get", "pods"}, nil); !errors.Is(err, client.ErrClosed) {
+		t.Errorf("call after Close returned %v, want ErrClosed", err)
+	}
+
+	missing := client.New(config.Context{Name: "missing", Backend: "memory", RabbitMQURL: h.Broker, CommandQueue: "missing", SkipPresenceCheck: true})
+	defer missing.Close()
+	if _, err := missing.Run(context.Background(), []string{"get", "pods"}, nil); !errors.Is(err, client.ErrQueueNotFound) {
+		t.Errorf("call to a missing queue returned %v, want ErrQueueNotFound", err)
+	}
+
+}
+
+func TestClientPresenceCheck(t *testing.T) {
+	h := testharness.New(t, testharness.Options{Agent: func(cfg *config.AgentConfig) {
+		cfg.HeartbeatInterval = 20 * time.Millisecond
+	}})
+	h.Kubectl.On("get pods", testharness.Reply{Output: "web\n"})
+
+	// A context never seen with an agent is not failed fast, as its agents may predate heartbeats
+	never := client.New(config.Context{Name: "never", Backend: "memory", RabbitMQURL: h.Broker, CommandQueue: "never"})
+	defer never.Close()
+	if _, err := never.Run(context.Background(), []string{"get", "pods"}, nil); !errors.Is(err, client.ErrQueueNotFound) {
+		t.Errorf("call to a context never seen with an agent returned %v, want ErrQueueNotFound", err)
+	}
+
+	if _, err := h.Run("get", "pods"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	// Once an agent was seen, its disappearance fails fast
+	h.Stop()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := h.Run("get", "pods"); !errors.Is(err, client.ErrNoAgent) {
+		t.Errorf("call after the agent stopped returned %v, want ErrNoAgent", err)
+	}
+}
+
+func TestClientComplete(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("__complete get po", testharness.Reply{Output: "pods\npodtemplates\n:4\nCompletion ended with directive: ShellCompDirectiveNoFileComp\n"})
+	h.Kubectl.On("__complete get", testharness.Reply{Output: "deployments\npods\n:4\n"})
+	c := h.Client()
+
+	for i := 0; i < 2; i++ {
+		completion, err := c.Complete(context.Background(), []string{"get"}, "po")
+		if err != nil {
+			t.Fatalf("Complete: %v", err)
+		}
+		if want := []string{"pods", "podtemplates"}; !reflect.DeepEqual(completion.Values, want) || completion.Directive != 4 {
+			t.Errorf("completion = %+v, want %q with directive 4", completion, want)
+		}
+	}
+	if calls := h.Kubectl.Calls(); len(calls) != 1 {
+		t.Errorf("kubectl was called %d times, want 1 as the second completion is cached", len(calls))
+	}
+
+	// An empty word to complete reaches kubectl, which then completes a new word
+	if _, err := c.Complete(context.Background(), []string{"get"}, ""); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	calls := h.Kubectl.Calls()
+	if want := []string{"__complete", "get", ""}; !reflect.DeepEqual(calls[len(calls)-1].Args, want) {
+		t.Errorf("kubectl args = %q, want %q", calls[len(calls)-1].Args, want)
+	}
+}
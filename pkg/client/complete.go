@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+)
+
+// DefaultCompletionCacheTTL is how long completions from the agent are reused
+const DefaultCompletionCacheTTL = 30 * time.Second
+
+// Completion holds kubectl's dynamic completions for a partial command line
+type Completion struct {
+	Values    []string `json:"values"`    // Candidates, each optionally followed by a tab and a description
+	Directive int      `json:"directive"` // Cobra shell completion directive
+}
+
+// WithCompletionCacheTTL sets how long completions are cached on disk;
+// negative disables the cache
+func WithCompletionCacheTTL(ttl time.Duration) Option {
+	return func(c *Client) { c.completionTTL = ttl }
+}
+
+// Complete asks the agent for kubectl's completions of toComplete following
+// args, e.g. args [get] and toComplete "po". Shells start a new process for
+// every completion, so results are cached on disk for a short time.
+func (c *Client) Complete(ctx context.Context, args []string, toComplete string) (*Completion, error) {
+	cacheFile := completionCacheFile(c.target.Name, args, toComplete)
+	if completion, ok := loadCompletion(cacheFile, c.completionTTL); ok {
+		return completion, nil
+	}
+
+	// Files are not inlined: kubectl completes -f values with local files
+	command := strings.Join(append(append([]string{protocol.CompleteVerb}, args...), toComplete), " ")
+	result, err := c.run(ctx, command, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	completion, err := parseCompletion(result.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.completionTTL > 0 {
+		if err := saveCompletion(cacheFile, completion, c.completionTTL); err != nil {
+			logging.Logger.WithError(err).Debug("Failed to cache completion")
+		}
+	}
+	return completion, nil
+}
+
+// parseCompletion parses the output of `kubectl __complete`: one candidate
+// per line followed by a `:<directive>` line. Anything after the directive,
+// such as kubectl's debug message on stderr, is ignored.
+func parseCompletion(output string) (*Completion, error) {
+	completion := &Completion{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, ":") {
+			if directive, err := strconv.Atoi(line[1:]); err == nil {
+				completion.Directive = directive
+				return completion, nil
+			}
+		}
+		if line != "" {
+			completion.Values = append(completion.Values, line)
+		}
+	}
+	return nil, fmt.Errorf("unexpected completion output from agent: %q", strings.TrimSpace(output))
+}
+
+// CompletionCacheDir is where completions are cached
+func CompletionCacheDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".kubegate", "cache", "completion")
+}
+
+// completionCacheFile returns the cache file of a completion request
+func completionCacheFile(contextName string, args []string, toComplete string) string {
+	sum := sha256.Sum256([]byte(strings.Join(append(append([]string{contextName}, args...), toComplete), "\x00")))
+	return filepath.Join(CompletionCacheDir(), hex.EncodeToString(sum[:16])+".json")
+}
+
+// loadCompletion returns a cached completion written less than ttl ago
+func loadCompletion(path string, ttl time.Duration) (*Completion, bool) {
+	if ttl <= 0 {
+		return nil, false
+	}
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > ttl {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var completion Completion
+	if err := json.Unmarshal(data, &completion); err != nil {
+		return nil, false
+	}
+	return &completion, true
+}
+
+// saveCompletion caches a completion and removes expired entries
+func saveCompletion(path string, completion *Completion, ttl time.Duration) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > ttl {
+				os.Remove(filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+
+	data, err := json.Marshal(completion)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+)
+
+// Errors returned by Client; they are wrapped with details, so compare them
+// with errors.Is
+var (
+	ErrNoAgent       = errors.New("no agent has been seen recently")
+	ErrQueueNotFound = errors.New("agent queue does not exist")
+	ErrTimeout       = errors.New("timeout waiting for response")
+	ErrRateLimited   = errors.New("rate limited by agent")
+	ErrClosed        = errors.New("client is closed")
+	// ErrConnectionLost is returned by calls whose response was lost when the
+	// connection to the broker dropped
+	ErrConnectionLost = errors.New("connection to the broker was lost")
+	ErrJobNotFound    = errors.New("job not found or expired")
+	// ErrPreviewRequired is returned by agents that only run previewed mutating commands
+	ErrPreviewRequired = errors.New("agent requires a preview of mutating commands")
+	// ErrProtected is returned for mutating commands on protected contexts
+	// that were not previewed and confirmed
+	ErrProtected = errors.New("context is protected")
+	// ErrApprovalPending is returned with the Result of a command the agent
+	// parked until an approver decides; see PendingJob and RunWithApproval
+	ErrApprovalPending = errors.New("command is waiting for approval")
+)
+
+// ExitError is returned along with the Result of a command that exited with a
+// non-zero status on the agent
+type ExitError = protocol.ExitError
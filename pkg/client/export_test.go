@@ -0,0 +1,7 @@
+package client
+
+// RateLimitBackoff exposes rateLimitBackoff to the tests
+var RateLimitBackoff = rateLimitBackoff
+
+// MinRateLimitBackoff exposes the first retry delay to the tests
+const MinRateLimitBackoff = minRateLimitBackoff
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// Output formats for fan-out results
+const (
+	FanOutText = "text"
+	FanOutJSON = "json"
+)
+
+// FanOutOptions controls how a command is run across several contexts
+type FanOutOptions struct {
+	Timeout time.Duration // Per-context response timeout; the context's own when zero
+	Output  string        // FanOutText or FanOutJSON
+	// Filter, when set, post-processes the output of each context that succeeded
+	Filter func(output string) (string, error)
+	// Raw writes text results one after another without per-cluster headers
+	Raw bool
+	// OnResult, when set, is called concurrently with the outcome of each context
+	OnResult func(contextName string, result *Result, err error)
+}
+
+// ClusterResult is the outcome of a command on a single context
+type ClusterResult struct {
+	Cluster string          `json:"cluster"`
+	Output  json.RawMessage `json:"output,omitempty"`
+	Error   string          `json:"error,omitempty"`
+
+	raw string
+}
+
+// ExecuteFanOut sends the same command to every context concurrently and
+// writes the collected results to w. It returns an error when at least one
+// context failed, after all results have been written.
+func ExecuteFanOut(ctx context.Context, contexts []config.Context, argv []string, opts FanOutOptions, w io.Writer) error {
+	results := make([]ClusterResult, len(contexts))
+	var wg sync.WaitGroup
+	for i := range contexts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := contexts[i]
+			c := New(target, WithTimeout(opts.Timeout))
+			defer c.Close()
+
+			result, err := c.Run(ctx, argv, nil)
+			if opts.OnResult != nil {
+				opts.OnResult(target.Name, result, err)
+			}
+			if err == nil && opts.Filter != nil {
+				filtered, filterErr := opts.Filter(result.Output)
+				result.Output, err = filtered, filterErr
+			}
+			results[i] = newClusterResult(target.Name, result, err)
+			if err != nil {
+				logging.Logger.WithFields(logrus.Fields{
+					"context": target.Name,
+					"error":   err.Error(),
+				}).Error("Fan-out command failed")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := writeFanOutResults(w, results, opts.Output, opts.Raw); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("command failed on %d of %d contexts", failed, len(results))
+	}
+	return nil
+}
+
+// newClusterResult records a response, keeping JSON output as structured data
+func newClusterResult(cluster string, result *Result, err error) ClusterResult {
+	response := ""
+	if result != nil {
+		response = result.Output
+	}
+	clusterResult := ClusterResult{Cluster: cluster, raw: response}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) && response != "" {
+		clusterResult.Error = strings.TrimSpace(response) // The agent's error output says more than the exit status
+		return clusterResult
+	}
+	if err != nil {
+		clusterResult.Error = err.Error()
+		return clusterResult
+	}
+	if json.Valid([]byte(response)) {
+		clusterResult.Output = json.RawMessage(response)
+	} else {
+		quoted, _ := json.Marshal(response)
+		clusterResult.Output = quoted
+	}
+	return clusterResult
+}
+
+// writeFanOutResults renders results with per-cluster headers or as a JSON array
+func writeFanOutResults(w io.Writer, results []ClusterResult, format string, raw bool) error {
+	if format == FanOutJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	for _, result := range results {
+		if raw {
+			io.WriteString(w, result.raw)
+			continue
+		}
+		if result.Error != "" {
+			fmt.Fprintf(w, "=== %s (failed) ===\n%s\n", result.Cluster, result.Error)
+			continue
+		}
+		fmt.Fprintf(w, "=== %s ===\n%s", result.Cluster, result.raw)
+		if len(result.raw) > 0 && result.raw[len(result.raw)-1] != '\n' {
+			fmt.Fprintln(w)
+		}
+	}
+	return nil
+}
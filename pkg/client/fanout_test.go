@@ -0,0 +1,99 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/testharness"
+)
+
+// fanOutContexts returns a context served by a harness agent and one without a
+// command queue
+func fanOutContexts(t *testing.T) []config.Context {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("get pods -n bad", testharness.Reply{Output: "Error from server (Forbidden): pods is forbidden", ExitCode: 1})
+	h.Kubectl.On("get pods", testharness.Reply{Output: `{"items":[]}`})
+
+	ok := config.Context{Name: "ok", Backend: "memory", RabbitMQURL: h.Broker, CommandQueue: h.CommandQueue}
+	return []config.Context{
+		ok,
+		{Name: "missing", Backend: "memory", RabbitMQURL: h.Broker, CommandQueue: "missing", SkipPresenceCheck: true},
+	}
+}
+
+func TestFanOutText(t *testing.T) {
+	contexts := fanOutContexts(t)
+
+	var out bytes.Buffer
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	err := client.ExecuteFanOut(context.Background(), contexts, []string{"get", "pods"}, client.FanOutOptions{
+		OnResult: func(contextName string, result *client.Result, err error) {
+			mu.Lock()
+			seen[contextName] = true
+			mu.Unlock()
+		},
+	}, &out)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 contexts") {
+		t.Errorf("ExecuteFanOut returned %v, want a failure on 1 of 2 contexts", err)
+	}
+	if !seen["ok"] || !seen["missing"] {
+		t.Errorf("OnResult saw %v, want both contexts", seen)
+	}
+
+	// Results are written in the order of the contexts, whichever finished first
+	text := out.String()
+	okAt, missingAt := strings.Index(text, "=== ok ===\n{\"items\":[]}\n"), strings.Index(text, "=== missing (failed) ===\n")
+	if okAt < 0 || missingAt < okAt {
+		t.Errorf("output = %q, want the ok result followed by the failure of missing", text)
+	}
+}
+
+func TestFanOutJSON(t *testing.T) {
+	contexts := fanOutContexts(t)
+	contexts[1] = contexts[0]
+	contexts[1].Name = "bad"
+
+	var out bytes.Buffer
+	err := client.ExecuteFanOut(context.Background(), contexts, []string{"get", "pods"}, client.FanOutOptions{
+		Output: client.FanOutJSON,
+		Filter: func(output string) (string, error) { return strings.ToUpper(output), nil },
+	}, &out)
+	if err != nil {
+		t.Fatalf("ExecuteFanOut: %v", err)
+	}
+	var results []client.ClusterResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("output is not a JSON array: %v\n%s", err, out.String())
+	}
+	if len(results) != 2 || results[0].Cluster != "ok" || results[1].Cluster != "bad" {
+		t.Fatalf("results = %+v, want ok and bad in order", results)
+	}
+	// The filter applies to every successful result and JSON output stays structured
+	var object map[string][]string
+	if err := json.Unmarshal(results[0].Output, &object); err != nil || object["ITEMS"] == nil {
+		t.Errorf("output of ok = %s, want the filtered JSON object", results[0].Output)
+	}
+
+	// An agent's error output is reported rather than its exit status
+	out.Reset()
+	err = client.ExecuteFanOut(context.Background(), contexts, []string{"get", "pods", "-n", "bad"}, client.FanOutOptions{Output: client.FanOutJSON}, &out)
+	if err == nil {
+		t.Fatal("ExecuteFanOut succeeded, want the failure of both contexts")
+	}
+	results = nil
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("output is not a JSON array: %v", err)
+	}
+	for _, result := range results {
+		if !strings.Contains(result.Error, "Forbidden") || result.Output != nil {
+			t.Errorf("result = %+v, want the agent's error output", result)
+		}
+	}
+}
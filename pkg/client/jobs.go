@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+)
+
+// DefaultJobPollInterval is how often WaitJob asks for the state of a job
+const DefaultJobPollInterval = 2 * time.Second
+
+// Job describes a command run asynchronously by an agent
+type Job = protocol.Job
+
+// Submit sends argv like Run but returns as soon as the agent has accepted
+// it as a job. The job's ID is the correlation ID of the request; its state
+// and output can be retrieved later, from any client of the same context,
+// for as long as the agent keeps job results. Commands that need approval
+// are returned as jobs waiting for it. Protected contexts are guarded as in Run.
+func (c *Client) Submit(ctx context.Context, argv []string, files map[string][]byte) (*Job, error) {
+	if err := c.checkProtected(ctx, argv); err != nil {
+		return nil, err
+	}
+	command, err := encodeCommand(argv, files)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.run(ctx, command, map[string]string{protocol.HeaderAsync: "true"}, nil)
+	if errors.Is(err, ErrApprovalPending) {
+		return PendingJob(result) // The job runs once approved
+	}
+	if err != nil {
+		if result != nil && result.Output != "" {
+			return nil, fmt.Errorf("%v: %s", err, result.Output)
+		}
+		return nil, err
+	}
+	return parseJob(result.Output)
+}
+
+// JobStatus returns the current state of a job
+func (c *Client) JobStatus(ctx context.Context, id string) (*Job, error) {
+	return c.jobQuery(ctx, protocol.JobStatus, id)
+}
+
+// CancelJob stops a running job; finished jobs are returned unchanged
+func (c *Client) CancelJob(ctx context.Context, id string) (*Job, error) {
+	return c.jobQuery(ctx, protocol.JobCancel, id)
+}
+
+// JobLogs returns the output of a finished job. A job whose command failed
+// returns its Result together with an *ExitError, like Run.
+func (c *Client) JobLogs(ctx context.Context, id string) (*Result, error) {
+	return c.run(ctx, jobCommand(protocol.JobLogs, id), nil, nil)
+}
+
+// WaitJob polls the state of a job every interval until it has finished or
+// ctx is done. A non-positive interval uses DefaultJobPollInterval.
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration) (*Job, error) {
+	if interval <= 0 {
+		interval = DefaultJobPollInterval
+	}
+	for {
+		job, err := c.JobStatus(ctx, id)
+		if err != nil || job.Done() {
+			return job, err
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return job, ctx.Err()
+		}
+	}
+}
+
+// jobQuery sends a job query and parses the job it returns
+func (c *Client) jobQuery(ctx context.Context, query, id string) (*Job, error) {
+	result, err := c.run(ctx, jobCommand(query, id), nil, nil)
+	if err != nil {
+		if result != nil && result.Output != "" {
+			return nil, fmt.Errorf("%v: %s", err, result.Output)
+		}
+		return nil, err
+	}
+	return parseJob(result.Output)
+}
+
+// jobCommand builds the __job pseudo-command
+func jobCommand(query, id string) string {
+	return protocol.JobVerb + " " + query + " " + id
+}
+
+// parseJob decodes the job returned by the agent
+func parseJob(output string) (*Job, error) {
+	var job Job
+	if err := parseJSONResponse(output, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// parseJSONResponse decodes a response the agent sends as JSON
+func parseJSONResponse(output string, v interface{}) error {
+	if err := json.Unmarshal([]byte(output), v); err != nil {
+		return fmt.Errorf("unexpected response from agent: %s", output)
+	}
+	return nil
+}
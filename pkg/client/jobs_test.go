@@ -0,0 +1,137 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/testharness"
+)
+
+func TestJobLifecycle(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("drain node-1", testharness.Reply{Output: "node/node-1 drained\n", Delay: 300 * time.Millisecond})
+	c := h.Client()
+	ctx := context.Background()
+
+	job, err := c.Submit(ctx, []string{"drain", "node-1"}, nil)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if job.ID == "" || job.State != protocol.JobRunning || job.Command != "drain node-1" {
+		t.Fatalf("Submit returned %+v", job)
+	}
+	if _, err := c.JobLogs(ctx, job.ID); err == nil {
+		t.Error("JobLogs of a running job succeeded, want an error")
+	}
+
+	// Another client of the same context can follow the job
+	other := h.Client()
+	done, err := other.WaitJob(ctx, job.ID, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("WaitJob: %v", err)
+	}
+	if done.State != protocol.JobSucceeded || done.FinishedAt.IsZero() {
+		t.Errorf("finished job = %+v", done)
+	}
+	result, err := other.JobLogs(ctx, job.ID)
+	if err != nil || result.Output != "node/node-1 drained\n" {
+		t.Errorf("JobLogs = %+v, %v", result, err)
+	}
+}
+
+func TestJobFailureAndCancel(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("rollout status", testharness.Reply{Output: "error: timed out\n", ExitCode: 3})
+	h.Kubectl.On("wait", testharness.Reply{Output: "done\n", Delay: time.Minute})
+	c := h.Client()
+	ctx := context.Background()
+
+	// A failed command keeps its exit status
+	job, err := c.Submit(ctx, []string{"rollout", "status", "deploy/web"}, nil)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if job, err = c.WaitJob(ctx, job.ID, 20*time.Millisecond); err != nil || job.State != protocol.JobFailed || job.ExitCode != 3 {
+		t.Fatalf("failed job = %+v, %v", job, err)
+	}
+	result, err := c.JobLogs(ctx, job.ID)
+	var exitErr *client.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 3 || !strings.Contains(result.Output, "error: timed out") {
+		t.Errorf("JobLogs = %+v, %v; want the output with exit status 3", result, err)
+	}
+
+	// Cancelling stops a running command
+	job, err = c.Submit(ctx, []string{"wait", "--for=condition=Ready", "pod/web"}, nil)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if _, err := c.CancelJob(ctx, job.ID); err != nil {
+		t.Fatalf("CancelJob: %v", err)
+	}
+	if job, err = c.WaitJob(ctx, job.ID, 20*time.Millisecond); err != nil || job.State != protocol.JobCancelled {
+		t.Errorf("cancelled job = %+v, %v", job, err)
+	}
+
+	if _, err := c.JobStatus(ctx, "no-such-job"); !errors.Is(err, client.ErrJobNotFound) {
+		t.Errorf("JobStatus of an unknown job = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestJobsRunApartFromCommands(t *testing.T) {
+	h := testharness.New(t, testharness.Options{
+		ResponseTimeout: 2 * time.Second,
+		Agent: func(cfg *config.AgentConfig) {
+			cfg.MaxConcurrentCommands = 1
+			cfg.MaxConcurrentJobs = 1
+		},
+	})
+	h.Kubectl.On("wait", testharness.Reply{Output: "done\n", Delay: time.Minute})
+	h.Kubectl.On("get pods", testharness.Reply{Output: "web\n"})
+	c := h.Client()
+	ctx := context.Background()
+
+	running, err := c.Submit(ctx, []string{"wait", "--for=delete", "pod/a"}, nil)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	queued, err := c.Submit(ctx, []string{"wait", "--for=delete", "pod/b"}, nil)
+	if err != nil {
+		t.Fatalf("Submit while the job pool is full: %v", err)
+	}
+
+	// Jobs hold no command slot, so commands still run
+	if result, err := c.Run(ctx, []string{"get", "pods"}, nil); err != nil || result.Output != "web\n" {
+		t.Fatalf("Run while jobs are running = %+v, %v", result, err)
+	}
+
+	// A job waiting for a job slot never starts once cancelled
+	if _, err := c.CancelJob(ctx, queued.ID); err != nil {
+		t.Fatalf("CancelJob: %v", err)
+	}
+	job, err := c.WaitJob(ctx, queued.ID, 20*time.Millisecond)
+	if err != nil || job.State != protocol.JobCancelled {
+		t.Fatalf("cancelled queued job = %+v, %v", job, err)
+	}
+	if _, err := c.CancelJob(ctx, running.ID); err != nil {
+		t.Fatalf("CancelJob: %v", err)
+	}
+	if _, err := c.WaitJob(ctx, running.ID, 20*time.Millisecond); err != nil {
+		t.Fatalf("WaitJob: %v", err)
+	}
+
+	var started int
+	for _, call := range h.Kubectl.Calls() {
+		if call.Args[0] == "wait" {
+			started++
+		}
+	}
+	if started != 1 {
+		t.Errorf("kubectl wait ran %d times, want only the job that had a slot", started)
+	}
+}
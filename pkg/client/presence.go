@@ -0,0 +1,54 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+)
+
+// PresenceCacheDir is where the client records which contexts it has seen agents on
+func PresenceCacheDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".kubegate", "cache", "presence")
+}
+
+// presenceMarker returns the file recording that agents of the context were seen
+func (c *Client) presenceMarker() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{c.target.Name, c.target.Backend, c.target.RabbitMQURL, c.target.CommandQueue}, "\x00")))
+	return filepath.Join(PresenceCacheDir(), hex.EncodeToString(sum[:16]))
+}
+
+// checkPresence fails with ErrNoAgent when no agent has a live heartbeat.
+// Agents that predate heartbeats never publish any, so it only fails once a
+// heartbeat has been seen on the context before.
+func (c *Client) checkPresence(mq queue.MessageQueue) error {
+	if c.target.SkipPresenceCheck || !protocol.SupportsPresence(mq) {
+		return nil
+	}
+	alive, err := protocol.AgentAlive(mq, c.target.CommandQueue)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("Failed to check agent presence")
+		return nil
+	}
+
+	marker := c.presenceMarker()
+	if alive {
+		if _, err := os.Stat(marker); err != nil {
+			if err := os.MkdirAll(filepath.Dir(marker), 0700); err == nil {
+				os.WriteFile(marker, nil, 0600)
+			}
+		}
+		return nil
+	}
+	if _, err := os.Stat(marker); err != nil {
+		logging.Logger.WithField("context", c.target.Name).Debug("No heartbeat seen yet, skipping the presence check")
+		return nil
+	}
+	return fmt.Errorf("%w on queue %s (context %s). Run 'kubegate agents' to check", ErrNoAgent, c.target.CommandQueue, c.target.Name)
+}
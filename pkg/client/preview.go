@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+)
+
+// Preview is what a mutating command would change, with the token that lets
+// the same command run on agents that require previews
+type Preview = protocol.Preview
+
+// IsMutating reports whether argv runs one of the default previewed verbs,
+// such as apply, delete, patch, scale and drain
+func IsMutating(argv []string) bool {
+	return protocol.IsMutating(argv, nil)
+}
+
+// Preview asks the agent what argv would change, with `kubectl diff` for
+// apply and a server-side dry run otherwise, without running it. Pass the
+// preview's token to the real call with WithPreviewToken.
+func (c *Client) Preview(ctx context.Context, argv []string, files map[string][]byte) (*Preview, error) {
+	command, err := encodeCommand(argv, files)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.run(ctx, command, map[string]string{protocol.HeaderPreview: "true"}, nil)
+	if errors.Is(err, ErrApprovalPending) {
+		// Agents park commands matching an approval rule, previews included
+		if job, jobErr := PendingJob(result); jobErr == nil {
+			return nil, fmt.Errorf("%w as job %s, which runs once approved", err, job.ID)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var preview Preview
+	if err := parseJSONResponse(result.Output, &preview); err != nil {
+		return nil, fmt.Errorf("%v; does the agent support previews?", err)
+	}
+	return &preview, nil
+}
+
+// checkProtected refuses mutating argv on a protected context unless ctx
+// carries the token of a preview, which the caller confirmed
+func (c *Client) checkProtected(ctx context.Context, argv []string) error {
+	if c.target.Protected && IsMutating(argv) && PreviewToken(ctx) == "" {
+		return fmt.Errorf("%w: context %s; preview the command and pass its token with WithPreviewToken", ErrProtected, c.target.Name)
+	}
+	return nil
+}
+
+// previewTokenType is the context key of a preview token
+type previewTokenType struct{}
+
+// WithPreviewToken returns a context whose calls carry token, from a Preview
+// of the same command, so that agents requiring previews run them
+func WithPreviewToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, previewTokenType{}, token)
+}
+
+// PreviewToken returns the preview token set with WithPreviewToken
+func PreviewToken(ctx context.Context) string {
+	token, _ := ctx.Value(previewTokenType{}).(string)
+	return token
+}
@@ -0,0 +1,194 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/testharness"
+)
+
+func TestPreviewGuard(t *testing.T) {
+	h := testharness.New(t, testharness.Options{
+		Agent: func(cfg *config.AgentConfig) { cfg.RequirePreview = true },
+	})
+	h.Kubectl.On("delete pod web --dry-run=server", testharness.Reply{Output: "pod \"web\" deleted (server dry run)\n"})
+	h.Kubectl.On("delete pod", testharness.Reply{Output: "pod \"web\" deleted\n"})
+	h.Kubectl.On("get pods", testharness.Reply{Output: "web Running\n"})
+	c := h.Client()
+	ctx := context.Background()
+
+	// Read-only commands are not guarded
+	if _, err := c.Run(ctx, []string{"get", "pods"}, nil); err != nil {
+		t.Fatalf("get pods: %v", err)
+	}
+
+	argv := []string{"delete", "pod", "web"}
+	if _, err := c.Run(ctx, argv, nil); !errors.Is(err, client.ErrPreviewRequired) {
+		t.Fatalf("delete without preview: err = %v, want ErrPreviewRequired", err)
+	}
+
+	preview, err := c.Preview(ctx, argv, nil)
+	if err != nil {
+		t.Fatalf("Preview: %v", err)
+	}
+	if preview.Method != protocol.PreviewDryRun || !strings.Contains(preview.Output, "server dry run") || preview.Token == "" {
+		t.Fatalf("preview = %+v", preview)
+	}
+	for _, call := range h.Kubectl.Calls() {
+		if strings.Join(call.Args, " ") == "delete pod web" {
+			t.Fatal("the preview ran the command")
+		}
+	}
+
+	// The token only allows the previewed command
+	tokenCtx := client.WithPreviewToken(ctx, preview.Token)
+	if _, err := c.Run(tokenCtx, []string{"delete", "pod", "db"}, nil); !errors.Is(err, client.ErrPreviewRequired) {
+		t.Errorf("delete of another pod: err = %v, want ErrPreviewRequired", err)
+	}
+	result, err := c.Run(tokenCtx, argv, nil)
+	if err != nil || result.Output != "pod \"web\" deleted\n" {
+		t.Errorf("delete with token = %+v, %v", result, err)
+	}
+}
+
+func TestRunGuardsProtectedContexts(t *testing.T) {
+	h := testharness.New(t, testharness.Options{
+		Context: func(c *config.Context) { c.Protected = true },
+	})
+	h.Kubectl.On("-n prod delete pod web --dry-run=server", testharness.Reply{Output: "pod \"web\" deleted (server dry run)\n"})
+	h.Kubectl.On("-n prod delete pod", testharness.Reply{Output: "pod \"web\" deleted\n"})
+	h.Kubectl.On("get pods", testharness.Reply{Output: "web Running\n"})
+	c := h.Client()
+	ctx := context.Background()
+
+	if _, err := c.Run(ctx, []string{"get", "pods"}, nil); err != nil {
+		t.Fatalf("get pods: %v", err)
+	}
+	argv := []string{"-n", "prod", "delete", "pod", "web"}
+	if _, err := c.Run(ctx, argv, nil); !errors.Is(err, client.ErrProtected) {
+		t.Fatalf("Run without preview: err = %v, want ErrProtected", err)
+	}
+	if _, err := c.Submit(ctx, argv, nil); !errors.Is(err, client.ErrProtected) {
+		t.Fatalf("Submit without preview: err = %v, want ErrProtected", err)
+	}
+	if calls := h.Kubectl.Calls(); len(calls) != 1 {
+		t.Fatalf("kubectl calls = %+v, want only get pods", calls)
+	}
+
+	preview, err := c.Preview(ctx, argv, nil)
+	if err != nil {
+		t.Fatalf("Preview: %v", err)
+	}
+	result, err := c.Run(client.WithPreviewToken(ctx, preview.Token), argv, nil)
+	if err != nil || result.Output != "pod \"web\" deleted\n" {
+		t.Errorf("delete with token = %+v, %v", result, err)
+	}
+}
+
+func TestPreviewApplyUsesDiff(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("diff", testharness.Reply{Output: "-  replicas: 2\n+  replicas: 3\n", ExitCode: 1})
+	c := h.Client()
+
+	files := map[string][]byte{"deploy.yaml": []byte("kind: Deployment\n")}
+	preview, err := c.Preview(context.Background(), []string{"apply", "-f", "deploy.yaml", "--dry-run=client"}, files)
+	if err != nil {
+		t.Fatalf("Preview: %v", err)
+	}
+	if preview.Method != protocol.PreviewDiff || preview.ExitCode != 0 || !strings.Contains(preview.Output, "+  replicas: 3") {
+		t.Errorf("preview = %+v", preview)
+	}
+	calls := h.Kubectl.Calls()
+	if len(calls) != 1 || calls[0].Args[0] != "diff" || strings.Contains(strings.Join(calls[0].Args, " "), "dry-run") {
+		t.Fatalf("calls = %+v, want a single kubectl diff", calls)
+	}
+	for _, content := range calls[0].Files {
+		if content != "kind: Deployment\n" {
+			t.Errorf("diff got file %q", content)
+		}
+	}
+}
+
+func TestPreviewNeverRunsCommands(t *testing.T) {
+	h := testharness.New(t, testharness.Options{})
+	h.Kubectl.On("", testharness.Reply{Output: "ok\n"})
+	c := h.Client()
+	ctx := context.Background()
+	files := map[string][]byte{"x.yaml": []byte("kind: ConfigMap\n")}
+
+	previewed := [][]string{
+		{"delete", "ns", "prod", "--"},
+		{"-n", "prod", "apply", "-f", "x.yaml"},
+		{"-n", "prod", "scale", "deploy/web", "--replicas=0", "--dry-run=none"},
+	}
+	for _, argv := range previewed {
+		if _, err := c.Preview(ctx, argv, files); err != nil {
+			t.Errorf("Preview(%q): %v", argv, err)
+		}
+	}
+	refused := [][]string{
+		{"exec", "web", "--", "whoami"},
+		{"-n", "prod", "cp", "web:/etc/passwd", "passwd"},
+		{"port-forward", "web", "8080"},
+		{"attach", "web"},
+		{"delete", "--raw", "/api/v1/namespaces/prod"},
+	}
+	for _, argv := range refused {
+		var exitErr *client.ExitError
+		if _, err := c.Preview(ctx, argv, nil); !errors.As(err, &exitErr) {
+			t.Errorf("Preview(%q): err = %v, want a refusal", argv, err)
+		}
+	}
+
+	// Every call is a diff, or a dry run flagged before any --
+	calls := h.Kubectl.Calls()
+	if len(calls) != len(previewed) {
+		t.Errorf("kubectl was called %d times, want %d", len(calls), len(previewed))
+	}
+	for _, call := range calls {
+		own := call.Args
+		for i, arg := range call.Args {
+			if arg == "--" {
+				own = call.Args[:i]
+				break
+			}
+		}
+		dryRun := false
+		for _, arg := range own {
+			if arg == "--dry-run=server" || arg == "diff" {
+				dryRun = true
+			}
+			if arg == "--dry-run=none" {
+				dryRun = false
+			}
+		}
+		if !dryRun {
+			t.Errorf("a preview ran kubectl %q", call.Args)
+		}
+	}
+}
+
+func TestIsMutating(t *testing.T) {
+	cases := map[string]bool{
+		"apply -f x.yaml":          true,
+		"delete pod web":           true,
+		"rollout restart deploy/x": true,
+		"rollout status deploy/x":  false,
+		"get pods":                 false,
+		"-n prod delete pod web":   true,
+		"--context=x apply -f y":   true,
+		"-n kube-system get pods":  false,
+		"-n prod rollout status x": false,
+		"":                         false,
+	}
+	for command, want := range cases {
+		if got := client.IsMutating(strings.Fields(command)); got != want {
+			t.Errorf("IsMutating(%q) = %v, want %v", command, got, want)
+		}
+	}
+}
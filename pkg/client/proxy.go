@@ -0,0 +1,259 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// maxProxyBody bounds the size of request bodies accepted by the proxy
+const maxProxyBody = 10 << 20
+
+// serverError matches kubectl's report of an API error, e.g.
+// `Error from server (NotFound): pods "web" not found`
+var serverError = regexp.MustCompile(`Error from server \(([A-Za-z]+)\):\s*(.*)`)
+
+// exitSuffix is appended by the agent to the output of failed commands
+var exitSuffix = regexp.MustCompile(`, error: exit status \d+$`)
+
+// reasonCodes maps Kubernetes status reasons to HTTP status codes
+var reasonCodes = map[string]int{
+	"BadRequest":           http.StatusBadRequest,
+	"Unauthorized":         http.StatusUnauthorized,
+	"Forbidden":            http.StatusForbidden,
+	"NotFound":             http.StatusNotFound,
+	"MethodNotAllowed":     http.StatusMethodNotAllowed,
+	"NotAcceptable":        http.StatusNotAcceptable,
+	"AlreadyExists":        http.StatusConflict,
+	"Conflict":             http.StatusConflict,
+	"Gone":                 http.StatusGone,
+	"Invalid":              http.StatusUnprocessableEntity,
+	"TooManyRequests":      http.StatusTooManyRequests,
+	"InternalError":        http.StatusInternalServerError,
+	"ServiceUnavailable":   http.StatusServiceUnavailable,
+	"ServerTimeout":        http.StatusGatewayTimeout,
+	"Timeout":              http.StatusGatewayTimeout,
+	"UnsupportedMediaType": http.StatusUnsupportedMediaType,
+}
+
+// Proxy serves the Kubernetes API of KubeGate contexts over plain HTTP, each
+// under /<context>/, so that tools speaking kubeconfig can reach clusters
+// through their agents. Requests are run on the agent with `kubectl --raw`:
+// GET with get, POST with create, PUT with replace and DELETE with delete.
+// PATCH and watches are not supported, and protected contexts are read-only.
+// Requests must carry the proxy's bearer token and a localhost Host header,
+// and browser requests are refused, so that web pages cannot reach the
+// clusters through it.
+type Proxy struct {
+	mu      sync.Mutex
+	targets map[string]config.Context
+	clients map[string]*Client
+	token   string
+	opts    []Option
+}
+
+// NewProxy returns a proxy for contexts that accepts requests authenticated
+// with token; opts apply to the client of each context
+func NewProxy(contexts []config.Context, token string, opts ...Option) *Proxy {
+	p := &Proxy{targets: map[string]config.Context{}, clients: map[string]*Client{}, token: token, opts: opts}
+	for _, target := range contexts {
+		p.targets[target.Name] = target
+	}
+	return p
+}
+
+// ProxyPath returns the path prefix under which the proxy serves contextName
+func ProxyPath(contextName string) string {
+	return "/" + url.PathEscape(contextName)
+}
+
+// ServeHTTP runs the API request on the agent of the context named by the first path segment
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if code, reason, message := p.authorize(r); code != 0 {
+		logging.Logger.WithFields(logrus.Fields{
+			"remote": r.RemoteAddr,
+			"host":   r.Host,
+			"reason": message,
+		}).Warn("Proxy request refused")
+		writeStatus(w, code, reason, message)
+		return
+	}
+
+	escaped, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	contextName, err := url.PathUnescape(escaped)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("invalid context in path: %v", err))
+		return
+	}
+	c, ok := p.client(contextName)
+	if !ok {
+		writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("KubeGate context %q not found", contextName))
+		return
+	}
+	if c.Context().Protected && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// Changes to protected contexts must be previewed and confirmed, which the proxy cannot do
+		writeStatus(w, http.StatusForbidden, "Forbidden", fmt.Sprintf("KubeGate context %q is protected; run mutating commands with 'kubegate run' to preview and confirm them", contextName))
+		return
+	}
+
+	uri := "/" + rest
+	if r.URL.RawQuery != "" {
+		uri += "?" + r.URL.RawQuery
+	}
+	if q := r.URL.Query().Get("watch"); q == "true" || q == "1" {
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "watch is not supported through KubeGate")
+		return
+	}
+
+	var argv []string
+	var files map[string][]byte
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		argv = []string{"get", "--raw", uri}
+	case http.MethodDelete:
+		argv = []string{"delete", "--raw", uri}
+	case http.MethodPost, http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxProxyBody))
+		if err != nil {
+			writeStatus(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("failed to read request body: %v", err))
+			return
+		}
+		verb := "create"
+		if r.Method == http.MethodPut {
+			verb = "replace"
+		} else {
+			status = http.StatusCreated
+		}
+		argv = []string{verb, "--raw", uri, "-f", "body.json"}
+		files = map[string][]byte{"body.json": body}
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not supported through KubeGate", r.Method))
+		return
+	}
+
+	result, err := c.Run(r.Context(), argv, files)
+	var exitErr *ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		code, reason, message := apiError(result.Output)
+		writeStatus(w, code, reason, message)
+		return
+	case errors.Is(err, ErrPreviewRequired):
+		writeStatus(w, http.StatusForbidden, "Forbidden", "the agent requires a preview of mutating commands, which the proxy cannot confirm")
+		return
+	case errors.Is(err, ErrApprovalPending):
+		// The request runs once approved; its result can only be followed as a job
+		writeStatus(w, http.StatusForbidden, "Forbidden", err.Error()+"; follow it with 'kubegate job wait'")
+		return
+	case errors.Is(err, ErrTimeout):
+		writeStatus(w, http.StatusGatewayTimeout, "Timeout", err.Error())
+		return
+	case err != nil:
+		logging.Logger.WithFields(logrus.Fields{
+			"context": contextName,
+			"error":   err.Error(),
+		}).Error("Proxy request failed")
+		writeStatus(w, http.StatusServiceUnavailable, "ServiceUnavailable", err.Error())
+		return
+	}
+
+	if json.Valid([]byte(result.Output)) {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, result.Output)
+	}
+}
+
+// authorize refuses requests from browsers, requests addressed to a host
+// other than localhost, as after DNS rebinding, and requests without the
+// proxy's token. It returns a zero code for accepted requests.
+func (p *Proxy) authorize(r *http.Request) (int, string, string) {
+	if r.Header.Get("Origin") != "" {
+		return http.StatusForbidden, "Forbidden", "browser requests are not accepted by the KubeGate proxy"
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); !strings.EqualFold(host, "localhost") && (ip == nil || !ip.IsLoopback()) {
+		return http.StatusForbidden, "Forbidden", fmt.Sprintf("host %q is not served; use localhost", r.Host)
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || p.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) != 1 {
+		return http.StatusUnauthorized, "Unauthorized", "a valid proxy token is required; run 'kubegate config export-kubeconfig' to add it to your kubeconfig"
+	}
+	return 0, "", ""
+}
+
+// Close closes the clients of all contexts
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, c := range p.clients {
+		c.Close()
+		delete(p.clients, name)
+	}
+	return nil
+}
+
+// client returns the shared client of a context, creating it on first use
+func (p *Proxy) client(contextName string) (*Client, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.clients[contextName]; ok {
+		return c, true
+	}
+	target, ok := p.targets[contextName]
+	if !ok {
+		return nil, false
+	}
+	c := New(target, p.opts...)
+	p.clients[contextName] = c
+	return c, true
+}
+
+// apiError recovers the HTTP status of a failed `kubectl --raw` from its output
+func apiError(output string) (int, string, string) {
+	match := serverError.FindStringSubmatch(output)
+	if match == nil {
+		return http.StatusInternalServerError, "InternalError", strings.TrimSpace(output)
+	}
+	code, ok := reasonCodes[match[1]]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	return code, match[1], exitSuffix.ReplaceAllString(strings.TrimSpace(match[2]), "")
+}
+
+// writeStatus writes a Kubernetes Status object, which kubectl and client
+// libraries turn into a readable error
+func writeStatus(w http.ResponseWriter, code int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind":       "Status",
+		"apiVersion": "v1",
+		"metadata":   map[string]interface{}{},
+		"status":     "Failure",
+		"message":    message,
+		"reason":     reason,
+		"code":       code,
+	})
+}
@@ -0,0 +1,183 @@
+package client_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/testharness"
+)
+
+// proxyToken is the bearer token of the proxies started by newProxyServer
+const proxyToken = "test-token"
+
+// newProxyServer serves the harness context through a Proxy
+func newProxyServer(t *testing.T, opts testharness.Options) (*testharness.Harness, string) {
+	h := testharness.New(t, opts)
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	proxy := client.NewProxy(cfg.Contexts, proxyToken)
+	server := httptest.NewServer(proxy)
+	t.Cleanup(func() {
+		server.Close()
+		proxy.Close()
+	})
+	return h, server.URL + client.ProxyPath(testharness.ContextName)
+}
+
+// proxyDo sends a request with the proxy's token
+func proxyDo(t *testing.T, method, url string, body io.Reader) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+proxyToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	return resp
+}
+
+func TestProxyGet(t *testing.T) {
+	h, base := newProxyServer(t, testharness.Options{})
+	h.Kubectl.On("get --raw /api/v1/namespaces/default/pods?limit=1", testharness.Reply{Output: `{"kind":"PodList","items":[]}`})
+
+	resp := proxyDo(t, http.MethodGet, base+"/api/v1/namespaces/default/pods?limit=1", nil)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %d %q, want 200 application/json", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if string(body) != `{"kind":"PodList","items":[]}` {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestProxyMapsErrors(t *testing.T) {
+	h, base := newProxyServer(t, testharness.Options{})
+	h.Kubectl.On("get --raw /api/v1/namespaces/default/pods/web", testharness.Reply{
+		Output:   `Error from server (NotFound): pods "web" not found`,
+		ExitCode: 1,
+	})
+
+	resp := proxyDo(t, http.MethodGet, base+"/api/v1/namespaces/default/pods/web", nil)
+	defer resp.Body.Close()
+	var status struct {
+		Kind, Reason, Message string
+		Code                  int
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("decode Status: %v", err)
+	}
+	if resp.StatusCode != http.StatusNotFound || status.Kind != "Status" || status.Reason != "NotFound" ||
+		status.Code != http.StatusNotFound || status.Message != `pods "web" not found` {
+		t.Errorf("got %d %+v", resp.StatusCode, status)
+	}
+
+	// Unknown contexts are reported without reaching an agent
+	resp = proxyDo(t, http.MethodGet, strings.TrimSuffix(base, client.ProxyPath(testharness.ContextName))+"/missing/api", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown context got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestProxyPostSendsBody(t *testing.T) {
+	h, base := newProxyServer(t, testharness.Options{})
+	h.Kubectl.On("create --raw /api/v1/namespaces/default/configmaps", testharness.Reply{Output: `{"kind":"ConfigMap"}`})
+	manifest := `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"app"}}`
+
+	resp := proxyDo(t, http.MethodPost, base+"/api/v1/namespaces/default/configmaps", strings.NewReader(manifest))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("got %d, want 201", resp.StatusCode)
+	}
+
+	calls := h.Kubectl.Calls()
+	if len(calls) != 1 || len(calls[0].Files) != 1 {
+		t.Fatalf("kubectl calls = %+v, want one with the request body", calls)
+	}
+	for _, data := range calls[0].Files {
+		if data != manifest {
+			t.Errorf("body file = %q, want %q", data, manifest)
+		}
+	}
+}
+
+func TestProxyRefusesUnauthorizedRequests(t *testing.T) {
+	h, base := newProxyServer(t, testharness.Options{})
+	h.Kubectl.On("get --raw", testharness.Reply{Output: `{"kind":"PodList","items":[]}`})
+	path := base + "/api/v1/namespaces/default/pods"
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		host   string
+		want   int
+	}{
+		{"no token", map[string]string{}, "", http.StatusUnauthorized},
+		{"wrong token", map[string]string{"Authorization": "Bearer wrong"}, "", http.StatusUnauthorized},
+		{"browser", map[string]string{"Authorization": "Bearer " + proxyToken, "Origin": "https://evil.example"}, "", http.StatusForbidden},
+		{"rebound host", map[string]string{"Authorization": "Bearer " + proxyToken}, "evil.example:8001", http.StatusForbidden},
+		{"localhost", map[string]string{"Authorization": "Bearer " + proxyToken}, "localhost:8001", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		for name, value := range tt.header {
+			req.Header.Set(name, value)
+		}
+		if tt.host != "" {
+			req.Host = tt.host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: GET: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+	if calls := h.Kubectl.Calls(); len(calls) != 1 {
+		t.Errorf("kubectl was called %d times, want only for the authorized request", len(calls))
+	}
+}
+
+func TestProxyRefusesChangesToProtectedContexts(t *testing.T) {
+	h, base := newProxyServer(t, testharness.Options{
+		Context: func(c *config.Context) { c.Protected = true },
+	})
+	h.Kubectl.On("get --raw", testharness.Reply{Output: `{"kind":"PodList","items":[]}`})
+	h.Kubectl.On("delete --raw", testharness.Reply{Output: `{"kind":"Status"}`})
+	h.Kubectl.On("create --raw", testharness.Reply{Output: `{"kind":"ConfigMap"}`})
+
+	path := base + "/api/v1/namespaces/default/configmaps"
+	for _, method := range []string{http.MethodDelete, http.MethodPost, http.MethodPut, http.MethodPatch} {
+		resp := proxyDo(t, method, path+"/app", strings.NewReader(`{}`))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: got %d, want 403", method, resp.StatusCode)
+		}
+	}
+	if calls := h.Kubectl.Calls(); len(calls) != 0 {
+		t.Fatalf("kubectl calls = %+v, want none", calls)
+	}
+
+	resp := proxyDo(t, http.MethodGet, path, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET: got %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,31 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/client"
+)
+
+func TestRateLimitBackoff(t *testing.T) {
+	tests := []struct {
+		retryAfter time.Duration
+		attempt    int
+		base       time.Duration
+	}{
+		{0, 1, client.MinRateLimitBackoff},
+		{0, 2, 2 * client.MinRateLimitBackoff},
+		{0, 4, 8 * client.MinRateLimitBackoff},
+		{100 * time.Millisecond, 1, client.MinRateLimitBackoff}, // Shorter than the backoff
+		{3 * time.Second, 1, 3 * time.Second},                   // The agent's wait wins
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			got := client.RateLimitBackoff(tt.retryAfter, tt.attempt)
+			// Jitter adds up to half of the base
+			if got < tt.base || got > tt.base+tt.base/2 {
+				t.Fatalf("RateLimitBackoff(%s, %d) = %s, want between %s and %s", tt.retryAfter, tt.attempt, got, tt.base, tt.base+tt.base/2)
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/utils"
+)
+
+func TestWatchFailsCallsWaitingForLostDirectReplies(t *testing.T) {
+	for _, direct := range []bool{true, false} {
+		c := New(config.Context{Name: "test"})
+		responses := c.expect("c1", false)
+		events := make(chan queue.ConnectionEvent, 2)
+		events <- queue.ConnectionEvent{State: queue.StateDisconnected}
+		close(events)
+		c.watch(&queue.Memory{}, direct, events)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := c.await(ctx, "c1", responses)
+		cancel()
+		if direct && !errors.Is(err, ErrConnectionLost) {
+			t.Errorf("await after a disconnect with direct replies returned %v, want ErrConnectionLost", err)
+		}
+		if !direct && !errors.Is(err, ErrTimeout) {
+			t.Errorf("await after a disconnect with a reply queue returned %v, want it to keep waiting", err)
+		}
+	}
+}
+
+func TestWatchDropsStoppedConnection(t *testing.T) {
+	c := New(config.Context{Name: "test", Backend: "memory"})
+	mq := &queue.Memory{URL: "watch"}
+	if err := mq.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	c.mq, c.session, c.replyTo = mq, utils.NewSessionManager(t.TempDir()+"/session.json", time.Hour, mq), "reply"
+
+	events := make(chan queue.ConnectionEvent)
+	close(events)
+	c.watch(mq, true, events)
+	if c.mq != nil || c.replyTo != "" {
+		t.Error("connection was kept after its backend stopped")
+	}
+}
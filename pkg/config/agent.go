@@ -1,16 +1,74 @@
 package config
 
 import (
+	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// RateLimit is a token bucket allowing Rate commands per second in bursts of
+// up to Burst. A zero Rate means unlimited.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
 type AgentConfig struct {
 	RabbitMQURL  string `yaml:"rabbitmq-url"`
 	CommandQueue string `yaml:"command-queue"`
 	Backend      string `yaml:"backend"`
+	Compression  string `yaml:"compression"` // Preferred response encoding (zstd/gzip/none)
+	// MaxMessageSize is the largest body in bytes sent in one message; larger responses are chunked
+	MaxMessageSize int    `yaml:"max-message-size"`
+	ClusterName    string `yaml:"cluster-name"`
+	// HeartbeatInterval controls how often presence heartbeats are published; negative disables them
+	HeartbeatInterval time.Duration `yaml:"heartbeat-interval"`
+	// HealthAddr is the listen address of the health endpoints; "off" disables them
+	HealthAddr string `yaml:"health-addr"`
+	// GCInterval enables the reply queue janitor when positive
+	GCInterval time.Duration `yaml:"gc-interval"`
+	// GCMinIdle is how long a reply queue must be idle before the janitor deletes it
+	GCMinIdle     time.Duration `yaml:"gc-min-idle"`
+	ManagementURL string        `yaml:"management-url"` // RabbitMQ management API, derived from the broker URL when empty
+	// IdempotencyTTL is how long responses are kept to answer duplicate commands; negative disables it
+	IdempotencyTTL time.Duration `yaml:"idempotency-ttl"`
+	// IdempotentVerbs lists the verbs whose duplicates are suppressed, replacing the default mutating verbs
+	IdempotentVerbs []string `yaml:"idempotent-verbs"`
+	// RateLimit applies to all commands, ClientRateLimit to each sender as
+	// authenticated by the broker unless ClientRateLimits has an entry for it
+	RateLimit        RateLimit            `yaml:"rate-limit"`
+	ClientRateLimit  RateLimit            `yaml:"client-rate-limit"`
+	ClientRateLimits map[string]RateLimit `yaml:"client-rate-limits"`
+	// MaxConcurrentCommands bounds how many commands run at once
+	MaxConcurrentCommands int `yaml:"max-concurrent-commands"`
+	// MaxConcurrentJobs bounds how many asynchronous jobs run at once, apart from commands
+	MaxConcurrentJobs int `yaml:"max-concurrent-jobs"`
+	// AllowSecretData returns Secret data in `get` output instead of masking it
+	AllowSecretData bool `yaml:"allow-secret-data"`
+	// JobDir stores the results of asynchronous jobs; defaults to ~/.kubegate/jobs
+	JobDir string `yaml:"job-dir"`
+	// JobTTL is how long job results are kept; negative disables asynchronous jobs
+	JobTTL time.Duration `yaml:"job-ttl"`
+	// RequirePreview refuses mutating commands that were not previewed first
+	RequirePreview bool `yaml:"require-preview"`
+	// PreviewVerbs lists the verbs that need a preview, replacing the default mutating verbs
+	PreviewVerbs []string `yaml:"preview-verbs"`
+	// PreviewSecret signs preview tokens; agent replicas must share it. Random per agent when empty.
+	PreviewSecret string `yaml:"preview-secret"`
+	// ApprovalRules park matching commands until an approver runs or denies
+	// them, e.g. "delete namespace" or "exec"; they need asynchronous jobs
+	ApprovalRules []string `yaml:"approval-rules"`
+	// Approvers lists the broker users, as authenticated by the broker,
+	// allowed to approve commands
+	Approvers []string `yaml:"approvers"`
+	// ApprovalTTL is how long commands wait for approval; defaults to an hour
+	ApprovalTTL time.Duration `yaml:"approval-ttl"`
 }
 
 // var agentConfigFile = filepath.Join(os.Getenv("HOME"), ".kubegate", "agent-config.yaml")
@@ -24,11 +82,13 @@ func LoadAgentConfig() (*AgentConfig, error) {
 
 	// If both environment variables are set, use them
 	if rabbitURL != "" && commandQueue != "" {
-		return &AgentConfig{
+		cfg := &AgentConfig{
 			RabbitMQURL:  rabbitURL,
 			CommandQueue: commandQueue,
 			Backend:      backend,
-		}, nil
+		}
+		overrideAgentConfigWithEnv(cfg)
+		return cfg, nil
 	}
 
 	// Otherwise, fall back to the YAML file
@@ -43,5 +103,123 @@ func LoadAgentConfig() (*AgentConfig, error) {
 		return nil, err
 	}
 
+	overrideAgentConfigWithEnv(&cfg)
 	return &cfg, nil
 }
+
+// overrideAgentConfigWithEnv overrides optional agent settings with environment variables.
+func overrideAgentConfigWithEnv(cfg *AgentConfig) {
+	if envCompression := os.Getenv("KUBEGATE_COMPRESSION"); envCompression != "" {
+		cfg.Compression = envCompression
+	}
+	if envMaxSize := os.Getenv("KUBEGATE_MAX_MESSAGE_SIZE"); envMaxSize != "" {
+		if size, err := strconv.Atoi(envMaxSize); err == nil {
+			cfg.MaxMessageSize = size
+		}
+	}
+	if envCluster := os.Getenv("KUBEGATE_CLUSTER_NAME"); envCluster != "" {
+		cfg.ClusterName = envCluster
+	}
+	if envInterval := os.Getenv("KUBEGATE_HEARTBEAT_INTERVAL"); envInterval != "" {
+		if interval, err := time.ParseDuration(envInterval); err == nil {
+			cfg.HeartbeatInterval = interval
+		}
+	}
+	if envHealthAddr := os.Getenv("KUBEGATE_HEALTH_ADDR"); envHealthAddr != "" {
+		cfg.HealthAddr = envHealthAddr
+	}
+	if envGCInterval := os.Getenv("KUBEGATE_GC_INTERVAL"); envGCInterval != "" {
+		if interval, err := time.ParseDuration(envGCInterval); err == nil {
+			cfg.GCInterval = interval
+		}
+	}
+	if envGCMinIdle := os.Getenv("KUBEGATE_GC_MIN_IDLE"); envGCMinIdle != "" {
+		if idle, err := time.ParseDuration(envGCMinIdle); err == nil {
+			cfg.GCMinIdle = idle
+		}
+	}
+	if envManagementURL := os.Getenv("KUBEGATE_MANAGEMENT_URL"); envManagementURL != "" {
+		cfg.ManagementURL = envManagementURL
+	}
+	if envTTL := os.Getenv("KUBEGATE_IDEMPOTENCY_TTL"); envTTL != "" {
+		if ttl, err := time.ParseDuration(envTTL); err == nil {
+			cfg.IdempotencyTTL = ttl
+		}
+	}
+	if envVerbs := os.Getenv("KUBEGATE_IDEMPOTENT_VERBS"); envVerbs != "" {
+		cfg.IdempotentVerbs = strings.Split(envVerbs, ",")
+	}
+	if envLimit := os.Getenv("KUBEGATE_RATE_LIMIT"); envLimit != "" {
+		if limit, err := ParseRateLimit(envLimit); err == nil {
+			cfg.RateLimit = limit
+		}
+	}
+	if envLimit := os.Getenv("KUBEGATE_CLIENT_RATE_LIMIT"); envLimit != "" {
+		if limit, err := ParseRateLimit(envLimit); err == nil {
+			cfg.ClientRateLimit = limit
+		}
+	}
+	if envConcurrent := os.Getenv("KUBEGATE_MAX_CONCURRENT_COMMANDS"); envConcurrent != "" {
+		if max, err := strconv.Atoi(envConcurrent); err == nil {
+			cfg.MaxConcurrentCommands = max
+		}
+	}
+	if envJobs := os.Getenv("KUBEGATE_MAX_CONCURRENT_JOBS"); envJobs != "" {
+		if max, err := strconv.Atoi(envJobs); err == nil {
+			cfg.MaxConcurrentJobs = max
+		}
+	}
+	if envAllow := os.Getenv("KUBEGATE_ALLOW_SECRET_DATA"); envAllow != "" {
+		cfg.AllowSecretData = envAllow == "true"
+	}
+	if envRequire := os.Getenv("KUBEGATE_REQUIRE_PREVIEW"); envRequire != "" {
+		cfg.RequirePreview = envRequire == "true"
+	}
+	if envVerbs := os.Getenv("KUBEGATE_PREVIEW_VERBS"); envVerbs != "" {
+		cfg.PreviewVerbs = strings.Split(envVerbs, ",")
+	}
+	if envSecret := os.Getenv("KUBEGATE_PREVIEW_SECRET"); envSecret != "" {
+		cfg.PreviewSecret = envSecret
+	}
+	if envRules := os.Getenv("KUBEGATE_APPROVAL_RULES"); envRules != "" {
+		cfg.ApprovalRules = strings.Split(envRules, ",")
+	}
+	if envApprovers := os.Getenv("KUBEGATE_APPROVERS"); envApprovers != "" {
+		cfg.Approvers = strings.Split(envApprovers, ",")
+	}
+	if envTTL := os.Getenv("KUBEGATE_APPROVAL_TTL"); envTTL != "" {
+		if ttl, err := time.ParseDuration(envTTL); err == nil {
+			cfg.ApprovalTTL = ttl
+		}
+	}
+	if envJobDir := os.Getenv("KUBEGATE_JOB_DIR"); envJobDir != "" {
+		cfg.JobDir = envJobDir
+	}
+	if envJobTTL := os.Getenv("KUBEGATE_JOB_TTL"); envJobTTL != "" {
+		if ttl, err := time.ParseDuration(envJobTTL); err == nil {
+			cfg.JobTTL = ttl
+		}
+	}
+}
+
+// ParseRateLimit parses "rate" or "rate/burst", e.g. "5" or "5/20"
+func ParseRateLimit(value string) (RateLimit, error) {
+	rateValue, burstValue, hasBurst := strings.Cut(value, "/")
+	var limit RateLimit
+	var err error
+	if limit.Rate, err = strconv.ParseFloat(strings.TrimSpace(rateValue), 64); err != nil {
+		return RateLimit{}, fmt.Errorf("invalid rate %q: %v", rateValue, err)
+	}
+	if math.IsNaN(limit.Rate) || math.IsInf(limit.Rate, 0) {
+		return RateLimit{}, fmt.Errorf("invalid rate %q: must be a finite number", rateValue)
+	}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(strings.TrimSpace(burstValue)); err != nil {
+			return RateLimit{}, fmt.Errorf("invalid burst %q: %v", burstValue, err)
+		}
+		if limit.Burst < 0 {
+			return RateLimit{}, fmt.Errorf("invalid burst %q: must not be negative", burstValue)
+		}
+	}
+	return limit, nil
+}
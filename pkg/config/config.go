@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -15,21 +18,50 @@ type Context struct {
 	CommandQueue string `yaml:"command-queue"`
 	ReplyQueue   string `yaml:"reply-queue"`
 	Backend      string `yaml:"backend"`
+	Compression  string `yaml:"compression,omitempty"` // Encoding for outgoing commands (zstd/gzip), empty sends them uncompressed
+	// MaxMessageSize is the largest body in bytes sent in one message; larger commands are chunked
+	MaxMessageSize int `yaml:"max-message-size,omitempty"`
+	// SkipPresenceCheck disables the fast-fail check for live agents, e.g. for agents that predate heartbeats
+	SkipPresenceCheck bool              `yaml:"skip-presence-check,omitempty"`
+	Labels            map[string]string `yaml:"labels,omitempty"` // Used to select contexts for fan-out commands
+	// PushgatewayURL enables pushing client latency metrics to a Prometheus Pushgateway
+	PushgatewayURL string `yaml:"pushgateway-url,omitempty"`
+	// ManagementURL overrides the RabbitMQ management API endpoint used by `kubegate gc`
+	ManagementURL string `yaml:"management-url,omitempty"`
+	// ClientID names this client in agent logs and Pushgateway metrics; defaults to user@hostname
+	ClientID string `yaml:"client-id,omitempty"`
+	// ResponseTimeout is how long `kubegate run` waits for the agent; defaults to 60s
+	ResponseTimeout time.Duration `yaml:"response-timeout,omitempty"`
+	// Protected contexts always preview mutating commands and ask for confirmation
+	Protected bool `yaml:"protected,omitempty"`
 }
 
 type Config struct {
-	CurrentContext string    `yaml:"current-context"`
-	Contexts       []Context `yaml:"contexts"`
+	CurrentContext string        `yaml:"current-context"`
+	Contexts       []Context     `yaml:"contexts"`
+	History        HistoryConfig `yaml:"history,omitempty"`
 }
 
-var configFile = filepath.Join(os.Getenv("HOME"), ".kubegate", "config.yaml")
+// HistoryConfig controls the local record of commands run with `kubegate run`
+type HistoryConfig struct {
+	Disabled   bool `yaml:"disabled,omitempty"`
+	MaxEntries int  `yaml:"max-entries,omitempty"` // Oldest entries are dropped beyond this; defaults to 5000
+	// ResponseBytes is how much of each response is kept; defaults to 1024, negative keeps none
+	ResponseBytes int `yaml:"response-bytes,omitempty"`
+}
+
+// configFile returns the path of the client configuration, resolved on each
+// call so that HOME can be changed by tests
+func configFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".kubegate", "config.yaml")
+}
 
 // LoadConfig loads the configuration from the YAML file and then overrides
 // any values with environment variables if they are set.
 func LoadConfig() (*Config, error) {
 	var cfg Config
 
-	file, err := os.ReadFile(configFile)
+	file, err := os.ReadFile(configFile())
 	if err != nil {
 		if os.IsNotExist(err) {
 			// If the file doesn't exist, start with an empty configuration.
@@ -54,6 +86,14 @@ func overrideConfigWithEnv(cfg *Config) {
 	if envCurrent := os.Getenv("CURRENT_CONTEXT"); envCurrent != "" {
 		cfg.CurrentContext = envCurrent
 	}
+	if envHistory := os.Getenv("KUBEGATE_HISTORY"); envHistory != "" {
+		cfg.History.Disabled = envHistory == "off" || envHistory == "false"
+	}
+	if envBytes := os.Getenv("KUBEGATE_HISTORY_RESPONSE_BYTES"); envBytes != "" {
+		if n, err := strconv.Atoi(envBytes); err == nil {
+			cfg.History.ResponseBytes = n
+		}
+	}
 
 	for i := range cfg.Contexts {
 		if cfg.Contexts[i].Name == cfg.CurrentContext {
@@ -81,12 +121,13 @@ func SaveConfig(cfg *Config) error {
 		return err
 	}
 
-	err = os.MkdirAll(filepath.Dir(configFile), 0755)
+	path := configFile()
+	err = os.MkdirAll(filepath.Dir(path), 0755)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(configFile, data, 0644)
+	return os.WriteFile(path, data, 0644)
 }
 
 // GetContext retrieves a context by name.
@@ -145,3 +186,65 @@ func DeleteContext(cfg *Config, contextName string) error {
 
 	return SaveConfig(cfg)
 }
+
+// SelectContexts returns the contexts matched by an explicit list of names,
+// all contexts, or a label selector such as "env=prod,region!=eu".
+func SelectContexts(cfg *Config, names []string, all bool, selector string) ([]Context, error) {
+	if all {
+		return cfg.Contexts, nil
+	}
+
+	if selector != "" {
+		var selected []Context
+		for _, ctx := range cfg.Contexts {
+			matched, err := MatchLabels(ctx.Labels, selector)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				selected = append(selected, ctx)
+			}
+		}
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("no contexts match selector: %s", selector)
+		}
+		return selected, nil
+	}
+
+	selected := make([]Context, 0, len(names))
+	for _, name := range names {
+		ctx, err := GetContext(cfg, name)
+		if err != nil {
+			return nil, fmt.Errorf("context not found: %s", name)
+		}
+		selected = append(selected, *ctx)
+	}
+	return selected, nil
+}
+
+// MatchLabels reports whether labels satisfy every requirement in selector.
+// Requirements are comma separated and use "key=value", "key!=value" or "key".
+func MatchLabels(labels map[string]string, selector string) (bool, error) {
+	for _, requirement := range strings.Split(selector, ",") {
+		requirement = strings.TrimSpace(requirement)
+		switch {
+		case requirement == "":
+			return false, fmt.Errorf("invalid selector: %q", selector)
+		case strings.Contains(requirement, "!="):
+			parts := strings.SplitN(requirement, "!=", 2)
+			if value, ok := labels[strings.TrimSpace(parts[0])]; ok && value == strings.TrimSpace(parts[1]) {
+				return false, nil
+			}
+		case strings.Contains(requirement, "="):
+			parts := strings.SplitN(requirement, "=", 2)
+			if value, ok := labels[strings.TrimSpace(parts[0])]; !ok || value != strings.TrimSpace(parts[1]) {
+				return false, nil
+			}
+		default:
+			if _, ok := labels[requirement]; !ok {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
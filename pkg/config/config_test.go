@@ -0,0 +1,117 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchLabels(t *testing.T) {
+	labels := map[string]string{"env": "prod", "region": "eu"}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"env=prod", true},
+		{"env = prod", true},
+		{"env=staging", false},
+		{"env!=staging", true},
+		{"env!=prod", false},
+		{"tier!=web", true},
+		{"region", true},
+		{"tier", false},
+		{"env=prod,region=eu", true},
+		{"env=prod, region=us", false},
+		{"missing=", false},
+	}
+	for _, tt := range tests {
+		got, err := MatchLabels(labels, tt.selector)
+		if err != nil {
+			t.Errorf("MatchLabels(%q): %v", tt.selector, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("MatchLabels(%q) = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+
+	for _, selector := range []string{"", "env=prod,", ",env=prod"} {
+		if _, err := MatchLabels(labels, selector); err == nil {
+			t.Errorf("MatchLabels(%q) succeeded, want an error for the empty requirement", selector)
+		}
+	}
+}
+
+func TestSelectContexts(t *testing.T) {
+	cfg := &Config{Contexts: []Context{
+		{Name: "prod-eu", Labels: map[string]string{"env": "prod", "region": "eu"}},
+		{Name: "prod-us", Labels: map[string]string{"env": "prod", "region": "us"}},
+		{Name: "staging"},
+	}}
+	tests := []struct {
+		name     string
+		names    []string
+		all      bool
+		selector string
+		want     []string
+		wantErr  bool
+	}{
+		{name: "all", all: true, names: []string{"staging"}, want: []string{"prod-eu", "prod-us", "staging"}},
+		{name: "by name in the given order", names: []string{"staging", "prod-eu"}, want: []string{"staging", "prod-eu"}},
+		{name: "unknown name", names: []string{"prod-eu", "dev"}, wantErr: true},
+		{name: "selector wins over names", names: []string{"staging"}, selector: "env=prod", want: []string{"prod-eu", "prod-us"}},
+		{name: "selector with several requirements", selector: "env=prod,region!=eu", want: []string{"prod-us"}},
+		{name: "selector matching nothing", selector: "env=dev", wantErr: true},
+		{name: "invalid selector", selector: "env=prod,", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, err := SelectContexts(cfg, tt.names, tt.all, tt.selector)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("SelectContexts selected %+v, want an error", selected)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SelectContexts: %v", err)
+			}
+			var names []string
+			for _, ctx := range selected {
+				names = append(names, ctx.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("selected %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  RateLimit
+	}{
+		{"5", RateLimit{Rate: 5}},
+		{"0.5", RateLimit{Rate: 0.5}},
+		{"20/40", RateLimit{Rate: 20, Burst: 40}},
+		{" 20 / 40 ", RateLimit{Rate: 20, Burst: 40}},
+		{"0", RateLimit{}},
+		{"-1", RateLimit{Rate: -1}}, // Unlimited, like zero
+	}
+	for _, tt := range tests {
+		got, err := ParseRateLimit(tt.value)
+		if err != nil {
+			t.Errorf("ParseRateLimit(%q): %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRateLimit(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "fast", "5/", "5/many", "5/-1", "NaN", "Inf", "5/2/1"} {
+		if limit, err := ParseRateLimit(value); err == nil {
+			t.Errorf("ParseRateLimit(%q) = %+v, want an error", value, limit)
+		}
+	}
+}
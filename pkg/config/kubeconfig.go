@@ -0,0 +1,157 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultKubeconfigSuffix is appended to KubeGate context names to name the exported kubectl contexts
+const DefaultKubeconfigSuffix = "-via-gate"
+
+// kubeconfig holds the parts of a kubectl config file that export edits;
+// everything else is kept as read
+type kubeconfig struct {
+	APIVersion     string                 `yaml:"apiVersion"`
+	Kind           string                 `yaml:"kind"`
+	Clusters       []kubeconfigEntry      `yaml:"clusters"`
+	Contexts       []kubeconfigEntry      `yaml:"contexts"`
+	Users          []kubeconfigEntry      `yaml:"users"`
+	CurrentContext string                 `yaml:"current-context"`
+	Extra          map[string]interface{} `yaml:",inline"`
+}
+
+// kubeconfigEntry is a named cluster, context or user
+type kubeconfigEntry struct {
+	Name  string                 `yaml:"name"`
+	Extra map[string]interface{} `yaml:",inline"`
+}
+
+// KubeconfigPath returns the kubeconfig kubectl reads first: the first path
+// in $KUBECONFIG, or ~/.kube/config
+func KubeconfigPath() string {
+	for _, path := range filepath.SplitList(os.Getenv("KUBECONFIG")) {
+		if path != "" {
+			return path
+		}
+	}
+	return filepath.Join(os.Getenv("HOME"), ".kube", "config")
+}
+
+// proxyTokenFile returns the path of the bearer token required by `kubegate proxy`
+func proxyTokenFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".kubegate", "proxy-token")
+}
+
+// ProxyToken returns the bearer token that `kubegate proxy` requires and
+// exported kubeconfigs send, generating it on first use. With rotate a new
+// token replaces the current one.
+func ProxyToken(rotate bool) (string, error) {
+	path := proxyTokenFile()
+	if !rotate {
+		data, err := os.ReadFile(path)
+		if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			return strings.TrimSpace(string(data)), nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read proxy token: %v", err)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate proxy token: %v", err)
+	}
+	token := hex.EncodeToString(secret)
+	if err := writeFileAtomic(path, []byte(token+"\n")); err != nil {
+		return "", fmt.Errorf("failed to write proxy token: %v", err)
+	}
+	return token, nil
+}
+
+// ExportKubeconfig adds a cluster, context and user named <context><suffix>
+// to the kubeconfig at path for each context, pointing at the KubeGate proxy
+// serving proxyURL and authenticating with its token. Existing entries of the
+// same name are replaced and all other content is kept. It returns the names
+// of the exported kubectl contexts.
+func ExportKubeconfig(path string, contexts []Context, proxyURL, token, suffix string) ([]string, error) {
+	cfg := kubeconfig{APIVersion: "v1", Kind: "Config"}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read kubeconfig: %v", err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse kubeconfig %s: %v", path, err)
+		}
+	}
+
+	proxyURL = strings.TrimSuffix(proxyURL, "/")
+	var names []string
+	for _, ctx := range contexts {
+		name := ctx.Name + suffix
+		cfg.Clusters = setKubeconfigEntry(cfg.Clusters, name, "cluster", map[string]interface{}{
+			"server": proxyURL + "/" + url.PathEscape(ctx.Name),
+		})
+		cfg.Users = setKubeconfigEntry(cfg.Users, name, "user", map[string]interface{}{
+			"token": token,
+		})
+		cfg.Contexts = setKubeconfigEntry(cfg.Contexts, name, "context", map[string]interface{}{
+			"cluster": name,
+			"user":    name,
+		})
+		names = append(names, name)
+	}
+
+	out, err := yaml.Marshal(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode kubeconfig: %v", err)
+	}
+	if err := writeFileAtomic(path, out); err != nil {
+		return nil, fmt.Errorf("failed to write kubeconfig: %v", err)
+	}
+	return names, nil
+}
+
+// writeFileAtomic replaces the file at path with data, readable only by the
+// user, so that readers never see a partial file. A symlink at path is
+// followed, so the file it points to is replaced.
+func writeFileAtomic(path string, data []byte) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// setKubeconfigEntry replaces or appends the entry called name
+func setKubeconfigEntry(entries []kubeconfigEntry, name, key string, value map[string]interface{}) []kubeconfigEntry {
+	entry := kubeconfigEntry{Name: name, Extra: map[string]interface{}{key: value}}
+	for i := range entries {
+		if entries[i].Name == name {
+			entries[i] = entry
+			return entries
+		}
+	}
+	return append(entries, entry)
+}
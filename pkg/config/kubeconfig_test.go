@@ -0,0 +1,150 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestExportKubeconfigKeepsUnrelatedEntries(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	existing := `apiVersion: v1
+kind: Config
+current-context: kind
+preferences:
+  colors: true
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+    certificate-authority-data: Y2E=
+- name: prod-via-gate
+  cluster:
+    server: http://old
+users:
+- name: kind
+  user:
+    client-key-data: a2V5
+contexts:
+- name: kind
+  context:
+    cluster: kind
+    user: kind
+`
+	if err := os.WriteFile(path, []byte(existing), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := ExportKubeconfig(path, []Context{{Name: "prod"}, {Name: "dev"}}, "http://127.0.0.1:8001/", "secret-token", DefaultKubeconfigSuffix)
+	if err != nil {
+		t.Fatalf("ExportKubeconfig: %v", err)
+	}
+	if len(names) != 2 || names[0] != "prod-via-gate" || names[1] != "dev-via-gate" {
+		t.Errorf("names = %v, want [prod-via-gate dev-via-gate]", names)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg kubeconfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("exported kubeconfig does not parse: %v", err)
+	}
+	if cfg.CurrentContext != "kind" || cfg.Extra["preferences"] == nil {
+		t.Errorf("current-context %q and preferences %v were not kept", cfg.CurrentContext, cfg.Extra["preferences"])
+	}
+
+	// entry returns the field of the entry called name
+	entry := func(entries []kubeconfigEntry, name, key string) map[interface{}]interface{} {
+		for _, e := range entries {
+			if e.Name == name {
+				value, _ := e.Extra[key].(map[interface{}]interface{})
+				return value
+			}
+		}
+		return nil
+	}
+	if kind := entry(cfg.Clusters, "kind", "cluster"); kind["certificate-authority-data"] != "Y2E=" {
+		t.Errorf("cluster kind = %v, want it kept", kind)
+	}
+	if kind := entry(cfg.Users, "kind", "user"); kind["client-key-data"] != "a2V5" {
+		t.Errorf("user kind = %v, want it kept", kind)
+	}
+	if kind := entry(cfg.Contexts, "kind", "context"); kind["cluster"] != "kind" {
+		t.Errorf("context kind = %v, want it kept", kind)
+	}
+	if len(cfg.Clusters) != 3 || len(cfg.Users) != 3 || len(cfg.Contexts) != 3 {
+		t.Errorf("got %d clusters, %d users and %d contexts, want 3 of each", len(cfg.Clusters), len(cfg.Users), len(cfg.Contexts))
+	}
+	if prod := entry(cfg.Clusters, "prod-via-gate", "cluster"); prod["server"] != "http://127.0.0.1:8001/prod" {
+		t.Errorf("cluster prod-via-gate = %v, want it replaced", prod)
+	}
+	if prod := entry(cfg.Users, "prod-via-gate", "user"); prod["token"] != "secret-token" {
+		t.Errorf("user prod-via-gate = %v, want the proxy token", prod)
+	}
+
+	// The file is replaced in one step, readable only by the user
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the kubeconfig", len(entries))
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o600 {
+		t.Errorf("kubeconfig mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestExportKubeconfigFollowsSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "real-config")
+	if err := os.WriteFile(target, []byte("apiVersion: v1\nkind: Config\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "config")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+
+	if _, err := ExportKubeconfig(link, []Context{{Name: "prod"}}, "http://127.0.0.1:8001", "token", DefaultKubeconfigSuffix); err != nil {
+		t.Fatalf("ExportKubeconfig: %v", err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("kubeconfig symlink was replaced by a file")
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg kubeconfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil || len(cfg.Users) != 1 {
+		t.Errorf("symlink target was not updated: %q, %v", data, err)
+	}
+}
+
+func TestProxyToken(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	first, err := ProxyToken(false)
+	if err != nil || len(first) != 64 {
+		t.Fatalf("ProxyToken = %q, %v; want a new 64 character token", first, err)
+	}
+	if again, err := ProxyToken(false); err != nil || again != first {
+		t.Errorf("ProxyToken again = %q, %v; want the stored %q", again, err, first)
+	}
+	rotated, err := ProxyToken(true)
+	if err != nil || rotated == first {
+		t.Errorf("ProxyToken(rotate) = %q, %v; want a new token", rotated, err)
+	}
+	if info, err := os.Stat(proxyTokenFile()); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o600 {
+		t.Errorf("token file mode = %v, want 0600", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,226 @@
+// Package history keeps a local record of the commands run through KubeGate,
+// so they can be searched, inspected and replayed.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/redact"
+	"github.com/loaynaser3/KubeGate/pkg/utils"
+)
+
+// History defaults
+const (
+	DefaultMaxEntries    = 5000
+	DefaultResponseBytes = 1024
+)
+
+// Entry is a command run on one context
+type Entry struct {
+	ID            int       `json:"id"`
+	Time          time.Time `json:"time"`
+	Context       string    `json:"context"`
+	Argv          []string  `json:"argv"` // kubectl arguments, with secrets masked
+	CorrelationID string    `json:"correlationId,omitempty"`
+	ExitCode      int       `json:"exitCode"`
+	DurationMs    int64     `json:"durationMs,omitempty"`
+	Error         string    `json:"error,omitempty"` // Why no response was received, e.g. a timeout
+	Response      string    `json:"response,omitempty"`
+	Truncated     bool      `json:"truncated,omitempty"` // Response was cut to the configured size
+}
+
+// Command returns the kubectl command line of the entry
+func (e Entry) Command() string {
+	return strings.Join(e.Argv, " ")
+}
+
+// Redacted reports whether secrets were masked in the arguments, in which
+// case the entry cannot be replayed as recorded
+func (e Entry) Redacted() bool {
+	return strings.Contains(e.Command(), redact.Mask)
+}
+
+// Path returns the history file, one JSON entry per line
+func Path() string {
+	return filepath.Join(os.Getenv("HOME"), ".kubegate", "history.jsonl")
+}
+
+// Record appends entry with the next ID, after masking secrets and cutting
+// the response to the configured size. It does nothing when history is disabled.
+func Record(cfg config.HistoryConfig, entry Entry) error {
+	if cfg.Disabled {
+		return nil
+	}
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	responseBytes := cfg.ResponseBytes
+	if responseBytes == 0 {
+		responseBytes = DefaultResponseBytes
+	}
+
+	entry.Argv = redact.Args(entry.Argv)
+	entry.Error = redact.String(entry.Error)
+	entry.Response, entry.Truncated = truncate(redact.String(entry.Response), responseBytes)
+
+	path := Path()
+	unlock, err := utils.LockPath(path)
+	if err != nil {
+		return fmt.Errorf("failed to lock history: %v", err)
+	}
+	defer unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read history: %v", err)
+	}
+	entry.ID = lastID(data) + 1
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode history entry: %v", err)
+	}
+	line = append(line, '\n')
+
+	// Drop the oldest entries once the limit is reached; IDs are kept
+	if lines := bytes.Count(data, []byte("\n")); lines >= maxEntries {
+		for ; lines >= maxEntries; lines-- {
+			data = data[bytes.IndexByte(data, '\n')+1:]
+		}
+		return writeFile(path, append(data, line...))
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to write history: %v", err)
+	}
+	return nil
+}
+
+// Load returns all entries, oldest first. Unreadable lines are skipped.
+func Load() ([]Entry, error) {
+	file, err := os.Open(Path())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %v", err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %v", err)
+	}
+	return entries, nil
+}
+
+// Get returns the entry with id
+func Get(id int) (*Entry, error) {
+	entries, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i].ID == id {
+			return &entries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("history entry %d not found", id)
+}
+
+// Query selects entries; zero fields match everything
+type Query struct {
+	Text    string    // Substring of the command line
+	Context string    // Exact context name
+	Since   time.Time // Entries recorded at or after this time
+	Failed  bool      // Only commands that failed
+	Limit   int       // Keep only the newest Limit matches
+}
+
+// Search returns the entries matching q, oldest first
+func Search(entries []Entry, q Query) []Entry {
+	var matched []Entry
+	for _, entry := range entries {
+		switch {
+		case q.Text != "" && !strings.Contains(entry.Command(), q.Text):
+		case q.Context != "" && entry.Context != q.Context:
+		case !q.Since.IsZero() && entry.Time.Before(q.Since):
+		case q.Failed && entry.ExitCode == 0 && entry.Error == "":
+		default:
+			matched = append(matched, entry)
+		}
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[len(matched)-q.Limit:]
+	}
+	return matched
+}
+
+// lastID returns the ID of the last complete entry in data, or 0
+func lastID(data []byte) int {
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return 0
+	}
+	var entry Entry
+	if err := json.Unmarshal(data[bytes.LastIndexByte(data, '\n')+1:], &entry); err != nil {
+		return 0
+	}
+	return entry.ID
+}
+
+// truncate cuts s to at most n bytes on a character boundary; a negative n keeps nothing
+func truncate(s string, n int) (string, bool) {
+	if n < 0 {
+		return "", false
+	}
+	if len(s) <= n {
+		return s, false
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n], true
+}
+
+// writeFile atomically replaces the history file
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write history: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write history: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write history: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write history: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package history
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/redact"
+)
+
+func TestRecordAndLoad(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cfg := config.HistoryConfig{MaxEntries: 3, ResponseBytes: 8}
+
+	for i, argv := range [][]string{
+		{"get", "pods"},
+		{"delete", "pod", "web"},
+		{"create", "secret", "generic", "db", "--from-literal", "password=hunter2"},
+		{"get", "nodes", "--token", "abc123"},
+	} {
+		entry := Entry{Time: time.Now(), Context: "prod", Argv: argv, Response: "response number " + argv[0]}
+		if i == 1 {
+			entry.ExitCode = 1
+		}
+		if err := Record(cfg, entry); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	entries, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	// The oldest entry was dropped and IDs are kept
+	if len(entries) != 3 || entries[0].ID != 2 || entries[2].ID != 4 {
+		t.Fatalf("entries = %+v, want IDs 2 to 4", entries)
+	}
+	if entries[0].Response != "response" || !entries[0].Truncated {
+		t.Errorf("response = %q (truncated %v), want the first 8 bytes", entries[0].Response, entries[0].Truncated)
+	}
+	if got := entries[1].Command(); got != "create secret generic db --from-literal password="+redact.Mask || !entries[1].Redacted() {
+		t.Errorf("secret literal recorded as %q", got)
+	}
+	if got := entries[2].Command(); got != "get nodes --token "+redact.Mask {
+		t.Errorf("token recorded as %q", got)
+	}
+
+	entry, err := Get(3)
+	if err != nil || entry.Argv[0] != "create" {
+		t.Errorf("Get(3) = %+v, %v", entry, err)
+	}
+	if _, err := Get(1); err == nil {
+		t.Error("Get of a dropped entry succeeded, want an error")
+	}
+}
+
+func TestRecordDisabled(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	if err := Record(config.HistoryConfig{Disabled: true}, Entry{Argv: []string{"get", "pods"}}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	if _, err := os.Stat(Path()); !os.IsNotExist(err) {
+		t.Errorf("history file exists with history disabled: %v", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	now := time.Now()
+	entries := []Entry{
+		{ID: 1, Time: now.Add(-48 * time.Hour), Context: "prod", Argv: []string{"delete", "pod", "web"}},
+		{ID: 2, Time: now.Add(-time.Hour), Context: "dev", Argv: []string{"get", "pods"}},
+		{ID: 3, Time: now.Add(-time.Hour), Context: "prod", Argv: []string{"get", "pods"}, ExitCode: 1},
+		{ID: 4, Time: now, Context: "prod", Argv: []string{"get", "nodes"}, Error: "timeout"},
+	}
+	tests := []struct {
+		name  string
+		query Query
+		want  []int
+	}{
+		{"all", Query{}, []int{1, 2, 3, 4}},
+		{"text", Query{Text: "get pods"}, []int{2, 3}},
+		{"context", Query{Context: "prod"}, []int{1, 3, 4}},
+		{"since", Query{Since: now.Add(-24 * time.Hour)}, []int{2, 3, 4}},
+		{"failed", Query{Failed: true}, []int{3, 4}},
+		{"limit keeps the newest", Query{Context: "prod", Limit: 2}, []int{3, 4}},
+	}
+	for _, tt := range tests {
+		var got []int
+		for _, entry := range Search(entries, tt.query) {
+			got = append(got, entry.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got IDs %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
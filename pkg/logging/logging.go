@@ -53,6 +53,11 @@ func Initialize() {
 	}
 	Logger.SetLevel(level)
 
+	// Redaction is on by default; LOG_REDACT=false shows raw values when debugging
+	if os.Getenv("LOG_REDACT") == "false" {
+		Logger.ReplaceHooks(make(logrus.LevelHooks))
+	}
+
 	// Configure log format (JSON or Text)
 	useJSON := os.Getenv("LOG_FORMAT") == "json"
 	if useJSON {
@@ -0,0 +1,32 @@
+package logging
+
+import (
+	"github.com/loaynaser3/KubeGate/pkg/redact"
+	"github.com/sirupsen/logrus"
+)
+
+// redactionHook masks secrets in log messages and fields before they are written
+type redactionHook struct{}
+
+func init() {
+	Logger.AddHook(redactionHook{})
+}
+
+func (redactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactionHook) Fire(entry *logrus.Entry) error {
+	entry.Message = redact.String(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = redact.String(v)
+		case []string:
+			entry.Data[key] = redact.Args(v)
+		case error:
+			entry.Data[key] = redact.String(v.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// clientBuckets are the upper bounds of the client request latency histogram
+var clientBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// clientRequestDuration describes the end-to-end latency of client commands;
+// the context is a grouping label of the push rather than a metric label
+var clientRequestDuration = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "client", "request_duration_seconds"),
+	"End-to-end latency of commands sent by the client, by verb and result.",
+	[]string{"verb", "result"}, nil,
+)
+
+// ClientTotals accumulates client request latencies across invocations. Each
+// CLI process only sees its own commands, so the totals are kept in a file
+// and pushed as a whole, as a long-running process would push its histograms.
+type ClientTotals struct {
+	Series []ClientSeries `json:"series"`
+}
+
+// ClientSeries is the latency histogram of one context, verb and result
+type ClientSeries struct {
+	Context string   `json:"context"`
+	Verb    string   `json:"verb"`
+	Result  string   `json:"result"`
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"`
+	Buckets []uint64 `json:"buckets"` // Cumulative counts for each bound of clientBuckets
+}
+
+// LoadClientTotals reads totals saved by SaveClientTotals; a missing or
+// unreadable file starts new totals
+func LoadClientTotals(path string) *ClientTotals {
+	totals := &ClientTotals{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return totals
+	}
+	if err := json.Unmarshal(data, totals); err != nil {
+		return &ClientTotals{}
+	}
+	return totals
+}
+
+// SaveClientTotals writes totals through a temporary file, so readers never see a partial file
+func SaveClientTotals(path string, totals *ClientTotals) error {
+	data, err := json.Marshal(totals)
+	if err != nil {
+		return fmt.Errorf("failed to encode client metrics: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write client metrics: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Observe records the latency of a client command
+func (t *ClientTotals) Observe(context, verb, result string, duration time.Duration) {
+	series := t.series(context, verb, result)
+	seconds := duration.Seconds()
+	series.Count++
+	series.Sum += seconds
+	for i, bound := range clientBuckets {
+		if seconds <= bound {
+			series.Buckets[i]++
+		}
+	}
+}
+
+// series returns the series of a label set, adding it if needed
+func (t *ClientTotals) series(context, verb, result string) *ClientSeries {
+	for i := range t.Series {
+		s := &t.Series[i]
+		if s.Context == context && s.Verb == verb && s.Result == result && len(s.Buckets) == len(clientBuckets) {
+			return s
+		}
+	}
+	t.Series = append(t.Series, ClientSeries{Context: context, Verb: verb, Result: result, Buckets: make([]uint64, len(clientBuckets))})
+	return &t.Series[len(t.Series)-1]
+}
+
+// clientCollector exposes the totals of one context as histograms
+type clientCollector struct {
+	totals  *ClientTotals
+	context string
+}
+
+func (c clientCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientRequestDuration
+}
+
+func (c clientCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, series := range c.totals.Series {
+		if series.Context != c.context || len(series.Buckets) != len(clientBuckets) {
+			continue
+		}
+		buckets := make(map[float64]uint64, len(clientBuckets))
+		for i, bound := range clientBuckets {
+			buckets[bound] = series.Buckets[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(clientRequestDuration, series.Count, series.Sum, buckets, series.Verb, series.Result)
+	}
+}
+
+// PushClientMetrics replaces the metrics of context and instance on a
+// Prometheus Pushgateway with the totals of that context. Grouping by
+// instance keeps clients on different hosts from overwriting each other.
+func PushClientMetrics(url, context, instance string, totals *ClientTotals) error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(clientCollector{totals: totals, context: context}); err != nil {
+		return err
+	}
+	return push.New(url, "kubegate_client").
+		Gatherer(registry).
+		Grouping("context", context).
+		Grouping("instance", instance).
+		Push()
+}
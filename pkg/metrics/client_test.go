@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestClientTotalsObserve(t *testing.T) {
+	totals := &ClientTotals{}
+	totals.Observe("prod", "get", "success", 200*time.Millisecond)
+	totals.Observe("prod", "get", "success", 2*time.Second)
+	totals.Observe("prod", "get", "error", 50*time.Millisecond)
+	totals.Observe("staging", "get", "success", time.Second)
+
+	if len(totals.Series) != 3 {
+		t.Fatalf("got %d series, want 3", len(totals.Series))
+	}
+	series := totals.Series[0]
+	if series.Count != 2 || series.Sum != 2.2 {
+		t.Errorf("prod get success has count %d and sum %v, want 2 and 2.2", series.Count, series.Sum)
+	}
+	// Buckets are cumulative: 0.2s is counted from the 0.25 bound, 2s from the 2.5 bound
+	want := []uint64{0, 1, 1, 1, 2, 2, 2, 2, 2}
+	for i, count := range series.Buckets {
+		if count != want[i] {
+			t.Errorf("bucket le=%v = %d, want %d", clientBuckets[i], count, want[i])
+		}
+	}
+}
+
+func TestClientTotalsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if totals := LoadClientTotals(path); len(totals.Series) != 0 {
+		t.Fatalf("missing file loaded %+v, want empty totals", totals)
+	}
+
+	// Each run adds to the totals of the previous ones
+	for i := 0; i < 3; i++ {
+		totals := LoadClientTotals(path)
+		totals.Observe("prod", "get", "success", time.Second)
+		if err := SaveClientTotals(path, totals); err != nil {
+			t.Fatalf("SaveClientTotals: %v", err)
+		}
+	}
+	totals := LoadClientTotals(path)
+	if len(totals.Series) != 1 || totals.Series[0].Count != 3 {
+		t.Errorf("totals after three runs = %+v, want one series with count 3", totals.Series)
+	}
+}
+
+func TestPushClientMetrics(t *testing.T) {
+	var mu sync.Mutex
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		method, path, body = r.Method, r.URL.Path, string(data)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	totals := &ClientTotals{}
+	totals.Observe("prod", "get", "success", time.Second)
+	totals.Observe("staging", "delete", "error", time.Second)
+	if err := PushClientMetrics(gateway.URL, "prod", "alice@laptop", totals); err != nil {
+		t.Fatalf("PushClientMetrics: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// PUT replaces the group, which holds the cumulative totals of this instance
+	if method != http.MethodPut {
+		t.Errorf("pushed with %s, want PUT", method)
+	}
+	if !strings.HasPrefix(path, "/metrics/job/kubegate_client/") || !strings.Contains(path, "/context/prod") || !strings.Contains(path, "/instance/alice@laptop") {
+		t.Errorf("pushed to %s, want the group of job kubegate_client, context prod and instance alice@laptop", path)
+	}
+	if !strings.Contains(body, "kubegate_client_request_duration_seconds") {
+		t.Errorf("pushed body does not contain the latency histogram")
+	}
+	if strings.Contains(body, "staging") {
+		t.Errorf("pushed body contains the series of another context")
+	}
+}
+
+func TestClientCollector(t *testing.T) {
+	totals := &ClientTotals{}
+	totals.Observe("prod", "get", "success", time.Second)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(clientCollector{totals: totals, context: "prod"})
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	var out strings.Builder
+	for _, family := range families {
+		expfmt.MetricFamilyToText(&out, family)
+	}
+	for _, line := range []string{
+		`kubegate_client_request_duration_seconds_bucket{result="success",verb="get",le="0.5"} 0`,
+		`kubegate_client_request_duration_seconds_bucket{result="success",verb="get",le="1"} 1`,
+		`kubegate_client_request_duration_seconds_count{result="success",verb="get"} 1`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("exposition does not contain %s:\n%s", line, out.String())
+		}
+	}
+}
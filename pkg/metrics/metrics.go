@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "kubegate"
+
+// Registry holds the agent metrics served on /metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// CommandsTotal counts commands handled by the agent by kubectl verb and result
+	CommandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "commands_total",
+		Help:      "Commands handled by the agent, by kubectl verb and result.",
+	}, []string{"verb", "result"})
+
+	// CommandDuration observes kubectl execution latency
+	CommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "command_duration_seconds",
+		Help:      "Time spent executing kubectl commands, by verb.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"verb"})
+
+	// CommandsInFlight is the number of commands currently being handled
+	CommandsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "commands_in_flight",
+		Help:      "Commands currently being handled by the agent.",
+	})
+
+	// QueueReceiveLag observes the time between a message being sent and received
+	QueueReceiveLag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "queue",
+		Name:      "receive_lag_seconds",
+		Help:      "Time between a message being published and consumed, by backend.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"backend"})
+
+	// PublishFailures counts messages that could not be published
+	PublishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "queue",
+		Name:      "publish_failures_total",
+		Help:      "Messages that failed to publish, by backend and operation.",
+	}, []string{"backend", "operation"})
+
+	// BrokerReconnects counts successful reconnections to the broker
+	BrokerReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "queue",
+		Name:      "broker_reconnects_total",
+		Help:      "Reconnections to the message broker, by backend.",
+	}, []string{"backend"})
+)
+
+func init() {
+	Registry.MustRegister(
+		CommandsTotal,
+		CommandDuration,
+		CommandsInFlight,
+		QueueReceiveLag,
+		PublishFailures,
+		BrokerReconnects,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the agent metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Verb returns a bounded label value for a kubectl verb, so arbitrary input
+// cannot blow up metric cardinality. Take the verb from
+// protocol.ParseCommandLine, as global flags may precede it.
+func Verb(verb string) string {
+	if knownVerbs[verb] {
+		return verb
+	}
+	return "other"
+}
+
+var knownVerbs = map[string]bool{
+	"annotate": true, "api-resources": true, "api-versions": true, "apply": true,
+	"auth": true, "autoscale": true, "certificate": true, "cluster-info": true,
+	"cordon": true, "cp": true, "create": true, "debug": true, "delete": true,
+	"describe": true, "diff": true, "drain": true, "edit": true, "events": true,
+	"exec": true, "explain": true, "expose": true, "get": true, "label": true,
+	"logs": true, "patch": true, "port-forward": true, "replace": true,
+	"rollout": true, "run": true, "scale": true, "set": true, "taint": true,
+	"top": true, "uncordon": true, "version": true, "wait": true,
+}
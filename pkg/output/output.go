@@ -0,0 +1,148 @@
+// Package output post-processes kubectl responses on the client: jq and
+// JSONPath filters applied to JSON output, and writing results to a terminal,
+// pipe or file.
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/itchyny/gojq"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// Filter turns a JSON response into the text to print
+type Filter func(response string) (string, error)
+
+// Compile returns the filter for a jq expression or a JSONPath template as
+// kubectl evaluates it, or nil when neither is given. With raw, jq prints
+// strings without quotes, like `jq -r`; JSONPath always does.
+func Compile(jq, jsonPath string, raw bool) (Filter, error) {
+	switch {
+	case jq != "" && jsonPath != "":
+		return nil, fmt.Errorf("--jq and --jsonpath cannot be used together")
+	case jq != "":
+		return compileJQ(jq, raw)
+	case jsonPath != "":
+		return compileJSONPath(jsonPath)
+	}
+	return nil, nil
+}
+
+// compileJSONPath parses a template with the JSONPath implementation of
+// kubectl, which also accepts a bare path such as `.metadata.name`
+func compileJSONPath(template string) (Filter, error) {
+	if !strings.Contains(template, "{") {
+		template = "{" + template + "}"
+	}
+	parser := jsonpath.New("jsonpath").AllowMissingKeys(true)
+	if err := parser.Parse(template); err != nil {
+		return nil, fmt.Errorf("invalid --jsonpath: %v", err)
+	}
+
+	return func(response string) (string, error) {
+		data, err := decodeJSON(response)
+		if err != nil {
+			return "", err
+		}
+		var out bytes.Buffer
+		data = integers(data)
+		if err := parser.Execute(&out, data); err != nil {
+			return "", fmt.Errorf("jsonpath: %v", err)
+		}
+		return out.String(), nil
+	}, nil
+}
+
+// compileJQ compiles a jq expression into a filter printing one result per line
+func compileJQ(expr string, raw bool) (Filter, error) {
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --jq: %v", err)
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --jq: %v", err)
+	}
+
+	return func(response string) (string, error) {
+		data, err := decodeJSON(response)
+		if err != nil {
+			return "", err
+		}
+		var out strings.Builder
+		iter := code.Run(data)
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := v.(error); ok {
+				return "", fmt.Errorf("jq: %v", err)
+			}
+			if s, ok := v.(string); ok && raw {
+				out.WriteString(s)
+			} else {
+				encoded, err := encodeJSON(v, "  ")
+				if err != nil {
+					return "", err
+				}
+				out.WriteString(encoded)
+			}
+			out.WriteByte('\n')
+		}
+		return out.String(), nil
+	}, nil
+}
+
+// decodeJSON parses a response into the generic values jq and JSONPath work on
+func decodeJSON(response string) (interface{}, error) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(response), &data); err != nil {
+		return nil, fmt.Errorf("response is not JSON: %v", err)
+	}
+	return data, nil
+}
+
+// integers turns whole numbers into int64, as Kubernetes decodes them, so that
+// JSONPath filters such as [?(@.status.restarts>0)] can compare them
+func integers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = integers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = integers(value)
+		}
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return int64(v)
+		}
+	}
+	return v
+}
+
+// encodeJSON renders v without escaping HTML characters, indented when indent is set
+func encodeJSON(v interface{}, indent string) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	if err := encoder.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// IsTerminal reports whether f is an interactive terminal, where banners
+// are shown; pipes and files get the output alone
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,104 @@
+package output
+
+import "testing"
+
+const podList = `{
+  "kind": "PodList",
+  "items": [
+    {"metadata": {"name": "web-1", "labels": {"app": "web"}}, "status": {"phase": "Running", "restarts": 0}},
+    {"metadata": {"name": "web-2", "labels": {"app": "web"}}, "status": {"phase": "Pending", "restarts": 3}},
+    {"metadata": {"name": "db-1"}, "status": {"phase": "Running", "restarts": 1}}
+  ]
+}`
+
+func TestJSONPath(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{`{.kind}`, "PodList"},
+		{`.kind`, "PodList"},
+		{`{.items[*].metadata.name}`, "web-1 web-2 db-1"},
+		{`{.items[0].metadata.name}`, "web-1"},
+		{`{.items[-1].metadata.name}`, "db-1"},
+		{`{.items[1:].metadata.name}`, "web-2 db-1"},
+		{`{.items[?(@.status.phase=="Running")].metadata.name}`, "web-1 db-1"},
+		{`{.items[?(@.status.restarts>0)].metadata.name}`, "web-2 db-1"},
+		{`{.items[?(@.metadata.labels)].metadata.name}`, "web-1 web-2"},
+		{`{..phase}`, "Running Pending Running"},
+		{`{.items[0].metadata['name']}`, "web-1"},
+		{`{.items[0].metadata.labels}`, `{"app":"web"}`},
+		{`{.items[0].missing}`, ""},
+		{`{range .items[*]}{.metadata.name}{"\t"}{.status.phase}{"\n"}{end}`, "web-1\tRunning\nweb-2\tPending\ndb-1\tRunning\n"},
+		{`{range .items[*]}{.metadata.name},{end}`, "web-1,web-2,db-1,"},
+		{`name={.items[2].metadata.name}`, "name=db-1"},
+	}
+	for _, tt := range tests {
+		filter, err := Compile("", tt.template, false)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.template, err)
+			continue
+		}
+		got, err := filter(podList)
+		if err != nil {
+			t.Errorf("%q: %v", tt.template, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestJSONPathErrors(t *testing.T) {
+	for _, template := range []string{`{.items`, `{.items[x]}`, `{.items[?(@.status.phase==)]}`} {
+		if _, err := Compile("", template, false); err == nil {
+			t.Errorf("Compile(%q) succeeded, want an error", template)
+		}
+	}
+}
+
+func TestJQ(t *testing.T) {
+	tests := []struct {
+		expr string
+		raw  bool
+		want string
+	}{
+		{`.items[].metadata.name`, false, "\"web-1\"\n\"web-2\"\n\"db-1\"\n"},
+		{`.items[].metadata.name`, true, "web-1\nweb-2\ndb-1\n"},
+		{`[.items[] | select(.status.restarts > 0) | .metadata.name]`, false, "[\n  \"web-2\",\n  \"db-1\"\n]\n"},
+		{`.items | length`, false, "3\n"},
+	}
+	for _, tt := range tests {
+		filter, err := Compile(tt.expr, "", tt.raw)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.expr, err)
+			continue
+		}
+		got, err := filter(podList)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	if filter, err := Compile("", "", false); filter != nil || err != nil {
+		t.Errorf("Compile without filters = %v, %v, want nil", filter, err)
+	}
+	if _, err := Compile(".kind", "{.kind}", false); err == nil {
+		t.Error("Compile with --jq and --jsonpath succeeded, want an error")
+	}
+	if _, err := Compile(".items[", "", false); err == nil {
+		t.Error("Compile with an invalid jq expression succeeded, want an error")
+	}
+
+	filter, _ := Compile(".kind", "", false)
+	if _, err := filter("pod/web created"); err == nil {
+		t.Error("filtering a non-JSON response succeeded, want an error")
+	}
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"strings"
+)
+
+// kubectlValueFlags are the kubectl flags, global or shared by many commands,
+// that take their value as the next argument, e.g. `-n kube-system`. Short
+// forms map to the long name they are recorded under.
+var kubectlValueFlags = map[string]string{
+	"--as": "as", "--as-group": "as-group", "--as-uid": "as-uid",
+	"--cache-dir": "cache-dir", "--certificate-authority": "certificate-authority",
+	"--client-certificate": "client-certificate", "--client-key": "client-key",
+	"--cluster": "cluster", "--context": "context", "--kubeconfig": "kubeconfig",
+	"-n": "namespace", "--namespace": "namespace", "--password": "password",
+	"--profile": "profile", "--profile-output": "profile-output",
+	"--request-timeout": "request-timeout", "-s": "server", "--server": "server",
+	"--tls-server-name": "tls-server-name", "--token": "token", "--user": "user",
+	"--username": "username", "-v": "v", "--v": "v", "--vmodule": "vmodule",
+	"--log-file": "log-file", "--log-dir": "log-dir",
+	"-o": "output", "--output": "output", "-l": "selector", "--selector": "selector",
+	"-f": "filename", "--filename": "filename", "-k": "kustomize", "--kustomize": "kustomize",
+	"--field-selector": "field-selector", "--template": "template",
+	"-L": "label-columns", "--label-columns": "label-columns", "--sort-by": "sort-by",
+	"-c": "container", "--container": "container", "--raw": "raw", "--type": "type",
+	"--for": "for", "--timeout": "timeout", "--grace-period": "grace-period",
+	"--cascade": "cascade", "--field-manager": "field-manager", "--subresource": "subresource",
+	"-p": "patch", "--patch": "patch", "--patch-file": "patch-file",
+	"--replicas": "replicas", "--image": "image", "--port": "port", "--chunk-size": "chunk-size",
+}
+
+// CommandLine is a kubectl command split into its verb, positional words
+// and flags, wherever the flags appear
+type CommandLine struct {
+	Verb  string
+	At    int                 // Index of the verb in the arguments, -1 without one
+	Words []string            // Positional arguments after the verb, e.g. resources and names
+	Flags map[string][]string // Values by long flag name without dashes; "" for flags without one
+	Rest  []string            // Arguments after --, such as the command run by exec
+}
+
+// ParseCommandLine splits args, which may start with global flags
+// (`-n prod delete ns foo`), into a CommandLine
+func ParseCommandLine(args []string) CommandLine {
+	cmd := CommandLine{At: -1, Flags: map[string][]string{}}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			cmd.Rest = args[i+1:]
+			return cmd
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := strings.Cut(arg, "=")
+			long, takesValue := kubectlValueFlags[name]
+			if !takesValue {
+				long = strings.TrimPrefix(name, "--")
+			} else if !hasValue && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			cmd.Flags[long] = append(cmd.Flags[long], value)
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// Short flags take their value attached (-oyaml, -n=prod) or next
+			name, value := arg[:2], strings.TrimPrefix(arg[2:], "=")
+			long, takesValue := kubectlValueFlags[name]
+			if !takesValue {
+				long = strings.TrimPrefix(name, "-")
+			} else if value == "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			cmd.Flags[long] = append(cmd.Flags[long], value)
+		case cmd.Verb == "":
+			cmd.Verb, cmd.At = arg, i
+		default:
+			cmd.Words = append(cmd.Words, arg)
+		}
+	}
+	return cmd
+}
+
+// Flag returns the last value of a flag and whether it was given
+func (c CommandLine) Flag(name string) (string, bool) {
+	values, ok := c.Flags[name]
+	if !ok {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
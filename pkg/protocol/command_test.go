@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	tests := []struct {
+		args  []string
+		verb  string
+		words []string
+		flags map[string][]string
+	}{
+		{[]string{"get", "pods"}, "get", []string{"pods"}, map[string][]string{}},
+		{
+			[]string{"-n", "prod", "--context=dev", "delete", "ns", "foo"},
+			"delete", []string{"ns", "foo"},
+			map[string][]string{"namespace": {"prod"}, "context": {"dev"}},
+		},
+		{
+			[]string{"get", "secret", "-oyaml", "-n=kube-system", "--watch"},
+			"get", []string{"secret"},
+			map[string][]string{"output": {"yaml"}, "namespace": {"kube-system"}, "watch": {""}},
+		},
+		{
+			[]string{"delete", "-f", "a.yaml", "--filename", "b.yaml"},
+			"delete", nil,
+			map[string][]string{"filename": {"a.yaml", "b.yaml"}},
+		},
+		{
+			[]string{"exec", "web", "-c", "app", "--", "rm", "-rf", "/"},
+			"exec", []string{"web"},
+			map[string][]string{"container": {"app"}},
+		},
+	}
+	for _, tt := range tests {
+		cmd := ParseCommandLine(tt.args)
+		if cmd.Verb != tt.verb || !reflect.DeepEqual(cmd.Words, tt.words) || !reflect.DeepEqual(cmd.Flags, tt.flags) {
+			t.Errorf("ParseCommandLine(%q) = %q %q %v, want %q %q %v", tt.args, cmd.Verb, cmd.Words, cmd.Flags, tt.verb, tt.words, tt.flags)
+		}
+	}
+}
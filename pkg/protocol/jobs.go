@@ -0,0 +1,51 @@
+package protocol
+
+import "time"
+
+// JobVerb is the pseudo-command querying jobs: __job status|logs|cancel <id>,
+// and __job approve|deny <id> for commands waiting for approval. It is
+// answered by the agent itself, without kubectl.
+const JobVerb = "__job"
+
+// Job queries
+const (
+	JobStatus  = "status"
+	JobLogs    = "logs"
+	JobCancel  = "cancel"
+	JobApprove = "approve"
+	JobDeny    = "deny"
+)
+
+// JobState is the lifecycle state of a job
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+	// Commands matching an approval rule wait for an approver, who either
+	// runs or denies them, until they expire
+	JobPendingApproval JobState = "pending-approval"
+	JobDenied          JobState = "denied"
+	JobExpired         JobState = "expired"
+)
+
+// Job describes a command run asynchronously by an agent
+type Job struct {
+	ID          string    `json:"id"`
+	Command     string    `json:"command"` // Redacted command line
+	State       JobState  `json:"state"`
+	ExitCode    int       `json:"exitCode"`
+	Agent       string    `json:"agent"`              // ID of the agent running the job
+	Client      string    `json:"client,omitempty"`   // Sender as authenticated by the broker
+	Approver    string    `json:"approver,omitempty"` // Identity that approved or denied the command
+	SubmittedAt time.Time `json:"submittedAt"`
+	FinishedAt  time.Time `json:"finishedAt,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// Done reports whether the job has finished
+func (j *Job) Done() bool {
+	return j.State != JobRunning && j.State != JobPendingApproval
+}
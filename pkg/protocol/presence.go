@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+)
+
+const (
+	// DefaultHeartbeatInterval is how often agents announce themselves
+	DefaultHeartbeatInterval = 15 * time.Second
+
+	// heartbeatLifetime is how many intervals a heartbeat stays valid
+	heartbeatLifetime = 3
+
+	// presenceLookback is how far back the presence log is read when listing
+	// agents; agents with heartbeat intervals above a third of it show up
+	// only intermittently
+	presenceLookback = 15 * time.Minute
+)
+
+// ErrPresenceUnsupported is returned when listing agents on a backend
+// without presence logs, such as SQS
+var ErrPresenceUnsupported = errors.New("agent presence is not supported on this backend")
+
+// Heartbeat is periodically published by each agent to its presence log
+type Heartbeat struct {
+	AgentID      string        `json:"agent_id"`
+	Cluster      string        `json:"cluster"`
+	Version      string        `json:"version"`
+	Capabilities []string      `json:"capabilities"`
+	Load         int64         `json:"load"` // Commands currently in flight
+	Queues       []string      `json:"queues"`
+	Interval     time.Duration `json:"interval"`
+	Timestamp    time.Time     `json:"timestamp"`
+}
+
+// Alive reports whether the heartbeat is recent enough for the agent to be considered up
+func (h Heartbeat) Alive(now time.Time) bool {
+	interval := h.Interval
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	return now.Sub(h.Timestamp) < heartbeatLifetime*interval
+}
+
+// PresenceLog returns the well-known log that agents serving commandQueue
+// append heartbeats to. Reading a log does not consume it, so any number of
+// clients can list agents at the same time.
+func PresenceLog(commandQueue string) string {
+	return commandQueue + ".presence-log"
+}
+
+// ListAgents returns the most recent live heartbeat of every agent serving
+// commandQueue. It returns an error if the backend does not support presence.
+func ListAgents(mq queue.MessageQueue, commandQueue string) ([]Heartbeat, error) {
+	now := time.Now()
+	latest := map[string]Heartbeat{}
+	err := readHeartbeats(mq, commandQueue, func(heartbeat Heartbeat) bool {
+		if !heartbeat.Alive(now) {
+			return true
+		}
+		if prev, seen := latest[heartbeat.AgentID]; !seen || heartbeat.Timestamp.After(prev.Timestamp) {
+			latest[heartbeat.AgentID] = heartbeat
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	agents := make([]Heartbeat, 0, len(latest))
+	for _, heartbeat := range latest {
+		agents = append(agents, heartbeat)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].Cluster != agents[j].Cluster {
+			return agents[i].Cluster < agents[j].Cluster
+		}
+		return agents[i].AgentID < agents[j].AgentID
+	})
+	return agents, nil
+}
+
+// AgentAlive reports whether any agent serving commandQueue has a live
+// heartbeat, reading the presence log only until it finds one
+func AgentAlive(mq queue.MessageQueue, commandQueue string) (bool, error) {
+	now := time.Now()
+	alive := false
+	err := readHeartbeats(mq, commandQueue, func(heartbeat Heartbeat) bool {
+		alive = heartbeat.Alive(now)
+		return !alive
+	})
+	return alive, err
+}
+
+// readHeartbeats visits the heartbeats of the presence log within presenceLookback
+func readHeartbeats(mq queue.MessageQueue, commandQueue string, visit func(Heartbeat) bool) error {
+	reader, ok := queue.Unwrap(mq).(queue.LogReader)
+	if !ok {
+		return ErrPresenceUnsupported
+	}
+
+	err := reader.ReadLog(PresenceLog(commandQueue), time.Now().Add(-presenceLookback), func(msg queue.Message) bool {
+		var heartbeat Heartbeat
+		if err := json.Unmarshal([]byte(msg.Body), &heartbeat); err != nil {
+			logging.Logger.WithError(err).Debug("Skipping malformed heartbeat")
+			return true
+		}
+		return visit(heartbeat)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read presence log: %w", err)
+	}
+	return nil
+}
+
+// SupportsPresence reports whether the backend behind mq can list agent heartbeats
+func SupportsPresence(mq queue.MessageQueue) bool {
+	_, ok := queue.Unwrap(mq).(queue.LogReader)
+	return ok
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"strings"
+	"time"
+)
+
+// Preview methods
+const (
+	PreviewDiff   = "diff"           // kubectl diff, for apply
+	PreviewDryRun = "server-dry-run" // The command with --dry-run=server
+)
+
+// DefaultPreviewVerbs are the mutating verbs previewed before they run
+var DefaultPreviewVerbs = []string{
+	"annotate", "apply", "autoscale", "cordon", "create", "delete", "drain",
+	"expose", "label", "patch", "replace", "rollout", "scale", "set", "taint",
+	"uncordon",
+}
+
+// readOnlyRollout lists the rollout subcommands that change nothing
+var readOnlyRollout = map[string]bool{"history": true, "status": true}
+
+// Preview is the agent's answer to a preview request
+type Preview struct {
+	Method    string    `json:"method"`   // PreviewDiff or PreviewDryRun
+	Output    string    `json:"output"`   // What the command would change
+	ExitCode  int       `json:"exitCode"` // Non-zero when the preview itself failed
+	Token     string    `json:"token"`    // Lets the same command run until ExpiresAt
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// IsMutating reports whether args run a verb in verbs, or in
+// DefaultPreviewVerbs when verbs is nil. Global flags before the verb, as in
+// `-n prod delete pod web`, are skipped.
+func IsMutating(args []string, verbs []string) bool {
+	cmd := ParseCommandLine(args)
+	if cmd.Verb == "" {
+		return false
+	}
+	if verbs == nil {
+		verbs = DefaultPreviewVerbs
+	}
+	for _, verb := range verbs {
+		if strings.TrimSpace(verb) != cmd.Verb {
+			continue
+		}
+		return cmd.Verb != "rollout" || len(cmd.Words) == 0 || !readOnlyRollout[cmd.Words[0]]
+	}
+	return false
+}
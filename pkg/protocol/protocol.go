@@ -0,0 +1,53 @@
+// Package protocol defines the messages exchanged by KubeGate clients and
+// agents: headers, statuses, pseudo-commands and the payloads they carry. It
+// is imported by both sides, so clients do not depend on the agent.
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// Headers of commands and their responses
+const (
+	HeaderClientID       = "X-Client-ID"
+	HeaderStatus         = "X-Status"          // Why the agent refused or parked the command, e.g. StatusRateLimited
+	HeaderRetryAfter     = "X-Retry-After"     // Milliseconds until the client may retry
+	HeaderExitCode       = "X-Exit-Code"       // Exit status of a failed command
+	HeaderIdempotencyKey = "X-Idempotency-Key" // Identifies retries of a request; defaults to the correlation ID
+	HeaderAsync          = "X-Async"           // "true" asks for the command's Job at once, its ID being the correlation ID
+	HeaderPreview        = "X-Preview"         // "true" asks for a Preview instead of running the command
+	HeaderPreviewToken   = "X-Preview-Token"   // Token of a preview of the same command, allowing it to run
+	HeaderStream         = "X-Stream"          // "true" asks for the output in parts, as the command writes it
+	HeaderSequence       = "X-Sequence"        // Position of a part (queue.HeaderPartial); on the final response, the number of parts
+)
+
+// Values of HeaderStatus
+const (
+	// StatusRateLimited marks a response to a command refused by a rate limit
+	StatusRateLimited = "rate-limited"
+	// StatusJobNotFound marks the response to a query for an unknown or expired job
+	StatusJobNotFound = "job-not-found"
+	// StatusPreviewRequired marks the refusal of a mutating command sent
+	// without a valid preview token to an agent that requires previews
+	StatusPreviewRequired = "preview-required"
+	// StatusApprovalPending marks the response to a command parked until an
+	// approver runs or denies it; the body is the command's Job
+	StatusApprovalPending = "approval-pending"
+)
+
+// CompleteVerb is the hidden kubectl command that prints shell completions;
+// the agent runs it like any other command
+const CompleteVerb = "__complete"
+
+// SessionDuration is how long a client reuses its reply queue
+const SessionDuration = time.Hour
+
+// ExitError reports a command that exited with a non-zero status
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
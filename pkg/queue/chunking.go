@@ -0,0 +1,333 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// HeaderChunkIndex is the zero-based position of a chunk within a split message
+	HeaderChunkIndex = "X-Chunk-Index"
+	// HeaderChunkTotal is the number of chunks a message was split into
+	HeaderChunkTotal = "X-Chunk-Total"
+	// HeaderChunkChecksum is the hex SHA-256 of the complete, reassembled body
+	HeaderChunkChecksum = "X-Chunk-Checksum"
+
+	// DefaultMaxMessageSize keeps bodies comfortably below the SQS limit of 256 KiB
+	DefaultMaxMessageSize = 192 * 1024
+
+	// DefaultMaxPendingMessages and DefaultMaxPendingBytes bound the incomplete
+	// messages a receiver buffers; the oldest are dropped to stay within them
+	DefaultMaxPendingMessages = 256
+	DefaultMaxPendingBytes    = 64 << 20
+
+	// chunkBufferTTL bounds how long an incomplete message is kept before it is dropped
+	chunkBufferTTL = 5 * time.Minute
+)
+
+// ChunkedQueue wraps a MessageQueue and splits bodies larger than MaxSize into
+// ordered chunks. The receiving side reassembles chunks by correlation ID,
+// tolerating out-of-order and duplicate deliveries, and verifies the checksum
+// before handing the complete message to the handler.
+type ChunkedQueue struct {
+	MessageQueue
+	MaxSize         int // Maximum body size in bytes of a single message
+	MaxPending      int // Maximum number of messages being reassembled
+	MaxPendingBytes int // Maximum size in bytes of the chunks being reassembled
+
+	mu       sync.Mutex
+	pending  map[string]*chunkBuffer // correlation ID -> chunks received so far
+	buffered int                     // Bytes of the chunks in pending
+}
+
+// chunkBuffer collects the chunks of a single message
+type chunkBuffer struct {
+	chunks   map[int]string
+	total    int
+	checksum string
+	headers  map[string]string
+	replyTo  string
+	started  time.Time
+	size     int // Bytes of the chunks received
+}
+
+// WithChunking wraps mq with transparent message splitting and reassembly
+func WithChunking(mq MessageQueue, maxSize int) *ChunkedQueue {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	return &ChunkedQueue{
+		MessageQueue:    mq,
+		MaxSize:         maxSize,
+		MaxPending:      DefaultMaxPendingMessages,
+		MaxPendingBytes: DefaultMaxPendingBytes,
+		pending:         map[string]*chunkBuffer{},
+	}
+}
+
+// Unwrap returns the wrapped MessageQueue
+func (c *ChunkedQueue) Unwrap() MessageQueue {
+	return c.MessageQueue
+}
+
+// SendMessage sends the command, splitting it into chunks when it exceeds MaxSize
+func (c *ChunkedQueue) SendMessage(queueName, message, correlationID, replyTo string, headers map[string]string) error {
+	return c.sendChunks(message, headers, func(body string, h map[string]string) error {
+		return c.MessageQueue.SendMessage(queueName, body, correlationID, replyTo, h)
+	})
+}
+
+// PublishResponse publishes the response, splitting it into chunks when it exceeds MaxSize
+func (c *ChunkedQueue) PublishResponse(replyTo, correlationID, response string, headers map[string]string) error {
+	return c.sendChunks(response, headers, func(body string, h map[string]string) error {
+		return c.MessageQueue.PublishResponse(replyTo, correlationID, body, h)
+	})
+}
+
+// ReceiveMessages reassembles chunked messages before invoking the handler
+func (c *ChunkedQueue) ReceiveMessages(queueName string, handler func(Message) error) error {
+	return c.MessageQueue.ReceiveMessages(queueName, c.reassemble(handler))
+}
+
+// ConsumeReplies consumes direct replies from the backend, reassembling chunks
+func (c *ChunkedQueue) ConsumeReplies(handler func(Message) error) (string, error) {
+	consumer, ok := c.MessageQueue.(ReplyConsumer)
+	if !ok {
+		return "", ErrRepliesUnsupported
+	}
+	return consumer.ConsumeReplies(c.reassemble(handler))
+}
+
+// reassemble wraps handler so it is only called with complete messages.
+// Invalid chunks and corrupted chunk sets are logged and dropped, as a
+// redelivery cannot repair them. When the handler fails, the other chunks are
+// kept so the redelivered last chunk completes the message again.
+func (c *ChunkedQueue) reassemble(handler func(Message) error) func(Message) error {
+	return func(msg Message) error {
+		complete, ok, err := c.addChunk(msg)
+		if err != nil {
+			logging.Logger.WithFields(logrus.Fields{
+				"correlation": msg.CorrelationID,
+				"error":       err.Error(),
+			}).Error("Dropping chunked message")
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		err = handler(complete)
+		if _, chunked := msg.Headers[HeaderChunkTotal]; chunked {
+			c.handled(msg, err)
+		}
+		return err
+	}
+}
+
+// sendChunks invokes send once per chunk of body
+func (c *ChunkedQueue) sendChunks(body string, headers map[string]string, send func(string, map[string]string) error) error {
+	if len(body) <= c.MaxSize {
+		return send(body, headers)
+	}
+
+	chunks := splitChunks(body, c.MaxSize)
+	sum := sha256.Sum256([]byte(body))
+	checksum := hex.EncodeToString(sum[:])
+
+	for i, chunk := range chunks {
+		h := copyHeaders(headers)
+		h[HeaderChunkIndex] = strconv.Itoa(i)
+		h[HeaderChunkTotal] = strconv.Itoa(len(chunks))
+		h[HeaderChunkChecksum] = checksum
+		if err := send(chunk, h); err != nil {
+			return fmt.Errorf("failed to send chunk %d/%d: %w", i+1, len(chunks), err)
+		}
+	}
+
+	logging.Logger.WithFields(logrus.Fields{
+		"chunks": len(chunks),
+		"size":   len(body),
+	}).Info("Message split into chunks")
+	return nil
+}
+
+// addChunk records msg and returns the reassembled message once every chunk
+// has arrived; the chunks are kept until handled is called. Messages that are
+// not chunked are returned unchanged.
+func (c *ChunkedQueue) addChunk(msg Message) (Message, bool, error) {
+	totalHeader, chunked := msg.Headers[HeaderChunkTotal]
+	if !chunked {
+		return msg, true, nil
+	}
+
+	total, err := strconv.Atoi(totalHeader)
+	if err != nil || total <= 0 {
+		return Message{}, false, fmt.Errorf("invalid chunk total %q", totalHeader)
+	}
+	index, err := strconv.Atoi(msg.Headers[HeaderChunkIndex])
+	if err != nil || index < 0 || index >= total {
+		return Message{}, false, fmt.Errorf("invalid chunk index %q of %d", msg.Headers[HeaderChunkIndex], total)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictStale()
+
+	key := chunkKey(msg)
+	buf, ok := c.pending[key]
+	if !ok {
+		for len(c.pending) > 0 && len(c.pending) >= c.MaxPending {
+			c.evictOldest(key)
+		}
+		buf = &chunkBuffer{
+			chunks:   map[int]string{},
+			total:    total,
+			checksum: msg.Headers[HeaderChunkChecksum],
+			started:  time.Now(),
+		}
+		c.pending[key] = buf
+	}
+	if _, duplicate := buf.chunks[index]; duplicate {
+		logging.Logger.WithFields(logrus.Fields{
+			"correlation": msg.CorrelationID,
+			"chunk":       index,
+		}).Debug("Ignoring duplicate chunk")
+		return Message{}, false, nil
+	}
+	buf.chunks[index] = msg.Body
+	buf.size += len(msg.Body)
+	c.buffered += len(msg.Body)
+	for c.buffered > c.MaxPendingBytes {
+		if !c.evictOldest(key) {
+			c.drop(key, "Dropping chunked message larger than the reassembly buffer")
+			return Message{}, false, fmt.Errorf("chunked message %s exceeds %d buffered bytes", msg.CorrelationID, c.MaxPendingBytes)
+		}
+	}
+	if index == 0 {
+		buf.headers = msg.Headers
+		buf.replyTo = msg.ReplyTo
+	}
+	if len(buf.chunks) < buf.total {
+		return Message{}, false, nil
+	}
+
+	var body strings.Builder
+	for i := 0; i < buf.total; i++ {
+		body.WriteString(buf.chunks[i])
+	}
+	sum := sha256.Sum256([]byte(body.String()))
+	if hex.EncodeToString(sum[:]) != buf.checksum {
+		c.remove(key)
+		return Message{}, false, fmt.Errorf("checksum mismatch for chunked message %s", msg.CorrelationID)
+	}
+
+	headers := copyHeaders(buf.headers)
+	delete(headers, HeaderChunkIndex)
+	delete(headers, HeaderChunkTotal)
+	delete(headers, HeaderChunkChecksum)
+	return Message{
+		Body:          body.String(),
+		CorrelationID: msg.CorrelationID,
+		ReplyTo:       buf.replyTo,
+		Headers:       headers,
+		UserID:        msg.UserID,
+	}, true, nil
+}
+
+// handled drops the chunks of a message completed by msg once it was handled.
+// If the handler failed, only msg is dropped, to be completed by its redelivery.
+func (c *ChunkedQueue) handled(msg Message, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := chunkKey(msg)
+	buf, ok := c.pending[key]
+	if !ok {
+		return
+	}
+	if err != nil {
+		index, _ := strconv.Atoi(msg.Headers[HeaderChunkIndex])
+		buf.size -= len(buf.chunks[index])
+		c.buffered -= len(buf.chunks[index])
+		delete(buf.chunks, index)
+		return
+	}
+	c.remove(key)
+}
+
+// chunkKey identifies the message a chunk belongs to; chunks of other
+// senders cannot be mixed into a message
+func chunkKey(msg Message) string {
+	return msg.UserID + "/" + msg.CorrelationID
+}
+
+// evictStale drops incomplete messages whose remaining chunks never arrived.
+// The caller must hold c.mu.
+func (c *ChunkedQueue) evictStale() {
+	for key, buf := range c.pending {
+		if time.Since(buf.started) > chunkBufferTTL {
+			c.drop(key, "Dropping incomplete chunked message")
+		}
+	}
+}
+
+// evictOldest drops the oldest message being reassembled other than the one
+// of keep, reporting whether there was one. The caller must hold c.mu.
+func (c *ChunkedQueue) evictOldest(keep string) bool {
+	oldest := ""
+	for key, buf := range c.pending {
+		if key != keep && (oldest == "" || buf.started.Before(c.pending[oldest].started)) {
+			oldest = key
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	c.drop(oldest, "Dropping incomplete chunked message to make room for others")
+	return true
+}
+
+// drop logs and removes a message being reassembled. The caller must hold c.mu.
+func (c *ChunkedQueue) drop(key, reason string) {
+	buf := c.pending[key]
+	logging.Logger.WithFields(logrus.Fields{
+		"correlation": key,
+		"received":    len(buf.chunks),
+		"total":       buf.total,
+		"size":        buf.size,
+	}).Warn(reason)
+	c.remove(key)
+}
+
+// remove forgets a message being reassembled. The caller must hold c.mu.
+func (c *ChunkedQueue) remove(key string) {
+	if buf, ok := c.pending[key]; ok {
+		c.buffered -= buf.size
+		delete(c.pending, key)
+	}
+}
+
+// splitChunks splits s into pieces of at most size bytes without breaking
+// UTF-8 sequences, since some backends only accept valid text
+func splitChunks(s string, size int) []string {
+	var chunks []string
+	for len(s) > size {
+		end := size
+		for end > 0 && !utf8.RuneStart(s[end]) {
+			end--
+		}
+		if end == 0 {
+			end = size
+		}
+		chunks = append(chunks, s[:end])
+		s = s[end:]
+	}
+	return append(chunks, s)
+}
@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// chunkMessages splits body the way ChunkedQueue sends it
+func chunkMessages(t *testing.T, body string, size int) []Message {
+	t.Helper()
+	var msgs []Message
+	c := WithChunking(nil, size)
+	err := c.sendChunks(body, map[string]string{"X-Test": "kept"}, func(chunk string, h map[string]string) error {
+		msgs = append(msgs, Message{Body: chunk, CorrelationID: "corr-1", ReplyTo: "replies", Headers: h})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("sendChunks: %v", err)
+	}
+	return msgs
+}
+
+// receive feeds msgs through a fresh receiver and returns the handled messages
+func receive(t *testing.T, msgs []Message) []Message {
+	t.Helper()
+	var got []Message
+	handle := WithChunking(nil, 0).reassemble(func(msg Message) error {
+		got = append(got, msg)
+		return nil
+	})
+	for _, msg := range msgs {
+		if err := handle(msg); err != nil {
+			t.Fatalf("reassemble returned %v", err)
+		}
+	}
+	return got
+}
+
+func TestChunkReassembly(t *testing.T) {
+	body := strings.Repeat("héllo wörld ", 50) // Multi-byte runes across chunk boundaries
+	msgs := chunkMessages(t, body, 64)
+	if len(msgs) < 3 {
+		t.Fatalf("body split into %d chunks, want several", len(msgs))
+	}
+
+	// Reverse order with every chunk delivered twice
+	var shuffled []Message
+	for i := len(msgs) - 1; i >= 0; i-- {
+		shuffled = append(shuffled, msgs[i], msgs[i])
+	}
+	got := receive(t, shuffled)
+	if len(got) != 1 {
+		t.Fatalf("handler called %d times, want once", len(got))
+	}
+	if got[0].Body != body || got[0].ReplyTo != "replies" || got[0].Headers["X-Test"] != "kept" {
+		t.Errorf("reassembled message = %+v", got[0])
+	}
+	if _, ok := got[0].Headers[HeaderChunkIndex]; ok {
+		t.Error("chunk headers were not removed")
+	}
+	for _, chunk := range msgs {
+		if len(chunk.Body) > 64 {
+			t.Errorf("chunk of %d bytes exceeds the limit", len(chunk.Body))
+		}
+	}
+}
+
+func TestChunkChecksumMismatch(t *testing.T) {
+	msgs := chunkMessages(t, strings.Repeat("x", 200), 64)
+	msgs[1].Body = strings.Repeat("y", len(msgs[1].Body))
+	if got := receive(t, msgs); len(got) != 0 {
+		t.Errorf("corrupted message was delivered: %+v", got)
+	}
+
+	// A later, intact copy of the message is still delivered
+	good := chunkMessages(t, strings.Repeat("x", 200), 64)
+	c := WithChunking(nil, 0)
+	var delivered int
+	handle := c.reassemble(func(Message) error { delivered++; return nil })
+	for _, msg := range append(msgs, good...) {
+		handle(msg)
+	}
+	if delivered != 1 || len(c.pending) != 0 {
+		t.Errorf("delivered %d messages with %d pending, want 1 and 0", delivered, len(c.pending))
+	}
+}
+
+func TestChunkBufferLimits(t *testing.T) {
+	c := WithChunking(nil, 0)
+	c.MaxPending, c.MaxPendingBytes = 2, 100
+	var delivered []string
+	handle := c.reassemble(func(msg Message) error {
+		delivered = append(delivered, msg.CorrelationID)
+		return nil
+	})
+	messages := func(correlationID string, size int) []Message {
+		msgs := chunkMessages(t, strings.Repeat("x", size), 16)
+		for i := range msgs {
+			msgs[i].CorrelationID = correlationID
+		}
+		return msgs
+	}
+
+	// A third incomplete message evicts the oldest
+	a, b, d := messages("a", 48), messages("b", 48), messages("d", 48)
+	for _, msg := range []Message{a[0], b[0], d[0]} {
+		handle(msg)
+	}
+	if _, ok := c.pending["/a"]; ok || len(c.pending) != 2 || c.buffered != 32 {
+		t.Errorf("pending %d messages of %d bytes including a, want b and d with 32 bytes", len(c.pending), c.buffered)
+	}
+	for _, msg := range d[1:] {
+		handle(msg)
+	}
+	if len(delivered) != 1 || delivered[0] != "d" || len(c.pending) != 1 || c.buffered != 16 {
+		t.Errorf("delivered %v with %d pending of %d bytes, want d with b pending", delivered, len(c.pending), c.buffered)
+	}
+
+	// A message larger than the buffer evicts the others, then is dropped
+	large := messages("large", 160)
+	var err error
+	for _, msg := range large {
+		if _, _, err = c.addChunk(msg); err != nil {
+			break
+		}
+	}
+	if err == nil || len(c.pending) != 0 || c.buffered != 0 {
+		t.Errorf("large message returned %v with %d pending of %d bytes, want an error and nothing pending", err, len(c.pending), c.buffered)
+	}
+}
+
+func TestInvalidChunkHeaders(t *testing.T) {
+	sum := sha256.Sum256([]byte("ab"))
+	checksum := hex.EncodeToString(sum[:])
+	chunk := func(index, total string) Message {
+		return Message{Body: "a", CorrelationID: "corr-1", Headers: map[string]string{
+			HeaderChunkIndex: index, HeaderChunkTotal: total, HeaderChunkChecksum: checksum,
+		}}
+	}
+	for _, msg := range []Message{chunk("0", "zero"), chunk("0", "0"), chunk("2", "2"), chunk("-1", "2")} {
+		if _, _, err := WithChunking(nil, 0).addChunk(msg); err == nil {
+			t.Errorf("addChunk accepted index %s of %s", msg.Headers[HeaderChunkIndex], msg.Headers[HeaderChunkTotal])
+		}
+	}
+	if got := receive(t, []Message{chunk("0", "zero")}); len(got) != 0 {
+		t.Errorf("invalid chunk was delivered: %+v", got)
+	}
+
+	// Messages without chunk headers pass through unchanged
+	plain := Message{Body: strconv.Itoa(42), CorrelationID: "corr-2"}
+	if got := receive(t, []Message{plain}); len(got) != 1 || got[0].Body != "42" {
+		t.Errorf("plain message = %+v", got)
+	}
+}
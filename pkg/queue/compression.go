@@ -0,0 +1,286 @@
+package queue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// HeaderContentEncoding names the encoding applied to the message body
+	HeaderContentEncoding = "Content-Encoding"
+	// HeaderAcceptEncoding lists the encodings the sender can decode in a reply
+	HeaderAcceptEncoding = "Accept-Encoding"
+
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+	EncodingNone = "none" // Disables compression entirely
+
+	// DefaultCompressionThreshold is the body size in bytes below which messages are sent uncompressed
+	DefaultCompressionThreshold = 1024
+
+	// MaxDecompressedSize bounds the size of a decompressed body, so that a
+	// small message cannot expand to exhaust the receiver's memory
+	MaxDecompressedSize = 64 << 20
+
+	// acceptedTTL is how long the encoding a requester accepts is kept for
+	// its response; responses sent later are simply not compressed
+	acceptedTTL = time.Hour
+)
+
+// SupportedEncodings lists the encodings this build can decode, in order of preference
+var SupportedEncodings = []string{EncodingZstd, EncodingGzip}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecompressedSize))
+)
+
+// Compress encodes body with the given encoding and returns it as Base64 text,
+// so that every backend can carry it as a plain string
+func Compress(body, encoding string) (string, error) {
+	var compressed []byte
+	switch encoding {
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write([]byte(body)); err != nil {
+			return "", fmt.Errorf("failed to gzip message: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return "", fmt.Errorf("failed to gzip message: %v", err)
+		}
+		compressed = buf.Bytes()
+	case EncodingZstd:
+		compressed = zstdEncoder.EncodeAll([]byte(body), nil)
+	default:
+		return "", fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+	return base64.StdEncoding.EncodeToString(compressed), nil
+}
+
+// Decompress reverses Compress
+func Decompress(body, encoding string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s message: %v", encoding, err)
+	}
+
+	switch encoding {
+	case EncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", fmt.Errorf("failed to gunzip message: %v", err)
+		}
+		defer r.Close()
+		out, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+		if err != nil {
+			return "", fmt.Errorf("failed to gunzip message: %v", err)
+		}
+		if len(out) > MaxDecompressedSize {
+			return "", fmt.Errorf("failed to gunzip message: larger than %d bytes", MaxDecompressedSize)
+		}
+		return string(out), nil
+	case EncodingZstd:
+		out, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress zstd message: %v", err)
+		}
+		return string(out), nil
+	default:
+		return "", fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// NegotiateEncoding picks the encoding to use for a reply given the peer's
+// Accept-Encoding header and our own preference. It returns "" when the peer
+// did not advertise any encoding we support.
+func NegotiateEncoding(acceptEncoding, preferred string) string {
+	if preferred == EncodingNone {
+		return ""
+	}
+	accepted := map[string]bool{}
+	for _, enc := range strings.Split(acceptEncoding, ",") {
+		accepted[strings.TrimSpace(enc)] = true
+	}
+	if preferred != "" && accepted[preferred] {
+		return preferred
+	}
+	for _, enc := range SupportedEncodings {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// CompressedQueue wraps a MessageQueue and transparently compresses message
+// bodies above Threshold. Commands are only compressed when Encoding is set,
+// because older agents cannot decode them; responses are compressed whenever
+// the requester advertised a supported encoding in Accept-Encoding.
+type CompressedQueue struct {
+	MessageQueue
+	Encoding  string // Preferred encoding, "" disables compression of outgoing commands
+	Threshold int    // Minimum body size in bytes before compression is applied
+
+	mu       sync.Mutex
+	accepted map[string]acceptedEncoding // Encoding negotiated with each requester by correlation ID
+	swept    time.Time                   // When expired entries of accepted were last dropped
+}
+
+// acceptedEncoding is the encoding negotiated for a response
+type acceptedEncoding struct {
+	encoding string
+	expires  time.Time
+}
+
+// WithCompression wraps mq with transparent body compression
+func WithCompression(mq MessageQueue, encoding string, threshold int) *CompressedQueue {
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	return &CompressedQueue{MessageQueue: mq, Encoding: encoding, Threshold: threshold, accepted: map[string]acceptedEncoding{}}
+}
+
+// Unwrap returns the wrapped MessageQueue
+func (c *CompressedQueue) Unwrap() MessageQueue {
+	return c.MessageQueue
+}
+
+// SendMessage advertises the encodings we accept and compresses the command when configured to
+func (c *CompressedQueue) SendMessage(queueName, message, correlationID, replyTo string, headers map[string]string) error {
+	headers = copyHeaders(headers)
+	headers[HeaderAcceptEncoding] = strings.Join(SupportedEncodings, ",")
+
+	body, err := c.encode(message, c.Encoding, headers)
+	if err != nil {
+		return err
+	}
+	return c.MessageQueue.SendMessage(queueName, body, correlationID, replyTo, headers)
+}
+
+// ReceiveMessages decodes compressed bodies before invoking the handler and
+// remembers which encoding each requester accepts for the matching response
+func (c *CompressedQueue) ReceiveMessages(queueName string, handler func(Message) error) error {
+	return c.MessageQueue.ReceiveMessages(queueName, c.decode(handler))
+}
+
+// ConsumeReplies consumes direct replies from the backend, decompressing them
+func (c *CompressedQueue) ConsumeReplies(handler func(Message) error) (string, error) {
+	consumer, ok := c.MessageQueue.(ReplyConsumer)
+	if !ok {
+		return "", ErrRepliesUnsupported
+	}
+	return consumer.ConsumeReplies(c.decode(handler))
+}
+
+// decode wraps handler so it receives decompressed messages, and records the
+// encoding each requester accepts for its response. Messages that cannot be
+// decoded are logged and dropped: failing would end the backend's receive
+// loop, and a redelivery cannot repair them.
+func (c *CompressedQueue) decode(handler func(Message) error) func(Message) error {
+	return func(msg Message) error {
+		if err := decodeMessage(&msg); err != nil {
+			logging.Logger.WithFields(logrus.Fields{
+				"correlation": msg.CorrelationID,
+				"encoding":    msg.Headers[HeaderContentEncoding],
+				"error":       err.Error(),
+			}).Error("Dropping message that cannot be decompressed")
+			return nil
+		}
+		if enc := NegotiateEncoding(msg.Headers[HeaderAcceptEncoding], c.Encoding); enc != "" && msg.CorrelationID != "" {
+			c.accept(msg.CorrelationID, enc)
+		}
+		return handler(msg)
+	}
+}
+
+// accept records the encoding for the response to correlationID. Entries of
+// commands never answered, e.g. dropped ones, expire after acceptedTTL.
+func (c *CompressedQueue) accept(correlationID, encoding string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.swept) > acceptedTTL/10 {
+		for id, entry := range c.accepted {
+			if now.After(entry.expires) {
+				delete(c.accepted, id)
+			}
+		}
+		c.swept = now
+	}
+	c.accepted[correlationID] = acceptedEncoding{encoding: encoding, expires: now.Add(acceptedTTL)}
+}
+
+// PublishResponse compresses the response if the requester accepts a
+// supported encoding. The encoding is kept for the responses that follow a
+// partial one.
+func (c *CompressedQueue) PublishResponse(replyTo, correlationID, response string, headers map[string]string) error {
+	c.mu.Lock()
+	entry, ok := c.accepted[correlationID]
+	if headers[HeaderPartial] != "true" {
+		delete(c.accepted, correlationID)
+	}
+	c.mu.Unlock()
+	encoding := ""
+	if ok && time.Now().Before(entry.expires) {
+		encoding = entry.encoding
+	}
+
+	headers = copyHeaders(headers)
+	body, err := c.encode(response, encoding, headers)
+	if err != nil {
+		return err
+	}
+	return c.MessageQueue.PublishResponse(replyTo, correlationID, body, headers)
+}
+
+// encode compresses body with encoding when it exceeds the threshold and
+// records the encoding in headers
+func (c *CompressedQueue) encode(body, encoding string, headers map[string]string) (string, error) {
+	if encoding == "" || encoding == EncodingNone || len(body) < c.Threshold {
+		return body, nil
+	}
+
+	compressed, err := Compress(body, encoding)
+	if err != nil {
+		return "", err
+	}
+	if len(compressed) >= len(body) {
+		return body, nil // Not worth it, e.g. already-compressed payloads
+	}
+
+	headers[HeaderContentEncoding] = encoding
+	logging.Logger.WithFields(logrus.Fields{
+		"encoding":        encoding,
+		"original_size":   len(body),
+		"compressed_size": len(compressed),
+	}).Debug("Compressed message body")
+	return compressed, nil
+}
+
+// decodeMessage decompresses msg in place according to its Content-Encoding header
+func decodeMessage(msg *Message) error {
+	encoding := msg.Headers[HeaderContentEncoding]
+	if encoding == "" {
+		return nil
+	}
+
+	body, err := Decompress(msg.Body, encoding)
+	if err != nil {
+		return err
+	}
+	msg.Body = body
+	msg.Headers = copyHeaders(msg.Headers)
+	delete(msg.Headers, HeaderContentEncoding)
+	return nil
+}
@@ -0,0 +1,241 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// podListYAML builds a payload resembling `kubectl get pods -o yaml` output
+func podListYAML(pods int) string {
+	var b strings.Builder
+	b.WriteString("apiVersion: v1\nitems:\n")
+	for i := 0; i < pods; i++ {
+		fmt.Fprintf(&b, `- apiVersion: v1
+  kind: Pod
+  metadata:
+    creationTimestamp: "2025-01-20T10:%02d:00Z"
+    labels:
+      app: web
+      pod-template-hash: 7d9f8c6b5
+    name: web-7d9f8c6b5-%05d
+    namespace: default
+    resourceVersion: "%d"
+    uid: 3f1c2a9e-8b7d-4c6e-9a1f-%012d
+  spec:
+    containers:
+    - image: nginx:1.27
+      imagePullPolicy: IfNotPresent
+      name: nginx
+      ports:
+      - containerPort: 80
+        protocol: TCP
+      resources:
+        limits:
+          cpu: 500m
+          memory: 256Mi
+    dnsPolicy: ClusterFirst
+    restartPolicy: Always
+    serviceAccountName: default
+  status:
+    phase: Running
+    podIP: 10.0.%d.%d
+    qosClass: Burstable
+`, i%60, i, 100000+i, i, i/250, i%250)
+	}
+	b.WriteString("kind: List\nmetadata:\n  resourceVersion: \"\"\n")
+	return b.String()
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	payload := podListYAML(20)
+	for _, enc := range SupportedEncodings {
+		compressed, err := Compress(payload, enc)
+		if err != nil {
+			t.Fatalf("%s: compress: %v", enc, err)
+		}
+		if len(compressed) >= len(payload) {
+			t.Errorf("%s: compressed size %d not smaller than %d", enc, len(compressed), len(payload))
+		}
+		out, err := Decompress(compressed, enc)
+		if err != nil {
+			t.Fatalf("%s: decompress: %v", enc, err)
+		}
+		if out != payload {
+			t.Errorf("%s: round trip mismatch", enc)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept, preferred, want string
+	}{
+		{"", "", ""},
+		{"zstd,gzip", "", EncodingZstd},
+		{"zstd, gzip", EncodingGzip, EncodingGzip},
+		{"gzip", EncodingZstd, EncodingGzip},
+		{"br", "", ""},
+		{"zstd,gzip", EncodingNone, ""},
+	}
+	for _, tt := range tests {
+		if got := NegotiateEncoding(tt.accept, tt.preferred); got != tt.want {
+			t.Errorf("NegotiateEncoding(%q, %q) = %q, want %q", tt.accept, tt.preferred, got, tt.want)
+		}
+	}
+}
+
+func TestDecompressLimitsSize(t *testing.T) {
+	huge := strings.Repeat("\x00", MaxDecompressedSize+1)
+	for _, enc := range SupportedEncodings {
+		compressed, err := Compress(huge, enc)
+		if err != nil {
+			t.Fatalf("%s: compress: %v", enc, err)
+		}
+		if _, err := Decompress(compressed, enc); err == nil {
+			t.Errorf("%s: a body larger than MaxDecompressedSize was decompressed", enc)
+		}
+	}
+}
+
+// recordingQueue records what is sent through it and delivers queued
+// messages to ReceiveMessages
+type recordingQueue struct {
+	MessageQueue
+	sent     []Message
+	incoming []Message
+}
+
+func (r *recordingQueue) SendMessage(queueName, message, correlationID, replyTo string, headers map[string]string) error {
+	r.sent = append(r.sent, Message{Body: message, CorrelationID: correlationID, ReplyTo: replyTo, Headers: headers})
+	return nil
+}
+
+func (r *recordingQueue) PublishResponse(replyTo, correlationID, response string, headers map[string]string) error {
+	r.sent = append(r.sent, Message{Body: response, CorrelationID: correlationID, Headers: headers})
+	return nil
+}
+
+func (r *recordingQueue) ReceiveMessages(queueName string, handler func(Message) error) error {
+	for _, msg := range r.incoming {
+		if err := handler(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCompressedQueue(t *testing.T) {
+	payload := podListYAML(20)
+
+	// The client compresses its command and advertises what it accepts
+	clientSide := &recordingQueue{}
+	client := WithCompression(clientSide, EncodingGzip, 0)
+	if err := client.SendMessage("commands", payload, "corr-1", "replies", nil); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	command := clientSide.sent[0]
+	if command.Headers[HeaderContentEncoding] != EncodingGzip || command.Headers[HeaderAcceptEncoding] == "" || command.Body == payload {
+		t.Fatalf("command = %+v, want a gzip body accepting encodings", command.Headers)
+	}
+
+	// The agent decodes it and compresses its response as negotiated; a
+	// plain-text peer, which advertises nothing, gets a plain response
+	plain := Message{Body: "get pods", CorrelationID: "corr-2", ReplyTo: "replies"}
+	broken := Message{Body: "not base64!", CorrelationID: "corr-3", Headers: map[string]string{HeaderContentEncoding: EncodingZstd}}
+	unknown := Message{Body: "eA==", CorrelationID: "corr-4", Headers: map[string]string{HeaderContentEncoding: "br", HeaderAcceptEncoding: "gzip"}}
+	agentSide := &recordingQueue{incoming: []Message{command, plain, broken, unknown}}
+	agent := WithCompression(agentSide, "", 0)
+	var received []Message
+	err := agent.ReceiveMessages("commands", func(msg Message) error {
+		received = append(received, msg)
+		return agent.PublishResponse(msg.ReplyTo, msg.CorrelationID, payload, nil)
+	})
+	if err != nil {
+		t.Fatalf("ReceiveMessages: %v; undecodable messages must be dropped", err)
+	}
+	if len(received) != 2 || received[0].Body != payload || received[1].Body != "get pods" {
+		t.Fatalf("received %d messages, want the command and the plain one", len(received))
+	}
+	if _, ok := received[0].Headers[HeaderContentEncoding]; ok {
+		t.Error("Content-Encoding was not removed from the decoded command")
+	}
+
+	compressed, uncompressed := agentSide.sent[0], agentSide.sent[1]
+	if compressed.Headers[HeaderContentEncoding] == "" || uncompressed.Headers[HeaderContentEncoding] != "" || uncompressed.Body != payload {
+		t.Errorf("responses have encodings %q and %q, want a compressed and a plain one",
+			compressed.Headers[HeaderContentEncoding], uncompressed.Headers[HeaderContentEncoding])
+	}
+
+	// The client decodes the compressed response
+	clientSide.incoming = []Message{compressed}
+	var response string
+	client.ReceiveMessages("replies", func(msg Message) error { response = msg.Body; return nil })
+	if response != payload {
+		t.Error("the client did not decode the compressed response")
+	}
+	if len(agent.accepted) != 0 {
+		t.Errorf("%d negotiated encodings left after the responses", len(agent.accepted))
+	}
+}
+
+func TestCompressedQueueCompressesPartialResponses(t *testing.T) {
+	payload := podListYAML(20)
+	agentSide := &recordingQueue{}
+	agent := WithCompression(agentSide, "", 0)
+	agent.accept("corr-1", EncodingGzip)
+	agent.PublishResponse("replies", "corr-1", payload, map[string]string{HeaderPartial: "true"})
+	agent.PublishResponse("replies", "corr-1", payload, nil)
+	for i, msg := range agentSide.sent {
+		if msg.Headers[HeaderContentEncoding] != EncodingGzip {
+			t.Errorf("response %d was not compressed", i)
+		}
+	}
+	if len(agent.accepted) != 0 {
+		t.Errorf("%d negotiated encodings left after the final response", len(agent.accepted))
+	}
+}
+
+func TestCompressedQueueExpiresEncodings(t *testing.T) {
+	c := WithCompression(&recordingQueue{}, "", 0)
+	c.accept("unanswered", EncodingZstd)
+	c.accepted["unanswered"] = acceptedEncoding{encoding: EncodingZstd, expires: time.Now().Add(-time.Second)}
+	c.swept = time.Time{}
+	c.accept("corr-1", EncodingZstd)
+	if _, ok := c.accepted["unanswered"]; ok || len(c.accepted) != 1 {
+		t.Errorf("accepted = %v, want only corr-1", c.accepted)
+	}
+}
+
+func BenchmarkCompressGetPodsYAML(b *testing.B) {
+	payload := podListYAML(200)
+	for _, enc := range SupportedEncodings {
+		b.Run(enc, func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			var compressed string
+			for i := 0; i < b.N; i++ {
+				compressed, _ = Compress(payload, enc)
+			}
+			b.ReportMetric(float64(len(payload))/float64(len(compressed)), "ratio")
+		})
+	}
+}
+
+func BenchmarkDecompressGetPodsYAML(b *testing.B) {
+	payload := podListYAML(200)
+	for _, enc := range SupportedEncodings {
+		compressed, err := Compress(payload, enc)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(enc, func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				if _, err := Decompress(compressed, enc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
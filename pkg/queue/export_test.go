@@ -0,0 +1,8 @@
+package queue
+
+// NewFakeRabbitMQ returns a factory of RabbitMQ backends that share a new
+// in-process fake broker, for the conformance suite
+func NewFakeRabbitMQ() func() MessageQueue {
+	broker := newFakeBroker()
+	return func() MessageQueue { return broker.rabbitMQ() }
+}
@@ -9,6 +9,8 @@ func NewMessageQueue(backend string, url string) (MessageQueue, error) {
 	switch backend {
 	case "rabbitmq":
 		return &RabbitMQ{URL: url}, nil
+	case "memory":
+		return &Memory{URL: url}, nil
 	case "sqs":
 		return &SQS{QueueURL: url, Timeout: 20 * time.Second}, nil
 	case "pubsub":
@@ -0,0 +1,601 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// directReplyPrefix prefixes the reply-to address the broker substitutes
+// for DirectReplyTo; publishing to it reaches the consuming channel
+const directReplyPrefix = DirectReplyTo + "."
+
+// fakeBroker is an in-process stand-in for RabbitMQ that runs the RabbitMQ
+// backend without a broker. It supports publisher confirms, mandatory
+// returns, Direct Reply-To and streams, and can drop connections, refuse
+// dials, nack publishes and withhold confirms to exercise failure handling.
+// All of its state is guarded by mu; notification channels are buffered by
+// the backend, so they are written with mu held.
+type fakeBroker struct {
+	mu           sync.Mutex
+	queues       map[string]*fakeQueue
+	conns        []*fakeConn
+	channels     map[string]*fakeChannel // Open channels by ID, for Direct Reply-To
+	nextID       int
+	dials        int
+	dialErr      error           // Returned by dial while set
+	nacks        map[string]bool // Routing keys whose publishes are nacked
+	holdConfirms bool            // Withholds confirms, as if the broker stalled
+}
+
+// fakeQueue is a classic queue, or a stream when log is kept
+type fakeQueue struct {
+	durable   bool
+	args      amqp.Table
+	stream    bool
+	messages  []amqp.Delivery // Waiting for a consumer
+	log       []fakeEntry     // Every message of a stream
+	consumers []*fakeConsumer
+	next      int // Round-robin position among consumers
+}
+
+// fakeEntry is a stream message with its publish time
+type fakeEntry struct {
+	delivery amqp.Delivery
+	at       time.Time
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{queues: map[string]*fakeQueue{}, channels: map[string]*fakeChannel{}, nacks: map[string]bool{}}
+}
+
+// dial connects to the broker; it is used as the dialer of RabbitMQ
+func (b *fakeBroker) dial(url string) (amqpConnection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dials++
+	if b.dialErr != nil {
+		return nil, b.dialErr
+	}
+	conn := &fakeConn{broker: b, user: "guest"}
+	if uri, err := amqp.ParseURI(url); err == nil {
+		conn.user = uri.Username
+	}
+	b.conns = append(b.conns, conn)
+	return conn, nil
+}
+
+// rabbitMQ returns a backend that dials the broker and reconnects quickly
+func (b *fakeBroker) rabbitMQ() *RabbitMQ {
+	return &RabbitMQ{
+		URL:            "amqp://fake",
+		MinBackoff:     time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		PublishTimeout: 2 * time.Second,
+		dialer:         b.dial,
+	}
+}
+
+// kill drops every connection, as a broker restart would
+func (b *fakeBroker) kill() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker forced connection closure", Server: true})
+	}
+	b.conns = nil
+}
+
+// restart drops every connection and every queue but streams, as a broker
+// restarting without persistent classic queues would
+func (b *fakeBroker) restart() {
+	b.kill()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, q := range b.queues {
+		if !q.stream {
+			delete(b.queues, name)
+		}
+	}
+}
+
+// setDialErr makes dials fail with err until it is set to nil
+func (b *fakeBroker) setDialErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dialErr = err
+}
+
+// dialCount returns how many times the broker was dialed
+func (b *fakeBroker) dialCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dials
+}
+
+// nack makes the broker reject publishes to routingKey
+func (b *fakeBroker) nack(routingKey string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nacks[routingKey] = true
+}
+
+// setHoldConfirms withholds confirms of later publishes while hold is set
+func (b *fakeBroker) setHoldConfirms(hold bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.holdConfirms = hold
+}
+
+// declare creates a queue directly on the broker, as an older client or
+// another application would have
+func (b *fakeBroker) declare(name string, durable bool, args amqp.Table) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queues[name] = &fakeQueue{durable: durable, args: args, stream: args["x-queue-type"] == "stream"}
+}
+
+// queue returns a snapshot of whether a queue exists and its settings
+func (b *fakeBroker) queue(name string) (durable bool, args amqp.Table, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return false, nil, false
+	}
+	return q.durable, q.args, true
+}
+
+// route delivers a message to a queue or Direct Reply-To consumer; b.mu must be held
+func (b *fakeBroker) route(key string, delivery amqp.Delivery) bool {
+	if id := strings.TrimPrefix(key, directReplyPrefix); id != key {
+		ch, ok := b.channels[id]
+		if !ok || ch.replies == nil {
+			return false
+		}
+		ch.replies.push(delivery)
+		return true
+	}
+
+	q, ok := b.queues[key]
+	if !ok {
+		return false
+	}
+	if q.stream {
+		q.log = append(q.log, fakeEntry{delivery: delivery, at: time.Now()})
+		for _, consumer := range q.consumers {
+			consumer.push(delivery)
+		}
+		return true
+	}
+	delivery.Acknowledger = fakeAcknowledger{broker: b, queue: key, delivery: delivery}
+	if len(q.consumers) == 0 {
+		q.messages = append(q.messages, delivery)
+		return true
+	}
+	q.next = (q.next + 1) % len(q.consumers)
+	q.consumers[q.next].push(delivery)
+	return true
+}
+
+// fakeConn is a connection to a fakeBroker
+type fakeConn struct {
+	broker   *fakeBroker
+	user     string // Authenticated user
+	closed   bool
+	closers  []chan *amqp.Error
+	channels []*fakeChannel
+}
+
+func (c *fakeConn) Channel() (amqpChannel, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	b.nextID++
+	ch := &fakeChannel{conn: c, id: fmt.Sprint(b.nextID)}
+	c.channels = append(c.channels, ch)
+	b.channels[ch.id] = ch
+	return ch, nil
+}
+
+func (c *fakeConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.closers = append(c.closers, receiver)
+	return receiver
+}
+
+func (c *fakeConn) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.shutdown(nil)
+	for i, conn := range b.conns {
+		if conn == c {
+			b.conns = append(b.conns[:i], b.conns[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// shutdown closes the connection and its channels; broker.mu must be held
+func (c *fakeConn) shutdown(reason *amqp.Error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, ch := range c.channels {
+		ch.shutdown(reason)
+	}
+	for _, closer := range c.closers {
+		if reason != nil {
+			closer <- reason
+		}
+		close(closer)
+	}
+}
+
+// fakeChannel is a channel of a fakeConn
+type fakeChannel struct {
+	conn       *fakeConn
+	id         string
+	closed     bool
+	confirming bool
+	published  uint64
+	confirms   []chan amqp.Confirmation
+	returns    []chan amqp.Return
+	closers    []chan *amqp.Error
+	consumers  []*fakeConsumer
+	replies    *fakeConsumer // Consumer of Direct Reply-To
+}
+
+// fail closes the channel with a channel-level error, as the broker does on
+// a refused operation, and returns the error; broker.mu must be held
+func (ch *fakeChannel) fail(code int, reason string) error {
+	err := &amqp.Error{Code: code, Reason: reason, Server: true}
+	ch.shutdown(err)
+	return err
+}
+
+// shutdown closes the channel, its consumers and notifications; broker.mu must be held
+func (ch *fakeChannel) shutdown(reason *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	b := ch.conn.broker
+	delete(b.channels, ch.id)
+	for _, q := range b.queues {
+		q.consumers = removeConsumers(q.consumers, ch)
+	}
+	for _, consumer := range ch.consumers {
+		consumer.stop()
+	}
+	if ch.replies != nil {
+		ch.replies.stop()
+	}
+	for _, closer := range ch.closers {
+		if reason != nil {
+			closer <- reason
+		}
+		close(closer)
+	}
+	for _, confirms := range ch.confirms {
+		close(confirms)
+	}
+	for _, returns := range ch.returns {
+		close(returns)
+	}
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	ch.conn.broker.mu.Lock()
+	defer ch.conn.broker.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.conn.broker.mu.Lock()
+	defer ch.conn.broker.mu.Unlock()
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.conn.broker.mu.Lock()
+	defer ch.conn.broker.mu.Unlock()
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+func (ch *fakeChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	ch.conn.broker.mu.Lock()
+	defer ch.conn.broker.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.closers = append(ch.closers, c)
+	return c
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		q = &fakeQueue{durable: durable, args: args, stream: args["x-queue-type"] == "stream"}
+		b.queues[name] = q
+	} else if q.durable != durable || !sameArgs(q.args, args) {
+		return amqp.Queue{}, ch.fail(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name))
+	}
+	return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *fakeChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", name))
+	}
+	return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *fakeChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, nil
+	}
+	delete(b.queues, name)
+	for _, consumer := range q.consumers {
+		consumer.stop()
+	}
+	return len(q.messages), nil
+}
+
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if msg.UserId != "" && msg.UserId != ch.conn.user {
+		ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - user_id property set to '"+msg.UserId+"' but authenticated user was '"+ch.conn.user+"'")
+		return nil
+	}
+	if msg.ReplyTo == DirectReplyTo {
+		if ch.replies == nil {
+			// The broker closes the channel; the publish itself does not fail
+			ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - fast reply consumer does not exist")
+			return nil
+		}
+		msg.ReplyTo = directReplyPrefix + ch.id
+	}
+
+	if ch.confirming {
+		ch.published++
+	}
+	delivery := amqp.Delivery{
+		Acknowledger:  fakeAcknowledger{},
+		Headers:       msg.Headers,
+		ContentType:   msg.ContentType,
+		CorrelationId: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		Expiration:    msg.Expiration,
+		UserId:        msg.UserId,
+		Body:          msg.Body,
+		RoutingKey:    key,
+		DeliveryTag:   ch.published,
+	}
+	if !b.route(key, delivery) && mandatory {
+		for _, returns := range ch.returns {
+			returns <- amqp.Return{ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE", RoutingKey: key, CorrelationId: msg.CorrelationId, Body: msg.Body}
+		}
+	}
+	if ch.confirming && !b.holdConfirms {
+		for _, confirms := range ch.confirms {
+			confirms <- amqp.Confirmation{DeliveryTag: ch.published, Ack: !b.nacks[key]}
+		}
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Consume(queue, consumerTag string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	consumer := newFakeConsumer()
+	if queue == DirectReplyTo {
+		if !autoAck || ch.replies != nil {
+			return nil, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer cannot acknowledge or already exists")
+		}
+		ch.replies = consumer
+		return consumer.out, nil
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, ch.fail(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", queue))
+	}
+	if q.stream {
+		if autoAck {
+			return nil, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - stream consumers must acknowledge")
+		}
+		since, _ := args["x-stream-offset"].(time.Time)
+		for _, entry := range q.log {
+			if !entry.at.Before(since) {
+				consumer.push(entry.delivery)
+			}
+		}
+	} else {
+		for _, delivery := range q.messages {
+			consumer.push(delivery)
+		}
+		q.messages = nil
+	}
+	q.consumers = append(q.consumers, consumer)
+	consumer.ch = ch
+	ch.consumers = append(ch.consumers, consumer)
+	return consumer.out, nil
+}
+
+func (ch *fakeChannel) Close() error {
+	ch.conn.broker.mu.Lock()
+	defer ch.conn.broker.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.shutdown(nil)
+	return nil
+}
+
+// fakeConsumer forwards deliveries to its channel from its own goroutine, so
+// the broker never blocks on a slow handler
+type fakeConsumer struct {
+	ch      *fakeChannel
+	out     chan amqp.Delivery
+	mu      sync.Mutex
+	pending []amqp.Delivery
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newFakeConsumer() *fakeConsumer {
+	c := &fakeConsumer{out: make(chan amqp.Delivery), wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go c.run()
+	return c
+}
+
+func (c *fakeConsumer) run() {
+	defer close(c.out)
+	for {
+		c.mu.Lock()
+		if len(c.pending) == 0 {
+			c.mu.Unlock()
+			select {
+			case <-c.wake:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+		delivery := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+
+		select {
+		case c.out <- delivery:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *fakeConsumer) push(delivery amqp.Delivery) {
+	c.mu.Lock()
+	c.pending = append(c.pending, delivery)
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *fakeConsumer) stop() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// removeConsumers returns consumers without those of ch
+func removeConsumers(consumers []*fakeConsumer, ch *fakeChannel) []*fakeConsumer {
+	kept := consumers[:0]
+	for _, consumer := range consumers {
+		if consumer.ch != ch {
+			kept = append(kept, consumer)
+		}
+	}
+	return kept
+}
+
+// sameArgs compares queue arguments, treating nil and empty tables alike
+func sameArgs(a, b amqp.Table) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// fakeAcknowledger accepts acknowledgements of fake deliveries. Deliveries
+// from classic queues that are rejected with requeue are routed to their
+// queue again, flagged as redelivered.
+type fakeAcknowledger struct {
+	broker   *fakeBroker // Unset for deliveries that cannot be requeued
+	queue    string
+	delivery amqp.Delivery
+}
+
+func (a fakeAcknowledger) Ack(tag uint64, multiple bool) error { return nil }
+
+func (a fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.Reject(tag, requeue)
+}
+
+func (a fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	if !requeue || a.broker == nil {
+		return nil
+	}
+	a.broker.mu.Lock()
+	defer a.broker.mu.Unlock()
+	delivery := a.delivery
+	delivery.Redelivered = true
+	a.broker.route(a.queue, delivery)
+	return nil
+}
+
+// errFakeDial is returned by dials while the fake broker refuses them
+var errFakeDial = errors.New("dial tcp: connection refused")
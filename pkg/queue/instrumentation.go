@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/metrics"
+	"github.com/loaynaser3/KubeGate/pkg/tracing"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HeaderSentAt carries the publish time in Unix milliseconds, used to measure receive lag
+const HeaderSentAt = "X-Sent-At"
+
+// withSentAt returns a copy of headers stamped with the current time
+func withSentAt(headers map[string]string) map[string]string {
+	headers = copyHeaders(headers)
+	headers[HeaderSentAt] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	return headers
+}
+
+// observeReceiveLag records how long a message spent between publish and consume
+func observeReceiveLag(backend string, headers map[string]string) {
+	sentAt, err := strconv.ParseInt(headers[HeaderSentAt], 10, 64)
+	if err != nil {
+		return
+	}
+	lag := time.Since(time.UnixMilli(sentAt))
+	if lag < 0 {
+		lag = 0 // Clock skew between hosts
+	}
+	metrics.QueueReceiveLag.WithLabelValues(backend).Observe(lag.Seconds())
+}
+
+// logHandlerError logs the failure of a handler on a message that was
+// delivered deliveries times; it is delivered again unless that reached MaxDeliveries
+func logHandlerError(queueName, correlationID string, deliveries int, err error) {
+	entry := logging.Logger.WithFields(logrus.Fields{
+		"error":       err.Error(),
+		"queue":       queueName,
+		"correlation": correlationID,
+		"deliveries":  deliveries,
+	})
+	if deliveries < MaxDeliveries {
+		entry.Warn("Failed to process message, delivering it again")
+	} else {
+		entry.Error("Failed to process message, dropping it")
+	}
+}
+
+// countPublishFailure records a failed publish for backend
+func countPublishFailure(backend, operation string) {
+	metrics.PublishFailures.WithLabelValues(backend, operation).Inc()
+}
+
+// startPublishSpan starts a producer span as a child of the trace context in
+// headers and returns a copy of headers carrying the new span
+func startPublishSpan(operation, backend, destination string, headers map[string]string) (map[string]string, trace.Span) {
+	ctx, span := tracing.Tracer().Start(tracing.Extract(headers), operation,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", backend),
+			attribute.String("messaging.destination.name", destination),
+		))
+	return tracing.Inject(ctx, headers), span
+}
+
+// startReceiveSpan starts a consumer span for msg and updates its headers so
+// the handler continues the same trace
+func startReceiveSpan(backend, queueName string, msg *Message) trace.Span {
+	ctx, span := tracing.Tracer().Start(tracing.Extract(msg.Headers), "ReceiveMessages",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", backend),
+			attribute.String("messaging.destination.name", queueName),
+			attribute.String("messaging.message.conversation_id", msg.CorrelationID),
+		))
+	msg.Headers = tracing.Inject(ctx, msg.Headers)
+	return span
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -1,17 +1,143 @@
 package queue
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// HeaderTTL sets a per-message expiry in milliseconds on backends that support it
+const HeaderTTL = "X-Message-TTL"
+
+// HeaderPartial set to "true" marks a response that more responses to the
+// same request follow, such as a part of streamed output
+const HeaderPartial = "X-Partial"
+
+// MaxDeliveries is how many times ReceiveMessages delivers a message whose
+// handler fails. The error is logged and the next message is handled; the
+// failed message is delivered again, then dropped once delivered MaxDeliveries times.
+const MaxDeliveries = 2
+
 type Message struct {
 	Body          string
 	CorrelationID string
 	ReplyTo       string
+	Headers       map[string]string // Optional metadata (encoding, negotiation) carried alongside the body
+	// UserID is the sender as authenticated by the broker, unlike headers that
+	// senders set themselves; empty when the sender did not identify itself
+	UserID string
 }
 
 type MessageQueue interface {
-	Connect() error                                                      // Establish connection to backend
-	CreateQueue(queueName string) error                                  // Create a new Queue
-	SendMessage(queueName, message, correlationID, replyTo string) error // Sends a command to the agent
-	ReceiveMessages(queueName string, handler func(Message) error) error // Processes messages from a queue (includes a custom handler)
-	PublishResponse(replyTo, correlationID, response string) error       // Sends responses back to the reply queue
-	DeleteQueue(queueName string) error                                  // Delete Queue
-	Close() error                                                        // Close connection
+	Connect() error                                                                                 // Establish connection to backend
+	CreateQueue(queueName string) error                                                             // Create a new Queue
+	SendMessage(queueName, message, correlationID, replyTo string, headers map[string]string) error // Sends a command to the agent
+	ReceiveMessages(queueName string, handler func(Message) error) error                            // Processes messages from a queue (includes a custom handler)
+	PublishResponse(replyTo, correlationID, response string, headers map[string]string) error       // Sends responses back to the reply queue
+	DeleteQueue(queueName string) error                                                             // Delete Queue
+	Close() error                                                                                   // Close connection
+}
+
+// LogReader is implemented by backends that can keep an append-only log which
+// any number of readers replay without consuming it. Messages are appended to
+// a log with SendMessage.
+type LogReader interface {
+	// CreateLog creates the log if needed; entries are kept for retention
+	CreateLog(name string, retention time.Duration) error
+	// ReadLog calls visit with the entries appended since, oldest first,
+	// until visit returns false or the end of the log is reached. A log that
+	// does not exist reads as empty.
+	ReadLog(name string, since time.Time, visit func(Message) bool) error
+}
+
+// HealthChecker is implemented by backends that can report whether their
+// connection to the broker is currently usable
+type HealthChecker interface {
+	Healthy() error
+}
+
+// ReplyQueuePrefix is the name prefix of per-client reply queues
+const ReplyQueuePrefix = "reply-queue-"
+
+// ErrRepliesUnsupported is returned by ConsumeReplies when the backend has no
+// way to deliver replies without a reply queue
+var ErrRepliesUnsupported = errors.New("backend does not support direct replies")
+
+// ReplyConsumer is implemented by backends that can deliver replies without a
+// dedicated reply queue. ConsumeReplies starts delivering replies to handler
+// and returns the address to use as replyTo on commands sent afterwards.
+type ReplyConsumer interface {
+	ConsumeReplies(handler func(Message) error) (replyTo string, err error)
+}
+
+// QueueInfo describes a queue returned by a QueueLister
+type QueueInfo struct {
+	Name      string
+	Messages  int       // Approximate number of messages in the queue
+	Consumers int       // Active consumers, when the backend reports them
+	IdleSince time.Time // When the queue was last used; zero if it is in use
+	// ConsumersUnknown is set by backends that cannot report consumers, such as SQS
+	ConsumersUnknown bool
+}
+
+// QueueLister is implemented by backends that can list queues by name prefix
+type QueueLister interface {
+	ListQueues(prefix string) ([]QueueInfo, error)
+}
+
+// UnroutableError is returned when the broker cannot deliver a message
+// because no queue matches its destination
+type UnroutableError struct {
+	Queue  string // Destination the message was published to
+	Reason string // Broker-supplied reason, e.g. NO_ROUTE
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("message to queue %s could not be routed: %s", e.Queue, e.Reason)
+}
+
+// ConnectionState describes the state of a backend's connection to the broker
+type ConnectionState string
+
+const (
+	StateConnected    ConnectionState = "connected"
+	StateDisconnected ConnectionState = "disconnected"
+	StateReconnecting ConnectionState = "reconnecting"
+	StateClosed       ConnectionState = "closed"
+)
+
+// ConnectionEvent reports a change of connection state
+type ConnectionEvent struct {
+	State   ConnectionState
+	Attempt int   // Reconnect attempt number, zero for the initial connection
+	Err     error // Cause of a disconnect or of a failed reconnect attempt
+}
+
+// EventSource is implemented by backends that reconnect on their own and
+// publish their connection state changes. The returned channel is closed
+// when the backend is closed; slow readers miss events rather than block it.
+type EventSource interface {
+	Events() <-chan ConnectionEvent
+}
+
+// Unwrap returns the backend underneath any decorators (compression,
+// chunking) applied to mq, so optional interfaces such as LogReader can be detected
+func Unwrap(mq MessageQueue) MessageQueue {
+	for {
+		wrapper, ok := mq.(interface{ Unwrap() MessageQueue })
+		if !ok {
+			return mq
+		}
+		mq = wrapper.Unwrap()
+	}
+}
+
+// copyHeaders returns a copy of headers that can be modified without
+// affecting the caller's map.
+func copyHeaders(headers map[string]string) map[string]string {
+	out := make(map[string]string, len(headers))
+	for k, v := range headers {
+		out[k] = v
+	}
+	return out
 }
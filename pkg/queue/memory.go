@@ -0,0 +1,410 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+)
+
+// errMemoryClosed is returned by operations attempted after Close
+var errMemoryClosed = errors.New("memory queue has been closed")
+
+// memoryBrokers holds the brokers of the memory backend by URL, so every
+// Memory connected with the same URL in a process shares its queues
+var (
+	memoryBrokersMu sync.Mutex
+	memoryBrokers   = map[string]*memoryBroker{}
+)
+
+// memoryBroker is an in-process broker
+type memoryBroker struct {
+	mu     sync.Mutex
+	queues map[string]*memoryQueue
+}
+
+// memoryQueue holds the messages of one queue
+type memoryQueue struct {
+	messages  []memoryMessage
+	notify    chan struct{} // Closed and replaced when messages arrive or the queue is deleted
+	deleted   bool
+	consumers int
+	idleSince time.Time
+	retention time.Duration // Set for logs, which keep messages for retention
+}
+
+// memoryMessage is a queued message with an optional expiry
+type memoryMessage struct {
+	Message
+	sent       time.Time
+	expires    time.Time
+	deliveries int // Times the message was passed to a handler
+}
+
+// Memory implements the MessageQueue interface with in-process queues. It is
+// meant for tests and local development: messages are lost when the process exits.
+type Memory struct {
+	// URL is the broker name, optionally prefixed with "user@" to set the
+	// UserID of messages sent; instances with the same name share queues
+	URL string
+
+	mu          sync.Mutex
+	broker      *memoryBroker
+	closed      chan struct{}
+	replyQueues []string
+}
+
+// Connect attaches to the broker named by URL, creating it on first use
+func (m *Memory) Connect() error {
+	name := m.URL
+	if _, broker, ok := strings.Cut(m.URL, "@"); ok {
+		name = broker
+	}
+	memoryBrokersMu.Lock()
+	broker, ok := memoryBrokers[name]
+	if !ok {
+		broker = &memoryBroker{queues: map[string]*memoryQueue{}}
+		memoryBrokers[name] = broker
+	}
+	memoryBrokersMu.Unlock()
+
+	m.mu.Lock()
+	m.broker = broker
+	m.closed = make(chan struct{})
+	m.mu.Unlock()
+	return nil
+}
+
+// Healthy reports an error once the queue has been closed
+func (m *Memory) Healthy() error {
+	if _, err := m.connection(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CreateQueue creates a queue if it does not exist yet
+func (m *Memory) CreateQueue(queueName string) error {
+	broker, err := m.connection()
+	if err != nil {
+		return err
+	}
+	broker.mu.Lock()
+	broker.declare(queueName)
+	broker.mu.Unlock()
+	return nil
+}
+
+// SendMessage adds a message to an existing queue
+func (m *Memory) SendMessage(queueName, message, correlationID, replyTo string, headers map[string]string) (err error) {
+	headers, span := startPublishSpan("SendMessage", "memory", queueName, withSentAt(headers))
+	defer func() { endSpan(span, err) }()
+
+	if err = m.push(queueName, Message{Body: message, CorrelationID: correlationID, ReplyTo: replyTo, Headers: headers}); err != nil {
+		countPublishFailure("memory", "send")
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+	return nil
+}
+
+// PublishResponse adds a response to the reply queue
+func (m *Memory) PublishResponse(replyTo, correlationID, response string, headers map[string]string) (err error) {
+	headers, span := startPublishSpan("PublishResponse", "memory", replyTo, withSentAt(headers))
+	defer func() { endSpan(span, err) }()
+
+	if replyTo == "" {
+		return fmt.Errorf("replyTo queue name is empty")
+	}
+	if err = m.push(replyTo, Message{Body: response, CorrelationID: correlationID, Headers: headers}); err != nil {
+		countPublishFailure("memory", "response")
+		return fmt.Errorf("failed to publish response to queue %s: %w", replyTo, err)
+	}
+	return nil
+}
+
+// ReceiveMessages creates the queue if needed and passes each message to the
+// handler. It returns nil once the queue is closed and an error if the queue
+// is deleted.
+func (m *Memory) ReceiveMessages(queueName string, handler func(Message) error) error {
+	broker, err := m.connection()
+	if err != nil {
+		return err
+	}
+	closed := m.closed
+
+	broker.mu.Lock()
+	q := broker.declare(queueName)
+	q.consumers++
+	broker.mu.Unlock()
+	defer func() {
+		broker.mu.Lock()
+		q.consumers--
+		q.idleSince = time.Now()
+		broker.mu.Unlock()
+	}()
+
+	for {
+		broker.mu.Lock()
+		if q.deleted {
+			broker.mu.Unlock()
+			return fmt.Errorf("queue %s was deleted", queueName)
+		}
+		msg, ok := q.pop(time.Now())
+		notify := q.notify
+		broker.mu.Unlock()
+
+		if !ok {
+			select {
+			case <-notify:
+				continue
+			case <-closed:
+				return nil
+			}
+		}
+
+		message := copyMessage(msg.Message) // Handlers may change the headers of a message delivered again
+		observeReceiveLag("memory", message.Headers)
+		span := startReceiveSpan("memory", queueName, &message)
+		err := handler(message)
+		endSpan(span, err)
+		if err != nil {
+			logHandlerError(queueName, msg.CorrelationID, msg.deliveries, err)
+			if msg.deliveries < MaxDeliveries {
+				broker.mu.Lock()
+				q.requeue(msg)
+				broker.mu.Unlock()
+			}
+		}
+	}
+}
+
+// ConsumeReplies delivers replies through a private queue that is deleted on Close
+func (m *Memory) ConsumeReplies(handler func(Message) error) (string, error) {
+	replyTo := "memory.reply-" + uuid.New().String()
+	if err := m.CreateQueue(replyTo); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.replyQueues = append(m.replyQueues, replyTo)
+	m.mu.Unlock()
+
+	go func() {
+		if err := m.ReceiveMessages(replyTo, handler); err != nil {
+			logging.Logger.WithError(err).WithField("queue", replyTo).Warn("Stopped receiving replies")
+		}
+	}()
+	return replyTo, nil
+}
+
+// CreateLog creates a queue that keeps its messages for retention instead of
+// handing them to a consumer
+func (m *Memory) CreateLog(name string, retention time.Duration) error {
+	broker, err := m.connection()
+	if err != nil {
+		return err
+	}
+	broker.mu.Lock()
+	broker.declare(name).retention = retention
+	broker.mu.Unlock()
+	return nil
+}
+
+// ReadLog visits the unexpired messages of a log sent since the given time
+func (m *Memory) ReadLog(name string, since time.Time, visit func(Message) bool) error {
+	broker, err := m.connection()
+	if err != nil {
+		return err
+	}
+	broker.mu.Lock()
+	var messages []memoryMessage
+	if q, ok := broker.queues[name]; ok {
+		messages = append(messages, q.messages...)
+	}
+	broker.mu.Unlock()
+
+	now := time.Now()
+	for _, msg := range messages {
+		if msg.sent.Before(since) || (!msg.expires.IsZero() && !now.Before(msg.expires)) {
+			continue
+		}
+		if !visit(copyMessage(msg.Message)) {
+			break
+		}
+	}
+	return nil
+}
+
+// ListQueues lists the queues whose name starts with prefix
+func (m *Memory) ListQueues(prefix string) ([]QueueInfo, error) {
+	broker, err := m.connection()
+	if err != nil {
+		return nil, err
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	var infos []QueueInfo
+	for name, q := range broker.queues {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		info := QueueInfo{Name: name, Messages: len(q.messages), Consumers: q.consumers}
+		if q.consumers == 0 {
+			info.IdleSince = q.idleSince
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// DeleteQueue removes a queue and stops its consumers
+func (m *Memory) DeleteQueue(queueName string) error {
+	broker, err := m.connection()
+	if err != nil {
+		return err
+	}
+	broker.mu.Lock()
+	broker.delete(queueName)
+	broker.mu.Unlock()
+	return nil
+}
+
+// Close stops consumers started on this instance and deletes its reply queues
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed == nil {
+		return nil
+	}
+	select {
+	case <-m.closed:
+		return nil
+	default:
+	}
+	close(m.closed)
+
+	m.broker.mu.Lock()
+	for _, name := range m.replyQueues {
+		m.broker.delete(name)
+	}
+	m.broker.mu.Unlock()
+	m.replyQueues = nil
+	return nil
+}
+
+// connection returns the broker, or an error if not connected or closed
+func (m *Memory) connection() (*memoryBroker, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.broker == nil {
+		return nil, fmt.Errorf("memory queue is not connected")
+	}
+	select {
+	case <-m.closed:
+		return nil, errMemoryClosed
+	default:
+	}
+	return m.broker, nil
+}
+
+// push adds a message to an existing queue, honouring HeaderTTL
+func (m *Memory) push(queueName string, msg Message) error {
+	broker, err := m.connection()
+	if err != nil {
+		return err
+	}
+	msg = copyMessage(msg)
+	if user, _, ok := strings.Cut(m.URL, "@"); ok {
+		msg.UserID = user
+	}
+
+	now := time.Now()
+	var expires time.Time
+	if ttl, err := strconv.ParseInt(msg.Headers[HeaderTTL], 10, 64); err == nil {
+		expires = now.Add(time.Duration(ttl) * time.Millisecond)
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	q, ok := broker.queues[queueName]
+	if !ok {
+		return &UnroutableError{Queue: queueName, Reason: "NO_ROUTE"}
+	}
+	if q.retention > 0 {
+		q.trim(now.Add(-q.retention))
+		if retained := now.Add(q.retention); expires.IsZero() || retained.Before(expires) {
+			expires = retained
+		}
+	}
+	q.messages = append(q.messages, memoryMessage{Message: msg, sent: now, expires: expires})
+	q.wake()
+	return nil
+}
+
+// declare returns the queue, creating it if needed; b.mu must be held
+func (b *memoryBroker) declare(queueName string) *memoryQueue {
+	q, ok := b.queues[queueName]
+	if !ok {
+		q = &memoryQueue{notify: make(chan struct{}), idleSince: time.Now()}
+		b.queues[queueName] = q
+	}
+	return q
+}
+
+// delete removes a queue and wakes its consumers; b.mu must be held
+func (b *memoryBroker) delete(queueName string) {
+	if q, ok := b.queues[queueName]; ok {
+		q.deleted = true
+		q.wake()
+		delete(b.queues, queueName)
+	}
+}
+
+// pop removes the first unexpired message and counts its delivery
+func (q *memoryQueue) pop(now time.Time) (memoryMessage, bool) {
+	for len(q.messages) > 0 {
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		if msg.expires.IsZero() || now.Before(msg.expires) {
+			q.idleSince = now
+			msg.deliveries++
+			return msg, true
+		}
+	}
+	return memoryMessage{}, false
+}
+
+// requeue puts a message back at the head of a queue that was not deleted
+func (q *memoryQueue) requeue(msg memoryMessage) {
+	if q.deleted {
+		return
+	}
+	q.messages = append([]memoryMessage{msg}, q.messages...)
+	q.wake()
+}
+
+// trim drops the messages of a log sent before cutoff
+func (q *memoryQueue) trim(cutoff time.Time) {
+	for len(q.messages) > 0 && q.messages[0].sent.Before(cutoff) {
+		q.messages = q.messages[1:]
+	}
+}
+
+// wake notifies consumers waiting on the queue
+func (q *memoryQueue) wake() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// copyMessage returns msg with its own copy of the headers
+func copyMessage(msg Message) Message {
+	msg.Headers = copyHeaders(msg.Headers)
+	return msg
+}
@@ -0,0 +1,80 @@
+package queue_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/queue/queuetest"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	broker := "memory-" + uuid.New().String()
+	queuetest.Run(t, func(t *testing.T) queue.MessageQueue {
+		mq, err := queue.NewMessageQueue("memory", broker)
+		if err != nil {
+			t.Fatalf("NewMessageQueue: %v", err)
+		}
+		return mq
+	})
+	queuetest.RunLog(t, func(t *testing.T) queue.MessageQueue {
+		return &queue.Memory{URL: broker}
+	})
+}
+
+func TestMemorySender(t *testing.T) {
+	broker := "memory-" + uuid.New().String()
+	queuetest.RunSender(t, func(t *testing.T) queue.MessageQueue {
+		return &queue.Memory{URL: "alice@" + broker}
+	}, "alice")
+	queuetest.RunSender(t, func(t *testing.T) queue.MessageQueue {
+		return queue.WithChunking(&queue.Memory{URL: "bob@" + broker}, 4)
+	}, "bob")
+	queuetest.RunSender(t, func(t *testing.T) queue.MessageQueue {
+		return &queue.Memory{URL: broker}
+	}, "")
+}
+
+// TestDecoratedMemoryConformance runs the suite through the chunking and
+// compression decorators, with limits low enough that both take effect
+func TestDecoratedMemoryConformance(t *testing.T) {
+	broker := "memory-" + uuid.New().String()
+	queuetest.Run(t, func(t *testing.T) queue.MessageQueue {
+		return queue.WithCompression(queue.WithChunking(&queue.Memory{URL: broker}, 4), "gzip", 1)
+	})
+}
+
+func TestMemoryLogSinceAndRetention(t *testing.T) {
+	mq := &queue.Memory{URL: "memory-" + uuid.New().String()}
+	if err := mq.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer mq.Close()
+	if err := mq.CreateLog("log", 50*time.Millisecond); err != nil {
+		t.Fatalf("CreateLog: %v", err)
+	}
+	read := func(since time.Time) []string {
+		var bodies []string
+		mq.ReadLog("log", since, func(msg queue.Message) bool {
+			bodies = append(bodies, msg.Body)
+			return true
+		})
+		return bodies
+	}
+
+	mq.SendMessage("log", "old", "", "", nil)
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	mq.SendMessage("log", "new", "", "", nil)
+	if got := read(since); !reflect.DeepEqual(got, []string{"new"}) {
+		t.Errorf("entries since the second send = %q, want [new]", got)
+	}
+
+	// Entries expire after the retention even though nothing consumed them
+	time.Sleep(60 * time.Millisecond)
+	if got := read(time.Time{}); len(got) != 0 {
+		t.Errorf("entries after the retention = %q, want none", got)
+	}
+}
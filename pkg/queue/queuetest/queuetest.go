@@ -0,0 +1,461 @@
+// Package queuetest provides a conformance suite for queue.MessageQueue
+// implementations.
+package queuetest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+)
+
+// Timeout bounds every wait in the suite
+const Timeout = 10 * time.Second
+
+// Factory returns a new, unconnected MessageQueue. Queues returned by the same
+// factory must share a broker, as an agent and a client would.
+type Factory func(t *testing.T) queue.MessageQueue
+
+// Run runs the conformance suite against the queues returned by newQueue
+func Run(t *testing.T, newQueue Factory) {
+	t.Run("SendReceive", func(t *testing.T) { testSendReceive(t, newQueue) })
+	t.Run("PreservesMetadata", func(t *testing.T) { testPreservesMetadata(t, newQueue) })
+	t.Run("PublishResponse", func(t *testing.T) { testPublishResponse(t, newQueue) })
+	t.Run("CreateDelete", func(t *testing.T) { testCreateDelete(t, newQueue) })
+	t.Run("Close", func(t *testing.T) { testClose(t, newQueue) })
+	t.Run("ConcurrentSend", func(t *testing.T) { testConcurrentSend(t, newQueue) })
+	t.Run("DirectReplies", func(t *testing.T) { testDirectReplies(t, newQueue) })
+	t.Run("HandlerFailure", func(t *testing.T) { testHandlerFailure(t, newQueue) })
+}
+
+// RunSender checks that commands and responses sent by the queues of
+// newQueue are received with user as their UserID
+func RunSender(t *testing.T, newQueue Factory, user string) {
+	sender, receiver := connect(t, newQueue), connect(t, newQueue)
+	name := queueName(t, receiver)
+	messages, _ := consume(receiver, name)
+
+	if err := sender.SendMessage(name, "get pods", "correlation-3", "", map[string]string{"X-Client-ID": "someone-else"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if msg := receive(t, messages); msg.UserID != user {
+		t.Errorf("command UserID = %q, want %q", msg.UserID, user)
+	}
+	if err := sender.PublishResponse(name, "correlation-3", "pod/web", nil); err != nil {
+		t.Fatalf("PublishResponse: %v", err)
+	}
+	if msg := receive(t, messages); msg.UserID != user {
+		t.Errorf("response UserID = %q, want %q", msg.UserID, user)
+	}
+}
+
+// connect returns a connected queue that is closed when the test ends
+func connect(t *testing.T, newQueue Factory) queue.MessageQueue {
+	t.Helper()
+	mq := newQueue(t)
+	if err := mq.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { mq.Close() })
+	return mq
+}
+
+// queueName returns a unique queue name and deletes the queue when the test ends
+func queueName(t *testing.T, mq queue.MessageQueue) string {
+	t.Helper()
+	name := fmt.Sprintf("queuetest-%s", uuid.New().String()[:8])
+	if err := mq.CreateQueue(name); err != nil {
+		t.Fatalf("CreateQueue(%s): %v", name, err)
+	}
+	t.Cleanup(func() { mq.DeleteQueue(name) })
+	return name
+}
+
+// consume starts receiving from name and returns the received messages and
+// a channel that yields ReceiveMessages' result
+func consume(mq queue.MessageQueue, name string) (<-chan queue.Message, <-chan error) {
+	messages := make(chan queue.Message, 1024)
+	done := make(chan error, 1)
+	go func() {
+		done <- mq.ReceiveMessages(name, func(msg queue.Message) error {
+			messages <- msg
+			return nil
+		})
+	}()
+	return messages, done
+}
+
+// receive waits for the next message
+func receive(t *testing.T, messages <-chan queue.Message) queue.Message {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(Timeout):
+		t.Fatalf("no message received after %s", Timeout)
+		return queue.Message{}
+	}
+}
+
+func testSendReceive(t *testing.T, newQueue Factory) {
+	mq := connect(t, newQueue)
+	name := queueName(t, mq)
+	messages, _ := consume(mq, name)
+
+	for i := 0; i < 3; i++ {
+		if err := mq.SendMessage(name, fmt.Sprintf("message %d", i), "", "", nil); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[receive(t, messages).Body] = true
+	}
+	for i := 0; i < 3; i++ {
+		if body := fmt.Sprintf("message %d", i); !seen[body] {
+			t.Errorf("message %q was not received", body)
+		}
+	}
+}
+
+func testPreservesMetadata(t *testing.T, newQueue Factory) {
+	sender, receiver := connect(t, newQueue), connect(t, newQueue)
+	name := queueName(t, receiver)
+	messages, _ := consume(receiver, name)
+
+	headers := map[string]string{"X-Test": "value"}
+	if err := sender.SendMessage(name, "get pods", "correlation-1", "reply-queue-test", headers); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	msg := receive(t, messages)
+	if msg.Body != "get pods" {
+		t.Errorf("Body = %q, want %q", msg.Body, "get pods")
+	}
+	if msg.CorrelationID != "correlation-1" {
+		t.Errorf("CorrelationID = %q, want %q", msg.CorrelationID, "correlation-1")
+	}
+	if msg.ReplyTo != "reply-queue-test" {
+		t.Errorf("ReplyTo = %q, want %q", msg.ReplyTo, "reply-queue-test")
+	}
+	if msg.Headers["X-Test"] != "value" {
+		t.Errorf("Headers[X-Test] = %q, want %q", msg.Headers["X-Test"], "value")
+	}
+	if _, ok := headers[queue.HeaderSentAt]; len(headers) != 1 || ok {
+		t.Errorf("SendMessage modified the caller's headers: %v", headers)
+	}
+}
+
+func testPublishResponse(t *testing.T, newQueue Factory) {
+	agent, client := connect(t, newQueue), connect(t, newQueue)
+	replyTo := queueName(t, client)
+	messages, _ := consume(client, replyTo)
+
+	if err := agent.PublishResponse(replyTo, "correlation-2", "pod/web", map[string]string{"X-Test": "value"}); err != nil {
+		t.Fatalf("PublishResponse: %v", err)
+	}
+	msg := receive(t, messages)
+	if msg.Body != "pod/web" || msg.CorrelationID != "correlation-2" {
+		t.Errorf("got %q with correlation %q, want %q with correlation %q", msg.Body, msg.CorrelationID, "pod/web", "correlation-2")
+	}
+	if msg.Headers["X-Test"] != "value" {
+		t.Errorf("Headers[X-Test] = %q, want %q", msg.Headers["X-Test"], "value")
+	}
+}
+
+func testCreateDelete(t *testing.T, newQueue Factory) {
+	mq := connect(t, newQueue)
+	name := queueName(t, mq)
+
+	// Creating an existing queue is not an error
+	if err := mq.CreateQueue(name); err != nil {
+		t.Fatalf("CreateQueue on an existing queue: %v", err)
+	}
+	if err := mq.SendMessage(name, "before delete", "", "", nil); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if err := mq.DeleteQueue(name); err != nil {
+		t.Fatalf("DeleteQueue: %v", err)
+	}
+
+	err := mq.SendMessage(name, "after delete", "", "", nil)
+	var unroutable *queue.UnroutableError
+	if !errors.As(err, &unroutable) {
+		t.Fatalf("SendMessage to a deleted queue returned %v, want an *queue.UnroutableError", err)
+	}
+
+	// A re-created queue starts empty
+	if err := mq.CreateQueue(name); err != nil {
+		t.Fatalf("CreateQueue after delete: %v", err)
+	}
+	messages, _ := consume(mq, name)
+	if err := mq.SendMessage(name, "after create", "", "", nil); err != nil {
+		t.Fatalf("SendMessage after re-create: %v", err)
+	}
+	if msg := receive(t, messages); msg.Body != "after create" {
+		t.Errorf("received %q from the re-created queue, want %q", msg.Body, "after create")
+	}
+}
+
+func testClose(t *testing.T, newQueue Factory) {
+	mq := newQueue(t)
+	if err := mq.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	name := queueName(t, mq)
+	_, done := consume(mq, name)
+	time.Sleep(100 * time.Millisecond) // Let the consumer start
+
+	if err := mq.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ReceiveMessages returned %v after Close, want nil", err)
+		}
+	case <-time.After(Timeout):
+		t.Fatalf("ReceiveMessages did not return within %s of Close", Timeout)
+	}
+
+	if err := mq.SendMessage(name, "after close", "", "", nil); err == nil {
+		t.Error("SendMessage after Close succeeded, want an error")
+	}
+	if err := mq.Close(); err != nil {
+		t.Errorf("second Close returned %v, want nil", err)
+	}
+}
+
+func testConcurrentSend(t *testing.T, newQueue Factory) {
+	const senders, perSender = 8, 25
+	mq := connect(t, newQueue)
+	name := queueName(t, mq)
+	messages, _ := consume(mq, name)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, senders)
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				if err := mq.SendMessage(name, fmt.Sprintf("%d-%d", s, i), "", "", nil); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("SendMessage: %v", err)
+	}
+
+	seen := map[string]bool{}
+	for len(seen) < senders*perSender {
+		msg := receive(t, messages)
+		if seen[msg.Body] {
+			t.Fatalf("message %q received twice", msg.Body)
+		}
+		seen[msg.Body] = true
+	}
+}
+
+func testDirectReplies(t *testing.T, newQueue Factory) {
+	client := connect(t, newQueue)
+	consumer, ok := client.(queue.ReplyConsumer)
+	if !ok {
+		t.Skip("backend does not implement queue.ReplyConsumer")
+	}
+	agent := connect(t, newQueue)
+
+	replies := make(chan queue.Message, 1)
+	replyTo, err := consumer.ConsumeReplies(func(msg queue.Message) error {
+		replies <- msg
+		return nil
+	})
+	if errors.Is(err, queue.ErrRepliesUnsupported) {
+		t.Skip("backend does not support direct replies")
+	}
+	if err != nil {
+		t.Fatalf("ConsumeReplies: %v", err)
+	}
+
+	// Direct replies need a command to reply to on some brokers, so relay one
+	commands := queueName(t, agent)
+	messages, _ := consume(agent, commands)
+	if err := client.SendMessage(commands, "get pods", "correlation-3", replyTo, nil); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	command := receive(t, messages)
+	if err := agent.PublishResponse(command.ReplyTo, command.CorrelationID, "pod/web", nil); err != nil {
+		t.Fatalf("PublishResponse: %v", err)
+	}
+	if msg := receive(t, replies); msg.Body != "pod/web" || msg.CorrelationID != "correlation-3" {
+		t.Errorf("got %q with correlation %q, want %q with correlation %q", msg.Body, msg.CorrelationID, "pod/web", "correlation-3")
+	}
+}
+
+// RunLog runs the suite for queue.LogReader against the queues returned by
+// newQueue, skipping it if they do not implement it
+func RunLog(t *testing.T, newQueue Factory) {
+	t.Run("ConcurrentReaders", func(t *testing.T) { testLogConcurrentReaders(t, newQueue) })
+	t.Run("StopVisiting", func(t *testing.T) { testLogStopVisiting(t, newQueue) })
+	t.Run("MissingLog", func(t *testing.T) { testLogMissing(t, newQueue) })
+}
+
+// connectLog returns a connected queue as a LogReader
+func connectLog(t *testing.T, newQueue Factory) (queue.MessageQueue, queue.LogReader) {
+	t.Helper()
+	mq := connect(t, newQueue)
+	reader, ok := mq.(queue.LogReader)
+	if !ok {
+		t.Skip("backend does not implement queue.LogReader")
+	}
+	return mq, reader
+}
+
+// logName creates a log with unique name holding bodies and deletes it when the test ends
+func logName(t *testing.T, mq queue.MessageQueue, reader queue.LogReader, bodies ...string) string {
+	t.Helper()
+	name := fmt.Sprintf("queuetest-log-%s", uuid.New().String()[:8])
+	if err := reader.CreateLog(name, time.Hour); err != nil {
+		t.Fatalf("CreateLog(%s): %v", name, err)
+	}
+	t.Cleanup(func() { mq.DeleteQueue(name) })
+	for _, body := range bodies {
+		if err := mq.SendMessage(name, body, "", "", nil); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+	}
+	return name
+}
+
+// readLog returns the bodies of the log entries since the given time
+func readLog(t *testing.T, reader queue.LogReader, name string, since time.Time) []string {
+	t.Helper()
+	var bodies []string
+	err := reader.ReadLog(name, since, func(msg queue.Message) bool {
+		bodies = append(bodies, msg.Body)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ReadLog(%s): %v", name, err)
+	}
+	return bodies
+}
+
+func testLogConcurrentReaders(t *testing.T, newQueue Factory) {
+	writer, writerLog := connectLog(t, newQueue)
+	start := time.Now().Add(-time.Minute)
+	name := logName(t, writer, writerLog, "one", "two", "three")
+
+	// Readers on other connections all see every entry, however often they read
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*3)
+	for i := 0; i < 8; i++ {
+		_, reader := connectLog(t, newQueue)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				var bodies []string
+				err := reader.ReadLog(name, start, func(msg queue.Message) bool {
+					bodies = append(bodies, msg.Body)
+					return true
+				})
+				if err != nil {
+					errs <- fmt.Errorf("reader %d: %v", i, err)
+				} else if fmt.Sprint(bodies) != "[one two three]" {
+					errs <- fmt.Errorf("reader %d read %q, want [one two three]", i, bodies)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testLogStopVisiting(t *testing.T, newQueue Factory) {
+	mq, reader := connectLog(t, newQueue)
+	name := logName(t, mq, reader, "one", "two", "three")
+
+	visited := 0
+	err := reader.ReadLog(name, time.Now().Add(-time.Minute), func(msg queue.Message) bool {
+		visited++
+		return msg.Body != "two"
+	})
+	if err != nil {
+		t.Fatalf("ReadLog: %v", err)
+	}
+	if visited != 2 {
+		t.Errorf("visited %d entries, want 2 as the visit stopped at the second", visited)
+	}
+}
+
+func testLogMissing(t *testing.T, newQueue Factory) {
+	_, reader := connectLog(t, newQueue)
+	name := fmt.Sprintf("queuetest-missing-%s", uuid.New().String()[:8])
+	if bodies := readLog(t, reader, name, time.Now().Add(-time.Minute)); len(bodies) != 0 {
+		t.Errorf("missing log read %q, want no entries", bodies)
+	}
+}
+
+func testHandlerFailure(t *testing.T, newQueue Factory) {
+	mq := connect(t, newQueue)
+	name := queueName(t, mq)
+
+	// The handler fails the first delivery of "flaky" and every delivery of "poison"
+	var mu sync.Mutex
+	deliveries := map[string]int{}
+	handled := make(chan string, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- mq.ReceiveMessages(name, func(msg queue.Message) error {
+			mu.Lock()
+			deliveries[msg.Body]++
+			n := deliveries[msg.Body]
+			mu.Unlock()
+			if msg.Body == "poison" || (msg.Body == "flaky" && n == 1) {
+				return fmt.Errorf("failed to handle %s", msg.Body)
+			}
+			handled <- msg.Body
+			return nil
+		})
+	}()
+
+	for _, body := range []string{"poison", "flaky", "after"} {
+		if err := mq.SendMessage(name, body, "correlation-"+body, "", nil); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+	}
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		select {
+		case body := <-handled:
+			seen[body] = true
+		case err := <-done:
+			t.Fatalf("ReceiveMessages returned %v after a handler failed, want it to go on", err)
+		case <-time.After(Timeout):
+			t.Fatalf("handled %v, want the failed message delivered again and the next one handled", seen)
+		}
+	}
+	if !seen["flaky"] || !seen["after"] {
+		t.Errorf("handled %v, want flaky and after", seen)
+	}
+
+	// The message failing every time is dropped after MaxDeliveries
+	time.Sleep(500 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if deliveries["poison"] != queue.MaxDeliveries || deliveries["flaky"] != 2 || deliveries["after"] != 1 {
+		t.Errorf("deliveries = %v, want poison delivered %d times, flaky twice and after once", deliveries, queue.MaxDeliveries)
+	}
+}
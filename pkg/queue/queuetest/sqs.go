@@ -0,0 +1,233 @@
+package queuetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StartSQS serves a fake SQS for the rest of the test and points the AWS SDK
+// at it, away from real credentials. It returns the base URL of the server;
+// queue URLs have the form <url>/000000000000/<name>.
+func StartSQS(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(newFakeSQS())
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	t.Setenv("AWS_ENDPOINT_URL_SQS", server.URL)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	return server.URL
+}
+
+// fakeSQS is a stand-in for SQS speaking the subset of its JSON protocol
+// that the SQS backend uses. Received messages stay invisible until they are
+// deleted or made visible again; their visibility timeout never expires.
+type fakeSQS struct {
+	mu     sync.Mutex
+	queues map[string]*fakeSQSQueue // By name
+}
+
+type fakeSQSQueue struct {
+	messages []fakeSQSMessage
+	inflight map[string]fakeSQSMessage // Received messages by receipt handle
+	notify   chan struct{}
+	created  time.Time
+	tags     map[string]string
+}
+
+type fakeSQSMessage struct {
+	MessageId         string
+	ReceiptHandle     string
+	Body              string
+	MessageAttributes map[string]fakeSQSAttribute `json:",omitempty"`
+	Attributes        map[string]string           `json:",omitempty"`
+	receives          int
+}
+
+type fakeSQSAttribute struct {
+	DataType    string
+	StringValue string
+}
+
+func newFakeSQS() *fakeSQS {
+	return &fakeSQS{queues: map[string]*fakeSQSQueue{}}
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		QueueName         string
+		QueueNamePrefix   string
+		QueueUrl          string
+		MessageBody       string
+		MessageAttributes map[string]fakeSQSAttribute
+		WaitTimeSeconds   int
+		ReceiptHandle     string
+		Tags              map[string]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		fakeSQSError(w, "InvalidParameterValue", err.Error())
+		return
+	}
+	name := input.QueueName
+	if input.QueueUrl != "" {
+		name = input.QueueUrl[strings.LastIndex(input.QueueUrl, "/")+1:]
+	}
+	queueURL := fmt.Sprintf("http://%s/000000000000/%s", r.Host, name)
+
+	f.mu.Lock()
+	q, exists := f.queues[name]
+	f.mu.Unlock()
+
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSQS.")
+	if !exists && action != "CreateQueue" && action != "ListQueues" {
+		fakeSQSError(w, "QueueDoesNotExist", "The specified queue does not exist.")
+		return
+	}
+
+	switch action {
+	case "CreateQueue":
+		f.mu.Lock()
+		if !exists {
+			f.queues[name] = &fakeSQSQueue{notify: make(chan struct{}), inflight: map[string]fakeSQSMessage{}, created: time.Now(), tags: map[string]string{}}
+		}
+		f.mu.Unlock()
+		fakeSQSReply(w, map[string]string{"QueueUrl": queueURL})
+	case "GetQueueUrl":
+		fakeSQSReply(w, map[string]string{"QueueUrl": queueURL})
+	case "SendMessage":
+		msg := fakeSQSMessage{MessageId: uuid.New().String(), Body: input.MessageBody, MessageAttributes: input.MessageAttributes, Attributes: map[string]string{}}
+		// SQS reports the signing principal; the fake uses the access key ID
+		if _, credential, ok := strings.Cut(r.Header.Get("Authorization"), "Credential="); ok {
+			accessKey, _, _ := strings.Cut(credential, "/")
+			msg.Attributes["SenderId"] = accessKey
+		}
+		f.mu.Lock()
+		q.messages = append(q.messages, msg)
+		close(q.notify)
+		q.notify = make(chan struct{})
+		f.mu.Unlock()
+		fakeSQSReply(w, map[string]string{"MessageId": msg.MessageId})
+	case "ReceiveMessage":
+		deadline := time.After(time.Duration(input.WaitTimeSeconds) * time.Second)
+		for {
+			f.mu.Lock()
+			messages, notify := q.messages, q.notify
+			if len(messages) > 10 {
+				messages = messages[:10]
+			}
+			q.messages = q.messages[len(messages):]
+			for i := range messages {
+				messages[i] = messages[i].receive()
+				q.inflight[messages[i].ReceiptHandle] = messages[i]
+			}
+			f.mu.Unlock()
+
+			if len(messages) > 0 {
+				fakeSQSReply(w, map[string][]fakeSQSMessage{"Messages": messages})
+				return
+			}
+			select {
+			case <-notify:
+			case <-deadline:
+				fakeSQSReply(w, map[string]string{})
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	case "DeleteMessage":
+		f.mu.Lock()
+		delete(q.inflight, input.ReceiptHandle)
+		f.mu.Unlock()
+		fakeSQSReply(w, map[string]string{})
+	case "ChangeMessageVisibility":
+		// Only a visibility timeout of zero is supported, making the message visible at once
+		f.mu.Lock()
+		if msg, ok := q.inflight[input.ReceiptHandle]; ok {
+			delete(q.inflight, input.ReceiptHandle)
+			q.messages = append([]fakeSQSMessage{msg}, q.messages...)
+			close(q.notify)
+			q.notify = make(chan struct{})
+		}
+		f.mu.Unlock()
+		fakeSQSReply(w, map[string]string{})
+	case "DeleteQueue":
+		f.mu.Lock()
+		delete(f.queues, name)
+		f.mu.Unlock()
+		fakeSQSReply(w, map[string]string{})
+	case "ListQueues":
+		var urls []string
+		f.mu.Lock()
+		for queueName := range f.queues {
+			if strings.HasPrefix(queueName, input.QueueNamePrefix) {
+				urls = append(urls, fmt.Sprintf("http://%s/000000000000/%s", r.Host, queueName))
+			}
+		}
+		f.mu.Unlock()
+		fakeSQSReply(w, map[string][]string{"QueueUrls": urls})
+	case "GetQueueAttributes":
+		f.mu.Lock()
+		attributes := map[string]string{
+			"ApproximateNumberOfMessages": fmt.Sprint(len(q.messages)),
+			"CreatedTimestamp":            fmt.Sprint(q.created.Unix()),
+			"LastModifiedTimestamp":       fmt.Sprint(q.created.Unix()),
+		}
+		f.mu.Unlock()
+		fakeSQSReply(w, map[string]map[string]string{"Attributes": attributes})
+	case "TagQueue":
+		f.mu.Lock()
+		for key, value := range input.Tags {
+			q.tags[key] = value
+		}
+		f.mu.Unlock()
+		fakeSQSReply(w, map[string]string{})
+	case "ListQueueTags":
+		f.mu.Lock()
+		tags := map[string]string{}
+		for key, value := range q.tags {
+			tags[key] = value
+		}
+		f.mu.Unlock()
+		fakeSQSReply(w, map[string]map[string]string{"Tags": tags})
+	default:
+		fakeSQSError(w, "InvalidAction", "unsupported action "+action)
+	}
+}
+
+// receive returns the message as received once more, with a new receipt handle
+func (m fakeSQSMessage) receive() fakeSQSMessage {
+	m.receives++
+	m.ReceiptHandle = uuid.New().String()
+	attributes := map[string]string{}
+	for key, value := range m.Attributes {
+		attributes[key] = value
+	}
+	attributes["ApproximateReceiveCount"] = fmt.Sprint(m.receives)
+	m.Attributes = attributes
+	return m
+}
+
+func fakeSQSReply(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(body)
+}
+
+func fakeSQSError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.sqs#" + code, "message": message})
+}
@@ -1,51 +1,134 @@
 package queue
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/loaynaser3/KubeGate/pkg/metrics"
+	"github.com/loaynaser3/KubeGate/pkg/redact"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
 
-// RabbitMQ implements the MessageQueue interface for RabbitMQ
+// Reconnect defaults for RabbitMQ
+const (
+	DefaultMinBackoff     = 500 * time.Millisecond
+	DefaultMaxBackoff     = 30 * time.Second
+	DefaultPublishTimeout = 30 * time.Second
+)
+
+// DirectReplyTo is the RabbitMQ pseudo-queue used for Direct Reply-To
+const DirectReplyTo = "amq.rabbitmq.reply-to"
+
+// logPrefetch and logIdleTimeout bound how ReadLog consumes a stream: how many
+// unacknowledged entries it buffers and how long it waits for the next one
+// before concluding it reached the end
+const (
+	logPrefetch    = 100
+	logIdleTimeout = 250 * time.Millisecond
+)
+
+// ReplyQueueExpiry is how long an unused reply queue lives before the broker deletes it
+const ReplyQueueExpiry = time.Hour
+
+// errRabbitMQClosed is returned by operations attempted after Close
+var errRabbitMQClosed = errors.New("RabbitMQ connection has been closed")
+
+// RabbitMQ implements the MessageQueue interface for RabbitMQ. After Connect
+// it watches the connection and channel and reconnects with exponential
+// backoff when either is lost, redeclaring queues and resuming consumers.
 type RabbitMQ struct {
-	Conn    *amqp.Connection
-	Channel *amqp.Channel
-	URL     string
+	URL string
+
+	// ManagementURL is the base URL of the management API used to list
+	// queues; when empty it is derived from URL
+	ManagementURL string
+
+	MinBackoff     time.Duration // First reconnect delay
+	MaxBackoff     time.Duration // Upper bound of the reconnect delay
+	PublishTimeout time.Duration // How long publishes wait for a reconnect before failing
+
+	dialer func(url string) (amqpConnection, error) // Opens connections; amqp.Dial when nil
+
+	mu        sync.Mutex
+	conn      amqpConnection
+	ch        amqpChannel // Publishing channel of conn, in confirm mode
+	pubMu     sync.Mutex  // Serializes publishes so each confirm matches its message
+	confirms  chan amqp.Confirmation
+	returns   chan amqp.Return
+	published uint64              // Delivery tag of the last publish on the current channel
+	replyCh   amqpChannel         // Channel consuming Direct Reply-To, which commands must be published on
+	replies   func(Message) error // Handler of Direct Reply-To, consumed again after a reconnect
+	connected bool
+	closed    bool
+	done      chan struct{}          // Closed by Close to stop reconnecting
+	changed   chan struct{}          // Closed and replaced on every connection change
+	queues    map[string]bool        // Declared queues, redeclared after a reconnect
+	listeners []chan ConnectionEvent // Subscribers registered through Events
 }
 
 // Connect establishes a connection to RabbitMQ and opens a channel
 func (r *RabbitMQ) Connect() error {
-	conn, err := amqp.Dial(r.URL)
+	conn, ch, err := r.dial()
 	if err != nil {
-		return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+		return err
 	}
-	r.Conn = conn
 
-	ch, err := conn.Channel()
-	if err != nil {
-		return fmt.Errorf("failed to open a channel: %v", err)
+	r.mu.Lock()
+	r.done = make(chan struct{})
+	r.changed = make(chan struct{})
+	if r.queues == nil {
+		r.queues = map[string]bool{}
 	}
-	r.Channel = ch
+	r.setConnection(conn, ch)
+	r.mu.Unlock()
+
+	r.emit(ConnectionEvent{State: StateConnected})
+	go r.watch(conn, ch)
 	logging.Logger.Info("Connected to RabbitMQ successfully")
 	return nil
 }
 
+// Events returns a channel of connection state changes
+func (r *RabbitMQ) Events() <-chan ConnectionEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make(chan ConnectionEvent, 16)
+	if r.closed {
+		close(events)
+		return events
+	}
+	r.listeners = append(r.listeners, events)
+	return events
+}
+
+// Healthy reports an error when the connection to RabbitMQ has been lost
+func (r *RabbitMQ) Healthy() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errRabbitMQClosed
+	}
+	if !r.connected {
+		return fmt.Errorf("RabbitMQ connection is down, reconnecting")
+	}
+	return nil
+}
+
 // DeclareQueue ensures a queue exists with consistent attributes
 func (r *RabbitMQ) DeclareQueue(queueName string) error {
-	_, err := r.Channel.QueueDeclare(
-		queueName,
-		true,  // Durable
-		false, // Auto-delete
-		false, // Exclusive
-		false, // No-wait
-		nil,   // Arguments
-	)
+	conn, ch, err := r.waitChannel(nil, time.Now().Add(r.publishTimeout()))
 	if err != nil {
 		return fmt.Errorf("failed to declare queue %s: %v", queueName, err)
 	}
+	if err := r.declareOn(conn, ch, queueName); err != nil {
+		return err
+	}
 
 	logging.Logger.WithField("queue", queueName).Info("Queue declared successfully")
 	return nil
@@ -53,44 +136,97 @@ func (r *RabbitMQ) DeclareQueue(queueName string) error {
 
 // CreateQueue ensures a queue exists with consistent attributes
 func (r *RabbitMQ) CreateQueue(queueName string) error {
-	_, err := r.Channel.QueueDeclare(
+	conn, ch, err := r.waitChannel(nil, time.Now().Add(r.publishTimeout()))
+	if err != nil {
+		return fmt.Errorf("failed to declare queue %s: %v", queueName, err)
+	}
+	if err := r.declareOn(conn, ch, queueName); err != nil {
+		return err
+	}
+
+	logging.Logger.WithField("queue", queueName).Info("Queue created successfully")
+	return nil
+}
+
+// declareOn declares a queue on ch, a channel of conn, and remembers it for
+// redeclaration
+func (r *RabbitMQ) declareOn(conn amqpConnection, ch amqpChannel, queueName string) error {
+	durable, args := true, amqp.Table(nil)
+	if strings.HasPrefix(queueName, ReplyQueuePrefix) {
+		// Reply queues created by earlier versions are durable and never
+		// expire; declaring them with other arguments fails and closes the
+		// channel, so an existing reply queue is used as it is
+		exists, err := queueExists(conn, queueName)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue %s: %v", queueName, err)
+		}
+		if exists {
+			r.mu.Lock()
+			r.queues[queueName] = true
+			r.mu.Unlock()
+			return nil
+		}
+		// Reply queues of crashed or abandoned clients expire on their own
+		durable, args = false, amqp.Table{"x-expires": ReplyQueueExpiry.Milliseconds()}
+	}
+
+	_, err := ch.QueueDeclare(
 		queueName, // Queue name
-		true,      // Durable
+		durable,   // Durable
 		false,     // Auto-delete
 		false,     // Exclusive
 		false,     // No-wait
-		nil,       // Arguments
+		args,      // Arguments
 	)
 	if err != nil {
 		return fmt.Errorf("failed to declare queue %s: %v", queueName, err)
 	}
 
-	logging.Logger.WithField("queue", queueName).Info("Queue created successfully")
+	r.mu.Lock()
+	r.queues[queueName] = true
+	r.mu.Unlock()
 	return nil
 }
 
+// queueExists checks for a queue on a channel of its own, as the broker
+// closes the channel when the queue does not exist
+func queueExists(conn amqpConnection, queueName string) (bool, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+
+	if _, err := ch.QueueDeclarePassive(queueName, false, false, false, false, nil); err != nil {
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 // SendMessage publishes a message to a specified queue
-func (r *RabbitMQ) SendMessage(queueName, message, correlationID, replyTo string) error {
-	// Ensure the queue exists
-	if err := r.DeclareQueue(queueName); err != nil {
-		return fmt.Errorf("failed to ensure queue exists: %v", err)
-	}
-
-	// Publish the message
-	err := r.Channel.Publish(
-		"",        // Exchange
-		queueName, // Routing key
-		false,     // Mandatory
-		false,     // Immediate
-		amqp.Publishing{
-			ContentType:   "text/plain",
-			Body:          []byte(message),
-			CorrelationId: correlationID,
-			ReplyTo:       replyTo,
-		},
-	)
+func (r *RabbitMQ) SendMessage(queueName, message, correlationID, replyTo string, headers map[string]string) (err error) {
+	headers, span := startPublishSpan("SendMessage", "rabbitmq", queueName, withSentAt(headers))
+	defer func() { endSpan(span, err) }()
+
+	// Publish the message, retrying across a reconnect. The queue is not
+	// declared here: a missing queue means no agent has ever consumed from it,
+	// and the broker returns the message as unroutable.
+	err = r.publish(queueName, amqp.Publishing{
+		ContentType:   "text/plain",
+		Body:          []byte(message),
+		CorrelationId: correlationID,
+		ReplyTo:       replyTo,
+		Headers:       toAMQPTable(headers),
+		Expiration:    headers[HeaderTTL],
+		UserId:        r.userID(),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to publish message: %v", err)
+		countPublishFailure("rabbitmq", "send")
+		return fmt.Errorf("failed to publish message: %w", err)
 	}
 
 	logging.Logger.WithFields(logrus.Fields{
@@ -101,71 +237,210 @@ func (r *RabbitMQ) SendMessage(queueName, message, correlationID, replyTo string
 	return nil
 }
 
-// ReceiveMessages consumes messages from a specified queue and invokes the handler
+// ReceiveMessages consumes messages from a specified queue and invokes the
+// handler. It resumes consuming after a reconnect and returns once the
+// connection is closed.
 func (r *RabbitMQ) ReceiveMessages(queueName string, handler func(Message) error) error {
-	// Ensure the queue exists
-	if err := r.DeclareQueue(queueName); err != nil {
-		return fmt.Errorf("failed to ensure queue exists: %v", err)
+	var prev amqpChannel
+	for {
+		conn, ch, err := r.waitChannel(prev, time.Time{})
+		if errors.Is(err, errRabbitMQClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		prev = ch
+
+		// Ensure the queue exists
+		if err := r.declareOn(conn, ch, queueName); err != nil {
+			if isChannelAlreadyClosedError(err) {
+				continue
+			}
+			return fmt.Errorf("failed to ensure queue exists: %v", err)
+		}
+
+		// Start consuming messages
+		msgs, err := ch.Consume(
+			queueName, // Queue name
+			"",        // Consumer tag
+			false,     // Auto-ack; messages are acknowledged once handled
+			false,     // Exclusive
+			false,     // No-local
+			false,     // No-wait
+			nil,       // Args
+		)
+		if err != nil {
+			if isChannelAlreadyClosedError(err) {
+				continue
+			}
+			return fmt.Errorf("failed to consume messages: %v", err)
+		}
+
+		logging.Logger.WithField("queue", queueName).Info("Started listening to queue")
+
+		// Process messages using the provided handler
+		for msg := range msgs {
+			settleDelivery(queueName, msg, handleDelivery(queueName, msg, handler))
+		}
+
+		if r.isClosed() {
+			return nil
+		}
+		logging.Logger.WithField("queue", queueName).Warn("Consumer interrupted, waiting for RabbitMQ to reconnect")
 	}
+}
 
-	// Start consuming messages
-	msgs, err := r.Channel.Consume(
-		queueName, // Queue name
-		"",        // Consumer tag
-		true,      // Auto-ack
-		false,     // Exclusive
-		false,     // No-local
-		false,     // No-wait
-		nil,       // Args
+// ConsumeReplies consumes from Direct Reply-To on the publishing channel, so
+// replies reach this client without a reply queue. Commands must be sent
+// after it returns. The consumer is started again on the channel of every
+// reconnect; replies sent while the connection was down are lost.
+func (r *RabbitMQ) ConsumeReplies(handler func(Message) error) (string, error) {
+	ch, err := r.channel()
+	if err != nil {
+		return "", fmt.Errorf("failed to consume direct replies: %v", err)
+	}
+	if err := consumeReplies(ch, handler); err != nil {
+		return "", fmt.Errorf("failed to consume direct replies: %v", err)
+	}
+
+	r.mu.Lock()
+	r.replies = handler
+	if r.ch == ch {
+		r.replyCh = ch
+	}
+	r.mu.Unlock()
+	return DirectReplyTo, nil
+}
+
+// consumeReplies passes the Direct Reply-To replies received on ch to handler
+func consumeReplies(ch amqpChannel, handler func(Message) error) error {
+	msgs, err := ch.Consume(
+		DirectReplyTo, // Queue name
+		"",            // Consumer tag
+		true,          // Auto-ack (required for Direct Reply-To)
+		false,         // Exclusive
+		false,         // No-local
+		false,         // No-wait
+		nil,           // Args
 	)
 	if err != nil {
-		return fmt.Errorf("failed to consume messages: %v", err)
+		return err
 	}
 
-	logging.Logger.WithField("queue", queueName).Info("Started listening to queue")
+	go func() {
+		for msg := range msgs {
+			// Direct replies are acknowledged on delivery and cannot be delivered again
+			if err := handleDelivery(DirectReplyTo, msg, handler); err != nil {
+				logHandlerError(DirectReplyTo, msg.CorrelationId, MaxDeliveries, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// CreateLog declares a stream queue, which readers consume from an offset
+// without removing messages; streams need RabbitMQ 3.9 or later. The
+// declaration uses its own channel, as a broker refusing it closes the channel.
+func (r *RabbitMQ) CreateLog(name string, retention time.Duration) error {
+	conn, err := r.connection()
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+
+	args := amqp.Table{
+		"x-queue-type": "stream",
+		"x-max-age":    fmt.Sprintf("%ds", int64(retention/time.Second)),
+	}
+	if _, err := ch.QueueDeclare(name, true, false, false, false, args); err != nil {
+		return fmt.Errorf("failed to declare stream %s: %v", name, err)
+	}
+	return nil
+}
+
+// ReadLog consumes a stream from the first message published at or after
+// since on a dedicated channel. Streams have no end marker, so reading stops
+// once no message arrived for logIdleTimeout.
+func (r *RabbitMQ) ReadLog(name string, since time.Time, visit func(Message) bool) error {
+	conn, err := r.connection()
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
 
-	// Process messages using the provided handler
-	for msg := range msgs {
-		message := Message{
-			Body:          string(msg.Body),
-			CorrelationID: msg.CorrelationId,
-			ReplyTo:       msg.ReplyTo,
+	if _, err := ch.QueueDeclarePassive(name, true, false, false, false, nil); err != nil {
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+			return nil
 		}
-		if err := handler(message); err != nil {
-			logging.Logger.WithFields(logrus.Fields{
-				"error":       err.Error(),
-				"correlation": msg.CorrelationId,
-			}).Error("Failed to process message")
+		return fmt.Errorf("failed to inspect stream %s: %v", name, err)
+	}
+	// Stream consumers must acknowledge and set a prefetch
+	if err := ch.Qos(logPrefetch, 0, false); err != nil {
+		return fmt.Errorf("failed to set prefetch: %v", err)
+	}
+	msgs, err := ch.Consume(name, "", false, false, false, false, amqp.Table{"x-stream-offset": since})
+	if err != nil {
+		return fmt.Errorf("failed to read stream %s: %v", name, err)
+	}
+
+	idle := time.NewTimer(logIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			msg.Ack(false)
+			if !visit(fromDelivery(msg)) {
+				return nil
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(logIdleTimeout)
+		case <-idle.C:
+			return nil
 		}
 	}
-	return nil
 }
 
 // PublishResponse sends a response message to the reply queue
-func (r *RabbitMQ) PublishResponse(replyTo, correlationID, response string) error {
+func (r *RabbitMQ) PublishResponse(replyTo, correlationID, response string, headers map[string]string) (err error) {
+	headers, span := startPublishSpan("PublishResponse", "rabbitmq", replyTo, withSentAt(headers))
+	defer func() { endSpan(span, err) }()
+
 	if replyTo == "" {
 		return fmt.Errorf("replyTo queue name is empty")
 	}
 
-	err := r.Channel.Publish(
-		"",      // Exchange
-		replyTo, // Reply queue
-		false,   // Mandatory
-		false,   // Immediate
-		amqp.Publishing{
-			ContentType:   "text/plain",
-			Body:          []byte(response),
-			CorrelationId: correlationID,
-		},
-	)
+	err = r.publish(replyTo, amqp.Publishing{
+		ContentType:   "text/plain",
+		Body:          []byte(response),
+		CorrelationId: correlationID,
+		Headers:       toAMQPTable(headers),
+		UserId:        r.userID(),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to publish response to queue %s: %v", replyTo, err)
+		countPublishFailure("rabbitmq", "response")
+		return fmt.Errorf("failed to publish response to queue %s: %w", replyTo, err)
 	}
 
 	// Log the response with additional metadata
-	truncatedResponse := response
-	if len(response) > 100 {
-		truncatedResponse = response[:100] + "..."
+	// Redact before truncating so a cut-off secret is not logged in part
+	truncatedResponse := redact.String(response)
+	if len(truncatedResponse) > 100 {
+		truncatedResponse = truncatedResponse[:100] + "..."
 	}
 
 	logging.Logger.WithFields(logrus.Fields{
@@ -180,7 +455,11 @@ func (r *RabbitMQ) PublishResponse(replyTo, correlationID, response string) erro
 
 // DeleteQueue deletes a RabbitMQ queue
 func (r *RabbitMQ) DeleteQueue(queueName string) error {
-	ch, err := r.Conn.Channel()
+	conn, err := r.connection()
+	if err != nil {
+		return fmt.Errorf("failed to delete queue %s: %w", queueName, err)
+	}
+	ch, err := conn.Channel()
 	if err != nil {
 		return fmt.Errorf("failed to open channel: %w", err)
 	}
@@ -196,28 +475,54 @@ func (r *RabbitMQ) DeleteQueue(queueName string) error {
 		return fmt.Errorf("failed to delete queue %s: %w", queueName, err)
 	}
 
+	r.mu.Lock()
+	delete(r.queues, queueName)
+	r.mu.Unlock()
+
 	logging.Logger.WithField("queue", queueName).Info("Queue deleted successfully")
 	return nil
 }
 
 // Close closes the RabbitMQ connection and channel
 func (r *RabbitMQ) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.connected = false
+	if r.done != nil {
+		close(r.done)
+	}
+	r.broadcast()
+	conn, ch := r.conn, r.ch
+	r.mu.Unlock()
+
 	var closeErrors []string
 
 	// Close the channel
-	if r.Channel != nil {
-		if err := r.Channel.Close(); err != nil && !isChannelAlreadyClosedError(err) {
+	if ch != nil {
+		if err := ch.Close(); err != nil && !isChannelAlreadyClosedError(err) {
 			closeErrors = append(closeErrors, fmt.Sprintf("Failed to close channel: %v", err))
 		}
 	}
 
 	// Close the connection
-	if r.Conn != nil {
-		if err := r.Conn.Close(); err != nil && !isConnectionAlreadyClosedError(err) {
+	if conn != nil {
+		if err := conn.Close(); err != nil && !isConnectionAlreadyClosedError(err) {
 			closeErrors = append(closeErrors, fmt.Sprintf("Failed to close connection: %v", err))
 		}
 	}
 
+	r.emit(ConnectionEvent{State: StateClosed})
+	r.mu.Lock()
+	for _, events := range r.listeners {
+		close(events)
+	}
+	r.listeners = nil
+	r.mu.Unlock()
+
 	// Log and return any errors encountered during closure
 	if len(closeErrors) > 0 {
 		errMsg := strings.Join(closeErrors, "; ")
@@ -236,3 +541,411 @@ func isChannelAlreadyClosedError(err error) bool {
 func isConnectionAlreadyClosedError(err error) bool {
 	return strings.Contains(err.Error(), "channel/connection is not open")
 }
+
+// dial opens a new connection and a channel in publisher-confirm mode
+func (r *RabbitMQ) dial() (amqpConnection, amqpChannel, error) {
+	dial := r.dialer
+	if dial == nil {
+		dial = dialAMQP
+	}
+	conn, err := dial(r.URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+	return conn, ch, nil
+}
+
+// setConnection installs a new connection and wakes waiters; r.mu must be held
+func (r *RabbitMQ) setConnection(conn amqpConnection, ch amqpChannel) {
+	r.conn, r.ch = conn, ch
+	// Publishes are serialized, so a small buffer keeps the connection's
+	// reader from blocking on confirms that arrive after a publish timed out
+	r.confirms = make(chan amqp.Confirmation, 16)
+	r.returns = make(chan amqp.Return, 16)
+	r.published = 0
+	ch.NotifyPublish(r.confirms)
+	ch.NotifyReturn(r.returns)
+	if r.replies != nil {
+		r.replyCh = ch // resume consumed Direct Reply-To on it
+	}
+	r.connected = true
+	r.broadcast()
+}
+
+// broadcast wakes every goroutine waiting for a connection change; r.mu must be held
+func (r *RabbitMQ) broadcast() {
+	if r.changed != nil {
+		close(r.changed)
+	}
+	r.changed = make(chan struct{})
+}
+
+// watch waits for the connection or channel to close and starts reconnecting
+func (r *RabbitMQ) watch(conn amqpConnection, ch amqpChannel) {
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	var reason *amqp.Error
+	select {
+	case reason = <-connClosed:
+	case reason = <-chClosed:
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.connected = false
+	r.broadcast()
+	r.mu.Unlock()
+
+	// A channel can fail on its own; drop the connection too and start over
+	conn.Close()
+
+	event := ConnectionEvent{State: StateDisconnected}
+	if reason != nil {
+		event.Err = reason
+	}
+	r.emit(event)
+	logging.Logger.WithError(event.Err).Warn("Lost connection to RabbitMQ")
+
+	r.reconnect()
+}
+
+// reconnect dials until it succeeds or the backend is closed, waiting an
+// exponentially growing, jittered delay between attempts
+func (r *RabbitMQ) reconnect() {
+	minBackoff, maxBackoff := r.MinBackoff, r.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultMinBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		// Full jitter keeps many agents from reconnecting in lockstep
+		delay := time.Duration(rand.Int63n(int64(backoff))) + time.Millisecond
+		select {
+		case <-r.done:
+			return
+		case <-time.After(delay):
+		}
+
+		r.emit(ConnectionEvent{State: StateReconnecting, Attempt: attempt})
+		conn, ch, err := r.dial()
+		if err == nil {
+			if err = r.resume(conn, ch); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			logging.Logger.WithFields(logrus.Fields{
+				"attempt": attempt,
+				"error":   err.Error(),
+			}).Warn("Failed to reconnect to RabbitMQ")
+			r.emit(ConnectionEvent{State: StateReconnecting, Attempt: attempt, Err: err})
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			conn.Close()
+			return
+		}
+		r.setConnection(conn, ch)
+		r.mu.Unlock()
+
+		metrics.BrokerReconnects.WithLabelValues("rabbitmq").Inc()
+		r.emit(ConnectionEvent{State: StateConnected, Attempt: attempt})
+		logging.Logger.WithField("attempt", attempt).Info("Reconnected to RabbitMQ")
+		go r.watch(conn, ch)
+		return
+	}
+}
+
+// resume prepares a new channel before it is installed: previously declared
+// queues are declared again and Direct Reply-To is consumed again
+func (r *RabbitMQ) resume(conn amqpConnection, ch amqpChannel) error {
+	if err := r.redeclare(conn, ch); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	replies := r.replies
+	r.mu.Unlock()
+	if replies != nil {
+		if err := consumeReplies(ch, replies); err != nil {
+			return fmt.Errorf("failed to consume direct replies: %v", err)
+		}
+	}
+	return nil
+}
+
+// redeclare declares every previously declared queue on a new channel of conn
+func (r *RabbitMQ) redeclare(conn amqpConnection, ch amqpChannel) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.queues))
+	for name := range r.queues {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+
+	for _, name := range names {
+		if err := r.declareOn(conn, ch, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitChannel returns the current connection and channel once connected,
+// skipping prev so callers whose channel just failed wait for its
+// replacement. A zero deadline waits until the backend is closed.
+func (r *RabbitMQ) waitChannel(prev amqpChannel, deadline time.Time) (amqpConnection, amqpChannel, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return nil, nil, errRabbitMQClosed
+		}
+		if r.changed == nil {
+			r.mu.Unlock()
+			return nil, nil, fmt.Errorf("not connected to RabbitMQ")
+		}
+		if r.connected && r.ch != prev {
+			conn, ch := r.conn, r.ch
+			r.mu.Unlock()
+			return conn, ch, nil
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil, nil, fmt.Errorf("timed out waiting for RabbitMQ to reconnect")
+		}
+	}
+}
+
+// channel returns the current channel, waiting up to the publish timeout for a reconnect
+func (r *RabbitMQ) channel() (amqpChannel, error) {
+	_, ch, err := r.waitChannel(nil, time.Now().Add(r.publishTimeout()))
+	return ch, err
+}
+
+// connection returns the current connection, waiting up to the publish timeout for a reconnect
+func (r *RabbitMQ) connection() (amqpConnection, error) {
+	conn, _, err := r.waitChannel(nil, time.Now().Add(r.publishTimeout()))
+	return conn, err
+}
+
+// publish sends msg to the default exchange with mandatory routing and waits
+// for the broker to confirm it. Messages that cannot be routed to a queue fail
+// with an UnroutableError; when the connection drops before the confirm
+// arrives the message is published again on the next channel.
+func (r *RabbitMQ) publish(routingKey string, msg amqp.Publishing) error {
+	r.pubMu.Lock()
+	defer r.pubMu.Unlock()
+
+	deadline := time.Now().Add(r.publishTimeout())
+	var prev amqpChannel
+	for {
+		_, ch, err := r.waitChannel(prev, deadline)
+		if err != nil {
+			return err
+		}
+		prev = ch
+
+		r.mu.Lock()
+		if r.ch != ch {
+			r.mu.Unlock()
+			continue
+		}
+		if msg.ReplyTo == DirectReplyTo && r.replyCh != ch {
+			// The broker rejects Direct Reply-To publishes from any other channel
+			r.mu.Unlock()
+			return fmt.Errorf("direct reply consumer was lost when the connection dropped")
+		}
+		confirms, returns := r.confirms, r.returns
+		r.published++
+		tag := r.published
+		r.mu.Unlock()
+
+		err = ch.Publish(
+			"",         // Exchange
+			routingKey, // Routing key
+			true,       // Mandatory
+			false,      // Immediate
+			msg,
+		)
+		if err != nil {
+			if isChannelAlreadyClosedError(err) {
+				continue
+			}
+			return err
+		}
+
+		confirm, ok, err := awaitConfirm(confirms, tag, deadline)
+		if err != nil {
+			return fmt.Errorf("%v for message to %s", err, routingKey)
+		}
+		if !ok {
+			continue // Channel closed before the confirm arrived
+		}
+
+		// The broker sends basic.return before the ack of an unroutable message
+		for len(returns) > 0 {
+			returned := <-returns
+			if returned.RoutingKey == routingKey && returned.CorrelationId == msg.CorrelationId {
+				return &UnroutableError{Queue: routingKey, Reason: returned.ReplyText}
+			}
+		}
+		if !confirm.Ack {
+			return fmt.Errorf("broker rejected message to %s", routingKey)
+		}
+		return nil
+	}
+}
+
+// awaitConfirm waits for the confirm of delivery tag, skipping late confirms
+// of earlier publishes that timed out. ok is false if the channel closed.
+func awaitConfirm(confirms <-chan amqp.Confirmation, tag uint64, deadline time.Time) (confirm amqp.Confirmation, ok bool, err error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case confirm, ok = <-confirms:
+			if !ok || confirm.DeliveryTag >= tag {
+				return confirm, ok, nil
+			}
+		case <-timer.C:
+			return confirm, false, fmt.Errorf("timed out waiting for broker confirm")
+		}
+	}
+}
+
+func (r *RabbitMQ) publishTimeout() time.Duration {
+	if r.PublishTimeout > 0 {
+		return r.PublishTimeout
+	}
+	return DefaultPublishTimeout
+}
+
+func (r *RabbitMQ) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// emit delivers an event to subscribers without blocking on slow readers
+func (r *RabbitMQ) emit(event ConnectionEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, events := range r.listeners {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// handleDelivery passes a delivery to handler, recording lag and a consumer span
+func handleDelivery(queueName string, msg amqp.Delivery, handler func(Message) error) error {
+	message := fromDelivery(msg)
+	observeReceiveLag("rabbitmq", message.Headers)
+	span := startReceiveSpan("rabbitmq", queueName, &message)
+	err := handler(message)
+	endSpan(span, err)
+	return err
+}
+
+// settleDelivery acknowledges a handled delivery. One whose handler failed is
+// requeued, unless it was delivered before: the broker only flags
+// redeliveries, so a redelivered message counts as delivered MaxDeliveries times.
+func settleDelivery(queueName string, msg amqp.Delivery, err error) {
+	if err == nil {
+		err = msg.Ack(false)
+	} else {
+		deliveries := 1
+		if msg.Redelivered {
+			deliveries = MaxDeliveries
+		}
+		logHandlerError(queueName, msg.CorrelationId, deliveries, err)
+		err = msg.Nack(false, deliveries < MaxDeliveries)
+	}
+	if err != nil {
+		// The channel is gone, and the broker delivers the message again
+		logging.Logger.WithFields(logrus.Fields{
+			"error":       err.Error(),
+			"queue":       queueName,
+			"correlation": msg.CorrelationId,
+		}).Warn("Failed to settle message")
+	}
+}
+
+// fromDelivery converts an AMQP delivery to a Message
+func fromDelivery(msg amqp.Delivery) Message {
+	return Message{
+		Body:          string(msg.Body),
+		CorrelationID: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		Headers:       fromAMQPTable(msg.Headers),
+		UserID:        msg.UserId,
+	}
+}
+
+// userID returns the user of the connection URL. Publishes carry it as
+// user_id, which the broker refuses unless it matches the authenticated user,
+// so consumers can rely on it.
+func (r *RabbitMQ) userID() string {
+	uri, err := amqp.ParseURI(r.URL)
+	if err != nil {
+		return ""
+	}
+	return uri.Username
+}
+
+// toAMQPTable converts message headers to an AMQP header table
+func toAMQPTable(headers map[string]string) amqp.Table {
+	if len(headers) == 0 {
+		return nil
+	}
+	table := amqp.Table{}
+	for k, v := range headers {
+		table[k] = v
+	}
+	return table
+}
+
+// fromAMQPTable extracts string headers from an AMQP header table
+func fromAMQPTable(table amqp.Table) map[string]string {
+	headers := map[string]string{}
+	for k, v := range table {
+		if s, ok := v.(string); ok {
+			headers[k] = s
+		}
+	}
+	return headers
+}
@@ -0,0 +1,105 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// managementTimeout bounds requests to the RabbitMQ management API
+const managementTimeout = 30 * time.Second
+
+// idleSinceLayouts are the formats RabbitMQ versions use for idle_since
+var idleSinceLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.000-07:00",
+	"2006-01-02 15:04:05",
+}
+
+// managementQueue is the subset of a management API queue object we use
+type managementQueue struct {
+	Name      string `json:"name"`
+	Messages  int    `json:"messages"`
+	Consumers int    `json:"consumers"`
+	IdleSince string `json:"idle_since"`
+}
+
+// ListQueues lists the queues of the connection's vhost whose name starts
+// with prefix, using the RabbitMQ management API
+func (r *RabbitMQ) ListQueues(prefix string) ([]QueueInfo, error) {
+	uri, err := amqp.ParseURI(r.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RabbitMQ URL: %v", err)
+	}
+	base, err := r.managementBase(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/api/queues/%s?columns=name,messages,consumers,idle_since", base, url.PathEscape(uri.Vhost))
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build management API request: %v", err)
+	}
+	req.SetBasicAuth(uri.Username, uri.Password)
+
+	client := &http.Client{Timeout: managementTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query RabbitMQ management API: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("RabbitMQ management API returned %s", resp.Status)
+	}
+
+	var queues []managementQueue
+	if err := json.NewDecoder(resp.Body).Decode(&queues); err != nil {
+		return nil, fmt.Errorf("failed to decode management API response: %v", err)
+	}
+
+	var infos []QueueInfo
+	for _, q := range queues {
+		if !strings.HasPrefix(q.Name, prefix) {
+			continue
+		}
+		infos = append(infos, QueueInfo{
+			Name:      q.Name,
+			Messages:  q.Messages,
+			Consumers: q.Consumers,
+			IdleSince: parseIdleSince(q.IdleSince),
+		})
+	}
+	return infos, nil
+}
+
+// managementBase returns ManagementURL, or the default management endpoint
+// on the broker host: port 15672 for amqp and 15671 for amqps
+func (r *RabbitMQ) managementBase(uri amqp.URI) (string, error) {
+	if r.ManagementURL != "" {
+		return strings.TrimSuffix(r.ManagementURL, "/"), nil
+	}
+	switch uri.Scheme {
+	case "amqp":
+		return fmt.Sprintf("http://%s:15672", uri.Host), nil
+	case "amqps":
+		return fmt.Sprintf("https://%s:15671", uri.Host), nil
+	default:
+		return "", fmt.Errorf("cannot derive management URL from scheme %q", uri.Scheme)
+	}
+}
+
+// parseIdleSince parses idle_since, returning the zero time when it is absent
+func parseIdleSince(value string) time.Time {
+	for _, layout := range idleSinceLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,131 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRabbitMQPublishUnroutable(t *testing.T) {
+	broker := newFakeBroker()
+	r := connectFake(t, broker, nil)
+
+	// Mandatory publishes to a missing queue come back as an UnroutableError
+	err := r.SendMessage("missing", "get pods", "correlation-1", "", nil)
+	var unroutable *UnroutableError
+	if !errors.As(err, &unroutable) {
+		t.Fatalf("SendMessage to a missing queue returned %v, want an *UnroutableError", err)
+	}
+	if unroutable.Queue != "missing" || unroutable.Reason != "NO_ROUTE" {
+		t.Errorf("UnroutableError = %+v, want queue missing and reason NO_ROUTE", unroutable)
+	}
+	err = r.PublishResponse("gone", "correlation-2", "pod/web", nil)
+	if !errors.As(err, &unroutable) || unroutable.Queue != "gone" {
+		t.Errorf("PublishResponse to a missing queue returned %v, want an *UnroutableError for gone", err)
+	}
+
+	// A return for another message does not fail the next publish
+	if err := r.CreateQueue("commands"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+	if err := r.SendMessage("commands", "get pods", "correlation-3", "", nil); err != nil {
+		t.Errorf("SendMessage to an existing queue after a return: %v", err)
+	}
+}
+
+func TestRabbitMQPublishNack(t *testing.T) {
+	broker := newFakeBroker()
+	r := connectFake(t, broker, nil)
+	if err := r.CreateQueue("commands"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+	if err := r.CreateQueue("other"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+
+	broker.nack("commands")
+	err := r.SendMessage("commands", "get pods", "", "", nil)
+	if err == nil || !strings.Contains(err.Error(), "broker rejected message to commands") {
+		t.Errorf("nacked publish returned %v, want a rejection error", err)
+	}
+	var unroutable *UnroutableError
+	if errors.As(err, &unroutable) {
+		t.Errorf("nacked publish returned an UnroutableError: %v", err)
+	}
+	// The channel stays usable after a nack
+	if err := r.SendMessage("other", "get pods", "", "", nil); err != nil {
+		t.Errorf("publish after a nack: %v", err)
+	}
+}
+
+func TestRabbitMQPublishConfirmTimeout(t *testing.T) {
+	broker := newFakeBroker()
+	r := connectFake(t, broker, func(r *RabbitMQ) { r.PublishTimeout = 50 * time.Millisecond })
+	if err := r.CreateQueue("commands"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+
+	broker.setHoldConfirms(true)
+	err := r.SendMessage("commands", "get pods", "", "", nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out waiting for broker confirm") {
+		t.Fatalf("publish without a confirm returned %v, want a confirm timeout", err)
+	}
+
+	// Later publishes wait for their own confirm, not the missing one
+	broker.setHoldConfirms(false)
+	if err := r.SendMessage("commands", "get pods", "", "", nil); err != nil {
+		t.Errorf("publish after a confirm timeout: %v", err)
+	}
+}
+
+func TestRabbitMQPublishRetriedAfterChannelLoss(t *testing.T) {
+	broker := newFakeBroker()
+	r := connectFake(t, broker, nil)
+	events := r.Events()
+	if err := r.CreateQueue("commands"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+	messages, _ := consumeFake(r, "commands")
+
+	// The connection drops before the confirm arrives; the message is
+	// published again on the next channel
+	broker.setHoldConfirms(true)
+	sent := make(chan error, 1)
+	go func() { sent <- r.SendMessage("commands", "get pods", "correlation-1", "", nil) }()
+	receiveFake(t, messages)
+	broker.setHoldConfirms(false)
+	broker.kill()
+	waitEvent(t, events, StateConnected)
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("SendMessage across a reconnect: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("SendMessage did not complete after the reconnect")
+	}
+	if msg := receiveFake(t, messages); msg.CorrelationID != "correlation-1" {
+		t.Errorf("republished message has correlation %q, want correlation-1", msg.CorrelationID)
+	}
+}
+
+func TestAwaitConfirmSkipsEarlierTags(t *testing.T) {
+	confirms := make(chan amqp.Confirmation, 3)
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: false}
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+
+	confirm, ok, err := awaitConfirm(confirms, 3, time.Now().Add(testTimeout))
+	if err != nil || !ok || confirm.DeliveryTag != 3 || !confirm.Ack {
+		t.Errorf("awaitConfirm = %+v, %v, %v; want the ack of tag 3", confirm, ok, err)
+	}
+
+	close(confirms)
+	if _, ok, err := awaitConfirm(confirms, 4, time.Now().Add(testTimeout)); ok || err != nil {
+		t.Errorf("awaitConfirm on a closed channel = %v, %v; want not ok without an error", ok, err)
+	}
+}
@@ -0,0 +1,187 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait in the RabbitMQ tests
+const testTimeout = 5 * time.Second
+
+// connectFake connects a backend to broker and closes it when the test ends
+func connectFake(t *testing.T, broker *fakeBroker, adjust func(*RabbitMQ)) *RabbitMQ {
+	t.Helper()
+	r := broker.rabbitMQ()
+	if adjust != nil {
+		adjust(r)
+	}
+	if err := r.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// waitEvent reads events until one has state, failing after testTimeout
+func waitEvent(t *testing.T, events <-chan ConnectionEvent, state ConnectionState) ConnectionEvent {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("events closed while waiting for %v", state)
+			}
+			if event.State == state {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %v event after %s", state, testTimeout)
+		}
+	}
+}
+
+// consumeFake receives from queueName in the background
+func consumeFake(r *RabbitMQ, queueName string) (<-chan Message, <-chan error) {
+	messages := make(chan Message, 64)
+	done := make(chan error, 1)
+	go func() {
+		done <- r.ReceiveMessages(queueName, func(msg Message) error {
+			messages <- msg
+			return nil
+		})
+	}()
+	return messages, done
+}
+
+// receiveFake waits for the next message
+func receiveFake(t *testing.T, messages <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatalf("no message received after %s", testTimeout)
+		return Message{}
+	}
+}
+
+func TestRabbitMQReconnectResumesConsuming(t *testing.T) {
+	broker := newFakeBroker()
+	agent := connectFake(t, broker, nil)
+	events := agent.Events()
+	if err := agent.CreateQueue("commands"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+	messages, _ := consumeFake(agent, "commands")
+	client := connectFake(t, broker, nil)
+
+	if err := client.SendMessage("commands", "before", "", "", nil); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if msg := receiveFake(t, messages); msg.Body != "before" {
+		t.Fatalf("received %q, want %q", msg.Body, "before")
+	}
+
+	// The broker loses its queues; the agent redeclares its queue and consumes again
+	broker.restart()
+	if event := waitEvent(t, events, StateDisconnected); event.Err == nil {
+		t.Error("disconnect event has no error, want the broker's close reason")
+	}
+	if event := waitEvent(t, events, StateConnected); event.Attempt < 1 {
+		t.Errorf("reconnect event has attempt %d, want at least 1", event.Attempt)
+	}
+	if err := agent.Healthy(); err != nil {
+		t.Errorf("Healthy after reconnect: %v", err)
+	}
+	if _, _, ok := broker.queue("commands"); !ok {
+		t.Fatal("command queue was not redeclared after the reconnect")
+	}
+
+	if err := client.SendMessage("commands", "after", "", "", nil); err != nil {
+		t.Fatalf("SendMessage after reconnect: %v", err)
+	}
+	if msg := receiveFake(t, messages); msg.Body != "after" {
+		t.Errorf("received %q after reconnect, want %q", msg.Body, "after")
+	}
+}
+
+func TestRabbitMQReconnectRetriesDials(t *testing.T) {
+	broker := newFakeBroker()
+	r := connectFake(t, broker, nil)
+	events := r.Events()
+	if err := r.CreateQueue("commands"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+
+	broker.setDialErr(errFakeDial)
+	broker.kill()
+	waitEvent(t, events, StateDisconnected)
+	if err := r.Healthy(); err == nil {
+		t.Error("Healthy succeeded while disconnected")
+	}
+	// Failed attempts are reported with their error
+	for event := waitEvent(t, events, StateReconnecting); event.Err == nil; event = waitEvent(t, events, StateReconnecting) {
+	}
+
+	// A publish during the outage waits for the reconnect instead of failing
+	sent := make(chan error, 1)
+	go func() { sent <- r.SendMessage("commands", "queued", "", "", nil) }()
+	time.Sleep(20 * time.Millisecond)
+	broker.setDialErr(nil)
+	waitEvent(t, events, StateConnected)
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Errorf("SendMessage during the outage: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("SendMessage did not complete after the reconnect")
+	}
+}
+
+func TestRabbitMQCloseDuringBackoff(t *testing.T) {
+	broker := newFakeBroker()
+	r := connectFake(t, broker, func(r *RabbitMQ) {
+		r.MinBackoff, r.MaxBackoff = time.Hour, time.Hour
+	})
+	events := r.Events()
+	if err := r.CreateQueue("commands"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+	_, done := consumeFake(r, "commands")
+
+	broker.kill()
+	waitEvent(t, events, StateDisconnected)
+	dials := broker.dialCount()
+
+	// Close interrupts the backoff delay and stops consumers waiting for a channel
+	closed := make(chan error, 1)
+	go func() { closed <- r.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close during backoff: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Close blocked during the reconnect backoff")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ReceiveMessages returned %v after Close, want nil", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("ReceiveMessages did not return after Close")
+	}
+	waitEvent(t, events, StateClosed)
+	if _, ok := <-events; ok {
+		t.Error("events still open after Close")
+	}
+	if err := r.SendMessage("commands", "after close", "", "", nil); err == nil {
+		t.Error("SendMessage after Close succeeded, want an error")
+	}
+	if broker.dialCount() != dials {
+		t.Errorf("broker was dialed %d times after Close", broker.dialCount()-dials)
+	}
+}
@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestRabbitMQDirectRepliesResumeAfterReconnect(t *testing.T) {
+	broker := newFakeBroker()
+	agent := connectFake(t, broker, nil)
+	agentEvents := agent.Events()
+	if err := agent.CreateQueue("commands"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+	commands, _ := consumeFake(agent, "commands")
+
+	client := connectFake(t, broker, nil)
+	clientEvents := client.Events()
+	replies := make(chan Message, 8)
+	replyTo, err := client.ConsumeReplies(func(msg Message) error {
+		replies <- msg
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ConsumeReplies: %v", err)
+	}
+
+	// roundTrip sends a command and answers it from the agent
+	roundTrip := func(body string) {
+		t.Helper()
+		if err := client.SendMessage("commands", body, body, replyTo, nil); err != nil {
+			t.Fatalf("SendMessage %s: %v", body, err)
+		}
+		cmd := receiveFake(t, commands)
+		if err := agent.PublishResponse(cmd.ReplyTo, cmd.CorrelationID, "re: "+cmd.Body, nil); err != nil {
+			t.Fatalf("PublishResponse %s: %v", body, err)
+		}
+		if reply := receiveFake(t, replies); reply.CorrelationID != body || reply.Body != "re: "+body {
+			t.Fatalf("reply = %q (%s), want %q (%s)", reply.Body, reply.CorrelationID, "re: "+body, body)
+		}
+	}
+
+	roundTrip("before")
+	broker.kill()
+	waitEvent(t, clientEvents, StateConnected)
+	waitEvent(t, agentEvents, StateConnected)
+	roundTrip("after")
+}
+
+func TestRabbitMQReplyQueueKeepsLegacyAttributes(t *testing.T) {
+	broker := newFakeBroker()
+	// Reply queues of earlier versions are durable and never expire
+	broker.declare(ReplyQueuePrefix+"legacy", true, nil)
+
+	r := connectFake(t, broker, nil)
+	events := r.Events()
+	if err := r.CreateQueue(ReplyQueuePrefix + "legacy"); err != nil {
+		t.Fatalf("CreateQueue on a legacy reply queue: %v", err)
+	}
+	if err := r.Healthy(); err != nil {
+		t.Fatalf("Healthy after declaring a legacy reply queue: %v", err)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %v event after declaring a legacy reply queue", event.State)
+	default:
+	}
+	if durable, args, _ := broker.queue(ReplyQueuePrefix + "legacy"); !durable || args != nil {
+		t.Errorf("legacy reply queue has durable=%v args=%v, want it unchanged", durable, args)
+	}
+
+	if err := r.CreateQueue(ReplyQueuePrefix + "new"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+	durable, args, _ := broker.queue(ReplyQueuePrefix + "new")
+	if durable || args["x-expires"] != ReplyQueueExpiry.Milliseconds() {
+		t.Errorf("new reply queue has durable=%v args=%v, want a non-durable queue with x-expires", durable, args)
+	}
+
+	// Redeclaring both after a reconnect keeps the legacy queue as it is
+	broker.kill()
+	waitEvent(t, events, StateConnected)
+	if err := r.Healthy(); err != nil {
+		t.Fatalf("Healthy after reconnect: %v", err)
+	}
+	if durable, _, ok := broker.queue(ReplyQueuePrefix + "legacy"); !ok || !durable {
+		t.Errorf("legacy reply queue after reconnect: exists=%v durable=%v, want it unchanged", ok, durable)
+	}
+}
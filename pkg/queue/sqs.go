@@ -2,26 +2,74 @@ package queue
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/loaynaser3/KubeGate/pkg/logging"
+	"github.com/sirupsen/logrus"
 )
 
-// SQS implementation of the MessageQueue interface
+// errSQSClosed is returned by operations attempted after Close
+var errSQSClosed = errors.New("sqs queue has been closed")
+
+const (
+	// sqsLastUsedTag holds when a reply queue was last consumed, in Unix
+	// milliseconds, as SQS only reports when queues were created or changed
+	sqsLastUsedTag = "kubegate-last-used"
+
+	// DefaultSQSTouchInterval is how often consumers update sqsLastUsedTag
+	DefaultSQSTouchInterval = 10 * time.Minute
+)
+
+// SQS implementation of the MessageQueue interface. Queue names are resolved
+// to URLs with GetQueueUrl; QueueURL is used for an empty name or a name
+// matching its last path segment, and URLs are used as they are. Names that
+// do not exist fall back to QueueURL, as earlier versions sent everything
+// there, except reply queues and queues this client created or deleted.
 type SQS struct {
 	Client   *sqs.Client   // AWS SQS client for interacting with the service
 	QueueURL string        // URL of the SQS queue
 	Config   aws.Config    // AWS configuration for the client
 	Timeout  time.Duration // Timeout for receiving messages
+	// TouchInterval is how often consumers of reply queues record that the
+	// queue is in use, in its kubegate-last-used tag; defaults to 10 minutes
+	TouchInterval time.Duration
+
+	mu     sync.Mutex
+	urls   map[string]string // Resolved queue URLs by name
+	owned  map[string]bool   // Queues created or deleted by this client, which never fall back
+	legacy map[string]bool   // Queues that fell back to QueueURL
+	ctx    context.Context   // Cancelled by Close to stop consumers
+	cancel context.CancelFunc
 }
 
-// Create new Queue
-// TODO: implement Create sqs queue, currently placeholder
+// CreateQueue creates a queue if it does not exist yet
 func (s *SQS) CreateQueue(queueName string) error {
+	ctx, err := s.context()
+	if err != nil {
+		return err
+	}
+	if isQueueURL(queueName) || queueName == "" || queueName == lastSegment(s.QueueURL) {
+		return nil
+	}
+	output, err := s.Client.CreateQueue(ctx, &sqs.CreateQueueInput{QueueName: aws.String(queueName)})
+	if err != nil {
+		return fmt.Errorf("failed to create queue %s: %v", queueName, err)
+	}
+	s.mu.Lock()
+	s.urls[queueName] = aws.ToString(output.QueueUrl)
+	s.owned[queueName] = true
+	delete(s.legacy, queueName)
+	s.mu.Unlock()
 	return nil
 }
 
@@ -33,38 +81,68 @@ func (s *SQS) Connect() error {
 	}
 	s.Config = cfg
 	s.Client = sqs.NewFromConfig(cfg)
+
+	s.mu.Lock()
+	s.urls = map[string]string{}
+	s.owned = map[string]bool{}
+	s.legacy = map[string]bool{}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.mu.Unlock()
 	return nil
 }
 
 // SendMessage sends a message to the SQS queue
-func (s *SQS) SendMessage(queueName, message, correlationID, replyTo string) error {
-	input := &sqs.SendMessageInput{
-		QueueUrl:    &s.QueueURL,
-		MessageBody: aws.String(message),
-		MessageAttributes: map[string]types.MessageAttributeValue{
-			"CorrelationID": {DataType: aws.String("String"), StringValue: aws.String(correlationID)},
-			"ReplyTo":       {DataType: aws.String("String"), StringValue: aws.String(replyTo)},
-		},
-	}
-	_, err := s.Client.SendMessage(context.TODO(), input)
-	if err != nil {
-		return fmt.Errorf("failed to send message: %v", err)
+func (s *SQS) SendMessage(queueName, message, correlationID, replyTo string, headers map[string]string) (err error) {
+	headers, span := startPublishSpan("SendMessage", "sqs", queueName, withSentAt(headers))
+	defer func() { endSpan(span, err) }()
+
+	if err = s.send(queueName, message, map[string]string{"CorrelationID": correlationID, "ReplyTo": replyTo}, headers); err != nil {
+		countPublishFailure("sqs", "send")
+		return fmt.Errorf("failed to send message: %w", err)
 	}
 	return nil
 }
 
-// ReceiveMessages listens for messages from the SQS queue
+// ReceiveMessages listens for messages from the SQS queue until Close is called
 func (s *SQS) ReceiveMessages(queueName string, handler func(Message) error) error {
+	ctx, err := s.context()
+	if err != nil {
+		return err
+	}
+	queueURL, err := s.queueURL(ctx, queueName)
+	if err != nil {
+		return fmt.Errorf("failed to receive messages: %w", err)
+	}
+
+	touchInterval := s.TouchInterval
+	if touchInterval <= 0 {
+		touchInterval = DefaultSQSTouchInterval
+	}
+	var touched time.Time
 	for {
+		// Reply queues are collected once idle, so mark them as used while consumed
+		if strings.HasPrefix(queueName, ReplyQueuePrefix) && time.Since(touched) >= touchInterval {
+			s.touch(ctx, queueURL)
+			touched = time.Now()
+		}
 		input := &sqs.ReceiveMessageInput{
-			QueueUrl:            &s.QueueURL,
+			QueueUrl:            aws.String(queueURL),
 			MaxNumberOfMessages: 10,
-			WaitTimeSeconds:     int32(s.Timeout.Seconds()),
+			WaitTimeSeconds:     int32(min(s.Timeout, 20*time.Second).Seconds()),
 			MessageAttributeNames: []string{
 				"All",
 			},
+			// The IAM principal that sent the message, which senders cannot forge,
+			// and how many times it was received
+			MessageSystemAttributeNames: []types.MessageSystemAttributeName{
+				types.MessageSystemAttributeNameSenderId,
+				types.MessageSystemAttributeNameApproximateReceiveCount,
+			},
+		}
+		output, err := s.Client.ReceiveMessage(ctx, input)
+		if ctx.Err() != nil {
+			return nil
 		}
-		output, err := s.Client.ReceiveMessage(context.TODO(), input)
 		if err != nil {
 			return fmt.Errorf("failed to receive messages: %v", err)
 		}
@@ -74,46 +152,335 @@ func (s *SQS) ReceiveMessages(queueName string, handler func(Message) error) err
 				Body:          aws.ToString(msg.Body),
 				CorrelationID: aws.ToString(msg.MessageAttributes["CorrelationID"].StringValue),
 				ReplyTo:       aws.ToString(msg.MessageAttributes["ReplyTo"].StringValue),
+				Headers:       headersFromAttributes(msg.MessageAttributes),
+				UserID:        msg.Attributes[string(types.MessageSystemAttributeNameSenderId)],
 			}
-			if err := handler(message); err != nil {
-				return fmt.Errorf("failed to handle message: %v", err)
+			observeReceiveLag("sqs", message.Headers)
+			span := startReceiveSpan("sqs", queueName, &message)
+			err = handler(message)
+			endSpan(span, err)
+			if err != nil {
+				deliveries, perr := strconv.Atoi(msg.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+				if perr != nil {
+					deliveries = MaxDeliveries // Without a count, the message could loop forever
+				}
+				logHandlerError(queueName, message.CorrelationID, deliveries, err)
+				if deliveries < MaxDeliveries {
+					s.redeliver(ctx, queueURL, msg.ReceiptHandle)
+					continue
+				}
 			}
 
-			// Delete the message after successful processing
-			_, err := s.Client.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-				QueueUrl:      &s.QueueURL,
+			// Delete the message once handled, or once it failed MaxDeliveries times
+			_, err = s.Client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(queueURL),
 				ReceiptHandle: msg.ReceiptHandle,
 			})
-			if err != nil {
-				return fmt.Errorf("failed to delete message: %v", err)
+			if err != nil && ctx.Err() == nil {
+				// The message is received again once its visibility timeout expires
+				logging.Logger.WithFields(logrus.Fields{
+					"error":       err.Error(),
+					"queue":       queueName,
+					"correlation": message.CorrelationID,
+				}).Warn("Failed to delete message")
 			}
 		}
 	}
 }
 
+// redeliver makes a received message visible again at once, rather than
+// when its visibility timeout expires
+func (s *SQS) redeliver(ctx context.Context, queueURL string, receiptHandle *string) {
+	_, err := s.Client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueURL),
+		ReceiptHandle:     receiptHandle,
+		VisibilityTimeout: 0,
+	})
+	if err != nil && ctx.Err() == nil {
+		logging.Logger.WithError(err).WithField("queue", queueURL).Warn("Failed to make message visible again")
+	}
+}
+
+// touch records in the sqsLastUsedTag of a queue that it is in use
+func (s *SQS) touch(ctx context.Context, queueURL string) {
+	_, err := s.Client.TagQueue(ctx, &sqs.TagQueueInput{
+		QueueUrl: aws.String(queueURL),
+		Tags:     map[string]string{sqsLastUsedTag: strconv.FormatInt(time.Now().UnixMilli(), 10)},
+	})
+	if err != nil && ctx.Err() == nil {
+		logging.Logger.WithFields(logrus.Fields{
+			"queue": queueURL,
+			"error": err.Error(),
+		}).Warn("Failed to mark reply queue as used; it may be collected while in use")
+	}
+}
+
 // PublishResponse sends a response message to the reply queue
-func (s *SQS) PublishResponse(replyTo, correlationID, response string) error {
-	input := &sqs.SendMessageInput{
-		QueueUrl:    &replyTo,
-		MessageBody: aws.String(response),
-		MessageAttributes: map[string]types.MessageAttributeValue{
-			"CorrelationID": {DataType: aws.String("String"), StringValue: aws.String(correlationID)},
-		},
+func (s *SQS) PublishResponse(replyTo, correlationID, response string, headers map[string]string) (err error) {
+	headers, span := startPublishSpan("PublishResponse", "sqs", replyTo, withSentAt(headers))
+	defer func() { endSpan(span, err) }()
+
+	if replyTo == "" {
+		return fmt.Errorf("replyTo queue name is empty")
+	}
+	if err = s.send(replyTo, response, map[string]string{"CorrelationID": correlationID}, headers); err != nil {
+		countPublishFailure("sqs", "response")
+		return fmt.Errorf("failed to send response: %w", err)
+	}
+	return nil
+}
+
+// send publishes body with the non-empty string attributes and headers
+func (s *SQS) send(queueName, body string, attributes, headers map[string]string) error {
+	ctx, err := s.context()
+	if err != nil {
+		return err
 	}
-	_, err := s.Client.SendMessage(context.TODO(), input)
+	queueURL, err := s.queueURL(ctx, queueName)
 	if err != nil {
-		return fmt.Errorf("failed to send response: %v", err)
+		return err
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(queueURL),
+		MessageBody:       aws.String(body),
+		MessageAttributes: map[string]types.MessageAttributeValue{},
+	}
+	for name, value := range attributes {
+		if value != "" {
+			input.MessageAttributes[name] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+		}
+	}
+	if err := setHeadersAttribute(input.MessageAttributes, headers); err != nil {
+		return err
+	}
+	if _, err := s.Client.SendMessage(ctx, input); err != nil {
+		return s.queueError(queueName, err)
 	}
 	return nil
 }
 
-// Delete RabbitMQ queue
-// TODO: implement delete sqs, currently placeholder
+// DeleteQueue deletes an SQS queue given its name or URL
 func (s *SQS) DeleteQueue(queueName string) error {
+	ctx, err := s.context()
+	if err != nil {
+		return err
+	}
+	// Never fall back here, which would delete the queue at QueueURL
+	s.mu.Lock()
+	s.owned[queueName] = true
+	delete(s.legacy, queueName)
+	s.mu.Unlock()
+	queueURL, err := s.resolve(ctx, queueName)
+	var unroutable *UnroutableError
+	if errors.As(err, &unroutable) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.forget(queueName)
+	_, err = s.Client.DeleteQueue(ctx, &sqs.DeleteQueueInput{QueueUrl: aws.String(queueURL)})
+	if err = s.queueError(queueName, err); errors.As(err, &unroutable) {
+		return nil // Already deleted
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete queue %s: %w", queueName, err)
+	}
 	return nil
 }
 
-// Close cleans up resources (no-op for SQS)
+// ListQueues lists the queues whose name starts with prefix. SQS does not
+// report consumers, so IdleSince is the latest of the creation and last
+// attribute change times and the time consumers last marked the queue as
+// used.
+func (s *SQS) ListQueues(prefix string) ([]QueueInfo, error) {
+	ctx, err := s.context()
+	if err != nil {
+		return nil, err
+	}
+	var infos []QueueInfo
+	paginator := sqs.NewListQueuesPaginator(s.Client, &sqs.ListQueuesInput{QueueNamePrefix: aws.String(prefix)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list queues: %v", err)
+		}
+
+		for _, queueURL := range page.QueueUrls {
+			output, err := s.Client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+				QueueUrl: aws.String(queueURL),
+				AttributeNames: []types.QueueAttributeName{
+					types.QueueAttributeNameApproximateNumberOfMessages,
+					types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+					types.QueueAttributeNameCreatedTimestamp,
+					types.QueueAttributeNameLastModifiedTimestamp,
+				},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get attributes of queue %s: %v", queueURL, err)
+			}
+
+			info := QueueInfo{Name: lastSegment(queueURL), ConsumersUnknown: true}
+			for _, name := range []types.QueueAttributeName{types.QueueAttributeNameApproximateNumberOfMessages, types.QueueAttributeNameApproximateNumberOfMessagesNotVisible} {
+				n, _ := strconv.Atoi(output.Attributes[string(name)])
+				info.Messages += n // Messages being received still count
+			}
+			for _, name := range []types.QueueAttributeName{types.QueueAttributeNameCreatedTimestamp, types.QueueAttributeNameLastModifiedTimestamp} {
+				if seconds, err := strconv.ParseInt(output.Attributes[string(name)], 10, 64); err == nil {
+					if t := time.Unix(seconds, 0); t.After(info.IdleSince) {
+						info.IdleSince = t
+					}
+				}
+			}
+			tags, err := s.Client.ListQueueTags(ctx, &sqs.ListQueueTagsInput{QueueUrl: aws.String(queueURL)})
+			if err != nil {
+				// Without the tag the queue may be in use, so report it as such
+				logging.Logger.WithFields(logrus.Fields{
+					"queue": queueURL,
+					"error": err.Error(),
+				}).Warn("Failed to get queue tags; treating the queue as in use")
+				info.IdleSince = time.Time{}
+			} else if millis, err := strconv.ParseInt(tags.Tags[sqsLastUsedTag], 10, 64); err == nil {
+				if t := time.UnixMilli(millis); t.After(info.IdleSince) {
+					info.IdleSince = t
+				}
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// Close stops consumers; later operations return an error
 func (s *SQS) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
 	return nil
 }
+
+// context returns the context cancelled by Close, or an error once closed
+func (s *SQS) context() (context.Context, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		return nil, fmt.Errorf("sqs queue is not connected")
+	}
+	if s.ctx.Err() != nil {
+		return nil, errSQSClosed
+	}
+	return s.ctx, nil
+}
+
+// queueURL resolves a queue name to its URL, falling back to QueueURL for
+// queues that do not exist as described on SQS
+func (s *SQS) queueURL(ctx context.Context, queueName string) (string, error) {
+	s.mu.Lock()
+	legacy := s.legacy[queueName]
+	s.mu.Unlock()
+	if legacy {
+		return s.QueueURL, nil
+	}
+	queueURL, err := s.resolve(ctx, queueName)
+	var unroutable *UnroutableError
+	if !errors.As(err, &unroutable) || s.QueueURL == "" || strings.HasPrefix(queueName, ReplyQueuePrefix) {
+		return queueURL, err
+	}
+	s.mu.Lock()
+	owned := s.owned[queueName]
+	if !owned {
+		s.legacy[queueName] = true // Warn once
+	}
+	s.mu.Unlock()
+	if owned {
+		return "", err
+	}
+	logging.Logger.WithFields(logrus.Fields{
+		"queue":     queueName,
+		"queue_url": s.QueueURL,
+	}).Warn("SQS queue does not exist, using the configured queue URL")
+	return s.QueueURL, nil
+}
+
+// resolve resolves a queue name to its URL, caching the result
+func (s *SQS) resolve(ctx context.Context, queueName string) (string, error) {
+	if queueName == "" || queueName == lastSegment(s.QueueURL) {
+		return s.QueueURL, nil
+	}
+	if isQueueURL(queueName) {
+		return queueName, nil
+	}
+
+	s.mu.Lock()
+	queueURL, ok := s.urls[queueName]
+	s.mu.Unlock()
+	if ok {
+		return queueURL, nil
+	}
+
+	output, err := s.Client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(queueName)})
+	if err != nil {
+		return "", s.queueError(queueName, err)
+	}
+	queueURL = aws.ToString(output.QueueUrl)
+	s.mu.Lock()
+	s.urls[queueName] = queueURL
+	s.mu.Unlock()
+	return queueURL, nil
+}
+
+// queueError maps a missing queue to an UnroutableError and drops its cached URL
+func (s *SQS) queueError(queueName string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var missing *types.QueueDoesNotExist
+	if errors.As(err, &missing) {
+		s.forget(queueName)
+		return &UnroutableError{Queue: queueName, Reason: missing.ErrorCode()}
+	}
+	return fmt.Errorf("queue %s: %v", queueName, err)
+}
+
+// forget drops the cached URL of a queue
+func (s *SQS) forget(queueName string) {
+	s.mu.Lock()
+	delete(s.urls, queueName)
+	s.mu.Unlock()
+}
+
+// isQueueURL reports whether queueName is a queue URL rather than a name
+func isQueueURL(queueName string) bool {
+	return strings.HasPrefix(queueName, "https://") || strings.HasPrefix(queueName, "http://")
+}
+
+// lastSegment returns the queue name at the end of a queue URL
+func lastSegment(queueURL string) string {
+	return queueURL[strings.LastIndex(queueURL, "/")+1:]
+}
+
+// setHeadersAttribute stores message headers as a single JSON attribute, since
+// SQS allows at most 10 message attributes per message
+func setHeadersAttribute(attributes map[string]types.MessageAttributeValue, headers map[string]string) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return fmt.Errorf("failed to encode message headers: %v", err)
+	}
+	attributes["Headers"] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(string(data))}
+	return nil
+}
+
+// headersFromAttributes decodes the JSON headers attribute written by setHeadersAttribute
+func headersFromAttributes(attributes map[string]types.MessageAttributeValue) map[string]string {
+	headers := map[string]string{}
+	if attr, ok := attributes["Headers"]; ok {
+		_ = json.Unmarshal([]byte(aws.ToString(attr.StringValue)), &headers)
+	}
+	return headers
+}
@@ -0,0 +1,73 @@
+package queue_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+	"github.com/loaynaser3/KubeGate/pkg/queue/queuetest"
+)
+
+func TestSQSConformance(t *testing.T) {
+	url := queuetest.StartSQS(t)
+	queuetest.Run(t, func(t *testing.T) queue.MessageQueue {
+		return &queue.SQS{QueueURL: url + "/000000000000/kubegate-commands", Timeout: time.Second}
+	})
+	queuetest.RunSender(t, func(t *testing.T) queue.MessageQueue {
+		return &queue.SQS{QueueURL: url + "/000000000000/kubegate-commands", Timeout: time.Second}
+	}, "test") // The access key ID set by StartSQS
+}
+
+func TestSQSFallsBackToQueueURL(t *testing.T) {
+	url := queuetest.StartSQS(t)
+	admin := &queue.SQS{QueueURL: url + "/000000000000/admin", Timeout: time.Second}
+	if err := admin.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer admin.Close()
+	if err := admin.CreateQueue("legacy"); err != nil {
+		t.Fatalf("CreateQueue: %v", err)
+	}
+
+	// Earlier versions sent everything to QueueURL whatever the queue name
+	s := &queue.SQS{QueueURL: url + "/000000000000/legacy", Timeout: time.Second}
+	if err := s.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if err := s.SendMessage("kubegate-commands", "get pods", "c1", "", nil); err != nil {
+		t.Fatalf("SendMessage to a missing queue: %v", err)
+	}
+	received := make(chan queue.Message, 1)
+	go s.ReceiveMessages("kubegate-commands", func(msg queue.Message) error {
+		received <- msg
+		return nil
+	})
+	select {
+	case msg := <-received:
+		if msg.Body != "get pods" {
+			t.Errorf("received %q, want %q", msg.Body, "get pods")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message sent to a missing queue was not received from QueueURL")
+	}
+
+	// Replies never land on QueueURL, where the agent would run them
+	var unroutable *queue.UnroutableError
+	if err := s.PublishResponse(queue.ReplyQueuePrefix+"gone", "c1", "ok", nil); !errors.As(err, &unroutable) {
+		t.Errorf("PublishResponse to a missing reply queue returned %v, want an *queue.UnroutableError", err)
+	}
+
+	// Deleting a missing queue leaves QueueURL alone
+	if err := s.DeleteQueue("kubegate-commands"); err != nil {
+		t.Fatalf("DeleteQueue: %v", err)
+	}
+	if infos, err := admin.ListQueues("legacy"); err != nil || len(infos) != 1 {
+		t.Errorf("ListQueues(legacy) = %v, %v; want the queue at QueueURL kept", infos, err)
+	}
+
+	s.Close()
+	if _, err := s.ListQueues(""); err == nil {
+		t.Error("ListQueues after Close succeeded")
+	}
+}
@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"context"
+	"testing"
+
+	"github.com/loaynaser3/KubeGate/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestTraceContextPropagatesThroughMessage checks that a trace started by the
+// client continues through publish, receive and the message handler
+func TestTraceContextPropagatesThroughMessage(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	ctx, root := tracing.Tracer().Start(context.Background(), "ExecuteRun")
+	headers, publish := startPublishSpan("SendMessage", "test", "commands", tracing.Inject(ctx, nil))
+	endSpan(publish, nil)
+	root.End()
+
+	msg := Message{Body: "get pods", CorrelationID: "abc", Headers: headers}
+	receive := startReceiveSpan("test", "commands", &msg)
+	_, handler := tracing.Tracer().Start(tracing.Extract(msg.Headers), "handleCommand")
+	handler.End()
+	endSpan(receive, nil)
+
+	spans := exporter.GetSpans()
+	byName := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	for _, name := range []string{"ExecuteRun", "SendMessage", "ReceiveMessages", "handleCommand"} {
+		if _, ok := byName[name]; !ok {
+			t.Fatalf("missing span %s in %d spans", name, len(spans))
+		}
+	}
+
+	traceID := byName["ExecuteRun"].SpanContext.TraceID()
+	chain := [][2]string{
+		{"SendMessage", "ExecuteRun"},
+		{"ReceiveMessages", "SendMessage"},
+		{"handleCommand", "ReceiveMessages"},
+	}
+	for _, link := range chain {
+		child, parent := byName[link[0]], byName[link[1]]
+		if child.SpanContext.TraceID() != traceID {
+			t.Errorf("%s is in trace %s, want %s", link[0], child.SpanContext.TraceID(), traceID)
+		}
+		if child.Parent.SpanID() != parent.SpanContext.SpanID() {
+			t.Errorf("%s parent is %s, want %s (%s)", link[0], child.Parent.SpanID(), parent.SpanContext.SpanID(), link[1])
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Package redact masks secrets in commands, responses and log output.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Mask replaces redacted values
+const Mask = "[REDACTED]"
+
+// rule replaces matches of a pattern
+type rule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+var rules = []rule{
+	// Values of credential flags: --token abc, --password=abc
+	{regexp.MustCompile(`(?i)(--(?:token|password|docker-password|client-secret|auth-token|bearer-token)(?:=|\s+))\S+`), "${1}" + Mask},
+	// Literal secret values, keeping the key: --from-literal=user=admin
+	{regexp.MustCompile(`(--from-literal(?:=|\s+)[^=\s]+=)\S+`), "${1}" + Mask},
+	// Authorization headers and bearer tokens
+	{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]+=*`), "${1}" + Mask},
+	// JSON Web Tokens, e.g. service account tokens
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), Mask},
+	// Base64 blobs such as inlined manifests and Secret data
+	{regexp.MustCompile(`[A-Za-z0-9+/]{40,}={0,2}`), Mask},
+}
+
+// String masks credential flags, bearer tokens, JWTs, base64 blobs and the
+// data of Secret manifests in s
+func String(s string) string {
+	if strings.Contains(s, "Secret") {
+		s = SecretData(s)
+	}
+	for _, r := range rules {
+		s = r.pattern.ReplaceAllString(s, r.replacement)
+	}
+	return s
+}
+
+// Strings applies String to every element of values
+func Strings(values []string) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = String(v)
+	}
+	return out
+}
+
+// Args masks secrets in argv like Strings, including values passed as the
+// argument after a credential flag, e.g. --token abc
+func Args(argv []string) []string {
+	out := Strings(argv)
+	for i := 0; i+1 < len(argv); i++ {
+		pair := String(argv[i] + " " + argv[i+1])
+		if strings.HasPrefix(pair, argv[i]+" ") && pair != argv[i]+" "+argv[i+1] {
+			out[i+1] = pair[len(argv[i])+1:]
+		}
+	}
+	return out
+}
+
+// SecretData masks the values of data and stringData in Secret objects,
+// including the items of Lists, in JSON or YAML output. Output without Secret
+// objects, or that cannot be parsed, is returned unchanged.
+func SecretData(output string) string {
+	trimmed := strings.TrimSpace(output)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var obj interface{}
+		if err := json.Unmarshal([]byte(trimmed), &obj); err != nil || !maskSecrets(obj) {
+			return output
+		}
+		data, err := json.MarshalIndent(obj, "", "    ")
+		if err != nil {
+			return output
+		}
+		return string(data) + "\n"
+	}
+
+	var docs []interface{}
+	decoder := yaml.NewDecoder(strings.NewReader(output))
+	masked := false
+	for {
+		var doc yaml.MapSlice
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return output
+		}
+		if maskSecrets(doc) {
+			masked = true
+		}
+		docs = append(docs, doc)
+	}
+	if !masked {
+		return output
+	}
+
+	var buf bytes.Buffer
+	for i, doc := range docs {
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		data, err := yaml.Marshal(doc)
+		if err != nil {
+			return output
+		}
+		buf.Write(data)
+	}
+	return buf.String()
+}
+
+// maskSecrets masks Secret data in a decoded JSON or YAML value and reports
+// whether anything was masked
+func maskSecrets(value interface{}) bool {
+	masked := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v["kind"] == "Secret" {
+			for _, field := range []string{"data", "stringData"} {
+				if data, ok := v[field].(map[string]interface{}); ok {
+					for key := range data {
+						data[key] = Mask
+						masked = true
+					}
+				}
+			}
+		}
+		if items, ok := v["items"]; ok {
+			masked = maskSecrets(items) || masked
+		}
+	case yaml.MapSlice:
+		if lookup(v, "kind") == "Secret" {
+			for i := range v {
+				if v[i].Key != "data" && v[i].Key != "stringData" {
+					continue
+				}
+				if data, ok := v[i].Value.(yaml.MapSlice); ok {
+					for j := range data {
+						data[j].Value = Mask
+						masked = true
+					}
+				}
+			}
+		}
+		masked = maskSecrets(lookup(v, "items")) || masked
+	case []interface{}:
+		for _, item := range v {
+			masked = maskSecrets(item) || masked
+		}
+	}
+	return masked
+}
+
+// lookup returns the value of key in a YAML mapping
+func lookup(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
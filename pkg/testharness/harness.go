@@ -0,0 +1,186 @@
+// Package testharness runs a KubeGate agent and client in-process over the
+// memory backend, with a scripted fake kubectl, for end-to-end tests.
+package testharness
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/loaynaser3/KubeGate/pkg/KubeGate"
+	"github.com/loaynaser3/KubeGate/pkg/client"
+	"github.com/loaynaser3/KubeGate/pkg/config"
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+)
+
+// ContextName is the name of the client context created by the harness
+const ContextName = "harness"
+
+// startTimeout bounds how long New waits for the agent to come up
+const startTimeout = 10 * time.Second
+
+// Options customizes the agent and client started by New
+type Options struct {
+	ResponseTimeout time.Duration             // Client response timeout; the default when zero
+	Agent           func(*config.AgentConfig) // Adjusts the agent config before it starts
+	Context         func(*config.Context)     // Adjusts the client context before it is saved
+}
+
+// Harness is an agent and a client context sharing an in-memory broker
+type Harness struct {
+	t *testing.T
+
+	Kubectl      *FakeKubectl
+	Broker       string // URL of the memory backend
+	CommandQueue string
+
+	stop func()
+}
+
+// New starts an agent with a fake kubectl and saves a client context for it
+// under a temporary HOME. The agent is stopped when the test ends. New sets
+// environment variables, so it cannot be used by parallel tests.
+func New(t *testing.T, opts Options) *Harness {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir()) // Isolates the client config and sessions
+	t.Setenv("CURRENT_CONTEXT", "")
+
+	h := &Harness{
+		t:            t,
+		Kubectl:      &FakeKubectl{},
+		Broker:       "harness-" + uuid.New().String(),
+		CommandQueue: "kubegate-commands",
+	}
+
+	agentCfg := &config.AgentConfig{
+		Backend:      "memory",
+		RabbitMQURL:  h.Broker,
+		CommandQueue: h.CommandQueue,
+		HealthAddr:   "off",
+	}
+	if opts.Agent != nil {
+		opts.Agent(agentCfg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- KubeGate.RunAgent(ctx, agentCfg, KubeGate.AgentOptions{Executor: h.Kubectl.Execute, StreamExecutor: h.Kubectl.Stream})
+	}()
+	var once sync.Once
+	h.stop = func() {
+		once.Do(func() {
+			cancel()
+			if err := <-stopped; err != nil {
+				t.Errorf("agent stopped with error: %v", err)
+			}
+		})
+	}
+	t.Cleanup(h.stop)
+
+	target := config.Context{
+		Name:            ContextName,
+		Backend:         "memory",
+		RabbitMQURL:     h.Broker,
+		CommandQueue:    h.CommandQueue,
+		ResponseTimeout: opts.ResponseTimeout,
+	}
+	if opts.Context != nil {
+		opts.Context(&target)
+	}
+	cfg := &config.Config{CurrentContext: ContextName}
+	config.SetContext(cfg, target)
+	if err := config.SaveConfig(cfg); err != nil {
+		t.Fatalf("failed to save client config: %v", err)
+	}
+
+	h.waitForAgent(t, stopped, agentCfg.HeartbeatInterval >= 0)
+	return h
+}
+
+// Stop stops the agent before the test ends
+func (h *Harness) Stop() {
+	h.stop()
+}
+
+// Client returns a client for the harness context, closed when the test ends
+func (h *Harness) Client(opts ...client.Option) *client.Client {
+	c, err := client.NewFromCurrentContext(opts...)
+	if err != nil {
+		h.t.Fatalf("failed to create client: %v", err)
+	}
+	h.t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// ClientAs returns a client like Client whose messages the broker
+// authenticates as user, as it does for RabbitMQ user_id and SQS senders
+func (h *Harness) ClientAs(user string, opts ...client.Option) *client.Client {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		h.t.Fatalf("failed to load client config: %v", err)
+	}
+	target, err := config.GetContext(cfg, ContextName)
+	if err != nil {
+		h.t.Fatalf("failed to get harness context: %v", err)
+	}
+	target.RabbitMQURL = user + "@" + h.Broker
+	c := client.New(*target, opts...)
+	h.t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Run runs argv with a new client for the harness context
+func (h *Harness) Run(argv ...string) (*client.Result, error) {
+	c := h.Client()
+	defer c.Close()
+	return c.Run(context.Background(), argv, nil)
+}
+
+// waitForAgent waits until the agent consumes its command queue and, with
+// heartbeats enabled, has announced its presence so the client's presence
+// check passes
+func (h *Harness) waitForAgent(t *testing.T, stopped <-chan error, presence bool) {
+	t.Helper()
+	mq := &queue.Memory{URL: h.Broker}
+	if err := mq.Connect(); err != nil {
+		t.Fatalf("failed to connect to the broker: %v", err)
+	}
+	defer mq.Close()
+
+	deadline := time.After(startTimeout)
+	for {
+		if h.agentReady(mq, presence) {
+			return
+		}
+		select {
+		case err := <-stopped:
+			t.Fatalf("agent stopped before it was ready: %v", err)
+		case <-deadline:
+			t.Fatalf("agent was not ready after %s", startTimeout)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// agentReady reports whether the command queue has a consumer and, if
+// presence is set, a heartbeat was published
+func (h *Harness) agentReady(mq *queue.Memory, presence bool) bool {
+	queues, err := mq.ListQueues(h.CommandQueue)
+	if err != nil {
+		return false
+	}
+	for _, info := range queues {
+		if info.Name == h.CommandQueue && info.Consumers > 0 {
+			if !presence {
+				return true
+			}
+			agents, err := protocol.ListAgents(mq, h.CommandQueue)
+			return err == nil && len(agents) > 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package testharness
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/loaynaser3/KubeGate/pkg/protocol"
+)
+
+// Reply is the scripted outcome of a fake kubectl invocation
+type Reply struct {
+	Output   string        // Combined output
+	ExitCode int           // Non-zero to fail the command
+	Delay    time.Duration // How long the command takes
+	Chunks   []string      // Output written in parts, each after Delay, instead of Output
+}
+
+// Call records a fake kubectl invocation
+type Call struct {
+	Args  []string          // Arguments as received by the executor
+	Files map[string]string // Contents of the files passed with -f/--filename, by path
+}
+
+// FakeKubectl is a scripted KubeGate.Executor and KubeGate.StreamExecutor
+// that records its calls
+type FakeKubectl struct {
+	mu     sync.Mutex
+	script []rule
+	calls  []Call
+}
+
+type rule struct {
+	prefix string
+	reply  Reply
+}
+
+// On scripts the reply to commands starting with prefix, e.g. "get pods".
+// Rules are matched in the order they were added.
+func (f *FakeKubectl) On(prefix string, reply Reply) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = append(f.script, rule{prefix: prefix, reply: reply})
+}
+
+// Calls returns the invocations made so far
+func (f *FakeKubectl) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// Execute implements KubeGate.Executor. Commands without a scripted reply
+// fail with exit status 1.
+func (f *FakeKubectl) Execute(ctx context.Context, args []string) (string, error) {
+	var output strings.Builder
+	err := f.Stream(ctx, args, &output)
+	return output.String(), err
+}
+
+// Stream implements KubeGate.StreamExecutor, writing each of the reply's
+// Chunks as it is produced
+func (f *FakeKubectl) Stream(ctx context.Context, args []string, w io.Writer) error {
+	call := Call{Args: append([]string(nil), args...), Files: readFiles(args)}
+	command := strings.Join(args, " ")
+
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	reply := Reply{Output: "fake kubectl: no reply scripted for " + command, ExitCode: 1}
+	for _, r := range f.script {
+		if strings.HasPrefix(command, r.prefix) {
+			reply = r.reply
+			break
+		}
+	}
+	f.mu.Unlock()
+
+	chunks := reply.Chunks
+	if chunks == nil {
+		chunks = []string{reply.Output}
+	}
+	for _, chunk := range chunks {
+		if reply.Delay > 0 {
+			select {
+			case <-time.After(reply.Delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if _, err := io.WriteString(w, chunk); err != nil {
+			return err
+		}
+	}
+	if reply.ExitCode != 0 {
+		return &protocol.ExitError{Code: reply.ExitCode}
+	}
+	return nil
+}
+
+// readFiles reads the files named by -f/--filename, while they still exist
+func readFiles(args []string) map[string]string {
+	files := map[string]string{}
+	for i, arg := range args {
+		var path string
+		switch {
+		case (arg == "-f" || arg == "--filename") && i+1 < len(args):
+			path = args[i+1]
+		case strings.HasPrefix(arg, "--filename="), strings.HasPrefix(arg, "-f="):
+			path = arg[strings.Index(arg, "=")+1:]
+		default:
+			continue
+		}
+		if data, err := os.ReadFile(path); err == nil {
+			files[path] = string(data)
+		}
+	}
+	return files
+}
@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInjectExtractRoundTrip(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	ctx, parent := Tracer().Start(context.Background(), "client")
+	headers := Inject(ctx, map[string]string{"Accept-Encoding": "zstd"})
+	parent.End()
+
+	if headers["Accept-Encoding"] != "zstd" {
+		t.Errorf("existing header lost: %v", headers)
+	}
+	if headers["traceparent"] == "" {
+		t.Fatalf("traceparent not injected: %v", headers)
+	}
+
+	_, child := Tracer().Start(Extract(headers), "agent")
+	child.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	client, agent := spans[0], spans[1]
+	if agent.SpanContext.TraceID() != client.SpanContext.TraceID() {
+		t.Errorf("agent span is in trace %s, want %s", agent.SpanContext.TraceID(), client.SpanContext.TraceID())
+	}
+	if agent.Parent.SpanID() != client.SpanContext.SpanID() {
+		t.Errorf("agent span parent is %s, want %s", agent.Parent.SpanID(), client.SpanContext.SpanID())
+	}
+}
+
+func TestExtractWithoutTraceContext(t *testing.T) {
+	if sc := trace.SpanContextFromContext(Extract(nil)); sc.IsValid() {
+		t.Errorf("expected no span context from empty headers, got %v", sc)
+	}
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LockPath blocks until it holds an exclusive lock on path+".lock", creating
+// its directory if needed, and returns the function releasing the lock
+func LockPath(path string) (func(), error) {
+	file, err := openLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return unlocker(file), nil
+}
+
+// TryLockPath is LockPath without waiting: it returns a nil function when
+// another process or file handle holds the lock
+func TryLockPath(path string) (func(), error) {
+	file, err := openLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := tryLockFile(file)
+	if err != nil || !locked {
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		return nil, nil
+	}
+	return unlocker(file), nil
+}
+
+// openLockFile opens path+".lock", creating it and its directory if needed
+func openLockFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	return file, nil
+}
+
+// unlocker returns the function releasing a lock held on file
+func unlocker(file *os.File) func() {
+	return func() {
+		_ = unlockFile(file)
+		file.Close()
+	}
+}
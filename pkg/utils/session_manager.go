@@ -2,8 +2,12 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -12,10 +16,17 @@ import (
 	"github.com/loaynaser3/KubeGate/pkg/queue"
 )
 
+// unsafeNameChars matches characters not allowed in session file names
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
 // Session holds information about the reply queue
 type Session struct {
 	QueueName string    `json:"queue_name"`
 	Timestamp time.Time `json:"timestamp"`
+	Context   string    `json:"context,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+
+	Path string `json:"-"` // File the session was loaded from
 }
 
 // SessionManager handles session-related logic for reply queues
@@ -23,6 +34,24 @@ type SessionManager struct {
 	FilePath        string
 	SessionDuration time.Duration
 	MessageQueue    queue.MessageQueue
+	Context         string // Context the session belongs to
+	Backend         string // Backend the reply queue lives on
+
+	unlease func()        // Releases the lease on the session's reply queue
+	private string        // Reply queue of this process alone, deleted by Release
+	done    chan struct{} // Closed by Release
+}
+
+// SessionDir returns the directory holding per-context session files
+func SessionDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".kubegate", "sessions")
+}
+
+// SessionPath returns the session file for a context and backend, so that
+// contexts on different brokers never share a reply queue
+func SessionPath(contextName, backend string) string {
+	name := unsafeNameChars.ReplaceAllString(contextName, "_") + "." + unsafeNameChars.ReplaceAllString(backend, "_") + ".json"
+	return filepath.Join(SessionDir(), name)
 }
 
 // NewSessionManager creates a new instance of SessionManager
@@ -37,44 +66,156 @@ func NewSessionManager(filePath string, duration time.Duration, mq queue.Message
 	}
 }
 
-// GetOrCreateReplyQueue manages the lifecycle of the reply queue
+// NewContextSessionManager creates a SessionManager whose session is stored
+// under SessionDir and keyed by context and backend
+func NewContextSessionManager(contextName, backend string, duration time.Duration, mq queue.MessageQueue) *SessionManager {
+	sm := NewSessionManager(SessionPath(contextName, backend), duration, mq)
+	sm.Context = contextName
+	sm.Backend = backend
+	return sm
+}
+
+// ListSessions returns the sessions stored in SessionDir, sorted by context
+func ListSessions() ([]Session, error) {
+	paths, err := filepath.Glob(filepath.Join(SessionDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []Session
+	for _, path := range paths {
+		session, err := readSession(path)
+		if err != nil {
+			logging.Logger.WithError(err).WithField("file_path", path).Warn("Skipping unreadable session file")
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Context < sessions[j].Context })
+	return sessions, nil
+}
+
+// ReceiveReplies delivers replies to handler and returns the replyTo address
+// for commands sent afterwards. Backends that support direct replies (RabbitMQ
+// Direct Reply-To) need neither a reply queue nor the session file; other
+// backends use the reply queue claimed with ClaimReplyQueue. Release must be
+// called once replies are no longer needed.
+func (sm *SessionManager) ReceiveReplies(handler func(queue.Message) error) (string, error) {
+	if consumer, ok := sm.MessageQueue.(queue.ReplyConsumer); ok {
+		replyTo, err := consumer.ConsumeReplies(handler)
+		if !errors.Is(err, queue.ErrRepliesUnsupported) {
+			return replyTo, err
+		}
+	}
+
+	replyQueue, err := sm.ClaimReplyQueue()
+	if err != nil {
+		return "", err
+	}
+	done := sm.done
+	go func() {
+		err := sm.MessageQueue.ReceiveMessages(replyQueue, handler)
+		select {
+		case <-done:
+			return // Stopped by Release
+		default:
+		}
+		if err != nil {
+			logging.Logger.WithError(err).WithField("queue_name", replyQueue).Error("Failed to receive replies")
+		}
+	}()
+	return replyQueue, nil
+}
+
+// ClaimReplyQueue returns a reply queue that no other process consumes from,
+// since consumers of a shared queue would take each other's replies. The
+// session's queue is used while this process holds its lease; when another
+// process holds it, a private queue is created and deleted by Release.
+func (sm *SessionManager) ClaimReplyQueue() (string, error) {
+	sm.done = make(chan struct{})
+	unlease, err := TryLockPath(sm.leasePath())
+	if err != nil {
+		return "", fmt.Errorf("failed to lease session: %w", err)
+	}
+	if unlease == nil {
+		private := queue.ReplyQueuePrefix + uuid.New().String()
+		logging.Logger.WithField("queue_name", private).Info("Session is in use by another process. Creating a private reply queue.")
+		if err := sm.MessageQueue.CreateQueue(private); err != nil {
+			return "", fmt.Errorf("failed to create reply queue: %w", err)
+		}
+		sm.private = private
+		return private, nil
+	}
+
+	replyQueue, err := sm.GetOrCreateReplyQueue()
+	if err != nil {
+		unlease()
+		return "", err
+	}
+	sm.unlease = unlease
+	return replyQueue, nil
+}
+
+// Release stops using the claimed reply queue: a private queue is deleted and
+// the lease on the session's queue is given up. The message queue must still
+// be connected.
+func (sm *SessionManager) Release() {
+	if sm.done != nil {
+		select {
+		case <-sm.done:
+		default:
+			close(sm.done)
+		}
+	}
+	if sm.private != "" {
+		if err := sm.MessageQueue.DeleteQueue(sm.private); err != nil {
+			logging.Logger.WithError(err).WithField("queue_name", sm.private).Warn("Failed to delete private reply queue")
+		}
+		sm.private = ""
+	}
+	if sm.unlease != nil {
+		sm.unlease()
+		sm.unlease = nil
+	}
+}
+
+// GetOrCreateReplyQueue manages the lifecycle of the session's reply queue.
+// The session file is locked for the whole exchange so that parallel
+// invocations do not race to create queues; only the holder of the lease
+// taken by ClaimReplyQueue should consume from the queue or let an expired
+// one be deleted.
 func (sm *SessionManager) GetOrCreateReplyQueue() (string, error) {
 	logging.Logger.WithField("file_path", sm.FilePath).Info("Attempting to get or create reply queue")
 
+	unlock, err := sm.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
 	// Check if the session file exists
-	if _, err := os.Stat(sm.FilePath); err == nil {
-		logging.Logger.Info("Session file found. Attempting to load it.")
-
-		// Load the session file
-		data, err := os.ReadFile(sm.FilePath)
-		if err == nil {
-			var session Session
-			if err := json.Unmarshal(data, &session); err == nil {
-				logging.Logger.WithFields(map[string]interface{}{
-					"queue_name": session.QueueName,
-					"timestamp":  session.Timestamp,
-				}).Info("Session file loaded successfully")
-
-				// Check if the session is still valid
-				if time.Since(session.Timestamp) < sm.SessionDuration {
-					logging.Logger.WithField("queue_name", session.QueueName).Info("Session is valid. Reusing the queue.")
-					return session.QueueName, nil // Reuse the existing queue
-				}
-
-				logging.Logger.WithField("queue_name", session.QueueName).Info("Session expired. Deleting the old queue.")
-				_ = sm.MessageQueue.DeleteQueue(session.QueueName) // Clean up expired queue
-			} else {
-				logging.Logger.WithError(err).Error("Failed to parse session file")
-			}
-		} else {
-			logging.Logger.WithError(err).Error("Failed to read session file")
+	session, err := readSession(sm.FilePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		logging.Logger.Info("Session file not found. Proceeding to create a new queue.")
+	case err != nil:
+		logging.Logger.WithError(err).Error("Failed to load session file")
+	case !sm.matches(session):
+		logging.Logger.WithField("queue_name", session.QueueName).Info("Session belongs to another context or backend. Creating a new queue.")
+	case time.Since(session.Timestamp) < sm.SessionDuration:
+		logging.Logger.WithField("queue_name", session.QueueName).Info("Session is valid. Reusing the queue.")
+		// Redeclare in case the broker expired the queue in the meantime
+		if err := sm.MessageQueue.CreateQueue(session.QueueName); err != nil {
+			return "", fmt.Errorf("failed to create reply queue: %w", err)
 		}
-	} else {
-		logging.Logger.WithError(err).Info("Session file not found. Proceeding to create a new queue.")
+		return session.QueueName, nil // Reuse the existing queue
+	default:
+		logging.Logger.WithField("queue_name", session.QueueName).Info("Session expired. Deleting the old queue.")
+		_ = sm.MessageQueue.DeleteQueue(session.QueueName) // Clean up expired queue
 	}
 
 	// Create a new reply queue
-	newQueue := "reply-queue-" + uuid.New().String()
+	newQueue := queue.ReplyQueuePrefix + uuid.New().String()
 	logging.Logger.WithField("queue_name", newQueue).Info("Creating new reply queue")
 	if err := sm.MessageQueue.CreateQueue(newQueue); err != nil {
 		logging.Logger.WithError(err).Error("Failed to create reply queue")
@@ -82,17 +223,7 @@ func (sm *SessionManager) GetOrCreateReplyQueue() (string, error) {
 	}
 
 	// Save the new session to the session file
-	session := Session{
-		QueueName: newQueue,
-		Timestamp: time.Now().UTC(),
-	}
-	fileData, err := json.Marshal(session)
-	if err != nil {
-		logging.Logger.WithError(err).Error("Failed to marshal session data")
-		return "", err
-	}
-
-	if err := os.WriteFile(sm.FilePath, fileData, 0644); err != nil {
+	if err := sm.writeSession(Session{QueueName: newQueue, Timestamp: time.Now().UTC()}); err != nil {
 		logging.Logger.WithError(err).Error("Failed to write session file")
 		return "", err
 	}
@@ -101,37 +232,122 @@ func (sm *SessionManager) GetOrCreateReplyQueue() (string, error) {
 	return newQueue, nil
 }
 
+// Renew restarts the validity period of the stored session
+func (sm *SessionManager) Renew() (Session, error) {
+	unlock, err := sm.lock()
+	if err != nil {
+		return Session{}, err
+	}
+	defer unlock()
+
+	session, err := readSession(sm.FilePath)
+	if err != nil {
+		return Session{}, fmt.Errorf("failed to load session: %w", err)
+	}
+	session.Timestamp = time.Now().UTC()
+	if err := sm.writeSession(session); err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
 // CleanupStaleSession removes stale session files and queues
 func (sm *SessionManager) CleanupStaleSession() error {
 	logging.Logger.WithField("file_path", sm.FilePath).Info("Attempting to clean up stale session")
 
-	// Check if the session file exists
-	if _, err := os.Stat(sm.FilePath); err == nil {
-		logging.Logger.Info("Session file found. Attempting to clean up.")
-
-		// Load the session file
-		data, err := os.ReadFile(sm.FilePath)
-		if err == nil {
-			var session Session
-			if err := json.Unmarshal(data, &session); err == nil {
-				logging.Logger.WithField("queue_name", session.QueueName).Info("Deleting queue from stale session")
-				_ = sm.MessageQueue.DeleteQueue(session.QueueName)
-			} else {
-				logging.Logger.WithError(err).Error("Failed to parse session file during cleanup")
-			}
-		} else {
-			logging.Logger.WithError(err).Error("Failed to read session file during cleanup")
-		}
+	// The queue of a session in use must not be deleted from under its consumer
+	unlease, err := TryLockPath(sm.leasePath())
+	if err != nil {
+		return fmt.Errorf("failed to lease session: %w", err)
+	}
+	if unlease == nil {
+		return fmt.Errorf("session is in use by another kubegate process")
+	}
+	defer unlease()
 
-		// Remove the session file
-		if err := os.Remove(sm.FilePath); err != nil {
-			logging.Logger.WithError(err).Error("Failed to remove session file during cleanup")
-			return err
-		}
-		logging.Logger.Info("Stale session cleanup completed successfully")
-	} else {
-		logging.Logger.WithError(err).Info("No session file found. No cleanup needed")
+	unlock, err := sm.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	session, err := readSession(sm.FilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		logging.Logger.Info("No session file found. No cleanup needed")
+		return nil
+	}
+	if err != nil {
+		logging.Logger.WithError(err).Error("Failed to load session file during cleanup")
+	} else if sm.MessageQueue != nil {
+		logging.Logger.WithField("queue_name", session.QueueName).Info("Deleting queue from stale session")
+		_ = sm.MessageQueue.DeleteQueue(session.QueueName)
+	}
+
+	// Remove the session file
+	if err := os.Remove(sm.FilePath); err != nil {
+		logging.Logger.WithError(err).Error("Failed to remove session file during cleanup")
+		return err
+	}
+	logging.Logger.Info("Stale session cleanup completed successfully")
+	return nil
+}
+
+// matches reports whether a stored session was created for this manager's context and backend
+func (sm *SessionManager) matches(session Session) bool {
+	return (sm.Context == "" || session.Context == sm.Context) && (sm.Backend == "" || session.Backend == sm.Backend)
+}
+
+// leasePath returns the path whose lock is held by the process consuming
+// from the session's reply queue
+func (sm *SessionManager) leasePath() string {
+	return sm.FilePath + ".lease"
+}
+
+// lock takes an exclusive lock on the session file's lock file
+func (sm *SessionManager) lock() (func(), error) {
+	unlock, err := LockPath(sm.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock session: %w", err)
+	}
+	return unlock, nil
+}
+
+// writeSession atomically replaces the session file
+func (sm *SessionManager) writeSession(session Session) error {
+	session.Context, session.Backend = sm.Context, sm.Backend
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session data: %w", err)
 	}
 
+	tmp, err := os.CreateTemp(filepath.Dir(sm.FilePath), filepath.Base(sm.FilePath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), sm.FilePath); err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
 	return nil
 }
+
+// readSession loads a session file
+func readSession(path string) (Session, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Session{}, err
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return Session{}, fmt.Errorf("failed to parse session file: %w", err)
+	}
+	session.Path = path
+	return session, nil
+}
@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/loaynaser3/KubeGate/pkg/queue"
+)
+
+// repliesOnly hides the direct replies of a backend, as on SQS
+type repliesOnly struct {
+	queue.MessageQueue
+}
+
+// newTestSessionManager returns a manager whose session file is in a
+// temporary directory, backed by a memory queue without direct replies
+func newTestSessionManager(t *testing.T, path string, broker string) *SessionManager {
+	t.Helper()
+	mq := &queue.Memory{URL: broker}
+	if err := mq.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { mq.Close() })
+	sm := NewSessionManager(path, time.Hour, repliesOnly{mq})
+	sm.Context, sm.Backend = "test", "memory"
+	return sm
+}
+
+// queueExists reports whether the memory broker of sm has queueName
+func queueExists(t *testing.T, sm *SessionManager, queueName string) bool {
+	t.Helper()
+	infos, err := sm.MessageQueue.(repliesOnly).MessageQueue.(*queue.Memory).ListQueues(queueName)
+	if err != nil {
+		t.Fatalf("ListQueues: %v", err)
+	}
+	return len(infos) == 1
+}
+
+func TestLockPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dir", "file")
+	unlock, err := LockPath(path)
+	if err != nil {
+		t.Fatalf("LockPath: %v", err)
+	}
+	if again, err := TryLockPath(path); err != nil || again != nil {
+		t.Fatalf("TryLockPath while locked = %v, %v; want no lock", again != nil, err)
+	}
+
+	locked := make(chan func())
+	go func() {
+		unlock, err := LockPath(path)
+		if err != nil {
+			t.Errorf("LockPath: %v", err)
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("LockPath returned while the lock was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("LockPath did not return after the lock was released")
+	}
+	unlock, err = TryLockPath(path)
+	if err != nil || unlock == nil {
+		t.Fatalf("TryLockPath after release = %v, %v; want the lock", unlock != nil, err)
+	}
+	unlock()
+}
+
+func TestWriteSessionIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	sm := NewSessionManager(filepath.Join(dir, "ctx.memory.json"), time.Hour, nil)
+	sm.Context, sm.Backend = "ctx", "memory"
+
+	for _, name := range []string{"reply-queue-a", "reply-queue-b"} {
+		if err := sm.writeSession(Session{QueueName: name, Timestamp: time.Now().UTC()}); err != nil {
+			t.Fatalf("writeSession: %v", err)
+		}
+	}
+	session, err := readSession(sm.FilePath)
+	if err != nil {
+		t.Fatalf("readSession: %v", err)
+	}
+	if session.QueueName != "reply-queue-b" || session.Context != "ctx" || session.Backend != "memory" || session.Path != sm.FilePath {
+		t.Errorf("session = %+v, want the last write with the manager's context and backend", session)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("directory holds %v, want only the session file", names)
+	}
+
+	// A failed write leaves no partial file behind
+	sm.FilePath = filepath.Join(dir, "missing", "ctx.memory.json")
+	if err := sm.writeSession(Session{QueueName: "reply-queue-c"}); err == nil {
+		t.Error("writeSession into a missing directory succeeded")
+	}
+	if _, err := os.Stat(sm.FilePath); !os.IsNotExist(err) {
+		t.Errorf("failed write left %s behind: %v", sm.FilePath, err)
+	}
+}
+
+func TestSessionMatches(t *testing.T) {
+	tests := []struct {
+		name             string
+		context, backend string
+		session          Session
+		want             bool
+	}{
+		{"same", "prod", "sqs", Session{Context: "prod", Backend: "sqs"}, true},
+		{"other context", "prod", "sqs", Session{Context: "dev", Backend: "sqs"}, false},
+		{"other backend", "prod", "sqs", Session{Context: "prod", Backend: "rabbitmq"}, false},
+		{"legacy session", "prod", "sqs", Session{}, false},
+		{"unkeyed manager", "", "", Session{Context: "dev", Backend: "rabbitmq"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &SessionManager{Context: tt.context, Backend: tt.backend}
+			if got := sm.matches(tt.session); got != tt.want {
+				t.Errorf("matches(%+v) = %v, want %v", tt.session, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimReplyQueueLeasesTheSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.memory.json")
+	broker := "sessions-" + uuid.New().String()
+	first := newTestSessionManager(t, path, broker)
+	second := newTestSessionManager(t, path, broker)
+
+	shared, err := first.ClaimReplyQueue()
+	if err != nil {
+		t.Fatalf("ClaimReplyQueue: %v", err)
+	}
+	private, err := second.ClaimReplyQueue()
+	if err != nil {
+		t.Fatalf("ClaimReplyQueue while leased: %v", err)
+	}
+	if private == shared {
+		t.Fatalf("parallel claims share reply queue %s", shared)
+	}
+	if session, err := readSession(path); err != nil || session.QueueName != shared {
+		t.Errorf("session = %+v, %v; want the leased queue %s", session, err, shared)
+	}
+
+	// The session cannot be cleared from under the process using it
+	if err := second.CleanupStaleSession(); err == nil {
+		t.Error("CleanupStaleSession of a leased session succeeded")
+	}
+	if !queueExists(t, first, shared) {
+		t.Errorf("leased queue %s was deleted", shared)
+	}
+
+	second.Release()
+	if queueExists(t, second, private) {
+		t.Errorf("private queue %s was not deleted by Release", private)
+	}
+	first.Release()
+	if !queueExists(t, first, shared) {
+		t.Errorf("session queue %s was deleted by Release", shared)
+	}
+
+	third := newTestSessionManager(t, path, broker)
+	reused, err := third.ClaimReplyQueue()
+	if err != nil {
+		t.Fatalf("ClaimReplyQueue after release: %v", err)
+	}
+	defer third.Release()
+	if reused != shared {
+		t.Errorf("claim after release got %s, want the session queue %s", reused, shared)
+	}
+}
+
+func TestExpiredSessionIsKeptWhileLeased(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.memory.json")
+	broker := "sessions-" + uuid.New().String()
+	first := newTestSessionManager(t, path, broker)
+	first.SessionDuration = time.Nanosecond
+
+	old, err := first.ClaimReplyQueue()
+	if err != nil {
+		t.Fatalf("ClaimReplyQueue: %v", err)
+	}
+	defer first.Release()
+
+	// The session expired, but only the lease holder may delete its queue
+	second := newTestSessionManager(t, path, broker)
+	second.SessionDuration = time.Nanosecond
+	if _, err := second.ClaimReplyQueue(); err != nil {
+		t.Fatalf("ClaimReplyQueue: %v", err)
+	}
+	defer second.Release()
+	if !queueExists(t, first, old) {
+		t.Errorf("expired session queue %s was deleted while in use", old)
+	}
+}
+
+func TestParallelSessionsReceiveOwnReplies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.memory.json")
+	broker := "sessions-" + uuid.New().String()
+
+	type session struct {
+		sm      *SessionManager
+		replyTo string
+		replies chan queue.Message
+	}
+	sessions := make([]session, 3)
+	for i := range sessions {
+		s := session{sm: newTestSessionManager(t, path, broker), replies: make(chan queue.Message, 10)}
+		replyTo, err := s.sm.ReceiveReplies(func(msg queue.Message) error {
+			s.replies <- msg
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ReceiveReplies: %v", err)
+		}
+		defer s.sm.Release()
+		s.replyTo = replyTo
+		sessions[i] = s
+	}
+
+	for round := 0; round < 3; round++ {
+		for i, s := range sessions {
+			if err := s.sm.MessageQueue.PublishResponse(s.replyTo, uuid.New().String(), s.replyTo, nil); err != nil {
+				t.Fatalf("PublishResponse %d: %v", i, err)
+			}
+		}
+	}
+	for i, s := range sessions {
+		for round := 0; round < 3; round++ {
+			select {
+			case msg := <-s.replies:
+				if msg.Body != s.replyTo {
+					t.Errorf("session %d received a reply for %s", i, msg.Body)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("session %d received %d of 3 replies", i, round)
+			}
+		}
+	}
+}
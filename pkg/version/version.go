@@ -0,0 +1,5 @@
+package version
+
+// Version is the KubeGate release version, set at build time with
+// -ldflags "-X github.com/loaynaser3/KubeGate/pkg/version.Version=v1.2.3"
+var Version = "dev"